@@ -5,6 +5,8 @@
 package girc
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,9 +18,14 @@ func (c *Client) registerBuiltins() {
 	c.Handlers.mu.Lock()
 
 	// Built-in things that should always be supported.
+	c.Handlers.register(true, false, RPL_WELCOME, HandlerFunc(handleWelcome))
 	c.Handlers.register(true, true, RPL_WELCOME, HandlerFunc(handleConnect))
+	c.Handlers.register(true, false, RPL_ENDOFMOTD, HandlerFunc(handleReady))
+	c.Handlers.register(true, false, ERR_NOMOTD, HandlerFunc(handleReady))
 	c.Handlers.register(true, false, PING, HandlerFunc(handlePING))
 	c.Handlers.register(true, false, PONG, HandlerFunc(handlePONG))
+	c.Handlers.register(true, false, RPL_MONONLINE, HandlerFunc(handleMonitor))
+	c.Handlers.register(true, false, RPL_MONOFFLINE, HandlerFunc(handleMonitor))
 
 	if !c.Config.disableTracking {
 		// Joins/parts/anything that may add/remove/rename users.
@@ -40,10 +47,15 @@ func (c *Client) registerBuiltins() {
 		// Other misc. useful stuff.
 		c.Handlers.register(true, false, TOPIC, HandlerFunc(handleTOPIC))
 		c.Handlers.register(true, false, RPL_TOPIC, HandlerFunc(handleTOPIC))
+		c.Handlers.register(true, false, RPL_CREATIONTIME, HandlerFunc(handleCREATIONTIME))
+		c.Handlers.register(true, false, RPL_WHOISIDLE, HandlerFunc(handleWHOISIDLE))
+		c.Handlers.register(true, false, RPL_YOURHOST, HandlerFunc(handleYOURHOST))
 		c.Handlers.register(true, false, RPL_MYINFO, HandlerFunc(handleMYINFO))
 		c.Handlers.register(true, false, RPL_ISUPPORT, HandlerFunc(handleISUPPORT))
 		c.Handlers.register(true, false, RPL_MOTDSTART, HandlerFunc(handleMOTD))
 		c.Handlers.register(true, false, RPL_MOTD, HandlerFunc(handleMOTD))
+		c.Handlers.register(true, false, RPL_NOWAWAY, HandlerFunc(handleSelfAway))
+		c.Handlers.register(true, false, RPL_UNAWAY, HandlerFunc(handleSelfAway))
 
 		// Keep users lastactive times up to date.
 		c.Handlers.register(true, false, PRIVMSG, HandlerFunc(updateLastActive))
@@ -57,6 +69,10 @@ func (c *Client) registerBuiltins() {
 		c.Handlers.register(true, false, CAP_AWAY, HandlerFunc(handleAWAY))
 		c.Handlers.register(true, false, CAP_ACCOUNT, HandlerFunc(handleACCOUNT))
 		c.Handlers.register(true, false, ALL_EVENTS, HandlerFunc(handleTags))
+		c.Handlers.register(true, false, METADATA, HandlerFunc(handleMetadata))
+		c.Handlers.register(true, false, RPL_KEYVALUE, HandlerFunc(handleMetadata))
+		c.Handlers.register(true, false, RPL_KEYNOTSET, HandlerFunc(handleMetadata))
+		c.Handlers.register(true, false, RPL_METADATASYNCLATER, HandlerFunc(handleMetadataSyncLater))
 
 		// SASL IRCv3 support.
 		c.Handlers.register(true, false, AUTHENTICATE, HandlerFunc(handleSASL))
@@ -66,45 +82,320 @@ func (c *Client) registerBuiltins() {
 		c.Handlers.register(true, false, ERR_SASLTOOLONG, HandlerFunc(handleSASLError))
 		c.Handlers.register(true, false, ERR_SASLABORTED, HandlerFunc(handleSASLError))
 		c.Handlers.register(true, false, RPL_SASLMECHS, HandlerFunc(handleSASLError))
+	} else {
+		// We still need to know our own nickname, even without tracking.
+		c.Handlers.register(true, false, NICK, HandlerFunc(handleSelfNICK))
 	}
 
 	// Nickname collisions.
 	c.Handlers.register(true, false, ERR_NICKNAMEINUSE, HandlerFunc(nickCollisionHandler))
 	c.Handlers.register(true, false, ERR_NICKCOLLISION, HandlerFunc(nickCollisionHandler))
 	c.Handlers.register(true, false, ERR_UNAVAILRESOURCE, HandlerFunc(nickCollisionHandler))
+	c.Handlers.register(true, false, ERR_ERRONEUSNICKNAME, HandlerFunc(handleErroneousNick))
 
 	c.Handlers.mu.Unlock()
 }
 
+// handleWelcome updates our nickname to the one that the server gives us.
+// 99% of the time, it's the one we supplied during connection, but we may
+// have used a fallback nickname, and some networks will rename users on
+// connect. This must not run in the background, as events following
+// RPL_WELCOME need to know our nickname.
+func handleWelcome(c *Client, e Event) {
+	if len(e.Params) == 0 {
+		return
+	}
+
+	c.state.Lock()
+	c.state.nick = e.Params[0]
+	c.state.registered = true
+	c.state.Unlock()
+
+	c.state.notify(c, UPDATE_GENERAL)
+}
+
 // handleConnect is a helper function which lets the client know that enough
 // time has passed and now they can send commands.
 //
 // Should always run in separate thread due to blocking delay.
 func handleConnect(c *Client, e Event) {
-	// This should be the nick that the server gives us. 99% of the time, it's
-	// the one we supplied during connection, but some networks will rename
-	// users on connect.
-	if len(e.Params) > 0 {
-		c.state.Lock()
-		c.state.nick = e.Params[0]
-		c.state.Unlock()
+	if len(e.Params) > 0 && c.Config.UserModes != "" {
+		c.Cmd.Mode(e.Params[0], c.Config.UserModes)
+	}
 
-		c.state.notify(c, UPDATE_GENERAL)
+	// If our nickname was in use, attempt to get it back.
+	if len(e.Params) > 0 && c.Config.RecoverNick && c.Config.ServicesPass != "" &&
+		ToRFC1459(e.Params[0]) != ToRFC1459(c.Config.Nick) {
+		c.Recover(c.Config.Nick, c.Config.ServicesPass)
 	}
 
 	time.Sleep(2 * time.Second)
+
+	// Send anything that was queued while we were disconnected.
+	c.flushPending()
+
 	c.RunHandlers(&Event{Command: CONNECTED, Trailing: c.Server()})
 }
 
+// handleReady marks registration as complete, once the server has sent the
+// MOTD (or let us know that there isn't one), which is the last part of
+// registration.
+func handleReady(c *Client, e Event) {
+	c.state.Lock()
+	if c.state.isReady {
+		// E.g. if MOTD was requested again.
+		c.state.Unlock()
+		return
+	}
+	c.state.isReady = true
+	close(c.state.ready)
+	retained := len(c.state.retained) > 0
+	c.state.Unlock()
+
+	c.state.notify(c, UPDATE_GENERAL)
+
+	if len(c.Config.AutoJoin) > 0 || retained {
+		// This may wait between each channel, so don't block other handlers.
+		go c.autoJoin()
+	}
+}
+
+// autoJoin joins the channels in Config.AutoJoin, followed by any channels
+// retained from the previous connection (see Config.RetainChannels).
+func (c *Client) autoJoin() {
+	var channels, keys []string
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(c.Config.AutoJoin); i++ {
+		fields := strings.Fields(c.Config.AutoJoin[i])
+		if len(fields) == 0 {
+			continue
+		}
+
+		if !c.validChannel(fields[0]) {
+			c.debug.Printf("not auto-joining invalid channel %q", fields[0])
+			continue
+		}
+
+		var key string
+		if len(fields) > 1 {
+			key = fields[1]
+		}
+
+		channels = append(channels, fields[0])
+		keys = append(keys, key)
+		seen[c.casefold(fields[0])] = true
+	}
+
+	c.state.Lock()
+	retained := c.state.retained
+	c.state.retained = nil
+	for i := 0; i < len(retained); i++ {
+		if seen[c.state.casefold(retained[i])] {
+			continue
+		}
+
+		channels = append(channels, retained[i])
+		keys = append(keys, c.state.keys[c.state.casefold(retained[i])].key)
+	}
+	c.state.Unlock()
+
+	if c.Config.AutoJoinDelay <= 0 {
+		if err := c.Cmd.JoinKeys(channels, keys); err != nil {
+			c.debug.Printf("unable to auto-join channels: %s", err)
+		}
+		return
+	}
+
+	for i := 0; i < len(channels); i++ {
+		if i > 0 {
+			time.Sleep(c.Config.AutoJoinDelay)
+
+			if !c.IsConnected() {
+				return
+			}
+		}
+
+		if err := c.Cmd.JoinKey(channels[i], keys[i]); err != nil {
+			c.debug.Printf("unable to auto-join %s: %s", channels[i], err)
+		}
+	}
+}
+
+// ErrNickUnavailable is returned by Connect() when the server rejects our
+// nickname during registration (either as in use, or as invalid), and there
+// are no fallback nicknames left to try (see Config.AltNicks).
+type ErrNickUnavailable struct {
+	// Nick is the last nickname which was attempted.
+	Nick string
+	// Event is the rejection from the server (e.g. ERR_NICKNAMEINUSE).
+	Event *Event
+}
+
+func (e ErrNickUnavailable) Error() string {
+	return fmt.Sprintf("no fallback nicknames left (last attempted %q, rejected with %s)", e.Nick, e.Event.Command)
+}
+
 // nickCollisionHandler helps prevent the client from having conflicting
-// nicknames with another bot, user, etc.
+// nicknames with another bot, user, etc. If we haven't registered yet, this
+// tries the next fallback nickname (see Config.AltNicks), so registration
+// doesn't stall.
 func nickCollisionHandler(c *Client, e Event) {
-	if c.Config.HandleNickCollide == nil {
-		c.Cmd.Nick(c.GetNick() + "_")
+	c.state.RLock()
+	registered := c.state.registered
+	c.state.RUnlock()
+
+	// The nickname which was rejected, i.e. "433 * <nick> :in use".
+	rejected := c.GetNick()
+	if len(e.Params) > 1 {
+		rejected = e.Params[1]
+	}
+
+	if c.Config.HandleNickCollide != nil {
+		c.Cmd.Nick(c.Config.HandleNickCollide(rejected))
 		return
 	}
 
-	c.Cmd.Nick(c.Config.HandleNickCollide(c.GetNick()))
+	// Once registered, a collision means a nick change we requested was
+	// refused, and we still have our previous nickname.
+	if registered {
+		return
+	}
+
+	next := c.nextNick(c.nickLen())
+	if next == "" {
+		c.fail(ErrNickUnavailable{Nick: rejected, Event: e.Copy()})
+		return
+	}
+
+	c.state.Lock()
+	c.state.nick = next
+	c.state.Unlock()
+
+	c.Cmd.Nick(next)
+}
+
+// handleErroneousNick handles ERR_ERRONEUSNICKNAME, where the server has
+// rejected our nickname as invalid. If we haven't registered yet, this tries
+// a sanitized version of the nickname (see sanitizeNick()), or the next
+// fallback nickname (see Config.AltNicks), so registration doesn't stall. If
+// no valid nickname can be found, the connection is closed.
+func handleErroneousNick(c *Client, e Event) {
+	c.state.RLock()
+	registered := c.state.registered
+	c.state.RUnlock()
+
+	// Once registered, we still have our previous nickname.
+	if registered {
+		return
+	}
+
+	// The nickname which was rejected, i.e. "432 * <nick> :Erroneous nickname".
+	rejected := c.GetNick()
+	if len(e.Params) > 1 {
+		rejected = e.Params[1]
+	}
+
+	maxLen := c.nickLen()
+
+	// Try the rejected nickname without any invalid characters first, then
+	// each fallback nickname, skipping any which end up the same as the
+	// rejected nickname.
+	next := sanitizeNick(rejected, maxLen)
+	for next == "" || ToRFC1459(next) == ToRFC1459(rejected) {
+		fallback := c.nextNick(maxLen)
+		if fallback == "" {
+			c.fail(ErrNickUnavailable{Nick: rejected, Event: e.Copy()})
+			return
+		}
+
+		next = sanitizeNick(fallback, maxLen)
+	}
+
+	c.debug.Printf("nickname %q rejected as invalid, trying %q", rejected, next)
+
+	c.state.Lock()
+	c.state.nick = next
+	c.state.Unlock()
+
+	c.Cmd.Nick(next)
+}
+
+// sanitizeNick removes characters from nick which aren't valid in a nickname
+// (see IsValidNick()), and truncates it to maxLen (if greater than 0). An
+// empty string is returned if nothing is left.
+func sanitizeNick(nick string, maxLen int) string {
+	out := make([]byte, 0, len(nick))
+	for i := 0; i < len(nick); i++ {
+		if IsValidNick(string(append(out, nick[i]))) {
+			out = append(out, nick[i])
+		}
+	}
+
+	if maxLen > 0 && len(out) > maxLen {
+		out = out[:maxLen]
+	}
+
+	return string(out)
+}
+
+// maxNickFallbacks is the maximum amount of underscores which will be
+// appended to Config.Nick when no Config.AltNicks are supplied.
+const maxNickFallbacks = 5
+
+// nextNick returns the next fallback nickname to attempt during
+// registration, or an empty string if there are none left. Each of
+// Config.AltNicks is tried in turn, or if there are none, Config.Nick with
+// up to maxNickFallbacks underscores appended. Attempts are counted (rather
+// than derived from the rejected nickname), as servers may truncate the
+// nickname before rejecting it. If maxLen is greater than 0, Config.Nick is
+// shortened to make room for the underscores.
+func (c *Client) nextNick(maxLen int) string {
+	c.state.Lock()
+	attempt := c.state.nickAttempts
+	c.state.nickAttempts++
+	c.state.Unlock()
+
+	return fallbackNick(c.Config, attempt, maxLen)
+}
+
+// fallbackNick returns the fallback nickname for the given attempt (starting
+// from 0), see Client.nextNick().
+func fallbackNick(conf Config, attempt, maxLen int) string {
+	if len(conf.AltNicks) > 0 {
+		if attempt < len(conf.AltNicks) {
+			return conf.AltNicks[attempt]
+		}
+
+		return ""
+	}
+
+	if attempt >= maxNickFallbacks {
+		return ""
+	}
+
+	suffix := strings.Repeat("_", attempt+1)
+	base := conf.Nick
+	if maxLen > 0 && len(base)+len(suffix) > maxLen {
+		if maxLen <= len(suffix) {
+			return ""
+		}
+		base = base[:maxLen-len(suffix)]
+	}
+
+	return base + suffix
+}
+
+// nickLen returns the maximum nickname length advertised by the server
+// (NICKLEN), or 0 if unknown.
+func (c *Client) nickLen() int {
+	if c.Config.disableTracking {
+		return 0
+	}
+
+	nicklen, _ := c.GetServerOption("NICKLEN")
+	n, _ := strconv.Atoi(nicklen)
+	return n
 }
 
 // handlePING helps respond to ping requests from the server.
@@ -113,9 +404,26 @@ func handlePING(c *Client, e Event) {
 }
 
 func handlePONG(c *Client, e Event) {
+	// The token is the last parameter, e.g. "PONG server :token".
+	token := e.Trailing
+	if token == "" && len(e.Params) > 0 {
+		token = e.Params[len(e.Params)-1]
+	}
+
 	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+
+	if !c.Config.DisablePongValidation {
+		if c.conn.pingToken == "" || token != c.conn.pingToken {
+			c.debug.Printf("ignoring PONG with unexpected token %q (wanted %q)", token, c.conn.pingToken)
+			return
+		}
+
+		// Only the first reply to each PING counts.
+		c.conn.pingToken = ""
+	}
+
 	c.conn.lastPong = time.Now()
-	c.conn.mu.Unlock()
 }
 
 // handleJOIN ensures that the state has updated users and channels.
@@ -157,6 +465,13 @@ func handleJOIN(c *Client, e Event) {
 	channel.addUser(user.Nick)
 	user.addChannel(channel.Name)
 
+	// The WHO sent below will also provide these, but we may as well track
+	// them in the meantime.
+	if e.Source.Ident != "" && e.Source.Host != "" {
+		user.Ident = e.Source.Ident
+		user.Host = e.Source.Host
+	}
+
 	// Assume extended-join (ircv3).
 	if len(e.Params) == 2 {
 		if e.Params[1] != "*" {
@@ -212,6 +527,8 @@ func handlePART(c *Client, e Event) {
 	if e.Source.Name == c.GetNick() {
 		c.state.Lock()
 		c.state.deleteChannel(channel)
+		// We left on purpose, so it shouldn't be joined again.
+		delete(c.state.keys, c.state.casefold(channel))
 		c.state.Unlock()
 		return
 	}
@@ -246,6 +563,67 @@ func handleTOPIC(c *Client, e Event) {
 	c.state.notify(c, UPDATE_STATE)
 }
 
+// handleCREATIONTIME tracks the creation time of a channel, which is sent
+// (RPL_CREATIONTIME) in response to a channel MODE query.
+func handleCREATIONTIME(c *Client, e Event) {
+	if len(e.Params) < 2 {
+		return
+	}
+
+	raw := e.Trailing
+	if len(e.Params) > 2 {
+		raw = e.Params[2]
+	}
+
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.state.Lock()
+	channel := c.state.lookupChannel(e.Params[1])
+	if channel == nil {
+		c.state.Unlock()
+		return
+	}
+
+	channel.Created = time.Unix(ts, 0)
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_STATE)
+}
+
+// handleWHOISIDLE tracks the idle and signon time of users which we are
+// tracking, from WHOIS responses (RPL_WHOISIDLE).
+func handleWHOISIDLE(c *Client, e Event) {
+	if len(e.Params) < 3 {
+		return
+	}
+
+	idle, err := strconv.ParseInt(e.Params[2], 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.state.Lock()
+	user := c.state.lookupUser(e.Params[1])
+	if user == nil {
+		c.state.Unlock()
+		return
+	}
+
+	user.Extras.Idle = time.Duration(idle) * time.Second
+	user.Extras.IdleUpdated = time.Now()
+
+	// Signon time isn't provided by all servers.
+	if len(e.Params) > 3 {
+		if signon, err := strconv.ParseInt(e.Params[3], 10, 64); err == nil {
+			user.Extras.Signon = time.Unix(signon, 0)
+		}
+	}
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_STATE)
+}
+
 // handlWHO updates our internal tracking of users/channels with WHO/WHOX
 // information.
 func handleWHO(c *Client, e Event) {
@@ -335,6 +713,29 @@ func handleNICK(c *Client, e Event) {
 	c.state.notify(c, UPDATE_STATE)
 }
 
+// handleSelfNICK keeps track of our own nickname when tracking is disabled.
+// Otherwise, this is handled by handleNICK.
+func handleSelfNICK(c *Client, e Event) {
+	if e.Source == nil {
+		return
+	}
+
+	to := e.Trailing
+	if len(e.Params) == 1 {
+		to = e.Params[0]
+	}
+
+	c.state.Lock()
+	if to == "" || ToRFC1459(e.Source.Name) != ToRFC1459(c.state.nick) {
+		c.state.Unlock()
+		return
+	}
+	c.state.nick = to
+	c.state.Unlock()
+
+	c.state.notify(c, UPDATE_GENERAL)
+}
+
 // handleQUIT handles users that are quitting from the network.
 func handleQUIT(c *Client, e Event) {
 	if e.Source == nil {
@@ -347,10 +748,56 @@ func handleQUIT(c *Client, e Event) {
 
 	c.state.Lock()
 	c.state.deleteUser("", e.Source.Name)
+	delete(c.state.metadata, c.state.casefold(e.Source.Name))
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
 }
 
+// handleYOURHOST handles incoming RPL_YOURHOST events, which tell us the
+// server name and version in human readable form, e.g. "Your host is
+// irc.example.com[127.0.0.1/6667], running version example-1.0". RPL_MYINFO
+// (which follows) takes precedence, if the server sends it.
+func handleYOURHOST(c *Client, e Event) {
+	name, version := parseYourHost(e.Trailing)
+	if name == "" && version == "" {
+		return
+	}
+
+	c.state.Lock()
+	if name != "" {
+		c.state.serverName = name
+	}
+	if version != "" {
+		c.state.serverVersion = version
+	}
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_GENERAL)
+}
+
+// parseYourHost parses the server name and version from the trailing text
+// of an RPL_YOURHOST reply.
+func parseYourHost(raw string) (name, version string) {
+	fields := strings.Fields(raw)
+
+	for i := 0; i < len(fields)-1; i++ {
+		switch strings.ToLower(fields[i]) {
+		case "is":
+			if name != "" {
+				continue
+			}
+
+			name = strings.TrimRight(fields[i+1], ",")
+			if sep := strings.IndexByte(name, '['); sep > 0 {
+				name = name[:sep]
+			}
+		case "version":
+			version = fields[i+1]
+		}
+	}
+
+	return name, version
+}
+
 // handleMYINFO handles incoming MYINFO events -- these are commonly used
 // to tell us what the server name is, what version of software is being used
 // as well as what channel and user modes are being used on the server.
@@ -362,8 +809,8 @@ func handleMYINFO(c *Client, e Event) {
 	}
 
 	c.state.Lock()
-	c.state.serverOptions["SERVER"] = e.Params[1]
-	c.state.serverOptions["VERSION"] = e.Params[2]
+	c.state.serverName = e.Params[1]
+	c.state.serverVersion = e.Params[2]
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_GENERAL)
 }
@@ -386,6 +833,8 @@ func handleISUPPORT(c *Client, e Event) {
 		return
 	}
 
+	var casemapping bool
+
 	c.state.Lock()
 	// Skip the first parameter, as it's our nickname.
 	for i := 1; i < len(e.Params); i++ {
@@ -399,8 +848,19 @@ func handleISUPPORT(c *Client, e Event) {
 		name := e.Params[i][0:j]
 		val := e.Params[i][j+1:]
 		c.state.serverOptions[name] = val
+
+		if name == "CASEMAPPING" {
+			casemapping = true
+		}
 	}
 	c.state.Unlock()
+
+	// Anything casefolded so far may have used a different mapping (the
+	// default, or that of the server we were previously connected to).
+	if casemapping {
+		c.rebuildCasefold()
+	}
+
 	c.state.notify(c, UPDATE_GENERAL)
 }
 
@@ -428,6 +888,24 @@ func handleMOTD(c *Client, e Event) {
 	c.state.Unlock()
 }
 
+// handleSelfAway handles RPL_NOWAWAY and RPL_UNAWAY, which are sent by the
+// server to confirm that we have been marked as away, or are no longer away.
+func handleSelfAway(c *Client, e Event) {
+	c.state.Lock()
+	c.state.away = e.Command == RPL_NOWAWAY
+	if !c.state.away {
+		c.state.awayMessage = ""
+	}
+
+	// Keep our own user (if tracked) consistent with what away-notify would
+	// show for other users.
+	if user := c.state.lookupUser(c.state.nick); user != nil {
+		user.Extras.Away = c.state.awayMessage
+	}
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_GENERAL)
+}
+
 // handleNAMES handles incoming NAMES queries, of which lists all users in
 // a given channel. Optionally also obtains ident/host values, as well as
 // permissions for each user, depending on what capabilities are enabled.
@@ -500,7 +978,8 @@ func handleNAMES(c *Client, e Event) {
 // a KICK where we know they are active, as they just kicked another user,
 // even though they may not be talking.
 func updateLastActive(c *Client, e Event) {
-	if e.Source == nil {
+	// Playback doesn't mean the user is active now.
+	if e.Source == nil || e.IsHistorical() {
 		return
 	}
 
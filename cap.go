@@ -18,13 +18,19 @@ var possibleCap = map[string][]string{
 	"cap-notify":        nil,
 	"chghost":           nil,
 	"extended-join":     nil,
+	"extended-monitor":  nil,
 	"invite-notify":     nil,
+	"message-tags":      nil,
 	"multi-prefix":      nil,
 	"server-time":       nil,
 	"userhost-in-names": nil,
 
-	"draft/message-tags-0.2": nil,
-	"draft/msgid":            nil,
+	"draft/chathistory":       nil,
+	"draft/metadata-2":        nil,
+	"draft/message-redaction": nil,
+	"draft/multiline":         nil,
+	"draft/message-tags-0.2":  nil,
+	"draft/msgid":             nil,
 
 	// "echo-message" is supported, but it's not enabled by default. This is
 	// to prevent unwanted confusion and utilize less traffic if it's not needed.
@@ -47,16 +53,22 @@ func (c *Client) listCAP() {
 func possibleCapList(c *Client) map[string][]string {
 	out := make(map[string][]string)
 
-	if c.Config.SASL != nil {
+	if c.Config.SASL != nil || len(c.Config.SASLMechanisms) > 0 {
 		out["sasl"] = nil
 	}
 
+	// Values are copied, so that neither the package-level defaults nor the
+	// config are shared between clients.
 	for k := range c.Config.SupportedCaps {
-		out[k] = c.Config.SupportedCaps[k]
+		out[k] = append([]string(nil), c.Config.SupportedCaps[k]...)
+	}
+
+	for i := 0; i < len(c.Config.RequestCaps); i++ {
+		out[c.Config.RequestCaps[i]] = nil
 	}
 
 	for k := range possibleCap {
-		out[k] = possibleCap[k]
+		out[k] = append([]string(nil), possibleCap[k]...)
 	}
 
 	return out
@@ -84,96 +96,143 @@ func parseCap(raw string) map[string][]string {
 	return out
 }
 
-// handleCAP attempts to find out what IRCv3 capabilities the server supports.
-// This will lock further registration until we have acknowledged (or denied)
-// the capabilities.
-func handleCAP(c *Client, e Event) {
-	if len(e.Params) >= 2 && (e.Params[1] == CAP_NEW || e.Params[1] == CAP_DEL) {
-		c.listCAP()
-		return
-	}
-
-	// We can assume there was a failure attempting to enable a capability.
-	if len(e.Params) == 2 && e.Params[1] == CAP_NAK {
-		// Let the server know that we're done.
-		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
-		return
-	}
-
+// supportedCaps returns which of caps (as advertised by the server) we'd
+// like to enable, storing their values in state. Must be called with the
+// state lock held.
+func (c *Client) supportedCaps(caps map[string][]string) (supported []string) {
 	possible := possibleCapList(c)
 
-	if len(e.Params) >= 2 && e.Params[1] == CAP_LS {
-		c.state.Lock()
+	for k := range caps {
+		if _, ok := possible[k]; !ok {
+			continue
+		}
 
-		caps := parseCap(e.Trailing)
+		if len(possible[k]) == 0 || len(caps[k]) == 0 {
+			supported = append(supported, k)
+			c.state.capValues[k] = caps[k]
+			continue
+		}
 
-		for k := range caps {
-			if _, ok := possible[k]; !ok {
-				continue
+		var contains bool
+		for i := 0; i < len(caps[k]); i++ {
+			for j := 0; j < len(possible[k]); j++ {
+				if caps[k][i] == possible[k][j] {
+					// Assume we have a matching split value.
+					contains = true
+					goto checkcontains
+				}
 			}
+		}
 
-			if len(possible[k]) == 0 || len(caps[k]) == 0 {
-				c.state.tmpCap = append(c.state.tmpCap, k)
-				continue
-			}
+	checkcontains:
+		if !contains {
+			continue
+		}
 
-			var contains bool
-			for i := 0; i < len(caps[k]); i++ {
-				for j := 0; j < len(possible[k]); j++ {
-					if caps[k][i] == possible[k][j] {
-						// Assume we have a matching split value.
-						contains = true
-						goto checkcontains
-					}
-				}
-			}
+		supported = append(supported, k)
+		c.state.capValues[k] = caps[k]
+	}
 
-		checkcontains:
-			if !contains {
-				continue
-			}
+	return supported
+}
 
-			c.state.tmpCap = append(c.state.tmpCap, k)
+// handleCAP attempts to find out what IRCv3 capabilities the server supports.
+// This will lock further registration until we have acknowledged (or denied)
+// the capabilities. Capabilities which are added (CAP NEW) or removed
+// (CAP DEL) after registration are requested or removed as needed.
+func handleCAP(c *Client, e Event) {
+	if len(e.Params) < 2 {
+		return
+	}
+
+	c.state.RLock()
+	registered := c.state.registered
+	c.state.RUnlock()
+
+	switch e.Params[1] {
+	case CAP_NEW:
+		c.state.Lock()
+		caps := c.supportedCaps(parseCap(e.Trailing))
+		c.state.Unlock()
+
+		if len(caps) > 0 {
+			c.write(&Event{Command: CAP, Params: []string{CAP_REQ}, Trailing: strings.Join(caps, " "), EmptyTrailing: true})
+		}
+		return
+	case CAP_DEL:
+		c.state.Lock()
+		for name := range parseCap(e.Trailing) {
+			c.state.removeCap(name)
 		}
 		c.state.Unlock()
+		return
+	case CAP_NAK:
+		// We can assume there was a failure attempting to enable a
+		// capability.
+		if len(e.Params) == 2 && !registered {
+			// Let the server know that we're done.
+			c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+		}
+		return
+	}
+
+	if e.Params[1] == CAP_LS {
+		c.state.Lock()
+		c.state.tmpCap = append(c.state.tmpCap, c.supportedCaps(parseCap(e.Trailing))...)
+		c.state.Unlock()
 
 		// Indicates if this is a multi-line LS. (2 args means it's the
 		// last LS).
 		if len(e.Params) == 2 {
+			c.state.Lock()
+			tmpCap := c.state.tmpCap
+			// Re-initialize the tmpCap, so if we get multiple 'CAP LS'
+			// requests, we can re-evaluate what we can support.
+			c.state.tmpCap = []string{}
+			c.state.Unlock()
+
 			// If we support no caps, just ack the CAP message and END.
-			if len(c.state.tmpCap) == 0 {
+			if len(tmpCap) == 0 {
 				c.write(&Event{Command: CAP, Params: []string{CAP_END}})
 				return
 			}
 
 			// Let them know which ones we'd like to enable.
-			c.write(&Event{Command: CAP, Params: []string{CAP_REQ}, Trailing: strings.Join(c.state.tmpCap, " "), EmptyTrailing: true})
-
-			// Re-initialize the tmpCap, so if we get multiple 'CAP LS' requests
-			// due to cap-notify, we can re-evaluate what we can support.
-			c.state.Lock()
-			c.state.tmpCap = []string{}
-			c.state.Unlock()
+			c.write(&Event{Command: CAP, Params: []string{CAP_REQ}, Trailing: strings.Join(tmpCap, " "), EmptyTrailing: true})
 		}
+		return
 	}
 
 	if len(e.Params) == 2 && len(e.Trailing) > 1 && e.Params[1] == CAP_ACK {
-		c.state.Lock()
-		c.state.enabledCap = strings.Split(e.Trailing, " ")
-
 		// Do we need to do sasl auth?
 		wantsSASL := false
-		for i := 0; i < len(c.state.enabledCap); i++ {
-			if c.state.enabledCap[i] == "sasl" {
+
+		c.state.Lock()
+		for _, name := range strings.Fields(e.Trailing) {
+			// A "-" prefix means the capability was disabled.
+			if strings.HasPrefix(name, "-") {
+				c.state.removeCap(name[1:])
+				continue
+			}
+
+			if !c.state.hasCap(name) {
+				c.state.enabledCap = append(c.state.enabledCap, name)
+			}
+
+			if name == "sasl" {
 				wantsSASL = true
-				break
 			}
 		}
 		c.state.Unlock()
 
-		if wantsSASL {
-			c.write(&Event{Command: AUTHENTICATE, Params: []string{c.Config.SASL.Method()}})
+		// Capabilities enabled after registration don't affect it.
+		if registered {
+			return
+		}
+
+		if wantsSASL && (c.Config.SASL != nil || len(c.Config.SASLMechanisms) > 0) {
 			// Don't "CAP END", since we want to authenticate.
+			c.startSASL()
 			return
 		}
 
@@ -210,6 +269,12 @@ func handleAWAY(c *Client, e Event) {
 	if user != nil {
 		user.Extras.Away = e.Trailing
 	}
+
+	// Some servers will also notify us of our own away status changes.
+	if ToRFC1459(e.Source.Name) == ToRFC1459(c.state.nick) {
+		c.state.away = e.Trailing != ""
+		c.state.awayMessage = e.Trailing
+	}
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
 }
@@ -228,11 +293,20 @@ func handleACCOUNT(c *Client, e Event) {
 		account = ""
 	}
 
+	nick := c.casefold(e.Source.Name)
+
 	c.state.Lock()
 	user := c.state.lookupUser(e.Source.Name)
 	if user != nil {
 		user.Extras.Account = account
 	}
+
+	// With extended-monitor, we're also notified about monitored users
+	// which we don't share a channel with.
+	if entry, ok := c.state.monitor[nick]; ok {
+		entry.account = account
+		c.state.monitor[nick] = entry
+	}
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
 }
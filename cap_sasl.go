@@ -7,6 +7,7 @@ package girc
 import (
 	"encoding/base64"
 	"fmt"
+	"strings"
 )
 
 // SASLMech is an representation of what a SASL mechanism should support.
@@ -80,24 +81,134 @@ func (sasl *SASLPlain) Encode(params []string) string {
 
 const saslChunkSize = 400
 
+// startSASL starts authenticating with the most preferred SASL mechanism
+// which the server supports. See Config.SASLMechanisms.
+func (c *Client) startSASL() {
+	mechs := c.Config.SASLMechanisms
+	if len(mechs) == 0 {
+		mechs = []SASLMech{c.Config.SASL}
+	}
+
+	c.state.Lock()
+	// With CAP 302, the server may advertise which mechanisms it supports.
+	c.state.sasl = filterSASL(mechs, c.state.capValues["sasl"])
+	sasl := c.state.sasl
+	c.state.Unlock()
+
+	if len(sasl) == 0 {
+		c.failSASL("no SASL mechanisms in common with the server")
+		return
+	}
+
+	c.write(&Event{Command: AUTHENTICATE, Params: []string{sasl[0].Method()}})
+}
+
+// nextSASL moves on to the next SASL mechanism, returning false if there
+// are none left to try.
+func (c *Client) nextSASL() bool {
+	c.state.Lock()
+	if len(c.state.sasl) < 2 {
+		c.state.Unlock()
+		return false
+	}
+	failed := c.state.sasl[0]
+	c.state.sasl = c.state.sasl[1:]
+	sasl := c.state.sasl
+	c.state.Unlock()
+
+	c.debug.Printf("SASL %s failed, trying %s", failed.Method(), sasl[0].Method())
+	c.write(&Event{Command: AUTHENTICATE, Params: []string{sasl[0].Method()}})
+	return true
+}
+
+// currentSASL returns the SASL mechanism currently in use.
+func (c *Client) currentSASL() SASLMech {
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	if len(c.state.sasl) > 0 {
+		return c.state.sasl[0]
+	}
+
+	return c.Config.SASL
+}
+
+// filterSASL returns the mechanisms in mechs which are in supported (in the
+// order of mechs). If supported is empty, all of mechs are returned.
+func filterSASL(mechs []SASLMech, supported []string) []SASLMech {
+	if len(supported) == 0 {
+		return append([]SASLMech(nil), mechs...)
+	}
+
+	var out []SASLMech
+	for i := 0; i < len(mechs); i++ {
+		for j := 0; j < len(supported); j++ {
+			if strings.EqualFold(mechs[i].Method(), supported[j]) {
+				out = append(out, mechs[i])
+				break
+			}
+		}
+	}
+
+	return out
+}
+
+// failSASL gives up on SASL authentication, either continuing without being
+// authenticated (see Config.SASLOptional), or closing the connection.
+func (c *Client) failSASL(reason string) {
+	if c.Config.SASLOptional {
+		c.debug.Printf("SASL failed, continuing unauthenticated: %s", reason)
+		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+		return
+	}
+
+	c.rx <- &Event{Command: ERROR, Trailing: "closing connection: " + reason}
+}
+
 func handleSASL(c *Client, e Event) {
+	sasl := c.currentSASL()
+
 	if e.Command == RPL_SASLSUCCESS || e.Command == ERR_SASLALREADY {
+		if e.Command == RPL_SASLSUCCESS && sasl != nil {
+			c.debug.Printf("authenticated using SASL %s", sasl.Method())
+
+			c.state.Lock()
+			c.state.saslMech = sasl.Method()
+			c.state.Unlock()
+		}
+
 		// Let the server know that we're done.
 		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
 		return
 	}
 
+	if sasl == nil {
+		return
+	}
+
 	// Assume they want us to handle sending auth.
-	auth := c.Config.SASL.Encode(e.Params)
+	auth := sasl.Encode(e.Params)
 
 	if auth == "" {
 		// Assume the SASL authentication method doesn't want to respond for
 		// some reason. The SASL spec and IRCv3 spec do not define a clear
 		// way to abort a SASL exchange, other than to disconnect, or proceed
 		// with CAP END.
+		c.state.RLock()
+		remaining := len(c.state.sasl)
+		c.state.RUnlock()
+
+		if c.Config.SASLOptional || remaining > 1 {
+			// The server should respond with ERR_SASLABORTED, after which
+			// we try the next mechanism, or continue without
+			// authenticating.
+			c.write(&Event{Command: AUTHENTICATE, Params: []string{"*"}})
+			return
+		}
+
 		c.rx <- &Event{Command: ERROR, Trailing: fmt.Sprintf(
 			"closing connection: SASL %s failed: %s",
-			c.Config.SASL.Method(), e.Trailing,
+			sasl.Method(), e.Trailing,
 		)}
 		return
 	}
@@ -125,13 +236,33 @@ func handleSASL(c *Client, e Event) {
 }
 
 func handleSASLError(c *Client, e Event) {
-	if c.Config.SASL == nil {
+	if c.Config.SASL == nil && len(c.Config.SASLMechanisms) == 0 {
 		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
 		return
 	}
 
+	switch e.Command {
+	case RPL_SASLMECHS:
+		// The server lists the mechanisms it supports, so skip any which
+		// it doesn't. ERR_SASLFAIL follows.
+		if len(e.Params) > 1 {
+			c.state.Lock()
+			if len(c.state.sasl) > 1 {
+				c.state.sasl = append(c.state.sasl[:1:1], filterSASL(c.state.sasl[1:], strings.Split(e.Params[1], ","))...)
+			}
+			c.state.Unlock()
+		}
+
+		// Wait for ERR_SASLFAIL, rather than ending twice.
+		return
+	case ERR_SASLFAIL, ERR_SASLABORTED:
+		if c.nextSASL() {
+			return
+		}
+	}
+
 	// Authentication failed. The SASL spec and IRCv3 spec do not define a
 	// clear way to abort a SASL exchange, other than to disconnect, or
 	// proceed with CAP END.
-	c.rx <- &Event{Command: ERROR, Trailing: "closing connection: " + e.Trailing}
+	c.failSASL(e.Trailing)
 }
@@ -10,6 +10,7 @@ import (
 	"io"
 	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 // handleTags handles any messages that have tags that will affect state. (e.g.
@@ -309,10 +310,11 @@ func validTag(name string) bool {
 // with tagDecoder first, it may be seen as invalid.
 func validTagValue(value string) bool {
 	for i := 0; i < len(value); i++ {
-		// Don't allow any invisible chars within the tag, or semicolons.
-		if value[i] < '!' || value[i] > '~' || value[i] == ';' {
+		// Don't allow any invisible chars within the tag, or semicolons. UTF-8
+		// is permitted, as it's commonly used for things like reactions.
+		if value[i] < '!' || value[i] == 0x7F || value[i] == ';' {
 			return false
 		}
 	}
-	return true
+	return utf8.ValidString(value)
 }
@@ -4,8 +4,14 @@
 
 package girc
 
-import "testing"
-import "reflect"
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestCapList(t *testing.T) {
 	c := New(Config{
@@ -101,7 +107,368 @@ func TestTagGetSetCount(t *testing.T) {
 	}
 
 	// Add a hidden ascii value at the end to make it invalid.
-	if err := e.Tags.Set("key", "invalid-value"+string(0x08)); err == nil {
+	if err := e.Tags.Set("key", "invalid-value\x08"); err == nil {
 		t.Fatal("tag set of invalid value should have returned error")
 	}
 }
+
+func TestRequestCaps(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.RequestCaps = []string{"example.org/cap", "example.org/unsupported"}
+
+	var requested string
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != CAP {
+			return nil
+		}
+
+		switch e.Params[0] {
+		case CAP_LS:
+			return []string{":dummy.int CAP * LS :batch example.org/cap"}
+		case CAP_REQ:
+			requested = e.Trailing
+			return []string{":dummy.int CAP * ACK :" + e.Trailing}
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	for i := 0; len(c.AckedCaps()) == 0; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for CAP ACK")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if !strings.Contains(requested, "example.org/cap") || strings.Contains(requested, "example.org/unsupported") {
+		t.Fatalf("CAP REQ = %q, wanted example.org/cap only if advertised", requested)
+	}
+
+	if got := c.AckedCaps(); !reflect.DeepEqual(got, []string{"example.org/cap"}) {
+		t.Fatalf("Client.AckedCaps() = %q, wanted %q", got, []string{"example.org/cap"})
+	}
+}
+
+// mockSASLServer responds to CAP negotiation and SASL PLAIN authentication,
+// failing authentication if fail is set. Commands received are sent to
+// received.
+func mockSASLServer(conn net.Conn, fail bool, received chan<- string) {
+	mockRespond(conn, func(e *Event) []string {
+		switch e.Command {
+		case CAP:
+			received <- CAP + " " + e.Params[0]
+			switch e.Params[0] {
+			case CAP_LS:
+				return []string{":dummy.int CAP * LS :sasl"}
+			case CAP_REQ:
+				return []string{":dummy.int CAP * ACK :" + e.Trailing}
+			}
+		case AUTHENTICATE:
+			received <- AUTHENTICATE + " " + e.Params[0]
+			if e.Params[0] == "PLAIN" {
+				return []string{"AUTHENTICATE +"}
+			}
+
+			if fail {
+				return []string{
+					":dummy.int 908 test PLAIN :are available SASL mechanisms",
+					":dummy.int 904 test :SASL authentication failed",
+				}
+			}
+			return []string{":dummy.int 903 test :SASL authentication successful"}
+		}
+		return nil
+	})
+}
+
+func TestSASLReconnect(t *testing.T) {
+	c := New(Config{
+		Server:     "dummy.int",
+		Port:       6667,
+		Nick:       "test",
+		User:       "test",
+		SASL:       &SASLPlain{User: "test", Pass: "example"},
+		AllowFlood: true,
+	})
+
+	expect := func(received <-chan string, want ...string) {
+		t.Helper()
+		for i := 0; i < len(want); i++ {
+			select {
+			case got := <-received:
+				if !strings.HasPrefix(got, want[i]) {
+					t.Fatalf("received %q, wanted %q", got, want[i])
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timed out waiting for %q", want[i])
+			}
+		}
+	}
+
+	sequence := []string{"CAP LS", "CAP REQ", "AUTHENTICATE PLAIN", "AUTHENTICATE ", "CAP END"}
+
+	// Authenticate, drop the connection, and ensure we authenticate again
+	// once reconnected.
+	for i := 0; i < 2; i++ {
+		conn, server := net.Pipe()
+		received := make(chan string, 10)
+		go mockSASLServer(conn, false, received)
+
+		errs := make(chan error, 1)
+		go func() { errs <- c.MockConnect(server) }()
+
+		expect(received, sequence...)
+
+		conn.Close()
+		select {
+		case <-errs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for disconnect")
+		}
+		server.Close()
+	}
+
+	// Failed authentication closes the connection, unless SASL is optional.
+	conn, server := net.Pipe()
+	defer conn.Close()
+	defer server.Close()
+
+	received := make(chan string, 10)
+	go mockSASLServer(conn, true, received)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(*ErrEvent); !ok {
+			t.Fatalf("Client.MockConnect() = %v after failed SASL, wanted *ErrEvent", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for failed SASL to close the connection")
+	}
+
+	c.Config.SASLOptional = true
+
+	conn, server = net.Pipe()
+	defer conn.Close()
+	defer server.Close()
+
+	received = make(chan string, 10)
+	go mockSASLServer(conn, true, received)
+
+	errs = make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+	defer c.Close()
+
+	expect(received, sequence...)
+
+	select {
+	case err := <-errs:
+		t.Fatalf("Client.MockConnect() returned %v with SASLOptional", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCapNewDel(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	requested := make(chan string, 5)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == CAP && len(e.Params) > 0 && e.Params[0] == CAP_REQ {
+			requested <- e.Trailing
+			return []string{":dummy.int CAP test ACK :" + e.Trailing}
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	c.state.Lock()
+	c.state.registered = true
+	c.state.Unlock()
+
+	waitCap := func(name string, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for c.HasCap(name) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Client.HasCap(%q) = %t, wanted %t", name, !want, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if _, err := conn.Write([]byte(":dummy.int CAP test ACK :away-notify\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitCap("away-notify", true)
+
+	// Only supported capabilities should be requested.
+	if _, err := conn.Write([]byte(":dummy.int CAP test NEW :invite-notify unknown-cap\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case req := <-requested:
+		if req != "invite-notify" {
+			t.Fatalf("requested %q after CAP NEW, wanted invite-notify", req)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for CAP REQ")
+	}
+
+	waitCap("invite-notify", true)
+	if !c.HasCap("away-notify") {
+		t.Fatal("Client.HasCap() lost existing capability after CAP NEW")
+	}
+
+	if _, err := conn.Write([]byte(":dummy.int CAP test DEL :away-notify\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitCap("away-notify", false)
+
+	if !c.HasCap("invite-notify") {
+		t.Fatal("Client.HasCap() lost unrelated capability after CAP DEL")
+	}
+}
+
+// unsupportedSASL is a SASL mechanism which the mock server doesn't support.
+type unsupportedSASL struct{}
+
+func (unsupportedSASL) Method() string                { return "EXAMPLE" }
+func (unsupportedSASL) Encode(params []string) string { return "+" }
+
+func TestSASLFallback(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.SASLMechanisms = []SASLMech{
+		&SASLExternal{}, unsupportedSASL{}, &SASLPlain{User: "test", Pass: "example"},
+	}
+
+	received := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		switch e.Command {
+		case CAP:
+			switch e.Params[0] {
+			case CAP_LS:
+				return []string{":dummy.int CAP * LS :sasl=PLAIN,EXTERNAL"}
+			case CAP_REQ:
+				return []string{":dummy.int CAP * ACK :" + e.Trailing}
+			case CAP_END:
+				received <- CAP + " " + CAP_END
+			}
+		case AUTHENTICATE:
+			received <- AUTHENTICATE + " " + e.Params[0]
+			switch e.Params[0] {
+			case "EXTERNAL", "PLAIN":
+				return []string{"AUTHENTICATE +"}
+			case "+":
+				// EXTERNAL fails.
+				return []string{":dummy.int 904 test :SASL authentication failed"}
+			}
+			return []string{":dummy.int 903 test :SASL authentication successful"}
+		}
+		return nil
+	})
+
+	go c.MockConnect(server)
+	defer c.Close()
+
+	for _, want := range []string{"AUTHENTICATE EXTERNAL", "AUTHENTICATE +", "AUTHENTICATE PLAIN", "AUTHENTICATE dGVzdA", "CAP END"} {
+		select {
+		case got := <-received:
+			if !strings.HasPrefix(got, want) {
+				t.Fatalf("received %q, wanted %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	if got := c.SASLMechanism(); got != "PLAIN" {
+		t.Fatalf("Client.SASLMechanism() = %q, wanted PLAIN", got)
+	}
+}
+
+func TestServerPassWithSASL(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.ServerPass = "secret"
+	c.Config.ServerPassFormat = "{nick}/network:{pass}"
+	c.Config.SASL = &SASLPlain{User: "account", Pass: "example"}
+
+	var mu sync.Mutex
+	var sent []string
+	go mockRespond(conn, func(e *Event) []string {
+		mu.Lock()
+		sent = append(sent, e.Command+" "+strings.Join(eventArgs(e), " "))
+		mu.Unlock()
+
+		switch e.Command {
+		case CAP:
+			switch e.Params[0] {
+			case CAP_LS:
+				return []string{":dummy.int CAP * LS :sasl"}
+			case CAP_REQ:
+				return []string{":dummy.int CAP * ACK :" + e.Trailing}
+			case CAP_END:
+				return []string{
+					":dummy.int 001 test :Welcome",
+					":dummy.int 376 test :End of /MOTD command.",
+				}
+			}
+		case AUTHENTICATE:
+			if e.Params[0] == "PLAIN" {
+				return []string{"AUTHENTICATE +"}
+			}
+			return []string{":dummy.int 903 test :SASL authentication successful"}
+		}
+		return nil
+	})
+
+	registered := make(chan struct{})
+	c.Handlers.Add(RPL_ENDOFMOTD, func(c *Client, e Event) { close(registered) })
+
+	go c.MockConnect(server)
+	defer c.Close()
+
+	select {
+	case <-registered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for registration")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{
+		"PASS test/network:secret", "CAP LS 302", "NICK test", "USER test * * Testing123",
+		"CAP REQ sasl", "AUTHENTICATE PLAIN", "AUTHENTICATE YWNjb3VudABhY2NvdW50AGV4YW1wbGU=", "CAP END",
+	}
+	if len(sent) < len(want) {
+		t.Fatalf("sent %q, wanted %q", sent, want)
+	}
+
+	for i := 0; i < len(want); i++ {
+		if sent[i] != want[i] {
+			t.Fatalf("sent %q, wanted %q", sent, want)
+		}
+	}
+
+	if got := c.SASLMechanism(); got != "PLAIN" {
+		t.Fatalf("Client.SASLMechanism() = %q, wanted PLAIN", got)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+// ChannelHandle is a convenience wrapper around Client.Cmd, for sending
+// commands to a single channel. See Client.Channel(). All methods are safe
+// to call on a nil ChannelHandle, in which case they do nothing (and return
+// a nil error).
+type ChannelHandle struct {
+	c    *Client
+	name string
+}
+
+// Channel returns a ChannelHandle for the named channel. If tracking is
+// enabled and the client isn't in the channel, nil is returned (which is
+// still safe to use).
+func (c *Client) Channel(name string) *ChannelHandle {
+	if !c.Config.disableTracking && !c.IsInChannel(name) {
+		return nil
+	}
+
+	return &ChannelHandle{c: c, name: name}
+}
+
+// Name returns the name of the channel, or an empty string if ch is nil.
+func (ch *ChannelHandle) Name() string {
+	if ch == nil {
+		return ""
+	}
+
+	return ch.name
+}
+
+// State returns a copy of the channel from state, or nil if it isn't tracked.
+// Panics if tracking is disabled.
+func (ch *ChannelHandle) State() *Channel {
+	if ch == nil {
+		return nil
+	}
+
+	return ch.c.LookupChannel(ch.name)
+}
+
+// Say sends a PRIVMSG to the channel. See Commands.Message().
+func (ch *ChannelHandle) Say(message string) error {
+	if ch == nil {
+		return nil
+	}
+
+	return ch.c.Cmd.Message(ch.name, message)
+}
+
+// Sayf sends a formatted PRIVMSG to the channel. See Commands.Messagef().
+func (ch *ChannelHandle) Sayf(format string, a ...interface{}) error {
+	if ch == nil {
+		return nil
+	}
+
+	return ch.c.Cmd.Messagef(ch.name, format, a...)
+}
+
+// Action sends a PRIVMSG ACTION (/me) to the channel. See Commands.Action().
+func (ch *ChannelHandle) Action(message string) error {
+	if ch == nil {
+		return nil
+	}
+
+	return ch.c.Cmd.Action(ch.name, message)
+}
+
+// Notice sends a NOTICE to the channel. See Commands.Notice().
+func (ch *ChannelHandle) Notice(message string) error {
+	if ch == nil {
+		return nil
+	}
+
+	return ch.c.Cmd.Notice(ch.name, message)
+}
+
+// Topic sets the topic of the channel. See Commands.Topic().
+func (ch *ChannelHandle) Topic(message string) error {
+	if ch == nil {
+		return nil
+	}
+
+	return ch.c.Cmd.Topic(ch.name, message)
+}
+
+// Kick kicks nick from the channel, with an optional reason. See
+// Commands.Kick().
+func (ch *ChannelHandle) Kick(nick, reason string) error {
+	if ch == nil {
+		return nil
+	}
+
+	return ch.c.Cmd.Kick(ch.name, []string{nick}, reason)
+}
+
+// Mode applies modes to the channel. See Commands.Mode().
+func (ch *ChannelHandle) Mode(modes string, params ...string) error {
+	if ch == nil {
+		return nil
+	}
+
+	return ch.c.Cmd.Mode(ch.name, modes, params...)
+}
+
+// Part leaves the channel, with an optional message. See Commands.Part()
+// and Commands.PartMessage().
+func (ch *ChannelHandle) Part(message string) error {
+	if ch == nil {
+		return nil
+	}
+
+	if message == "" {
+		return ch.c.Cmd.Part(ch.name)
+	}
+
+	return ch.c.Cmd.PartMessage(ch.name, message)
+}
@@ -12,8 +12,11 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,6 +33,10 @@ type Client struct {
 	rx chan *Event
 	// tx is a buffer of events waiting to be sent.
 	tx chan *Event
+	// pending holds events sent while disconnected. See
+	// Config.QueueWhileDisconnected and Config.ReplayOnReconnect.
+	pending   []pendingEvent
+	pendingMu sync.Mutex
 	// state represents the throw-away state for the irc session.
 	state *state
 	// initTime represents the creation time of the client.
@@ -47,6 +54,11 @@ type Client struct {
 	// stop is used to communicate with Connect(), letting it know that the
 	// client wishes to cancel/close.
 	stop context.CancelFunc
+	// closed is true once Close() has been called, until the next call to
+	// Connect(). This distinguishes an intentional shutdown from an
+	// unexpected disconnect, so that we never reconnect after the former.
+	// Guarded by mu.
+	closed bool
 	// conn is a net.Conn reference to the IRC server. If this is nil, it is
 	// safe to assume that we're not connected. If this is not nil, this
 	// means we're either connected, connecting, or cleaning up. This should
@@ -54,6 +66,27 @@ type Client struct {
 	conn *ircConn
 	// debug is used if a writer is supplied for Client.Config.Debugger.
 	debug *log.Logger
+	// ignoreMu guards ignores.
+	ignoreMu sync.RWMutex
+	// ignores are the masks of users to ignore, see Client.Ignore().
+	ignores []string
+	// serverIndex is the index of the current server, in the list of servers
+	// (see Config.Servers). Guarded by mu.
+	serverIndex int
+	// rand is the source of randomness for the client, see
+	// Config.RandSource. It is safe for concurrent use.
+	rand *rand.Rand
+	// typingMu guards typing.
+	typingMu sync.Mutex
+	// typing is the last typing notification sent to each target, see
+	// Client.Typing().
+	typing map[string]typingStatus
+	// metrics are the counters backing Client.Metrics().
+	metrics clientMetrics
+	// streamMu guards stream.
+	streamMu sync.Mutex
+	// stream is the channel of events returned by Client.Events(), if used.
+	stream *eventStream
 }
 
 // Config contains configuration options for an IRC client
@@ -62,11 +95,36 @@ type Config struct {
 	// has an affect during the dial process
 	Server string
 	// ServerPass is the server password used to authenticate. This only has
-	// an affect during the dial process.
+	// an affect during the dial process. PASS is sent before capability
+	// negotiation, so it may be used alongside SASL (e.g. to log in to a
+	// bouncer, while the bouncer authenticates with SASL).
 	ServerPass string
+	// ServerPassFormat is the format of the password sent with PASS, for
+	// servers which expect more than just the password (e.g. bouncers, or
+	// networks which identify with services using PASS). "{nick}", "{user}"
+	// and "{pass}" are replaced with Nick, User and ServerPass respectively,
+	// e.g. "{nick}:{pass}", or "account:{pass}". Defaults to "{pass}".
+	ServerPassFormat string
 	// Port is the port that will be used during server connection. This only
 	// has an affect during the dial process.
 	Port int
+	// MaxLineLength is the maximum length of a line sent by the server
+	// (including tags), in bytes. If exceeded, the connection is closed, and
+	// Connect returns an ErrLineTooLong. Defaults to 8703 (8191 bytes of
+	// tags, plus a 512 byte message).
+	MaxLineLength int
+	// DialTimeout is the maximum amount of time to wait when connecting to
+	// the server. Defaults to 5 seconds.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout is the maximum amount of time to wait for the TLS
+	// handshake to complete when SSL is enabled. If the handshake fails,
+	// Connect returns an ErrTLSHandshake. Defaults to DialTimeout.
+	TLSHandshakeTimeout time.Duration
+	// Servers is a list of "host:port" servers to connect to. If set, it is
+	// used in place of Server and Port. If the client is unable to connect
+	// to a server, the next server in the list is tried, and so on. See
+	// Client.CurrentServer().
+	Servers []string
 	// Nick is an rfc-valid nickname used during connection. This only has an
 	// affect during the dial process.
 	Nick string
@@ -76,11 +134,31 @@ type Config struct {
 	// Name is the "realname" that's used during connection. This only has an
 	// affect during the dial process.
 	Name string
+	// DisableAutoRegister disables sending the registration sequence (PASS,
+	// CAP LS, NICK and USER) when connecting, for setups which require a
+	// custom handshake (e.g. pre-authenticated proxies). The loops are
+	// still started, and WEBIRC (if configured) is still sent. Use
+	// Client.Register() to send the standard sequence, or send your own. If
+	// you send CAP LS yourself, capabilities are still negotiated as usual.
+	DisableAutoRegister bool
 	// SASL contains the necessary authentication data to authenticate
 	// with SASL. See the documentation for SASLMech for what is currently
 	// supported. Capability tracking must be enabled for this to work, as
-	// this requires IRCv3 CAP handling.
+	// this requires IRCv3 CAP handling. SASL authentication is repeated
+	// each time the client connects.
 	SASL SASLMech
+	// SASLMechanisms are SASL mechanisms to try in order of preference,
+	// each with its own credentials, e.g. []SASLMech{&SASLExternal{},
+	// &SASLPlain{User: "user", Pass: "pass"}}. Mechanisms which the server
+	// doesn't advertise (via CAP LS, or RPL_SASLMECHS) are skipped, and if
+	// authentication with one mechanism fails, the next is tried. If set,
+	// SASL is ignored. See Client.SASLMechanism() for which mechanism
+	// succeeded.
+	SASLMechanisms []SASLMech
+	// SASLOptional when enabled, allows the client to continue connecting
+	// without being authenticated if SASL authentication fails (e.g. if
+	// services are down), rather than closing the connection.
+	SASLOptional bool
 	// Bind is used to bind to a specific host or ip during the dial process
 	// when connecting to the server. This can be a hostname, however it must
 	// resolve to an IPv4/IPv6 address bindable on your system. Otherwise,
@@ -98,6 +176,11 @@ type Config struct {
 	// AllowFlood allows the client to bypass the rate limit of outbound
 	// messages.
 	AllowFlood bool
+	// ConnectBurst is the amount of events which can be sent after
+	// connecting without being rate limited (e.g. joining many channels at
+	// once), after which the normal rate limit applies. Servers usually
+	// tolerate a small burst right after connecting.
+	ConnectBurst int
 	// GlobalFormat enables passing through all events which have trailing
 	// text through the color Fmt() function, so you don't have to wrap
 	// every response in the Fmt() method.
@@ -115,6 +198,9 @@ type Config struct {
 	// log raw messages, look at a handler and girc.ALLEVENTS and the relevant
 	// Event.Bytes() or Event.String() methods.
 	Out io.Writer
+	// OutColor when enabled, colorizes the output written to Out using ANSI
+	// escape codes, for use with terminals.
+	OutColor bool
 	// RecoverFunc is called when a handler throws a panic. If RecoverFunc is
 	// set, the panic will be considered recovered, otherwise the client will
 	// panic. Set this to DefaultRecoverHandler if you don't want the client
@@ -122,15 +208,42 @@ type Config struct {
 	// DefaultRecoverHandler will log the panic to Debug or os.Stdout if
 	// Debug is unset.
 	RecoverFunc func(c *Client, e *HandlerError)
+	// QuitOnPanic when enabled, sends a QUIT (see Client.Quit()) and closes
+	// the connection when a handler throws a panic, rather than continuing
+	// with a client which may be in an inconsistent state. The panic is
+	// still passed to RecoverFunc first, if set, however the client won't
+	// panic if RecoverFunc is unset.
+	QuitOnPanic bool
+	// QuitMessage is the default reason sent with QUIT by Client.Quit() (and
+	// when QuitOnPanic is enabled), if no reason is given.
+	QuitMessage string
+	// RandSource is the source of randomness used by the client, which can
+	// be set to a fixed seed for reproducible tests. It is used to generate
+	// handler uids (see Caller.Add()), and batch reference tags (see
+	// Commands.MessageMultiline()). It does not need to be safe for
+	// concurrent use. Defaults to a randomly seeded source.
+	RandSource rand.Source
+	// MetricsObserver when set, is notified of events sent and received,
+	// connections, and handler panics, allowing metrics to be fed into your
+	// own monitoring system. Also see Client.Metrics().
+	MetricsObserver MetricsObserver
 	// SupportedCaps are the IRCv3 capabilities you would like the client to
 	// support on top of the ones which the client already supports (see
 	// cap.go for which ones the client enables by default). Only use this
 	// if you have not called DisableTracking(). The keys value gets passed
 	// to the server if supported.
 	SupportedCaps map[string][]string
+	// RequestCaps are additional IRCv3 capabilities to request from the
+	// server (if advertised), and is a shorthand for SupportedCaps without
+	// values. girc doesn't handle the events resulting from these, so you
+	// will need to add your own handlers. See Client.AckedCaps() for which
+	// were enabled by the server.
+	RequestCaps []string
 	// Version is the application version information that will be used in
 	// response to a CTCP VERSION, if default CTCP replies have not been
-	// overwritten or a VERSION handler was already supplied.
+	// overwritten or a VERSION handler was already supplied. If empty, a
+	// default which includes the girc version is used. See also
+	// Client.SetVersion().
 	Version string
 	// PingDelay is the frequency between when the client sends a keep-alive
 	// PING to the server, and awaits a response (and times out if the server
@@ -139,6 +252,190 @@ type Config struct {
 	// and the client. If this is set to -1, the client will not attempt to
 	// send client -> server PING requests.
 	PingDelay time.Duration
+	// DisableClientPing disables sending keep-alive PINGs to the server (the
+	// same as setting PingDelay to -1), relying solely on the servers PINGs
+	// and IdleTimeout to detect dead connections. Client.Latency() is not
+	// available when this is set.
+	DisableClientPing bool
+	// PingPayload when set, is sent as the token with each keep-alive PING,
+	// rather than the current timestamp.
+	PingPayload string
+	// DisablePongValidation disables checking that each PONG from the
+	// server echoes the token of the last keep-alive PING we sent. By
+	// default, other PONGs (e.g. replies to Commands.Ping(), or replies to
+	// an older PING) are ignored, so they don't affect Client.Latency() or
+	// the ping timeout. Only enable this for servers which don't echo the
+	// token.
+	DisablePongValidation bool
+	// IdleTimeout when set, is how long the client will wait without
+	// receiving anything from the server, before considering the connection
+	// dead. This is independent of PingDelay, and should be set higher than
+	// it (as otherwise, an idle connection will time out before the server
+	// responds to our PING). Defaults to 0, which disables this check.
+	IdleTimeout time.Duration
+	// PingStartDelay is how long after connecting the client will wait
+	// before sending keep-alive PINGs to the server, to give it time to
+	// register (some servers will not respond to PINGs during SASL
+	// negotiation, for example). Defaults to 30 seconds. If this is set to
+	// -1, the client will not wait.
+	PingStartDelay time.Duration
+	// PingTimeout is how long past PingDelay the client will wait for a PONG
+	// from the server, before considering the connection timed out. Defaults
+	// to 60 seconds.
+	PingTimeout time.Duration
+	// CTCPReplyRate limits how many automatic CTCP replies (e.g. VERSION,
+	// PING, TIME, and unknown query errors) will be sent to a single user
+	// within a window of time, to prevent others from using the client to
+	// flood the network. Requests over the limit are silently ignored, however
+	// they are still passed to handlers. Defaults to 3 replies every 10
+	// seconds. Set Replies to -1 to disable the limit.
+	CTCPReplyRate CTCPRate
+	// CTCPDecoder, if set, replaces the standard CTCP decoder (see
+	// DecodeCTCP()) when deciding if an incoming PRIVMSG or NOTICE is a CTCP
+	// event, allowing non-standard CTCP formats to be handled with
+	// Client.CTCP. It should return nil if the event isn't CTCP. See
+	// CTCPEvent for the fields which should be populated. Most users won't
+	// need this.
+	CTCPDecoder func(e Event) *CTCPEvent
+	// WebIRC when set (i.e. the password is not empty), sends a WEBIRC
+	// command as the first line after connecting, allowing gateways (e.g.
+	// CGI:IRC) to pass along the hostname and address of the real user. This
+	// requires the gateway to be configured on the server.
+	WebIRC WebIRC
+	// ConnectCallback when set, is called once the connection to the server
+	// has been established, before the client registers (CAP, PASS, NICK,
+	// USER). This is the place to send additional commands which need to be
+	// sent before registration. To run something once registered, see
+	// Client.Ready() or the CONNECTED event.
+	ConnectCallback func(c *Client)
+	// HistoricalThreshold is how far in the past the server-time of an event
+	// must be, for the event to be considered historical (e.g. playback from
+	// a bouncer), see Event.IsHistorical(). Defaults to 30 seconds.
+	HistoricalThreshold time.Duration
+	// PreProcess when set, is called with each event received from the
+	// server before it's dispatched (see Client.RunHandlers()), and may
+	// modify the event (e.g. to normalize it, or add tags), or drop it by
+	// returning false. It's called once per event, from the goroutine
+	// reading from the server, so it should return quickly. Dropped events
+	// aren't seen by any handler (including the internal handlers which
+	// track state and respond to PINGs), aren't logged (except as dropped,
+	// see Config.Debug) and aren't written to Config.Out. As PreProcess is
+	// called first, logging and Config.Out show the modified event. Events
+	// generated by the client itself (e.g. CONNECTED) aren't passed to
+	// PreProcess.
+	PreProcess func(event *Event) bool
+	// AutoJoin is a list of channels to join once registered (after any
+	// capability negotiation and SASL authentication), each optionally
+	// followed by a space and the channel key, e.g. "#channel key". Channels
+	// are joined using as few JOIN commands as possible (see
+	// Commands.JoinKeys()), unless AutoJoinDelay is set. Channels are joined
+	// again each time the client connects.
+	AutoJoin []string
+	// AutoJoinDelay when set, joins each channel in AutoJoin with a separate
+	// JOIN command, waiting this long between each, which may be needed on
+	// networks which limit how quickly channels can be joined.
+	AutoJoinDelay time.Duration
+	// RetainChannels when enabled, joins the channels which the client was
+	// in when it was disconnected again after reconnecting (along with
+	// AutoJoin), using the key each channel was joined with (see
+	// Commands.JoinKeys()), or the current key of the channel if it was
+	// changed in the meantime. Channels which were left using PART are
+	// forgotten, along with their key. Requires tracking (see
+	// Client.DisableTracking()).
+	RetainChannels bool
+	// UserModes are the user modes (e.g. "+iw") to set on ourselves once the
+	// server has accepted our registration. If empty, the default modes of
+	// the server are used.
+	UserModes string
+	// RejectUnsafe when enabled, causes Send to return ErrUnsafeEvent
+	// (without sending anything) for events which contain carriage returns,
+	// newlines or NUL bytes, which may be used to inject additional commands
+	// when relaying untrusted input. By default, these characters are
+	// stripped from events when sent.
+	RejectUnsafe bool
+	// QueueWhileDisconnected when enabled, causes events sent while the
+	// client is disconnected to be held (up to SendQueueSize events) and
+	// sent once the client has reconnected, rather than Send returning
+	// ErrNotConnected.
+	QueueWhileDisconnected bool
+	// ReconnectDelay when set, causes Client.Run() to reconnect after being
+	// disconnected, waiting this long before the first attempt. The delay
+	// doubles after each failed attempt, up to MaxReconnectDelay, and is
+	// reset once a connection has lasted longer than MaxReconnectDelay.
+	ReconnectDelay time.Duration
+	// MaxReconnectDelay is the maximum delay between reconnection attempts
+	// made by Client.Run(). Defaults to 5 minutes.
+	MaxReconnectDelay time.Duration
+	// ReplayOnReconnect when greater than 0, holds up to this many events
+	// which couldn't be sent because the connection was lost, and sends them
+	// (in order) once the client has reconnected and registered. This
+	// includes events still waiting in the send queue when the connection
+	// was lost, as well as events sent while disconnected (as with
+	// QueueWhileDisconnected). Registration and protocol messages (e.g.
+	// NICK, CAP, PING) are never replayed, as they are regenerated when
+	// reconnecting. Events are dropped once older than ReplayMaxAge.
+	ReplayOnReconnect int
+	// ReplayMaxAge is how long events held by ReplayOnReconnect are kept
+	// for, after which they are dropped rather than replayed. Defaults to 1
+	// minute.
+	ReplayMaxAge time.Duration
+	// ReadBufferSize is the size of the buffer used when reading from the
+	// server. Larger buffers may reduce syscalls on busy connections, and
+	// smaller buffers save memory when running many clients. Defaults to
+	// the bufio default (4096 bytes).
+	ReadBufferSize int
+	// WriteBufferSize is the size of the buffer used when writing to the
+	// server. Defaults to the bufio default (4096 bytes).
+	WriteBufferSize int
+	// SendQueueSize is the amount of events which can be queued to be sent
+	// to the server, before SendQueuePolicy applies. Defaults to 25.
+	SendQueueSize int
+	// SendQueuePolicy is what happens when sending an event while the send
+	// queue is full (e.g. if the server is slow to read). Defaults to
+	// QueueBlock.
+	SendQueuePolicy QueuePolicy
+	// MaxHandlerConcurrency limits the amount of handlers (including
+	// background handlers) which can execute at the same time. Once reached,
+	// events will be queued until a handler completes. Only handlers added
+	// by the user for events received from the server are limited; internal
+	// handlers, temporary handlers (see Caller.AddTmp()), those used by
+	// methods which wait on a reply (e.g. Client.SendAndWait()), and
+	// handlers executed with Client.RunHandlers() are not. Note that
+	// handlers which block waiting on other events still count against this
+	// limit while waiting. This cannot be changed once the client has
+	// started handling events. Defaults to 0, which means unlimited.
+	MaxHandlerConcurrency int
+	// DrainTimeout is how long Connect() will wait for any handlers which are
+	// still executing (including background handlers) to complete once the
+	// client has disconnected, before returning. This ensures handlers don't
+	// interact with a client which is in the middle of being torn down or
+	// reconnected. Defaults to not waiting.
+	DrainTimeout time.Duration
+	// BanMask is the format of the mask which Client.KickBan() bans.
+	// "{nick}", "{ident}" and "{host}" are replaced with the nickname, ident
+	// and host of the user being banned. Defaults to "*!*@{host}".
+	BanMask string
+	// EventsBufferSize is the size of the buffer of the channel returned by
+	// Client.Events(). Defaults to 100.
+	EventsBufferSize int
+	// EventsPolicy is what happens when the channel returned by
+	// Client.Events() is full. Defaults to QueueBlock.
+	EventsPolicy QueuePolicy
+	// ReorderWindow when set, holds events which have a server-time tag for
+	// up to ReorderWindow, and dispatches them in order of their server-time.
+	// This is useful when history playback (e.g. from a bouncer) is
+	// interleaved with live events. Events without a server-time tag are
+	// dispatched immediately. Note that this delays all events which have
+	// a server-time tag by up to ReorderWindow. Disabled by default.
+	ReorderWindow time.Duration
+	// Dedup when enabled, drops events which are identical (including tags)
+	// to the previous event received from the server, if received within
+	// DedupWindow. This is useful for buggy servers or relays which deliver
+	// duplicate lines. Disabled by default.
+	Dedup bool
+	// DedupWindow is the window of time in which identical events are
+	// considered duplicates, when Dedup is enabled. Defaults to 100ms.
+	DedupWindow time.Duration
 
 	// disableTracking disables all channel and user-level tracking. Useful
 	// for highly embedded scripts with single purposes. This has an exported
@@ -150,8 +447,47 @@ type Config struct {
 	// underscore to the end of the nickname, in order to bypass using
 	// an invalid nickname. For example, if "test" is already in use, or is
 	// blocked by the network/a service, the client will try and use "test_",
-	// then it will attempt "test__", "test___", and so on.
+	// then it will attempt "test__", "test___", and so on, up to 5
+	// underscores, before giving up.
 	HandleNickCollide func(oldNick string) (newNick string)
+	// AltNicks are the nicknames which will be tried, in order, if Nick is
+	// in use when connecting. This is ignored if HandleNickCollide is set. If
+	// all of them are in use, the client will disconnect, and Connect() will
+	// return ErrNickUnavailable.
+	AltNicks []string
+	// ServicesNick is the nickname of the services bot used by
+	// Client.Identify() and Client.Recover(). Defaults to "NickServ".
+	ServicesNick string
+	// IdentifyCmd is the format of the message sent to ServicesNick when
+	// identifying with Client.Identify(). "{pass}" is replaced with the
+	// password, and "{nick}" with our current nickname. Must contain
+	// "{pass}". Defaults to "IDENTIFY {pass}". Note that if SASL is
+	// available on the network, it should be preferred over this.
+	IdentifyCmd string
+	// ServicesPass is the password used to identify with services when
+	// RecoverNick is enabled.
+	ServicesPass string
+	// RecoverNick when set, will attempt to recover Nick if it was in use
+	// when connecting (ERR_NICKNAMEINUSE), once the client has registered with
+	// an alternative nickname. This uses Client.Recover() with ServicesPass.
+	RecoverNick bool
+	// AccountWhoisTimeout when set, allows Client.RequireAccount() to WHOIS
+	// users whose services account is unknown, waiting up to this long for
+	// a response. Disabled by default.
+	AccountWhoisTimeout time.Duration
+}
+
+// WebIRC contains the information sent to the server in a WEBIRC command.
+// See Config.WebIRC.
+type WebIRC struct {
+	// Password is the password for the gateway, as configured on the server.
+	Password string
+	// Gateway is the name of the gateway software, e.g. "cgiirc".
+	Gateway string
+	// Hostname is the hostname of the user connecting through the gateway.
+	Hostname string
+	// Address is the IP address of the user connecting through the gateway.
+	Address string
 }
 
 // ErrInvalidConfig is returned when the configuration passed to the client
@@ -165,10 +501,16 @@ func (e ErrInvalidConfig) Error() string { return "invalid configuration: " + e.
 
 // isValid checks some basic settings to ensure the config is valid.
 func (conf *Config) isValid() error {
-	if conf.Server == "" {
+	if conf.Server == "" && len(conf.Servers) == 0 {
 		return &ErrInvalidConfig{Conf: *conf, err: errors.New("empty server")}
 	}
 
+	for i := 0; i < len(conf.Servers); i++ {
+		if _, _, err := net.SplitHostPort(conf.Servers[i]); err != nil {
+			return &ErrInvalidConfig{Conf: *conf, err: fmt.Errorf("bad server %q: %s", conf.Servers[i], err)}
+		}
+	}
+
 	// Default port to 6667 (the standard IRC port).
 	if conf.Port == 0 {
 		conf.Port = 6667
@@ -181,13 +523,77 @@ func (conf *Config) isValid() error {
 	if !IsValidNick(conf.Nick) {
 		return &ErrInvalidConfig{Conf: *conf, err: errors.New("bad nickname specified")}
 	}
+	if conf.WebIRC.Password != "" && (conf.WebIRC.Gateway == "" ||
+		conf.WebIRC.Hostname == "" || conf.WebIRC.Address == "") {
+		return &ErrInvalidConfig{Conf: *conf, err: errors.New("webirc requires a gateway, hostname and address")}
+	}
+
+	for i := 0; i < len(conf.AltNicks); i++ {
+		if !IsValidNick(conf.AltNicks[i]) {
+			return &ErrInvalidConfig{Conf: *conf, err: errors.New("bad alternative nickname specified")}
+		}
+	}
 	if !IsValidUser(conf.User) {
 		return &ErrInvalidConfig{Conf: *conf, err: errors.New("bad user/ident specified")}
 	}
 
+	if conf.IdentifyCmd != "" && !strings.Contains(conf.IdentifyCmd, "{pass}") {
+		return &ErrInvalidConfig{Conf: *conf, err: errors.New("identify command is missing {pass}")}
+	}
+
 	return nil
 }
 
+// QueuePolicy is what happens when sending an event while the send queue is
+// full. See Config.SendQueuePolicy.
+type QueuePolicy int
+
+const (
+	// QueueBlock blocks until there is room in the queue.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest drops the oldest event in the queue, to make room for
+	// the new event.
+	QueueDropOldest
+	// QueueDropNewest drops the event being sent, and Client.Send() returns
+	// ErrSendQueueFull.
+	QueueDropNewest
+)
+
+// defaultSendQueueSize is the default for Config.SendQueueSize.
+const defaultSendQueueSize = 25
+
+// sendQueueSize returns the configured send queue size, or the default.
+func sendQueueSize(conf Config) int {
+	if conf.SendQueueSize > 0 {
+		return conf.SendQueueSize
+	}
+
+	return defaultSendQueueSize
+}
+
+// defaultHistoricalThreshold is the default for Config.HistoricalThreshold.
+const defaultHistoricalThreshold = 30 * time.Second
+
+// defaultMaxReconnectDelay is the default for Config.MaxReconnectDelay.
+const defaultMaxReconnectDelay = 5 * time.Minute
+
+// defaultReplayMaxAge is the default for Config.ReplayMaxAge.
+const defaultReplayMaxAge = 1 * time.Minute
+
+// ErrSendQueueFull is returned when an event is dropped because the send
+// queue is full. See Config.SendQueuePolicy.
+var ErrSendQueueFull = errors.New("send queue is full, event dropped")
+
+// ErrUnsafeEvent is returned when sending an event which contains a carriage
+// return, newline or NUL byte, when Config.RejectUnsafe is enabled.
+var ErrUnsafeEvent = errors.New("event contains carriage return, newline or NUL characters")
+
+// SendQueueLen returns the amount of events currently waiting in the send
+// queue. See Config.SendQueueSize.
+func (c *Client) SendQueueLen() int {
+	return len(c.tx)
+}
+
 // ErrNotConnected is returned if a method is used when the client isn't
 // connected.
 var ErrNotConnected = errors.New("client is not connected to server")
@@ -197,7 +603,7 @@ func New(config Config) *Client {
 	c := &Client{
 		Config:   config,
 		rx:       make(chan *Event, 25),
-		tx:       make(chan *Event, 25),
+		tx:       make(chan *Event, sendQueueSize(config)),
 		CTCP:     newCTCP(),
 		initTime: time.Now(),
 	}
@@ -217,8 +623,15 @@ func New(config Config) *Client {
 		c.debug.Print("initializing debugging")
 	}
 
+	src := c.Config.RandSource
+	if src == nil {
+		src = rand.NewSource(randSeed())
+	}
+	c.rand = rand.New(&lockedSource{src: src})
+
 	// Setup the caller.
 	c.Handlers = newCaller(c.debug)
+	c.Handlers.rand = c.rand
 
 	// Give ourselves a new state.
 	c.state = &state{}
@@ -269,26 +682,77 @@ func (c *Client) TLSConnectionState() (*tls.ConnectionState, error) {
 	return nil, ErrConnNotTLS
 }
 
+// TLSState returns the negotiated TLS connection state (e.g. the server
+// certificate chain, cipher suite, and TLS version). ok is false if the
+// client isn't connected, or the connection doesn't use TLS. See also
+// Client.TLSConnectionState().
+func (c *Client) TLSState() (state *tls.ConnectionState, ok bool) {
+	state, err := c.TLSConnectionState()
+	return state, err == nil
+}
+
 // ErrConnNotTLS is returned when Client.TLSConnectionState() is called, and
 // the connection to the server wasn't made with TLS.
 var ErrConnNotTLS = errors.New("underlying connection is not tls")
 
 // Close closes the network connection to the server, and sends a STOPPED
-// event. This should cause Connect() to return with nil. This should be
-// safe to call multiple times. See Connect()'s documentation on how
-// handlers and goroutines are handled when disconnected from the server.
+// event. This should cause Connect() (or Run()) to return with nil. This
+// should be safe to call multiple times. See Connect()'s documentation on
+// how handlers and goroutines are handled when disconnected from the server.
 func (c *Client) Close() {
-	c.mu.RLock()
+	c.mu.Lock()
+	c.closed = true
 	if c.stop != nil {
 		c.debug.Print("requesting client to stop")
 		c.stop()
 	}
-	c.mu.RUnlock()
+	c.mu.Unlock()
+}
+
+// Quit sends a QUIT to the server with reason (or Config.QuitMessage if
+// reason is empty), and then closes the connection, the same as Close(),
+// once the QUIT has been written. Unlike Close(), this lets the server (and
+// other users) know why we're leaving. If we aren't connected, Quit is the
+// same as Close(). Note that servers may not show the reason if we haven't
+// been connected for long.
+func (c *Client) Quit(reason string) {
+	if reason == "" {
+		reason = c.Config.QuitMessage
+	}
+
+	if !c.IsConnected() {
+		c.Close()
+		return
+	}
+
+	// Ensure we won't reconnect, or hold events to replay in the meantime.
+	// The connection is closed by sendLoop once the QUIT has been written.
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	event := &Event{Command: QUIT}
+	if reason != "" {
+		event.Trailing = reason
+	}
+
+	if err := c.write(event); err != nil {
+		c.Close()
+	}
+}
+
+// wasClosed returns true if Close() has been called since the last call to
+// Connect(), i.e. if the client shouldn't reconnect.
+func (c *Client) wasClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.closed
 }
 
 // ErrEvent is an error returned when the server (or library) sends an ERROR
-// message response. The string returned contains the trailing text from the
-// message.
+// message response, or when the server rejects a command with an error
+// numeric. The string returned contains the trailing text from the message.
 type ErrEvent struct {
 	Event *Event
 }
@@ -302,6 +766,7 @@ func (e *ErrEvent) Error() string {
 }
 
 func (c *Client) execLoop(ctx context.Context, errs chan error, wg *sync.WaitGroup) {
+	defer wg.Done()
 	c.debug.Print("starting execLoop")
 	defer c.debug.Print("closing execLoop")
 
@@ -317,14 +782,13 @@ func (c *Client) execLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 			for {
 				select {
 				case event = <-c.rx:
-					c.RunHandlers(event)
+					c.runEvent(event, true)
 				default:
 					goto done
 				}
 			}
 
 		done:
-			wg.Done()
 			return
 		case event = <-c.rx:
 			if event != nil && event.Command == ERROR {
@@ -336,13 +800,13 @@ func (c *Client) execLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 				// some reason the server doesn't disconnect the client, or
 				// if this library is the source of the error, this should
 				// signal back up to the main connect loop, to disconnect.
-				errs <- &ErrEvent{Event: event}
+				sendError(ctx, errs, &ErrEvent{Event: event})
 
 				// Make sure to not actually exit, so we can let any handlers
 				// actually handle the ERROR event.
 			}
 
-			c.RunHandlers(event)
+			c.runEvent(event, true)
 		}
 	}
 }
@@ -364,8 +828,54 @@ func (c *Client) DisableTracking() {
 }
 
 // Server returns the string representation of host+port pair for net.Conn.
+// This is the same as Client.CurrentServer().
 func (c *Client) Server() string {
-	return fmt.Sprintf("%s:%d", c.Config.Server, c.Config.Port)
+	return c.CurrentServer()
+}
+
+// CurrentServer returns the "host:port" of the server which the client is
+// connected to (or will next attempt to connect to). See Config.Servers.
+func (c *Client) CurrentServer() string {
+	servers := c.servers()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return servers[c.serverIndex%len(servers)]
+}
+
+// servers returns the list of servers to connect to, either Config.Servers,
+// or Config.Server and Config.Port.
+func (c *Client) servers() []string {
+	if len(c.Config.Servers) > 0 {
+		return c.Config.Servers
+	}
+
+	port := c.Config.Port
+	if port == 0 {
+		port = 6667
+	}
+
+	return []string{net.JoinHostPort(c.Config.Server, strconv.Itoa(port))}
+}
+
+// writeOut writes the prettified version of event to Config.Out, if
+// supported by the event.
+func (c *Client) writeOut(event *Event) {
+	if c.Config.Out == nil {
+		return
+	}
+
+	pretty, ok := event.Pretty()
+	if !ok {
+		return
+	}
+
+	pretty = StripRaw(pretty)
+	if c.Config.OutColor {
+		pretty = colorPretty(pretty)
+	}
+
+	fmt.Fprintln(c.Config.Out, pretty)
 }
 
 // Lifetime returns the amount of time that has passed since the client was
@@ -422,11 +932,101 @@ func (c *Client) IsConnected() bool {
 	return connected
 }
 
-// GetNick returns the current nickname of the active connection. Panics if
-// tracking is disabled.
-func (c *Client) GetNick() string {
-	c.panicIfNotTracking()
+// Ready returns a channel which is closed once the server has completed our
+// registration (i.e. after the MOTD has been sent). Commands like JOIN may
+// be dropped by the server if sent before this. A new channel is used for
+// each connection, so Ready should be called again after reconnecting.
+func (c *Client) Ready() <-chan struct{} {
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	return c.state.ready
+}
+
+// IsRegistered returns true if the server has completed our registration on
+// the current connection. See Client.Ready().
+func (c *Client) IsRegistered() bool {
+	if !c.IsConnected() {
+		return false
+	}
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	return c.state.isReady
+}
+
+// SetVersion changes the application version information used in response
+// to a CTCP VERSION (see Config.Version). This is safe to call while
+// connected. An empty string restores the default.
+func (c *Client) SetVersion(version string) {
+	c.mu.Lock()
+	c.Config.Version = version
+	c.mu.Unlock()
+}
+
+// version returns the version used in response to a CTCP VERSION.
+func (c *Client) version() string {
+	c.mu.RLock()
+	version := c.Config.Version
+	c.mu.RUnlock()
+
+	if version == "" {
+		return defaultVersion()
+	}
 
+	return version
+}
+
+// Every calls fn every d while the client is connected, stopping once the
+// client disconnects, or cancel is called. fn is never called concurrently
+// with itself; ticks which occur while fn is still running are skipped. If
+// the client isn't connected yet, fn is called once it has connected.
+func (c *Client) Every(d time.Duration, fn func(*Client)) (cancel func()) {
+	stop := make(chan struct{})
+	var once sync.Once
+	cancel = func() { once.Do(func() { close(stop) }) }
+
+	cuid, _ := c.Handlers.AddTmp(DISCONNECTED, 0, func(_ *Client, _ Event) bool {
+		cancel()
+		return true
+	})
+
+	go func() {
+		defer c.Handlers.Remove(cuid)
+
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if !c.IsConnected() {
+					continue
+				}
+
+				// Don't run fn if we were cancelled while waiting.
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				fn(c)
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// GetNick returns the current nickname of the active connection. This is
+// updated when the server welcomes us, and when our nickname changes, so may
+// differ from Config.Nick (e.g. if a fallback nickname was used, or the
+// server forcefully changed our nickname).
+func (c *Client) GetNick() string {
 	c.state.RLock()
 	defer c.state.RUnlock()
 
@@ -463,6 +1063,44 @@ func (c *Client) GetHost() (host string) {
 	return host
 }
 
+// SetAway marks the client as away with the given message (see
+// Commands.Away()). Once the server has confirmed the change (RPL_NOWAWAY),
+// Client.AmAway() will return true. If message is empty, this is the same
+// as calling Client.SetBack(). Panics if tracking is disabled.
+func (c *Client) SetAway(message string) error {
+	c.panicIfNotTracking()
+
+	if message == "" {
+		return c.SetBack()
+	}
+
+	c.state.Lock()
+	c.state.awayMessage = message
+	c.state.Unlock()
+
+	return c.Cmd.Away(message)
+}
+
+// SetBack marks the client as no longer being away (see Commands.Back()).
+// Once the server has confirmed the change (RPL_UNAWAY), Client.AmAway()
+// will return false. Panics if tracking is disabled.
+func (c *Client) SetBack() error {
+	c.panicIfNotTracking()
+
+	return c.Cmd.Back()
+}
+
+// AmAway returns true if the server has confirmed that the client is marked
+// as away. Panics if tracking is disabled.
+func (c *Client) AmAway() (away bool) {
+	c.panicIfNotTracking()
+
+	c.state.RLock()
+	away = c.state.away
+	c.state.RUnlock()
+	return away
+}
+
 // ChannelList returns the (sorted) active list of channel names that the client
 // is in. Panics if tracking is disabled.
 func (c *Client) ChannelList() []string {
@@ -543,6 +1181,20 @@ func (c *Client) LookupChannel(name string) (channel *Channel) {
 	return channel
 }
 
+// ChannelCreated returns when channel was created, as reported by the server.
+// ok is false if the channel isn't tracked, or the server hasn't reported its
+// creation time. Panics if tracking is disabled.
+func (c *Client) ChannelCreated(channel string) (created time.Time, ok bool) {
+	c.panicIfNotTracking()
+
+	c.state.RLock()
+	if ch := c.state.lookupChannel(channel); ch != nil {
+		created = ch.Created
+	}
+	c.state.RUnlock()
+	return created, !created.IsZero()
+}
+
 // LookupUser looks up a given user in state. If the user doesn't exist, nil
 // is returned. Panics if tracking is disabled.
 func (c *Client) LookupUser(nick string) (user *User) {
@@ -563,7 +1215,7 @@ func (c *Client) IsInChannel(channel string) (in bool) {
 	c.panicIfNotTracking()
 
 	c.state.RLock()
-	_, in = c.state.channels[ToRFC1459(channel)]
+	_, in = c.state.channels[c.state.casefold(channel)]
 	c.state.RUnlock()
 	return in
 }
@@ -583,6 +1235,140 @@ func (c *Client) GetServerOption(key string) (result string, ok bool) {
 	return result, ok
 }
 
+// supportsOption returns true if the server has advertised the given
+// RPL_ISUPPORT option. As this information is unavailable if tracking is
+// disabled, it is assumed to be supported in that case.
+func (c *Client) supportsOption(key string) (ok bool) {
+	if c.Config.disableTracking {
+		return true
+	}
+
+	c.state.RLock()
+	_, ok = c.state.serverOptions[key]
+	c.state.RUnlock()
+	return ok
+}
+
+// targetLimit returns the maximum number of targets the server accepts for
+// command, as advertised via TARGMAX (e.g. "TARGMAX=JOIN:,KICK:1"). A limit
+// of 0 means there is no limit. ok is false if the server hasn't advertised
+// a limit for command.
+func (c *Client) targetLimit(command string) (limit int, ok bool) {
+	c.state.RLock()
+	targmax, exists := c.state.serverOptions["TARGMAX"]
+	c.state.RUnlock()
+
+	if !exists {
+		return 0, false
+	}
+
+	for _, entry := range strings.Split(targmax, ",") {
+		i := strings.IndexByte(entry, ':')
+		if i < 0 || !strings.EqualFold(entry[:i], command) {
+			continue
+		}
+
+		limit, _ = strconv.Atoi(entry[i+1:])
+		return limit, true
+	}
+
+	return 0, false
+}
+
+// casefold normalizes input for case-insensitive comparison, based on the
+// CASEMAPPING advertised by the server. Defaults to rfc1459 casemapping.
+func (c *Client) casefold(input string) string {
+	c.state.RLock()
+	mapping := c.state.serverOptions["CASEMAPPING"]
+	c.state.RUnlock()
+
+	return casefoldWith(mapping, input)
+}
+
+// casefoldWith normalizes input for case-insensitive comparison using
+// mapping (a CASEMAPPING value), defaulting to rfc1459 casemapping.
+func casefoldWith(mapping, input string) string {
+	if mapping == "ascii" {
+		return strings.ToLower(input)
+	}
+
+	return ToRFC1459(input)
+}
+
+// rebuildCasefold re-keys lookups which are keyed by casefolded names (see
+// Client.casefold()), e.g. channels, users and monitored nicknames, using
+// the current CASEMAPPING. This is needed when CASEMAPPING differs from what the lookups
+// were built with, e.g. if it was advertised after using Client.Monitor(),
+// or after reconnecting to a server with a different CASEMAPPING.
+func (c *Client) rebuildCasefold() {
+	c.state.Lock()
+	mapping := c.state.serverOptions["CASEMAPPING"]
+
+	monitor := make(map[string]monitorEntry, len(c.state.monitor))
+	for _, entry := range c.state.monitor {
+		monitor[casefoldWith(mapping, entry.nick)] = entry
+	}
+	c.state.monitor = monitor
+
+	keys := make(map[string]channelKey, len(c.state.keys))
+	for _, entry := range c.state.keys {
+		keys[casefoldWith(mapping, entry.channel)] = entry
+	}
+	c.state.keys = keys
+
+	metadata := make(map[string]metadataEntry, len(c.state.metadata))
+	for _, entry := range c.state.metadata {
+		metadata[casefoldWith(mapping, entry.target)] = entry
+	}
+	c.state.metadata = metadata
+
+	// Channels and users reference each other by their casefolded names, so
+	// both are rebuilt using the previous lookups.
+	channels := make(map[string]*Channel, len(c.state.channels))
+	for _, channel := range c.state.channels {
+		list := make([]string, 0, len(channel.UserList))
+		for i := 0; i < len(channel.UserList); i++ {
+			if user := c.state.users[channel.UserList[i]]; user != nil {
+				list = append(list, casefoldWith(mapping, user.Nick))
+			}
+		}
+		sort.Strings(list)
+		channel.UserList = list
+		channel.casemapping = mapping
+
+		channels[casefoldWith(mapping, channel.Name)] = channel
+	}
+
+	users := make(map[string]*User, len(c.state.users))
+	for _, user := range c.state.users {
+		list := make([]string, 0, len(user.ChannelList))
+		for i := 0; i < len(user.ChannelList); i++ {
+			if channel := c.state.channels[user.ChannelList[i]]; channel != nil {
+				list = append(list, casefoldWith(mapping, channel.Name))
+			}
+		}
+		sort.Strings(list)
+		user.ChannelList = list
+		user.casemapping = mapping
+
+		users[casefoldWith(mapping, user.Nick)] = user
+	}
+
+	c.state.channels = channels
+	c.state.users = users
+	c.state.Unlock()
+
+	c.typingMu.Lock()
+	if c.typing != nil {
+		typing := make(map[string]typingStatus, len(c.typing))
+		for _, status := range c.typing {
+			typing[casefoldWith(mapping, status.target)] = status
+		}
+		c.typing = typing
+	}
+	c.typingMu.Unlock()
+}
+
 // NetworkName returns the network identifier. E.g. "EsperNet", "ByteIRC".
 // May be empty if the server does not support RPL_ISUPPORT (or RPL_PROTOCTL).
 // Will panic if used when tracking has been disabled.
@@ -593,15 +1379,41 @@ func (c *Client) NetworkName() (name string) {
 	return name
 }
 
+// ServerName returns the name of the server we're connected to, as given by
+// the server during connection (RPL_MYINFO, or RPL_YOURHOST), which may
+// differ from Config.Server (e.g. when connecting to a round-robin address).
+// May be empty if the server didn't supply this information. Will panic if
+// used when tracking has been disabled.
+func (c *Client) ServerName() (name string) {
+	c.panicIfNotTracking()
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	return c.state.serverName
+}
+
 // ServerVersion returns the server software version, if the server has
-// supplied this information during connection. May be empty if the server
-// does not support RPL_MYINFO. Will panic if used when tracking has been
-// disabled.
+// supplied this information during connection (RPL_MYINFO, or
+// RPL_YOURHOST). May be empty if the server didn't supply this information.
+// Will panic if used when tracking has been disabled.
 func (c *Client) ServerVersion() (version string) {
 	c.panicIfNotTracking()
 
-	version, _ = c.GetServerOption("VERSION")
-	return version
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	return c.state.serverVersion
+}
+
+// SASLMechanism returns the name of the SASL mechanism (e.g. "PLAIN") which
+// we authenticated with when connecting, or an empty string if we didn't
+// authenticate using SASL. See Config.SASLMechanisms.
+func (c *Client) SASLMechanism() string {
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	return c.state.saslMech
 }
 
 // ServerMOTD returns the servers message of the day, if the server has sent
@@ -615,11 +1427,40 @@ func (c *Client) ServerMOTD() (motd string) {
 	return motd
 }
 
+// LastPong returns the last time the server replied to one of our
+// keep-alive PINGs (see Config.PingDelay). Until the first reply, this is
+// the time at which the client started pinging the server. Returns the zero
+// time if the client isn't connected.
+func (c *Client) LastPong() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.conn == nil {
+		return time.Time{}
+	}
+
+	c.conn.mu.RLock()
+	defer c.conn.mu.RUnlock()
+
+	return c.conn.lastPong
+}
+
 // Latency is the latency between the server and the client. This is measured
 // by determining the difference in time between when we ping the server, and
-// when we receive a pong.
+// when we receive a pong. Returns 0 if the latency is unavailable, e.g. if
+// the client is not connected, or client PINGs are disabled (see
+// Config.PingDelay and Config.DisableClientPing).
 func (c *Client) Latency() (delta time.Duration) {
+	if c.Config.DisableClientPing || c.Config.PingDelay <= 0 {
+		return 0
+	}
+
 	c.mu.RLock()
+	if c.conn == nil {
+		c.mu.RUnlock()
+		return 0
+	}
+
 	c.conn.mu.RLock()
 	delta = c.conn.lastPong.Sub(c.conn.lastPing)
 	c.conn.mu.RUnlock()
@@ -632,9 +1473,43 @@ func (c *Client) Latency() (delta time.Duration) {
 	return delta
 }
 
+// AckedCaps returns which of the capabilities requested via
+// Config.RequestCaps and Config.SupportedCaps were enabled by the server.
+func (c *Client) AckedCaps() []string {
+	var acked []string
+
+	for i := 0; i < len(c.Config.RequestCaps); i++ {
+		if c.HasCap(c.Config.RequestCaps[i]) {
+			acked = append(acked, c.Config.RequestCaps[i])
+		}
+	}
+
+	for k := range c.Config.SupportedCaps {
+		if c.HasCap(k) {
+			acked = append(acked, k)
+		}
+	}
+
+	sort.Strings(acked)
+	return acked
+}
+
+// HasCap returns true if the given capability was acknowledged by the
+// server, and is currently enabled. This reflects capabilities which are
+// added or removed by the server at runtime (CAP NEW/DEL). Unlike
+// HasCapability, it doesn't panic if tracking is disabled (in which case it
+// returns false).
+func (c *Client) HasCap(name string) bool {
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	return c.state.hasCap(name)
+}
+
 // HasCapability checks if the client connection has the given capability. If
 // you want the full list of capabilities, listen for the girc.CAP_ACK event.
-// Will panic if used when tracking has been disabled.
+// Will panic if used when tracking has been disabled. See also
+// Client.HasCap().
 func (c *Client) HasCapability(name string) (has bool) {
 	c.panicIfNotTracking()
 
@@ -642,18 +1517,7 @@ func (c *Client) HasCapability(name string) (has bool) {
 		return false
 	}
 
-	name = strings.ToLower(name)
-
-	c.state.RLock()
-	for i := 0; i < len(c.state.enabledCap); i++ {
-		if strings.ToLower(c.state.enabledCap[i]) == name {
-			has = true
-			break
-		}
-	}
-	c.state.RUnlock()
-
-	return has
+	return c.HasCap(name)
 }
 
 // panicIfNotTracking will throw a panic when it's called, and tracking is
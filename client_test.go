@@ -5,7 +5,12 @@
 package girc
 
 import (
+	"bytes"
+	"math/rand"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -76,6 +81,12 @@ func TestConfigValid(t *testing.T) {
 		t.Fatalf("invalid user passed validation check: %s", err)
 	}
 	conf.User = "test"
+
+	conf.WebIRC = WebIRC{Password: "secret", Gateway: "cgiirc"}
+	if err = conf.isValid(); err == nil {
+		t.Fatalf("incomplete webirc passed validation check: %s", err)
+	}
+	conf.WebIRC = WebIRC{}
 }
 
 func TestClientLifetime(t *testing.T) {
@@ -198,3 +209,1207 @@ func TestClientClose(t *testing.T) {
 	case <-done:
 	}
 }
+
+func TestClientConnectionEvents(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	var mu sync.Mutex
+	var seen []string
+	var reason string
+	record := func(c *Client, e Event) {
+		mu.Lock()
+		seen = append(seen, e.Command)
+		if e.Command == DISCONNECTED {
+			reason = e.Trailing
+		}
+		mu.Unlock()
+	}
+
+	c.Handlers.Add(CONNECTING, record)
+	c.Handlers.Add(INITIALIZED, record)
+	c.Handlers.Add(DISCONNECTED, record)
+
+	initialized := make(chan struct{})
+	c.Handlers.Add(INITIALIZED, func(c *Client, e Event) { close(initialized) })
+
+	errchan := make(chan error, 1)
+	go func() { errchan <- c.MockConnect(server) }()
+
+	select {
+	case <-initialized:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out during connect")
+	}
+
+	// Drop the connection from the server side.
+	conn.Close()
+
+	var err error
+	select {
+	case err = <-errchan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+
+	if err == nil {
+		t.Fatal("Client.MockConnect() returned no error after connection was dropped")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{CONNECTING, INITIALIZED, DISCONNECTED}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("connection events = %v, wanted %v", seen, want)
+	}
+
+	if reason != err.Error() {
+		t.Fatalf("DISCONNECTED reason = %q, wanted %q", reason, err.Error())
+	}
+}
+
+func TestClientEvery(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	var calls int32
+	var running int32
+	cancel := c.Every(10*time.Millisecond, func(c *Client) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			t.Error("Client.Every() callback was run concurrently")
+		}
+		time.Sleep(15 * time.Millisecond)
+		atomic.AddInt32(&calls, 1)
+		atomic.AddInt32(&running, -1)
+	})
+	defer cancel()
+
+	// Shouldn't be called while not connected.
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("Client.Every() callback called %d times before connect", n)
+	}
+
+	errchan := make(chan error, 1)
+	go func() { errchan <- c.MockConnect(server) }()
+
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n == 0 {
+		t.Fatal("Client.Every() callback wasn't called while connected")
+	}
+
+	conn.Close()
+	select {
+	case <-errchan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+
+	// Allow any in-progress call to finish.
+	time.Sleep(50 * time.Millisecond)
+	n := atomic.LoadInt32(&calls)
+	time.Sleep(100 * time.Millisecond)
+	if after := atomic.LoadInt32(&calls); after != n {
+		t.Fatalf("Client.Every() callback called %d times after disconnect", after-n)
+	}
+}
+
+func TestClientIsolation(t *testing.T) {
+	var clients []*Client
+	for _, isupport := range []string{"CASEMAPPING=ascii NETWORK=NetA", "CASEMAPPING=rfc1459 NETWORK=NetB"} {
+		c, conn, server := genMockConn()
+		defer conn.Close()
+		defer server.Close()
+		go mockReadBuffer(conn)
+
+		mockConnected(t, c, server)
+		defer c.Close()
+
+		if _, err := conn.Write([]byte(":dummy.int 005 test " + isupport + " :are supported by this server\r\n")); err != nil {
+			t.Fatalf("unable to write ISUPPORT: %s", err)
+		}
+
+		clients = append(clients, c)
+	}
+
+	a, b := clients[0], clients[1]
+	for _, want := range []struct {
+		c       *Client
+		network string
+	}{{a, "NetA"}, {b, "NetB"}} {
+		deadline := time.Now().Add(2 * time.Second)
+		for want.c.NetworkName() != want.network {
+			if time.Now().After(deadline) {
+				t.Fatalf("Client.NetworkName() = %q, wanted %q", want.c.NetworkName(), want.network)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if got := a.casefold("Nick[A]"); got != "nick[a]" {
+		t.Fatalf("ascii Client.casefold() = %q, wanted nick[a]", got)
+	}
+
+	if got := b.casefold("Nick[A]"); got != "nick{a}" {
+		t.Fatalf("rfc1459 Client.casefold() = %q, wanted nick{a}", got)
+	}
+
+	before := b.Handlers.Len()
+	a.Handlers.Add(PRIVMSG, func(c *Client, e Event) {})
+	if b.Handlers.Len() != before {
+		t.Fatal("adding a handler to one client affected another")
+	}
+
+	a.Config.SupportedCaps = map[string][]string{"example": {"a"}}
+	possibleCapList(a)["example"][0] = "b"
+	if a.Config.SupportedCaps["example"][0] != "a" {
+		t.Fatal("possibleCapList() shares values with Config.SupportedCaps")
+	}
+}
+
+func TestClientAway(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != AWAY {
+			return nil
+		}
+
+		if len(e.Params) > 0 {
+			return []string{":dummy.int 306 test :You have been marked as being away"}
+		}
+
+		return []string{":dummy.int 305 test :You are no longer marked as being away"}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	updated := make(chan struct{}, 1)
+	c.Handlers.Add(UPDATE_GENERAL, func(c *Client, e Event) {
+		select {
+		case updated <- struct{}{}:
+		default:
+		}
+	})
+
+	if c.AmAway() {
+		t.Fatal("Client.AmAway() = true before being marked away")
+	}
+
+	c.SetAway("gone fishing")
+	select {
+	case <-updated:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for RPL_NOWAWAY")
+	}
+
+	if !c.AmAway() {
+		t.Fatal("Client.AmAway() = false after RPL_NOWAWAY")
+	}
+
+	c.SetBack()
+	select {
+	case <-updated:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for RPL_UNAWAY")
+	}
+
+	if c.AmAway() {
+		t.Fatal("Client.AmAway() = true after RPL_UNAWAY")
+	}
+}
+
+func TestClientAltNicks(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.AltNicks = []string{"alt1", "alt2"}
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != NICK {
+			return nil
+		}
+
+		if e.Params[0] != "alt2" {
+			return []string{":dummy.int 433 * " + e.Params[0] + " :Nickname is already in use"}
+		}
+
+		return []string{":dummy.int 001 alt2 :Welcome to the network"}
+	})
+
+	registered := make(chan string, 1)
+	c.Handlers.Add(UPDATE_GENERAL, func(c *Client, e Event) {
+		c.state.RLock()
+		defer c.state.RUnlock()
+
+		if c.state.registered {
+			registered <- c.state.nick
+		}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	select {
+	case nick := <-registered:
+		if nick != "alt2" {
+			t.Fatalf("Client.GetNick() = %q, wanted %q", nick, "alt2")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for registration")
+	}
+}
+
+func TestClientAltNicksExhausted(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.AltNicks = []string{"alt1"}
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != NICK {
+			return nil
+		}
+
+		return []string{":dummy.int 433 * " + e.Params[0] + " :Nickname is already in use"}
+	})
+
+	// The server never sent an ERROR, so handlers shouldn't see one.
+	var errorEvents int32
+	c.Handlers.Add(ERROR, func(c *Client, e Event) { atomic.AddInt32(&errorEvents, 1) })
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	select {
+	case err := <-errs:
+		e, ok := err.(ErrNickUnavailable)
+		if !ok {
+			t.Fatalf("Client.MockConnect() = %#v, wanted ErrNickUnavailable", err)
+		}
+		if e.Nick != "alt1" || e.Event.Command != ERR_NICKNAMEINUSE {
+			t.Fatalf("Client.MockConnect() = %#v, wanted rejection of %q", e, "alt1")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Client.MockConnect() to fail")
+	}
+
+	if n := atomic.LoadInt32(&errorEvents); n != 0 {
+		t.Fatalf("ERROR handler executed %d times, wanted 0", n)
+	}
+}
+
+func TestClientNickFallbacksTruncated(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.Nick = "abcdefghi"
+
+	var mu sync.Mutex
+	var attempts int
+
+	// Servers may truncate the nickname before rejecting it, so every
+	// fallback is echoed back as the original nickname.
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != NICK {
+			return nil
+		}
+
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+
+		nick := e.Params[0]
+		if len(nick) > 9 {
+			nick = nick[:9]
+		}
+
+		return []string{":dummy.int 433 * " + nick + " :Nickname is already in use"}
+	})
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(ErrNickUnavailable); !ok {
+			t.Fatalf("Client.MockConnect() = %#v, wanted ErrNickUnavailable", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Client.MockConnect() to fail")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts > 1+maxNickFallbacks {
+		t.Fatalf("sent %d NICK commands, wanted at most %d", attempts, 1+maxNickFallbacks)
+	}
+}
+
+func TestErroneousNick(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.AltNicks = []string{"alt1"}
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != NICK {
+			return nil
+		}
+
+		if e.Params[0] != "alt1" {
+			return []string{":dummy.int 432 * " + e.Params[0] + " :Erroneous nickname"}
+		}
+
+		return []string{":dummy.int 001 alt1 :Welcome to the network"}
+	})
+
+	registered := make(chan string, 1)
+	c.Handlers.Add(UPDATE_GENERAL, func(c *Client, e Event) {
+		c.state.RLock()
+		defer c.state.RUnlock()
+
+		if c.state.registered {
+			registered <- c.state.nick
+		}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	select {
+	case nick := <-registered:
+		if nick != "alt1" {
+			t.Fatalf("Client.GetNick() = %q, wanted %q", nick, "alt1")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for registration")
+	}
+}
+
+func TestErroneousNickExhausted(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.AltNicks = []string{"alt1"}
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != NICK {
+			return nil
+		}
+
+		return []string{":dummy.int 432 * " + e.Params[0] + " :Erroneous nickname"}
+	})
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(ErrNickUnavailable); !ok {
+			t.Fatalf("Client.MockConnect() = %#v, wanted ErrNickUnavailable", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Client.MockConnect() to fail")
+	}
+}
+
+func TestErroneousNickLong(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.Nick = "abcdefghi"
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != NICK {
+			return nil
+		}
+
+		if e.Params[0] == "abcdefghi" {
+			return []string{":dummy.int 432 * abcdefghi :Erroneous nickname"}
+		}
+
+		return []string{":dummy.int 001 " + e.Params[0] + " :Welcome to the network"}
+	})
+
+	registered := make(chan string, 1)
+	c.Handlers.Add(UPDATE_GENERAL, func(c *Client, e Event) {
+		c.state.RLock()
+		defer c.state.RUnlock()
+
+		if c.state.registered {
+			registered <- c.state.nick
+		}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	select {
+	case nick := <-registered:
+		if nick != "abcdefghi_" {
+			t.Fatalf("Client.GetNick() = %q, wanted %q", nick, "abcdefghi_")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for registration")
+	}
+}
+
+func TestFallbackNick(t *testing.T) {
+	tests := []struct {
+		nick    string
+		attempt int
+		maxLen  int
+		want    string
+	}{
+		{nick: "test", attempt: 0, want: "test_"},
+		{nick: "test", attempt: 2, want: "test___"},
+		{nick: "test", attempt: maxNickFallbacks, want: ""},
+		{nick: "abcdefghi", attempt: 0, want: "abcdefghi_"},
+		{nick: "abcdefghi", attempt: 0, maxLen: 9, want: "abcdefgh_"},
+		{nick: "abcdefghi", attempt: 1, maxLen: 9, want: "abcdefg__"},
+		{nick: "abc", attempt: 2, maxLen: 3, want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := fallbackNick(Config{Nick: tt.nick}, tt.attempt, tt.maxLen); got != tt.want {
+			t.Errorf("fallbackNick(%q, %d, %d) = %q, want %q", tt.nick, tt.attempt, tt.maxLen, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeNick(t *testing.T) {
+	tests := []struct {
+		nick   string
+		maxLen int
+		want   string
+	}{
+		{nick: "test", want: "test"},
+		{nick: "bad.nick", want: "badnick"},
+		{nick: "1abc", want: "abc"},
+		{nick: "averylongnickname", want: "averylongnickname"},
+		{nick: "averylongnickname", maxLen: 12, want: "averylongnic"},
+		{nick: "bad.averylongnickname", want: "badaverylongnickname"},
+		{nick: "...", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeNick(tt.nick, tt.maxLen); got != tt.want {
+			t.Errorf("sanitizeNick(%q, %d) = %q, want %q", tt.nick, tt.maxLen, got, tt.want)
+		}
+	}
+}
+
+func TestClientGetNick(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.DisableTracking()
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	updated := make(chan struct{}, 2)
+	c.Handlers.Add(UPDATE_GENERAL, func(c *Client, e Event) { updated <- struct{}{} })
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(":dummy.int 001 forced :Welcome\r\n:forced!user@host NICK :renamed\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once for RPL_WELCOME, and once for NICK.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-updated:
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for nickname update")
+		}
+	}
+
+	if nick := c.GetNick(); nick != "renamed" {
+		t.Fatalf("Client.GetNick() = %q, wanted %q", nick, "renamed")
+	}
+}
+
+func TestClientReady(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	ready := c.Ready()
+	if c.IsRegistered() {
+		t.Fatal("Client.IsRegistered() = true before registration")
+	}
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(":dummy.int 001 test :Welcome\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ready:
+		t.Fatal("Client.Ready() closed before end of MOTD")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := conn.Write([]byte(":dummy.int 422 test :MOTD File is missing\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ready:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Client.Ready()")
+	}
+
+	if !c.IsRegistered() {
+		t.Fatal("Client.IsRegistered() = false after registration")
+	}
+
+	// Ensure a second MOTD doesn't cause issues.
+	if _, err := conn.Write([]byte(":dummy.int 376 test :End of /MOTD command.\r\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientDrainTimeout(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.DrainTimeout = 2 * time.Second
+
+	var finished int32
+	started := make(chan struct{})
+	c.Handlers.AddBg(PRIVMSG, func(c *Client, e Event) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+	})
+
+	go mockReadBuffer(conn)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(":nick!user@host PRIVMSG #chan :hello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	c.Close()
+
+	select {
+	case <-errs:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for Client.MockConnect() to return")
+	}
+
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Fatal("Client.MockConnect() returned before handlers finished")
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	events := c.Events()
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(":nick!user@host PRIVMSG #channel :hello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for found := false; !found; {
+		select {
+		case e := <-events:
+			found = e.Command == PRIVMSG && e.Trailing == "hello"
+		case <-timeout:
+			t.Fatal("timed out waiting for event from Client.Events()")
+		}
+	}
+
+	c.Close()
+
+	// Ensure the channel is closed once disconnected, even if not drained.
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Client.Events() channel not closed after disconnect")
+		}
+	}
+}
+
+type testObserver struct {
+	received, sent, connects, panics int64
+}
+
+func (o *testObserver) EventReceived(event *Event, bytes int) { atomic.AddInt64(&o.received, 1) }
+func (o *testObserver) EventSent(event *Event, bytes int)     { atomic.AddInt64(&o.sent, 1) }
+func (o *testObserver) Connected(server string)               { atomic.AddInt64(&o.connects, 1) }
+func (o *testObserver) HandlerPanic(err *HandlerError)        { atomic.AddInt64(&o.panics, 1) }
+
+func TestQuitOnPanic(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.QuitOnPanic = true
+	c.Config.QuitMessage = "something went wrong"
+
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		panic("test")
+	})
+
+	quit := make(chan string, 1)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == QUIT {
+			quit <- e.Trailing
+		}
+		return nil
+	})
+
+	initialized := make(chan struct{})
+	c.Handlers.Add(INITIALIZED, func(c *Client, e Event) { close(initialized) })
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	select {
+	case <-initialized:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out during connect")
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(":nick!user@host PRIVMSG #channel :hello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case reason := <-quit:
+		if reason != c.Config.QuitMessage {
+			t.Fatalf("QUIT reason = %q, wanted %q", reason, c.Config.QuitMessage)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for QUIT")
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Client.MockConnect() = %v, wanted nil after quitting", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the client to close")
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	observer := &testObserver{}
+	c.Config.MetricsObserver = observer
+
+	done := make(chan struct{})
+	c.Config.RecoverFunc = func(c *Client, e *HandlerError) { close(done) }
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		panic("test")
+	})
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(":nick!user@host PRIVMSG #channel :hello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for PRIVMSG")
+	}
+
+	m := c.Metrics()
+	if m.EventsIn != 1 || m.BytesIn != uint64(len(":nick!user@host PRIVMSG #channel :hello\r\n")) {
+		t.Fatalf("Metrics() EventsIn = %d, BytesIn = %d", m.EventsIn, m.BytesIn)
+	}
+	if m.Commands[PRIVMSG] != 1 {
+		t.Fatalf("Metrics().Commands[PRIVMSG] = %d, wanted 1", m.Commands[PRIVMSG])
+	}
+	if m.Connects != 1 || m.HandlerPanics != 1 || m.EventsOut == 0 || m.BytesOut == 0 {
+		t.Fatalf("unexpected Metrics(): %#v", m)
+	}
+
+	if atomic.LoadInt64(&observer.received) != 1 || atomic.LoadInt64(&observer.connects) != 1 ||
+		atomic.LoadInt64(&observer.panics) != 1 || atomic.LoadInt64(&observer.sent) == 0 {
+		t.Fatalf("unexpected MetricsObserver calls: %#v", observer)
+	}
+}
+
+func TestClientRandSource(t *testing.T) {
+	conf := Config{Server: "dummy.int", Nick: "test", User: "test"}
+
+	conf.RandSource = rand.NewSource(1)
+	a := New(conf)
+	conf.RandSource = rand.NewSource(1)
+	b := New(conf)
+
+	noop := func(c *Client, e Event) {}
+	for i := 0; i < 5; i++ {
+		cuidA, cuidB := a.Handlers.Add(PRIVMSG, noop), b.Handlers.Add(PRIVMSG, noop)
+		if cuidA != cuidB {
+			t.Fatalf("handler uids differ with the same RandSource: %q != %q", cuidA, cuidB)
+		}
+	}
+
+	if a.batchRef() != b.batchRef() {
+		t.Fatal("batch references differ with the same RandSource")
+	}
+}
+
+func TestClientClosedFlag(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.QueueWhileDisconnected = true
+	go mockReadBuffer(conn)
+
+	errchan := make(chan error, 1)
+	done := make(chan struct{})
+	c.Handlers.AddBg(INITIALIZED, func(c *Client, e Event) { close(done) })
+	go func() { errchan <- c.MockConnect(server) }()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out during connect")
+	}
+
+	if c.wasClosed() {
+		t.Fatal("Client.wasClosed() = true before Client.Close()")
+	}
+
+	c.Close()
+	select {
+	case err := <-errchan:
+		if err != nil {
+			t.Fatalf("Client.MockConnect() returned error after Client.Close(): %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Client.Close()")
+	}
+
+	if !c.wasClosed() {
+		t.Fatal("Client.wasClosed() = false after Client.Close()")
+	}
+
+	// Events shouldn't be held for a reconnect which won't happen.
+	if err := c.Send(&Event{Command: PING, Params: []string{"test"}}); err != ErrNotConnected {
+		t.Fatalf("Client.Send() = %v after Client.Close(), wanted ErrNotConnected", err)
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if _, err := conn.Write([]byte(":irc.example.com 002 test :Your host is irc.example.com[127.0.0.1/6667], running version example-1.0\r\n")); err != nil {
+		t.Fatalf("unable to write RPL_YOURHOST: %s", err)
+	}
+
+	waitFor := func(what string, get func() string, want string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for get() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Client.%s() = %q, wanted %q", what, get(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("ServerName", c.ServerName, "irc.example.com")
+	waitFor("ServerVersion", c.ServerVersion, "example-1.0")
+
+	lines := ":irc.example.com 004 test leaf.example.com example-1.1 iow biklmnopstv\r\n" +
+		":irc.example.com 005 test NETWORK=ExampleNet :are supported by this server\r\n"
+	if _, err := conn.Write([]byte(lines)); err != nil {
+		t.Fatalf("unable to write RPL_MYINFO: %s", err)
+	}
+
+	waitFor("ServerName", c.ServerName, "leaf.example.com")
+	waitFor("ServerVersion", c.ServerVersion, "example-1.1")
+	waitFor("NetworkName", c.NetworkName, "ExampleNet")
+
+	// The server name and version aren't ISUPPORT options.
+	if value, ok := c.GetServerOption("SERVER"); ok {
+		t.Fatalf("Client.GetServerOption(%q) = %q, wanted nothing", "SERVER", value)
+	}
+
+	// Nor can ISUPPORT options of the same name replace them.
+	if _, err := conn.Write([]byte(":irc.example.com 005 test SERVER=other VERSION=other :are supported by this server\r\n")); err != nil {
+		t.Fatalf("unable to write RPL_ISUPPORT: %s", err)
+	}
+
+	waitFor("GetServerOption", func() string { value, _ := c.GetServerOption("SERVER"); return value }, "other")
+	waitFor("ServerName", c.ServerName, "leaf.example.com")
+	waitFor("ServerVersion", c.ServerVersion, "example-1.1")
+}
+
+func TestAutoJoin(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		delay time.Duration
+		want  []string
+	}{
+		{name: "batched", want: []string{"JOIN #b,#a key"}},
+		{name: "delayed", delay: 10 * time.Millisecond, want: []string{"JOIN #a", "JOIN #b key"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(Config{
+				Server: "dummy.int", Nick: "test", User: "test", AllowFlood: true,
+				AutoJoin: []string{"#a", "#b key", "invalid"}, AutoJoinDelay: tt.delay,
+			})
+
+			server := NewTestServer(c)
+			defer server.Close()
+			defer c.Close()
+
+			if err := server.Register(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, line := range tt.want {
+				if _, err := server.Expect(line); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer which is safe for concurrent use, e.g. as
+// Config.Debug.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRetainChannels(t *testing.T) {
+	debug := &lockedBuffer{}
+	c := New(Config{
+		Server: "dummy.int", Nick: "test", User: "test", AllowFlood: true,
+		AutoJoin: []string{"#auto"}, RetainChannels: true, Debug: debug,
+	})
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	server := NewTestServer(c)
+	if err := server.Register(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Expect("JOIN #auto"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Cmd.JoinKeys([]string{"#keyed", "#changed", "#open", "#gone"}, []string{"secret", "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Expect("JOIN #keyed,#changed,#open,#gone secret,old"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Send(
+		":test!user@host JOIN #auto",
+		":test!user@host JOIN #keyed",
+		":test!user@host JOIN #changed",
+		":test!user@host JOIN #open",
+		":test!user@host JOIN #gone",
+		":op!user@host MODE #changed +k new",
+		":test!user@host PART #gone",
+	)
+	waitFor("channels to be tracked", func() bool {
+		ch := c.LookupChannel("#changed")
+		if ch == nil || c.LookupChannel("#gone") != nil {
+			return false
+		}
+		key, _ := ch.Modes.Get("k")
+		return key == "new"
+	})
+
+	if log := debug.String(); strings.Contains(log, "secret") || !strings.Contains(log, "JOIN #keyed,#changed,#open,#gone") {
+		t.Fatal("channel key was logged")
+	}
+
+	server.Close()
+
+	server = NewTestServer(c)
+	defer server.Close()
+	defer c.Close()
+
+	if err := server.Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Config.AutoJoin isn't joined twice, and #gone was left using PART.
+	if _, err := server.Expect("JOIN #changed,#keyed,#auto,#open new,secret"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCasemappingRebuild(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test", AllowFlood: true})
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	connect := func() *TestServer {
+		t.Helper()
+		server := NewTestServer(c)
+		if err := server.Register(); err != nil {
+			t.Fatal(err)
+		}
+
+		server.Send("005 test MONITOR :are supported by this server")
+		waitFor("MONITOR", func() bool { return c.supportsOption(MONITOR) })
+
+		c.state.Lock()
+		c.state.enabledCap = append(c.state.enabledCap, "message-tags")
+		c.state.Unlock()
+		return server
+	}
+
+	hasTyping := func(key string) bool {
+		c.typingMu.Lock()
+		defer c.typingMu.Unlock()
+		_, ok := c.typing[key]
+		return ok
+	}
+
+	hasMonitor := func(key string) bool {
+		c.state.RLock()
+		defer c.state.RUnlock()
+		_, ok := c.state.monitor[key]
+		return ok
+	}
+
+	// Typing notifications are tracked across connections.
+	server := connect()
+	server.Send("005 test CASEMAPPING=rfc1459 :are supported by this server")
+	if err := c.Typing("Nick[A]", TypingActive); err != nil {
+		t.Fatal(err)
+	}
+	if !hasTyping("nick{a}") {
+		t.Fatal("typing status not tracked with rfc1459 casemapping")
+	}
+	server.Close()
+
+	server = connect()
+	defer server.Close()
+	defer c.Close()
+
+	// CASEMAPPING may be advertised after monitoring nicknames.
+	if err := c.Monitor("Other[B]"); err != nil {
+		t.Fatal(err)
+	}
+	if !hasMonitor("other{b}") {
+		t.Fatal("monitored nickname not tracked with rfc1459 casemapping")
+	}
+
+	server.Send("005 test CASEMAPPING=ascii :are supported by this server")
+	waitFor("typing status to be rebuilt", func() bool { return hasTyping("nick[a]") && !hasTyping("nick{a}") })
+	waitFor("monitor to be rebuilt", func() bool { return hasMonitor("other[b]") && !hasMonitor("other{b}") })
+}
+
+func TestCasemappingReconnect(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test", AllowFlood: true, RetainChannels: true})
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// With rfc1459 casemapping, "Other[B]" and "other{b}" are the same user.
+	server := NewTestServer(c)
+	server.Send("005 test CASEMAPPING=rfc1459 :are supported by this server")
+	if err := server.Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Cmd.JoinKeys([]string{"#Key[1]"}, []string{"secret"}); err != nil {
+		t.Fatal(err)
+	}
+	server.Send(":test!user@host JOIN #Key[1]", ":Other[B]!user@host JOIN #Key[1]")
+	waitFor("user to join", func() bool { return c.LookupUser("other{b}") != nil })
+	server.Close()
+
+	// With ascii casemapping, they're different users, and the channel (and
+	// its key) is still found.
+	server = NewTestServer(c)
+	defer server.Close()
+	defer c.Close()
+
+	server.Send("005 test CASEMAPPING=ascii :are supported by this server")
+	if err := server.Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := server.Expect("JOIN #Key[1] secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Send(":test!user@host JOIN #Key[1]", ":Other[B]!user@host JOIN #Key[1]", ":Other{B}!user@host JOIN #Key[1]")
+	waitFor("users to join", func() bool {
+		ch := c.LookupChannel("#KEY[1]")
+		return ch != nil && ch.Len() == 3
+	})
+
+	for _, nick := range []string{"Other[B]", "Other{B}"} {
+		user := c.LookupUser(strings.ToLower(nick))
+		if user == nil || user.Nick != nick {
+			t.Fatalf("Client.LookupUser(%q) = %#v, wanted %q", strings.ToLower(nick), user, nick)
+		}
+
+		if !user.InChannel("#key[1]") {
+			t.Fatalf("User.InChannel(%q) = false for %q", "#key[1]", nick)
+		}
+	}
+
+	if c.IsInChannel("#key{1}") {
+		t.Fatal("Client.IsInChannel() matched a different channel with ascii casemapping")
+	}
+
+	// Changing the casemapping while connected rebuilds the state.
+	server.Send("005 test CASEMAPPING=rfc1459 :are supported by this server")
+	waitFor("state to be rebuilt", func() bool { return c.IsInChannel("#key{1}") })
+
+	if user := c.LookupUser("other{b}"); user == nil {
+		t.Fatal("Client.LookupUser() didn't find user after rebuilding with rfc1459 casemapping")
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test", AllowFlood: true})
+
+	got := make(chan Event, 5)
+	c.Handlers.Add(ALL_EVENTS, func(c *Client, e Event) {
+		if e.Command == PRIVMSG {
+			got <- e
+		}
+	})
+
+	server := NewTestServer(c)
+	defer server.Close()
+	defer c.Close()
+
+	if err := server.Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(capServerTimeFormat)
+	now := time.Now().UTC().Format(capServerTimeFormat)
+
+	server.Send(
+		"@time="+past+" :TEST!user@host PRIVMSG other :\x01VERSION\x01",
+		"@time="+past+" :other!user@host PRIVMSG test :hello",
+		"@time="+now+" :other!user@host PRIVMSG test :hello",
+		":other!user@host PRIVMSG test :hello",
+	)
+
+	for _, want := range []struct {
+		echo, historical bool
+	}{{true, true}, {false, true}, {false, false}, {false, false}} {
+		select {
+		case e := <-got:
+			if e.Echo != want.echo || e.IsHistorical() != want.historical {
+				t.Fatalf("%q: Echo = %t, IsHistorical() = %t, wanted %t, %t",
+					e.String(), e.Echo, e.IsHistorical(), want.echo, want.historical)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	// Our own CTCP request shouldn't be replied to.
+	server.Send("PING :marker")
+	_, err := server.expect("PONG", func(e *Event) bool {
+		if e.Command == NOTICE {
+			t.Fatalf("replied to our own CTCP with %q", e.String())
+		}
+		return e.Command == PONG
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,113 +5,224 @@
 package girc
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Commands holds a large list of useful methods to interact with the server,
-// and wrappers for common events.
+// and wrappers for common events. Channel names and other targets passed to
+// these methods are validated, and ErrInvalidTarget is returned (without
+// sending anything) if they would produce a malformed command. Use
+// Client.Send() or Commands.SendRaw() to send commands without validation.
 type Commands struct {
 	c *Client
 }
 
-// Nick changes the client nickname.
-func (cmd *Commands) Nick(name string) {
-	cmd.c.Send(&Event{Command: NICK, Params: []string{name}})
+// Nick changes the client nickname. ErrInvalidTarget is returned if name
+// isn't a valid nickname.
+func (cmd *Commands) Nick(name string) error {
+	if !IsValidNick(name) {
+		return ErrInvalidTarget{Target: name}
+	}
+
+	return cmd.c.Send(&Event{Command: NICK, Params: []string{name}})
 }
 
 // Join attempts to enter a list of IRC channels, at bulk if possible to
-// prevent sending extensive JOIN commands.
-func (cmd *Commands) Join(channels ...string) {
-	// We can join multiple channels at once, however we need to ensure that
-	// we are not exceeding the line length. (see maxLength)
-	max := maxLength - len(JOIN) - 1
+// prevent sending extensive JOIN commands. See JoinKeys() for joining
+// channels which require a key.
+func (cmd *Commands) Join(channels ...string) error {
+	return cmd.JoinKeys(channels, nil)
+}
+
+// JoinKeys attempts to enter a list of IRC channels, where keys[i] is the key
+// (password) for channels[i]. Channels without a key may be given a blank
+// key, or be placed after len(keys). Channels are joined in as few JOIN
+// commands as possible, while respecting the maximum line length and the
+// JOIN target limit advertised by the server (TARGMAX). Keys are masked when
+// logged (see Event.Secrets), and remembered for Config.RetainChannels. If
+// any channel name is invalid, ErrInvalidTarget is returned and nothing is
+// sent.
+func (cmd *Commands) JoinKeys(channels, keys []string) error {
+	if len(keys) > len(channels) {
+		return errors.New("more keys than channels supplied")
+	}
 
-	var buffer string
+	// Keys are matched to channels positionally, so channels with keys must
+	// come before those without.
+	var keyed, unkeyed, keyList []string
+	for i, channel := range channels {
+		if !cmd.c.validChannel(channel) {
+			return ErrInvalidTarget{Target: channel}
+		}
 
-	for i := 0; i < len(channels); i++ {
-		if len(buffer+","+channels[i]) > max {
-			cmd.c.Send(&Event{Command: JOIN, Params: []string{buffer}})
-			buffer = ""
+		if i >= len(keys) || keys[i] == "" {
+			unkeyed = append(unkeyed, channel)
 			continue
 		}
 
-		if len(buffer) == 0 {
-			buffer = channels[i]
-		} else {
-			buffer += "," + channels[i]
+		if strings.ContainsAny(keys[i], " ,") {
+			return fmt.Errorf("invalid key for channel %q", channel)
 		}
 
-		if i == len(channels)-1 {
-			cmd.c.Send(&Event{Command: JOIN, Params: []string{buffer}})
+		keyed = append(keyed, channel)
+		keyList = append(keyList, keys[i])
+	}
+
+	if len(keyed) > 0 && !cmd.c.Config.disableTracking {
+		// Remembered for Config.RetainChannels.
+		cmd.c.state.Lock()
+		for i := 0; i < len(keyed); i++ {
+			cmd.c.state.keys[cmd.c.state.casefold(keyed[i])] = channelKey{channel: keyed[i], key: keyList[i]}
+		}
+		cmd.c.state.Unlock()
+	}
+
+	limit, _ := cmd.c.targetLimit(JOIN)
+
+	var chans, ks []string
+	length := len(JOIN)
+
+	flush := func() {
+		if len(chans) == 0 {
 			return
 		}
+
+		event := &Event{Command: JOIN, Params: []string{strings.Join(chans, ",")}}
+		if len(ks) > 0 {
+			event.Params = append(event.Params, strings.Join(ks, ","))
+			event.Secrets = ks
+		}
+
+		cmd.c.Send(event)
+		chans, ks = nil, nil
+		length = len(JOIN)
 	}
+
+	for i, channel := range append(keyed, unkeyed...) {
+		// Each channel and key is preceded by either a space or a comma.
+		size := len(channel) + 1
+		if i < len(keyList) {
+			size += len(keyList[i]) + 1
+		}
+
+		if length+size > maxLength || (limit > 0 && len(chans) >= limit) {
+			flush()
+		}
+
+		chans = append(chans, channel)
+		if i < len(keyList) {
+			ks = append(ks, keyList[i])
+		}
+		length += size
+	}
+
+	flush()
+	return nil
 }
 
 // JoinKey attempts to enter an IRC channel with a password.
-func (cmd *Commands) JoinKey(channel, password string) {
-	cmd.c.Send(&Event{Command: JOIN, Params: []string{channel, password}})
+func (cmd *Commands) JoinKey(channel, password string) error {
+	return cmd.JoinKeys([]string{channel}, []string{password})
 }
 
 // Part leaves an IRC channel.
-func (cmd *Commands) Part(channels ...string) {
+func (cmd *Commands) Part(channels ...string) error {
+	if err := cmd.checkChannels(channels...); err != nil {
+		return err
+	}
+
 	for i := 0; i < len(channels); i++ {
 		cmd.c.Send(&Event{Command: PART, Params: []string{channels[i]}})
 	}
+	return nil
 }
 
 // PartMessage leaves an IRC channel with a specified leave message.
-func (cmd *Commands) PartMessage(channel, message string) {
-	cmd.c.Send(&Event{Command: PART, Params: []string{channel}, Trailing: message, EmptyTrailing: true})
+func (cmd *Commands) PartMessage(channel, message string) error {
+	if err := cmd.checkChannels(channel); err != nil {
+		return err
+	}
+
+	return cmd.c.Send(&Event{Command: PART, Params: []string{channel}, Trailing: message, EmptyTrailing: true})
 }
 
 // SendCTCP sends a CTCP request to target. Note that this method uses
 // PRIVMSG specifically. ctcpType is the CTCP command, e.g. "FINGER", "TIME",
 // "VERSION", etc.
-func (cmd *Commands) SendCTCP(target, ctcpType, message string) {
+func (cmd *Commands) SendCTCP(target, ctcpType, message string) error {
 	out := EncodeCTCPRaw(ctcpType, message)
 	if out == "" {
 		panic(fmt.Sprintf("invalid CTCP: %s -> %s: %s", target, ctcpType, message))
 	}
 
-	cmd.Message(target, out)
+	return cmd.Message(target, out)
 }
 
 // SendCTCPf sends a CTCP request to target using a specific format. Note that
 // this method uses PRIVMSG specifically. ctcpType is the CTCP command, e.g.
 // "FINGER", "TIME", "VERSION", etc.
-func (cmd *Commands) SendCTCPf(target, ctcpType, format string, a ...interface{}) {
-	cmd.SendCTCP(target, ctcpType, fmt.Sprintf(format, a...))
+func (cmd *Commands) SendCTCPf(target, ctcpType, format string, a ...interface{}) error {
+	return cmd.SendCTCP(target, ctcpType, fmt.Sprintf(format, a...))
 }
 
 // SendCTCPReplyf sends a CTCP response to target using a specific format.
 // Note that this method uses NOTICE specifically. ctcpType is the CTCP
 // command, e.g. "FINGER", "TIME", "VERSION", etc.
-func (cmd *Commands) SendCTCPReplyf(target, ctcpType, format string, a ...interface{}) {
-	cmd.SendCTCPReply(target, ctcpType, fmt.Sprintf(format, a...))
+func (cmd *Commands) SendCTCPReplyf(target, ctcpType, format string, a ...interface{}) error {
+	return cmd.SendCTCPReply(target, ctcpType, fmt.Sprintf(format, a...))
 }
 
 // SendCTCPReply sends a CTCP response to target. Note that this method uses
 // NOTICE specifically.
-func (cmd *Commands) SendCTCPReply(target, ctcpType, message string) {
+func (cmd *Commands) SendCTCPReply(target, ctcpType, message string) error {
 	out := EncodeCTCPRaw(ctcpType, message)
 	if out == "" {
 		panic(fmt.Sprintf("invalid CTCP: %s -> %s: %s", target, ctcpType, message))
 	}
 
-	cmd.Notice(target, out)
+	return cmd.Notice(target, out)
 }
 
 // Message sends a PRIVMSG to target (either channel, service, or user).
-func (cmd *Commands) Message(target, message string) {
-	cmd.c.Send(&Event{Command: PRIVMSG, Params: []string{target}, Trailing: message, EmptyTrailing: true})
+func (cmd *Commands) Message(target, message string) error {
+	if err := checkTargets(target); err != nil {
+		return err
+	}
+
+	return cmd.c.Send(&Event{Command: PRIVMSG, Params: []string{target}, Trailing: message, EmptyTrailing: true})
 }
 
 // Messagef sends a formated PRIVMSG to target (either channel, service, or
 // user).
-func (cmd *Commands) Messagef(target, format string, a ...interface{}) {
-	cmd.Message(target, fmt.Sprintf(format, a...))
+func (cmd *Commands) Messagef(target, format string, a ...interface{}) error {
+	return cmd.Message(target, fmt.Sprintf(format, a...))
+}
+
+// MessageStatus sends a PRIVMSG to channel, which is only delivered to
+// members with the status given by prefix (or higher), e.g. OperatorPrefix
+// or VoicePrefix. If the server doesn't advertise prefix via STATUSMSG in
+// RPL_ISUPPORT, ErrNotSupported is returned and nothing is sent. See also
+// Event.StatusMessage().
+func (cmd *Commands) MessageStatus(prefix, channel, message string) error {
+	cmd.c.state.RLock()
+	statusmsg := cmd.c.state.serverOptions["STATUSMSG"]
+	cmd.c.state.RUnlock()
+
+	if len(prefix) != 1 || !strings.Contains(statusmsg, prefix) {
+		return ErrNotSupported{Feature: "STATUSMSG " + prefix}
+	}
+
+	if err := cmd.checkChannels(channel); err != nil {
+		return err
+	}
+
+	return cmd.c.Send(&Event{Command: PRIVMSG, Params: []string{prefix + channel}, Trailing: message, EmptyTrailing: true})
 }
 
 // ErrInvalidSource is returned when a method needs to know the origin of an
@@ -122,76 +233,83 @@ var ErrInvalidSource = errors.New("event has nil or invalid source address")
 // Reply sends a reply to channel or user, based on where the supplied event
 // originated from. See also ReplyTo(). Panics if the incoming event has no
 // source.
-func (cmd *Commands) Reply(event Event, message string) {
+func (cmd *Commands) Reply(event Event, message string) error {
 	if event.Source == nil {
 		panic(ErrInvalidSource)
 	}
 
 	if len(event.Params) > 0 && IsValidChannel(event.Params[0]) {
-		cmd.Message(event.Params[0], message)
-		return
+		return cmd.Message(event.Params[0], message)
 	}
 
-	cmd.Message(event.Source.Name, message)
+	return cmd.Message(event.Source.Name, message)
 }
 
 // Replyf sends a reply to channel or user with a format string, based on
 // where the supplied event originated from. See also ReplyTof(). Panics if
 // the incoming event has no source.
-func (cmd *Commands) Replyf(event Event, format string, a ...interface{}) {
-	cmd.Reply(event, fmt.Sprintf(format, a...))
+func (cmd *Commands) Replyf(event Event, format string, a ...interface{}) error {
+	return cmd.Reply(event, fmt.Sprintf(format, a...))
 }
 
 // ReplyTo sends a reply to a channel or user, based on where the supplied
 // event originated from. ReplyTo(), when originating from a channel will
 // default to replying with "<user>, <message>". See also Reply(). Panics if
 // the incoming event has no source.
-func (cmd *Commands) ReplyTo(event Event, message string) {
+func (cmd *Commands) ReplyTo(event Event, message string) error {
 	if event.Source == nil {
 		panic(ErrInvalidSource)
 	}
 
 	if len(event.Params) > 0 && IsValidChannel(event.Params[0]) {
-		cmd.Message(event.Params[0], event.Source.Name+", "+message)
-		return
+		return cmd.Message(event.Params[0], event.Source.Name+", "+message)
 	}
 
-	cmd.Message(event.Source.Name, message)
+	return cmd.Message(event.Source.Name, message)
 }
 
 // ReplyTof sends a reply to a channel or user with a format string, based
 // on where the supplied event originated from. ReplyTo(), when originating
 // from a channel will default to replying with "<user>, <message>". See
 // also Replyf(). Panics if the incoming event has no source.
-func (cmd *Commands) ReplyTof(event Event, format string, a ...interface{}) {
-	cmd.ReplyTo(event, fmt.Sprintf(format, a...))
+func (cmd *Commands) ReplyTof(event Event, format string, a ...interface{}) error {
+	return cmd.ReplyTo(event, fmt.Sprintf(format, a...))
 }
 
 // Action sends a PRIVMSG ACTION (/me) to target (either channel, service,
 // or user).
-func (cmd *Commands) Action(target, message string) {
-	cmd.c.Send(&Event{
-		Command:  PRIVMSG,
-		Params:   []string{target},
-		Trailing: fmt.Sprintf("\001ACTION %s\001", message),
+func (cmd *Commands) Action(target, message string) error {
+	if err := checkTargets(target); err != nil {
+		return err
+	}
+
+	return cmd.c.Send(&Event{
+		Command:       PRIVMSG,
+		Params:        []string{target},
+		Trailing:      fmt.Sprintf("\001ACTION %s\001", message),
+		EmptyTrailing: true,
 	})
 }
 
 // Actionf sends a formated PRIVMSG ACTION (/me) to target (either channel,
 // service, or user).
-func (cmd *Commands) Actionf(target, format string, a ...interface{}) {
-	cmd.Action(target, fmt.Sprintf(format, a...))
+func (cmd *Commands) Actionf(target, format string, a ...interface{}) error {
+	return cmd.Action(target, fmt.Sprintf(format, a...))
 }
 
 // Notice sends a NOTICE to target (either channel, service, or user).
-func (cmd *Commands) Notice(target, message string) {
-	cmd.c.Send(&Event{Command: NOTICE, Params: []string{target}, Trailing: message, EmptyTrailing: true})
+func (cmd *Commands) Notice(target, message string) error {
+	if err := checkTargets(target); err != nil {
+		return err
+	}
+
+	return cmd.c.Send(&Event{Command: NOTICE, Params: []string{target}, Trailing: message, EmptyTrailing: true})
 }
 
 // Noticef sends a formated NOTICE to target (either channel, service, or
 // user).
-func (cmd *Commands) Noticef(target, format string, a ...interface{}) {
-	cmd.Notice(target, fmt.Sprintf(format, a...))
+func (cmd *Commands) Noticef(target, format string, a ...interface{}) error {
+	return cmd.Notice(target, fmt.Sprintf(format, a...))
 }
 
 // SendRaw sends a raw string (or multiple) to the server, without carriage
@@ -220,27 +338,41 @@ func (cmd *Commands) SendRawf(format string, a ...interface{}) error {
 
 // Topic sets the topic of channel to message. Does not verify the length
 // of the topic.
-func (cmd *Commands) Topic(channel, message string) {
-	cmd.c.Send(&Event{Command: TOPIC, Params: []string{channel}, Trailing: message, EmptyTrailing: true})
+func (cmd *Commands) Topic(channel, message string) error {
+	if err := cmd.checkChannels(channel); err != nil {
+		return err
+	}
+
+	return cmd.c.Send(&Event{Command: TOPIC, Params: []string{channel}, Trailing: message, EmptyTrailing: true})
 }
 
 // Who sends a WHO query to the server, which will attempt WHOX by default.
 // See http://faerion.sourceforge.net/doc/irc/whox.var for more details. This
 // sends "%tcuhnr,2" per default. Do not use "1" as this will conflict with
 // girc's builtin tracking functionality.
-func (cmd *Commands) Who(users ...string) {
+func (cmd *Commands) Who(users ...string) error {
+	if err := checkTargets(users...); err != nil {
+		return err
+	}
+
 	for i := 0; i < len(users); i++ {
 		cmd.c.Send(&Event{Command: WHO, Params: []string{users[i], "%tcuhnr,2"}})
 	}
+	return nil
 }
 
 // Whois sends a WHOIS query to the server, targeted at a specific user (or
 // set of users). As WHOIS is a bit slower, you may want to use WHO for brief
 // user info.
-func (cmd *Commands) Whois(users ...string) {
+func (cmd *Commands) Whois(users ...string) error {
+	if err := checkTargets(users...); err != nil {
+		return err
+	}
+
 	for i := 0; i < len(users); i++ {
 		cmd.c.Send(&Event{Command: WHOIS, Params: []string{users[i]}})
 	}
+	return nil
 }
 
 // Ping sends a PING query to the server, with a specific identifier that
@@ -256,76 +388,269 @@ func (cmd *Commands) Pong(id string) {
 }
 
 // Oper sends a OPER authentication query to the server, with a username
-// and password.
-func (cmd *Commands) Oper(user, pass string) {
-	cmd.c.Send(&Event{Command: OPER, Params: []string{user, pass}, Sensitive: true})
+// and password. The password is masked when logged.
+func (cmd *Commands) Oper(user, pass string) error {
+	if err := checkTargets(user); err != nil {
+		return err
+	}
+
+	return cmd.c.Send(&Event{Command: OPER, Params: []string{user, pass}, Secrets: []string{pass}})
 }
 
-// Kick sends a KICK query to the server, attempting to kick nick from
+// Kick sends a KICK query to the server, attempting to kick users from
 // channel, with reason. If reason is blank, one will not be sent to the
-// server.
-func (cmd *Commands) Kick(channel, user, reason string) {
-	if reason != "" {
-		cmd.c.Send(&Event{Command: KICK, Params: []string{channel, user}, Trailing: reason, EmptyTrailing: true})
+// server. Users are kicked in as few KICK commands as possible if the server
+// advertises support for multiple KICK targets (TARGMAX), otherwise each user
+// is kicked individually.
+func (cmd *Commands) Kick(channel string, users []string, reason string) error {
+	if err := cmd.checkChannels(channel); err != nil {
+		return err
+	}
+
+	if err := checkTargets(users...); err != nil {
+		return err
+	}
+
+	send := func(targets []string) {
+		event := &Event{Command: KICK, Params: []string{channel, strings.Join(targets, ",")}}
+		if reason != "" {
+			event.Trailing = reason
+			event.EmptyTrailing = true
+		}
+
+		cmd.c.Send(event)
 	}
 
-	cmd.c.Send(&Event{Command: KICK, Params: []string{channel, user}})
+	limit, ok := cmd.c.targetLimit(KICK)
+	if !ok || limit == 1 {
+		for i := 0; i < len(users); i++ {
+			send(users[i : i+1])
+		}
+		return nil
+	}
+
+	// "KICK <channel> <users> :<reason>"
+	max := maxLength - len(KICK) - len(channel) - len(reason) - 4
+
+	var targets []string
+	var length int
+
+	for _, user := range users {
+		if len(targets) > 0 && (length+len(user)+1 > max || (limit > 0 && len(targets) >= limit)) {
+			send(targets)
+			targets, length = nil, 0
+		}
+
+		targets = append(targets, user)
+		length += len(user) + 1
+	}
+
+	if len(targets) > 0 {
+		send(targets)
+	}
+	return nil
 }
 
 // Ban adds the +b mode on the given mask on a channel.
-func (cmd *Commands) Ban(channel, mask string) {
-	cmd.Mode(channel, "+b", mask)
+func (cmd *Commands) Ban(channel, mask string) error {
+	if err := cmd.checkChannels(channel); err != nil {
+		return err
+	}
+
+	return cmd.Mode(channel, "+b", mask)
 }
 
 // Unban removes the +b mode on the given mask on a channel.
-func (cmd *Commands) Unban(channel, mask string) {
-	cmd.Mode(channel, "-b", mask)
+func (cmd *Commands) Unban(channel, mask string) error {
+	if err := cmd.checkChannels(channel); err != nil {
+		return err
+	}
+
+	return cmd.Mode(channel, "-b", mask)
+}
+
+// KickBan bans the mask of nick on channel (see Config.BanMask), and then
+// kicks them from channel with reason. The mask is generated from the users
+// ident and host in state, so an error is returned if the user (or their
+// host) isn't being tracked. Panics if tracking is disabled.
+func (c *Client) KickBan(channel, nick, reason string) error {
+	user := c.LookupUser(nick)
+	if user == nil || user.Host == "" {
+		return fmt.Errorf("unable to kickban %q: user not found in state", nick)
+	}
+
+	if err := c.Cmd.Ban(channel, c.banMask(user)); err != nil {
+		return err
+	}
+
+	return c.Cmd.Kick(channel, []string{user.Nick}, reason)
+}
+
+// defaultBanMask is the default for Config.BanMask.
+const defaultBanMask = "*!*@{host}"
+
+// banMask generates a ban mask for user, using Config.BanMask.
+func (c *Client) banMask(user *User) string {
+	format := c.Config.BanMask
+	if format == "" {
+		format = defaultBanMask
+	}
+
+	return strings.NewReplacer(
+		"{nick}", user.Nick,
+		"{ident}", user.Ident,
+		"{host}", user.Host,
+	).Replace(format)
 }
 
 // Mode sends a mode change to the server which should be applied to target
 // (usually a channel or user), along with a set of modes (generally "+m",
 // "+mmmm", or "-m", where "m" is the mode you want to change). Params is only
 // needed if the mode change requires a parameter (ban or invite-only exclude.)
-func (cmd *Commands) Mode(target, modes string, params ...string) {
+func (cmd *Commands) Mode(target, modes string, params ...string) error {
+	if err := checkTargets(target); err != nil {
+		return err
+	}
+
 	out := []string{target, modes}
 	out = append(out, params...)
 
-	cmd.c.Send(&Event{Command: MODE, Params: out})
+	return cmd.c.Send(&Event{Command: MODE, Params: out})
 }
 
 // Invite sends a INVITE query to the server, to invite nick to channel.
-func (cmd *Commands) Invite(channel string, users ...string) {
+func (cmd *Commands) Invite(channel string, users ...string) error {
+	if err := cmd.checkChannels(channel); err != nil {
+		return err
+	}
+
+	if err := checkTargets(users...); err != nil {
+		return err
+	}
+
 	for i := 0; i < len(users); i++ {
 		cmd.c.Send(&Event{Command: INVITE, Params: []string{users[i], channel}})
 	}
+	return nil
+}
+
+// InviteWait is much like Invite, however it only invites a single user, and
+// waits up to timeout for the server to acknowledge the invite (RPL_INVITING).
+// If the server rejects the invite (e.g. ERR_USERONCHANNEL), the rejecting
+// event is returned along with an *ErrEvent. ErrNoResponse is returned if
+// the server doesn't respond in time.
+func (cmd *Commands) InviteWait(channel, user string, timeout time.Duration) (*Event, error) {
+	if err := cmd.checkChannels(channel); err != nil {
+		return nil, err
+	}
+
+	if err := checkTargets(user); err != nil {
+		return nil, err
+	}
+
+	event, err := cmd.c.await(
+		func() { _ = cmd.Invite(channel, user) },
+		timeout,
+		func(e *Event) bool {
+			return hasParam(e, user) || hasParam(e, channel)
+		},
+		RPL_INVITING, ERR_NOSUCHNICK, ERR_NOSUCHCHANNEL, ERR_NOTONCHANNEL,
+		ERR_USERONCHANNEL, ERR_CHANOPRIVSNEEDED,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Command != RPL_INVITING {
+		return event, &ErrEvent{Event: event}
+	}
+
+	return event, nil
+}
+
+// Knock sends a KNOCK request to the server, asking the operators of channel
+// for an invite. reason is optional. If the server doesn't advertise KNOCK
+// support via RPL_ISUPPORT, ErrNotSupported is returned and nothing is sent.
+func (cmd *Commands) Knock(channel, reason string) error {
+	if err := cmd.checkChannels(channel); err != nil {
+		return err
+	}
+
+	if !cmd.c.supportsOption(KNOCK) {
+		return ErrNotSupported{Feature: KNOCK}
+	}
+
+	if reason == "" {
+		return cmd.c.Send(&Event{Command: KNOCK, Params: []string{channel}})
+	}
+
+	return cmd.c.Send(&Event{Command: KNOCK, Params: []string{channel}, Trailing: reason, EmptyTrailing: true})
+}
+
+// KnockWait is much like Knock, however it waits up to timeout for the server
+// to let us know if the knock was delivered (RPL_KNOCKDLVR). If the server
+// rejects the knock (e.g. ERR_CHANOPEN), the rejecting event is returned along
+// with an *ErrEvent. ErrNoResponse is returned if the server doesn't respond
+// in time.
+func (cmd *Commands) KnockWait(channel, reason string, timeout time.Duration) (*Event, error) {
+	if err := cmd.checkChannels(channel); err != nil {
+		return nil, err
+	}
+
+	if !cmd.c.supportsOption(KNOCK) {
+		return nil, ErrNotSupported{Feature: KNOCK}
+	}
+
+	event, err := cmd.c.await(
+		func() { _ = cmd.Knock(channel, reason) },
+		timeout,
+		func(e *Event) bool {
+			// ERR_CANNOTKNOCK generally only references the channel in the
+			// trailing text.
+			return e.Command == ERR_CANNOTKNOCK || hasParam(e, channel)
+		},
+		RPL_KNOCKDLVR, ERR_CANNOTKNOCK, ERR_TOOMANYKNOCK, ERR_CHANOPEN,
+		ERR_KNOCKONCHAN, ERR_NOSUCHCHANNEL,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Command != RPL_KNOCKDLVR {
+		return event, &ErrEvent{Event: event}
+	}
+
+	return event, nil
 }
 
 // Away sends a AWAY query to the server, suggesting that the client is no
 // longer active. If reason is blank, Client.Back() is called. Also see
 // Client.Back().
-func (cmd *Commands) Away(reason string) {
+func (cmd *Commands) Away(reason string) error {
 	if reason == "" {
-		cmd.Back()
-		return
+		return cmd.Back()
 	}
 
-	cmd.c.Send(&Event{Command: AWAY, Params: []string{reason}})
+	return cmd.c.Send(&Event{Command: AWAY, Params: []string{reason}})
 }
 
 // Back sends a AWAY query to the server, however the query is blank,
 // suggesting that the client is active once again. Also see Client.Away().
-func (cmd *Commands) Back() {
-	cmd.c.Send(&Event{Command: AWAY})
+func (cmd *Commands) Back() error {
+	return cmd.c.Send(&Event{Command: AWAY})
 }
 
 // List sends a LIST query to the server, which will list channels and topics.
 // Supports multiple channels at once, in hopes it will reduce extensive
 // LIST queries to the server. Supply no channels to run a list against the
 // entire server (warning, that may mean LOTS of channels!)
-func (cmd *Commands) List(channels ...string) {
+func (cmd *Commands) List(channels ...string) error {
 	if len(channels) == 0 {
-		cmd.c.Send(&Event{Command: LIST})
-		return
+		return cmd.c.Send(&Event{Command: LIST})
+	}
+
+	if err := cmd.checkChannels(channels...); err != nil {
+		return err
 	}
 
 	// We can LIST multiple channels at once, however we need to ensure that
@@ -336,7 +661,9 @@ func (cmd *Commands) List(channels ...string) {
 
 	for i := 0; i < len(channels); i++ {
 		if len(buffer+","+channels[i]) > max {
-			cmd.c.Send(&Event{Command: LIST, Params: []string{buffer}})
+			if err := cmd.c.Send(&Event{Command: LIST, Params: []string{buffer}}); err != nil {
+				return err
+			}
 			buffer = ""
 			continue
 		}
@@ -348,14 +675,235 @@ func (cmd *Commands) List(channels ...string) {
 		}
 
 		if i == len(channels)-1 {
-			cmd.c.Send(&Event{Command: LIST, Params: []string{buffer}})
-			return
+			return cmd.c.Send(&Event{Command: LIST, Params: []string{buffer}})
 		}
 	}
+
+	return nil
 }
 
 // Whowas sends a WHOWAS query to the server. amount is the amount of results
 // you want back.
-func (cmd *Commands) Whowas(user string, amount int) {
-	cmd.c.Send(&Event{Command: WHOWAS, Params: []string{user, string(amount)}})
+func (cmd *Commands) Whowas(user string, amount int) error {
+	if err := checkTargets(user); err != nil {
+		return err
+	}
+
+	return cmd.c.Send(&Event{Command: WHOWAS, Params: []string{user, strconv.Itoa(amount)}})
+}
+
+// ErrNoResponse is returned when a command which expects a response from the
+// server doesn't receive one within the allotted time.
+var ErrNoResponse = errors.New("timed out waiting for a response from the server")
+
+// ErrNotSupported is returned when a command requires a feature which the
+// server has not advertised support for (e.g. via RPL_ISUPPORT).
+type ErrNotSupported struct {
+	Feature string // Feature is the unsupported feature or ISUPPORT option.
+}
+
+func (e ErrNotSupported) Error() string { return "server does not support " + e.Feature }
+
+// ErrInvalidTarget is returned when a command is supplied an invalid channel
+// or nickname.
+type ErrInvalidTarget struct {
+	Target string // Target is the invalid channel or nickname.
+}
+
+func (e ErrInvalidTarget) Error() string { return "invalid target: " + e.Target }
+
+// validChannel is like IsValidChannel, however if the server advertises
+// which channel prefixes it supports (CHANTYPES), channel must start with
+// one of them.
+func (c *Client) validChannel(channel string) bool {
+	if channel == "" {
+		return false
+	}
+
+	c.state.RLock()
+	chantypes, ok := c.state.serverOptions["CHANTYPES"]
+	c.state.RUnlock()
+
+	if ok && chantypes != "" {
+		if !strings.ContainsRune(chantypes, rune(channel[0])) {
+			return false
+		}
+
+		// The prefix is valid, so just validate the rest of the name.
+		channel = ChannelPrefix + channel[1:]
+	}
+
+	return IsValidChannel(channel)
+}
+
+// checkChannels returns ErrInvalidTarget for the first invalid channel.
+func (cmd *Commands) checkChannels(channels ...string) error {
+	for i := 0; i < len(channels); i++ {
+		if !cmd.c.validChannel(channels[i]) {
+			return ErrInvalidTarget{Target: channels[i]}
+		}
+	}
+
+	return nil
+}
+
+// checkTargets returns ErrInvalidTarget for the first target (e.g. a
+// nickname, channel, or mask) which can't be sent as a single parameter.
+func checkTargets(targets ...string) error {
+	for i := 0; i < len(targets); i++ {
+		if targets[i] == "" || targets[i][0] == ':' || strings.ContainsAny(targets[i], " \r\n\x00") {
+			return ErrInvalidTarget{Target: targets[i]}
+		}
+	}
+
+	return nil
+}
+
+// hasParam checks if any of the events params (excluding the first, which is
+// usually our own nickname) match the given value.
+func hasParam(e *Event, value string) bool {
+	for i := 1; i < len(e.Params); i++ {
+		if ToRFC1459(e.Params[i]) == ToRFC1459(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// await registers temporary handlers across each of the provided commands,
+// calls send, and then waits up to timeout for an event where match returns
+// true. All handlers are removed before await returns.
+func (c *Client) await(send func(), timeout time.Duration, match func(e *Event) bool, commands ...string) (*Event, error) {
+	result := make(chan *Event, 1)
+
+	cuids := make([]string, 0, len(commands))
+	for i := 0; i < len(commands); i++ {
+		cuids = append(cuids, c.Handlers.addWait(commands[i], true, func(_ *Client, e Event) {
+			if !match(&e) {
+				return
+			}
+
+			select {
+			case result <- &e:
+			default:
+			}
+		}))
+	}
+
+	defer func() {
+		for i := 0; i < len(cuids); i++ {
+			c.Handlers.Remove(cuids[i])
+		}
+	}()
+
+	send()
+
+	select {
+	case event := <-result:
+		return event, nil
+	case <-time.After(timeout):
+		return nil, ErrNoResponse
+	}
+}
+
+// SendAndWait sends event, and collects all numeric replies from the server,
+// until an event with the command until is received (which is included as
+// the last event), or until timeout has elapsed. For example, sending a
+// WHOIS and waiting until RPL_ENDOFWHOIS.
+//
+// As IRC has no general way of relating replies to requests, any numeric
+// received in the meantime is collected, including replies to other
+// requests. If timeout elapses, the events collected so far are returned
+// along with ErrNoResponse.
+func (c *Client) SendAndWait(event *Event, until string, timeout time.Duration) ([]*Event, error) {
+	return c.sendAndCollect(event, timeout, func(e *Event) bool { return e.Command == until })
+}
+
+// sendAndCollect is much like Client.SendAndWait(), however the last event
+// is the first for which last returns true, which is collected even if it
+// isn't a numeric.
+func (c *Client) sendAndCollect(event *Event, timeout time.Duration, last func(e *Event) bool) ([]*Event, error) {
+	if !c.IsConnected() {
+		return nil, ErrNotConnected
+	}
+
+	var mu sync.Mutex
+	var events []*Event
+	var finished bool
+	done := make(chan struct{})
+
+	// This is not a background handler, to ensure that events are collected
+	// in the order they were received.
+	cuid := c.Handlers.addWait(ALL_EVENTS, false, func(_ *Client, e Event) {
+		isLast := last(&e)
+		if !isLast && !IsNumeric(e.Command) {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if finished {
+			return
+		}
+
+		events = append(events, &e)
+		if isLast {
+			finished = true
+			close(done)
+		}
+	})
+	defer c.Handlers.Remove(cuid)
+
+	c.Send(event)
+
+	var err error
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		err = ErrNoResponse
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	finished = true
+
+	return events, err
+}
+
+// WaitFor blocks until an event with the given command is received for which
+// match returns true (or any event with the command, if match is nil), and
+// returns it. If ctx is cancelled (or its deadline passes) first, the error
+// from ctx is returned. The handler used to wait is always removed before
+// WaitFor returns.
+//
+// To wait for a reply to something, prefer sending it from a handler, or
+// after starting WaitFor in another goroutine, as the reply may otherwise
+// arrive before WaitFor is called.
+func (c *Client) WaitFor(ctx context.Context, command string, match func(e Event) bool) (Event, error) {
+	result := make(chan Event, 1)
+
+	_, done, reason := c.Handlers.AddTmpContext(ctx, command, func(_ *Client, e Event) bool {
+		if match != nil && !match(e) {
+			return false
+		}
+
+		// Background handlers may run concurrently, so only the first
+		// matching event is kept.
+		select {
+		case result <- e:
+		default:
+		}
+
+		return true
+	})
+
+	<-done
+
+	if err := reason(); err != nil {
+		return Event{}, err
+	}
+
+	return <-result, nil
 }
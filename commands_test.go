@@ -0,0 +1,554 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockRespond reads all lines written by the client, calling respond with
+// each parsed event. Any lines returned by respond are written back to the
+// client, as if they came from the server.
+func mockRespond(conn net.Conn, respond func(e *Event) []string) {
+	b := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(300 * time.Second))
+		line, err := b.ReadString(byte('\n'))
+		if err != nil {
+			return
+		}
+
+		event := ParseEvent(line)
+		if event == nil {
+			continue
+		}
+
+		for _, out := range respond(event) {
+			if _, err = conn.Write([]byte(out + "\r\n")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// mockConnected connects c using server, and waits for the client to be
+// initialized.
+func mockConnected(t *testing.T, c *Client, server net.Conn) {
+	done := make(chan struct{}, 1)
+	cuid := c.Handlers.Add(INITIALIZED, func(c *Client, e Event) { close(done) })
+	defer c.Handlers.Remove(cuid)
+
+	go c.MockConnect(server)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out during connect")
+	}
+}
+
+func TestInviteWait(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != INVITE || len(e.Params) != 2 {
+			return nil
+		}
+
+		if e.Params[0] == "other" {
+			return []string{":dummy.int 443 test other " + e.Params[1] + " :is already on channel"}
+		}
+
+		return []string{":dummy.int 341 test " + e.Params[0] + " " + e.Params[1]}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	event, err := c.Cmd.InviteWait("#channel", "nick", 2*time.Second)
+	if err != nil {
+		t.Fatalf("Commands.InviteWait() returned error: %s", err)
+	}
+	if event.Command != RPL_INVITING {
+		t.Fatalf("Commands.InviteWait() = %q, wanted %q", event.Command, RPL_INVITING)
+	}
+
+	event, err = c.Cmd.InviteWait("#channel", "other", 2*time.Second)
+	if _, ok := err.(*ErrEvent); !ok {
+		t.Fatalf("Commands.InviteWait() error = %#v, wanted *ErrEvent", err)
+	}
+	if event == nil || event.Command != ERR_USERONCHANNEL {
+		t.Fatalf("Commands.InviteWait() = %#v, wanted %q", event, ERR_USERONCHANNEL)
+	}
+}
+
+func TestKnockWait(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != KNOCK || len(e.Params) != 1 {
+			return nil
+		}
+
+		if e.Params[0] == "#open" {
+			return []string{":dummy.int 713 test #open :Channel is open."}
+		}
+
+		return []string{":dummy.int 711 test " + e.Params[0] + " :Your KNOCK has been delivered."}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if err := c.Cmd.Knock("#channel", ""); err == nil {
+		t.Fatal("Commands.Knock() should fail when KNOCK isn't in ISUPPORT")
+	} else if !strings.Contains(err.Error(), KNOCK) {
+		t.Fatalf("Commands.Knock() error = %q, should mention %s", err, KNOCK)
+	}
+
+	c.state.Lock()
+	c.state.serverOptions[KNOCK] = ""
+	c.state.Unlock()
+
+	event, err := c.Cmd.KnockWait("#channel", "let me in", 2*time.Second)
+	if err != nil {
+		t.Fatalf("Commands.KnockWait() returned error: %s", err)
+	}
+	if event.Command != RPL_KNOCKDLVR {
+		t.Fatalf("Commands.KnockWait() = %q, wanted %q", event.Command, RPL_KNOCKDLVR)
+	}
+
+	event, err = c.Cmd.KnockWait("#open", "", 2*time.Second)
+	if _, ok := err.(*ErrEvent); !ok {
+		t.Fatalf("Commands.KnockWait() error = %#v, wanted *ErrEvent", err)
+	}
+	if event == nil || event.Command != ERR_CHANOPEN {
+		t.Fatalf("Commands.KnockWait() = %#v, wanted %q", event, ERR_CHANOPEN)
+	}
+}
+
+func TestMessageStatus(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	sent := make(chan string, 1)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == PRIVMSG {
+			sent <- e.String()
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if err := c.Cmd.MessageStatus(OperatorPrefix, "#channel", "hello"); err == nil {
+		t.Fatal("Commands.MessageStatus() should fail when STATUSMSG isn't in ISUPPORT")
+	}
+
+	c.state.Lock()
+	c.state.serverOptions["STATUSMSG"] = "@+"
+	c.state.Unlock()
+
+	if _, ok := c.Cmd.MessageStatus(HalfOperatorPrefix, "#channel", "hello").(ErrNotSupported); !ok {
+		t.Fatal("Commands.MessageStatus() should fail for a prefix not in STATUSMSG")
+	}
+	if _, ok := c.Cmd.MessageStatus(OperatorPrefix, "nochan", "hello").(ErrInvalidTarget); !ok {
+		t.Fatal("Commands.MessageStatus() should fail for an invalid channel")
+	}
+
+	if err := c.Cmd.MessageStatus(OperatorPrefix, "#channel", "hello ops"); err != nil {
+		t.Fatalf("Commands.MessageStatus() returned error: %s", err)
+	}
+
+	select {
+	case raw := <-sent:
+		if want := "PRIVMSG @#channel :hello ops"; raw != want {
+			t.Fatalf("sent %q, wanted %q", raw, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for PRIVMSG")
+	}
+}
+
+func TestSendAndWait(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != WHOIS || len(e.Params) != 1 || e.Params[0] == "silent" {
+			return nil
+		}
+
+		return []string{
+			":dummy.int 311 test nick user host.com * :Real Name",
+			":nick!user@host.com PRIVMSG #chan :unrelated",
+			":dummy.int 312 test nick dummy.int :Dummy Server",
+			":dummy.int 318 test nick :End of /WHOIS list.",
+			":dummy.int 319 test nick :#too-late",
+		}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	events, err := c.SendAndWait(&Event{Command: WHOIS, Params: []string{"nick"}}, RPL_ENDOFWHOIS, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Client.SendAndWait() returned error: %s", err)
+	}
+
+	want := []string{RPL_WHOISUSER, RPL_WHOISSERVER, RPL_ENDOFWHOIS}
+	if len(events) != len(want) {
+		t.Fatalf("Client.SendAndWait() returned %d events, wanted %d", len(events), len(want))
+	}
+	for i := 0; i < len(want); i++ {
+		if events[i].Command != want[i] {
+			t.Fatalf("Client.SendAndWait() event %d = %q, wanted %q", i, events[i].Command, want[i])
+		}
+	}
+
+	_, err = c.SendAndWait(&Event{Command: WHOIS, Params: []string{"silent"}}, RPL_ENDOFWHOIS, 100*time.Millisecond)
+	if err != ErrNoResponse {
+		t.Fatalf("Client.SendAndWait() error = %v, wanted ErrNoResponse", err)
+	}
+
+	c.Handlers.mu.RLock()
+	remaining := len(c.Handlers.external[ALL_EVENTS])
+	c.Handlers.mu.RUnlock()
+	if remaining != 0 {
+		t.Fatalf("Client.SendAndWait() left %d handlers behind", remaining)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != PING || len(e.Params) != 1 {
+			return nil
+		}
+
+		return []string{
+			":nick!user@host.com PRIVMSG #chan :unrelated",
+			":nick!user@host.com PRIVMSG #chan :" + e.Params[0],
+		}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	result := make(chan Event, 1)
+	errs := make(chan error, 1)
+	go func() {
+		e, err := c.WaitFor(ctx, PRIVMSG, func(e Event) bool { return e.Trailing == "pong" })
+		result <- e
+		errs <- err
+	}()
+
+	// Wait for the handler to be registered before sending.
+	for !hasHandler(c, PRIVMSG) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Cmd.Ping("pong")
+
+	if err := <-errs; err != nil {
+		t.Fatalf("Client.WaitFor() returned error: %s", err)
+	}
+	if e := <-result; e.Trailing != "pong" {
+		t.Fatalf("Client.WaitFor() = %q, wanted the matching event", e.String())
+	}
+
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := c.WaitFor(cancelled, PRIVMSG, nil); err != context.Canceled {
+		t.Fatalf("Client.WaitFor() error = %v, wanted context.Canceled", err)
+	}
+
+	if hasHandler(c, PRIVMSG) {
+		t.Fatal("Client.WaitFor() left a handler behind")
+	}
+}
+
+// hasHandler returns true if there are any external handlers for cmd.
+func hasHandler(c *Client, cmd string) bool {
+	c.Handlers.mu.RLock()
+	defer c.Handlers.mu.RUnlock()
+
+	return len(c.Handlers.external[cmd]) > 0
+}
+
+func TestJoinKeys(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	joins := make(chan *Event, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == JOIN {
+			joins <- e
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if err := c.Cmd.Join("#valid", "invalid"); err == nil {
+		t.Fatal("Commands.Join() should fail with an invalid channel")
+	}
+
+	c.state.Lock()
+	c.state.serverOptions["TARGMAX"] = "PRIVMSG:4,JOIN:2"
+	c.state.Unlock()
+
+	if err := c.Cmd.JoinKeys([]string{"#a", "#b", "#c"}, []string{"", "key"}); err != nil {
+		t.Fatalf("Commands.JoinKeys() returned error: %s", err)
+	}
+
+	want := [][]string{{"#b,#a", "key"}, {"#c"}}
+	for _, params := range want {
+		select {
+		case e := <-joins:
+			if strings.Join(e.Params, " ") != strings.Join(params, " ") {
+				t.Fatalf("Commands.JoinKeys() sent %q, wanted %q", e.Params, params)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for JOIN %q", params)
+		}
+	}
+
+	select {
+	case e := <-joins:
+		t.Fatalf("Commands.JoinKeys() sent unexpected JOIN %q", e.Params)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestKickBan(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.BanMask = "*!{ident}@{host}"
+
+	sent := make(chan *Event, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		// Ignore the MODE query sent when joining a channel.
+		if e.Command == KICK || (e.Command == MODE && len(e.Params) > 1) {
+			sent <- e
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case e := <-sent:
+			if got := strings.TrimSpace(e.String()); got != want {
+				t.Fatalf("got %q, wanted %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	// Without TARGMAX, each user should be kicked individually.
+	c.Cmd.Kick("#channel", []string{"a", "b"}, "bye")
+	expect("KICK #channel a :bye")
+	expect("KICK #channel b :bye")
+
+	c.state.Lock()
+	c.state.serverOptions["TARGMAX"] = "KICK:2"
+	c.state.Unlock()
+
+	c.Cmd.Kick("#channel", []string{"a", "b", "c"}, "")
+	expect("KICK #channel a,b")
+	expect("KICK #channel c")
+
+	if err := c.KickBan("#channel", "bad", "bye"); err == nil {
+		t.Fatal("Client.KickBan() should fail for an unknown user")
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(":test!~test@local.int JOIN #channel\r\n:bad!~bad@bad.host JOIN #channel\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; c.LookupUser("bad") == nil; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for user to be tracked")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := c.KickBan("#channel", "bad", "bye"); err != nil {
+		t.Fatalf("Client.KickBan() returned error: %s", err)
+	}
+	expect("MODE #channel +b *!~bad@bad.host")
+	expect("KICK #channel bad :bye")
+}
+
+func TestChannelHandle(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	sent := make(chan *Event, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == PRIVMSG || e.Command == TOPIC {
+			sent <- e
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	ch := c.Channel("#channel")
+	if ch != nil {
+		t.Fatal("Client.Channel() should return nil when not in channel")
+	}
+
+	// Should be a no-op.
+	ch.Say("hello")
+
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(":test!~test@local.int JOIN #channel\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ch == nil; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for channel to be tracked")
+		}
+		time.Sleep(20 * time.Millisecond)
+		ch = c.Channel("#channel")
+	}
+
+	if ch.Name() != "#channel" {
+		t.Fatalf("ChannelHandle.Name() == %q, wanted #channel", ch.Name())
+	}
+
+	ch.Say("hello")
+	ch.Topic("new topic")
+
+	for _, want := range []string{"PRIVMSG #channel :hello", "TOPIC #channel :new topic"} {
+		select {
+		case e := <-sent:
+			if got := strings.TrimSpace(e.String()); got != want {
+				t.Fatalf("got %q, wanted %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestCommandValidation(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	invalid := map[string]error{
+		"Join":    c.Cmd.Join("nochan"),
+		"Nick":    c.Cmd.Nick("bad nick"),
+		"Message": c.Cmd.Message("bad target", "hello"),
+		"Notice":  c.Cmd.Notice("", "hello"),
+		"Part":    c.Cmd.Part("#ok", "nochan"),
+		"Topic":   c.Cmd.Topic("nochan", "topic"),
+		"Kick":    c.Cmd.Kick("#channel", []string{"bad\r\nnick"}, ""),
+		"Mode":    c.Cmd.Mode(":test", "+i"),
+		"Invite":  c.Cmd.Invite("nochan", "nick"),
+		"Knock":   c.Cmd.Knock("nochan", ""),
+		"List":    c.Cmd.List("#ok", "nochan"),
+		"Whowas":  c.Cmd.Whowas("bad nick", 1),
+		"Oper":    c.Cmd.Oper("", "pass"),
+
+		"MessageMultiline": c.Cmd.MessageMultiline("bad target", "a\nb"),
+	}
+
+	for name, err := range invalid {
+		if _, ok := err.(ErrInvalidTarget); !ok {
+			t.Errorf("Commands.%s() = %v, wanted ErrInvalidTarget", name, err)
+		}
+	}
+
+	if err := c.Cmd.Join("&local"); err != nil {
+		t.Fatalf("Commands.Join() returned error without CHANTYPES: %s", err)
+	}
+
+	c.state.Lock()
+	c.state.serverOptions["CHANTYPES"] = "#"
+	c.state.Unlock()
+
+	if err := c.Cmd.Join("&local"); err == nil {
+		t.Fatal("Commands.Join() should fail for a prefix not in CHANTYPES")
+	}
+
+	if err := c.Cmd.Message("#channel", "hello"); err != nil {
+		t.Fatalf("Commands.Message() returned error: %s", err)
+	}
+
+	// Raw sends aren't validated.
+	if err := c.Cmd.SendRaw("JOIN nochan"); err != nil {
+		t.Fatalf("Commands.SendRaw() returned error: %s", err)
+	}
+
+	if _, err := c.Cmd.KnockWait("nochan", "", time.Second); err == nil {
+		t.Fatal("Commands.KnockWait() should fail for an invalid channel")
+	}
+
+	// Errors from sending are returned, rather than discarded.
+	disconnected := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+	disconnected.state.Lock()
+	disconnected.state.serverOptions[KNOCK] = ""
+	disconnected.state.Unlock()
+
+	sent := map[string]error{
+		"Knock":            disconnected.Cmd.Knock("#channel", ""),
+		"Whowas":           disconnected.Cmd.Whowas("nick", 1),
+		"List":             disconnected.Cmd.List(),
+		"Oper":             disconnected.Cmd.Oper("user", "pass"),
+		"Away":             disconnected.Cmd.Away("gone"),
+		"MessageMultiline": disconnected.Cmd.MessageMultiline("#channel", "a\nb"),
+	}
+
+	for name, err := range sent {
+		if err != ErrNotConnected {
+			t.Errorf("Commands.%s() = %v, wanted ErrNotConnected", name, err)
+		}
+	}
+}
@@ -6,10 +6,12 @@ package girc
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -25,6 +27,9 @@ var endline = []byte("\r\n")
 type ircConn struct {
 	io   *bufio.ReadWriter
 	sock net.Conn
+	// maxLine is the maximum length of an incoming line, see
+	// Config.MaxLineLength.
+	maxLine int
 
 	mu sync.RWMutex
 	// lastWrite is used to keep track of when we last wrote to the server.
@@ -35,6 +40,9 @@ type ircConn struct {
 	// writeDelay is used to keep track of rate limiting of events sent to
 	// the server.
 	writeDelay time.Duration
+	// burst is the amount of events which can still be sent without being
+	// rate limited, see Config.ConnectBurst.
+	burst int
 	// connected is true if we're actively connected to a server.
 	connected bool
 	// connTime is the time at which the client has connected to a server.
@@ -45,6 +53,13 @@ type ircConn struct {
 	// received a successful pong back.
 	lastPong  time.Time
 	pingDelay time.Duration
+	// pingToken is the token sent with the last keep-alive PING, which the
+	// server must echo back in its PONG (see Config.DisablePongValidation).
+	pingToken string
+	// lastRead is the last time we received anything from the server.
+	lastRead time.Time
+	// fail reports an error back to internalConnect, see Client.fail().
+	fail func(err error)
 }
 
 // Dialer is an interface implementation of net.Dialer. Use this if you would
@@ -57,6 +72,14 @@ type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
 }
 
+// contextDialer is a Dialer which also supports dialing with a context.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// defaultDialTimeout is the default for Config.DialTimeout.
+const defaultDialTimeout = 5 * time.Second
+
 // newConn sets up and returns a new connection to the server.
 func newConn(conf Config, dialer Dialer, addr string) (*ircConn, error) {
 	if err := conf.isValid(); err != nil {
@@ -66,8 +89,13 @@ func newConn(conf Config, dialer Dialer, addr string) (*ircConn, error) {
 	var conn net.Conn
 	var err error
 
+	timeout := conf.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+
 	if dialer == nil {
-		netDialer := &net.Dialer{Timeout: 5 * time.Second}
+		netDialer := &net.Dialer{Timeout: timeout}
 
 		if conf.Bind != "" {
 			var local *net.TCPAddr
@@ -82,18 +110,33 @@ func newConn(conf Config, dialer Dialer, addr string) (*ircConn, error) {
 		dialer = netDialer
 	}
 
-	if conn, err = dialer.Dial("tcp", addr); err != nil {
+	// Dialers which support contexts (e.g. net.Dialer, and most proxy
+	// dialers) can also be bound by the timeout.
+	if ctxDialer, ok := dialer.(contextDialer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		conn, err = ctxDialer.DialContext(ctx, "tcp", addr)
+		cancel()
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
 		return nil, err
 	}
 
 	if conf.SSL {
-		var tlsConn net.Conn
-		tlsConn, err = tlsHandshake(conn, conf.TLSConfig, conf.Server, true)
+		handshakeTimeout := conf.TLSHandshakeTimeout
+		if handshakeTimeout <= 0 {
+			handshakeTimeout = timeout
+		}
+
+		host, _, _ := net.SplitHostPort(addr)
+
+		ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+		conn, err = tlsHandshake(ctx, conn, conf.TLSConfig, host, true)
+		cancel()
 		if err != nil {
 			return nil, err
 		}
-
-		conn = tlsConn
 	}
 
 	ctime := time.Now()
@@ -103,19 +146,19 @@ func newConn(conf Config, dialer Dialer, addr string) (*ircConn, error) {
 		connTime:  &ctime,
 		connected: true,
 	}
-	c.newReadWriter()
+	c.newReadWriter(conf.ReadBufferSize, conf.WriteBufferSize)
 
 	return c, nil
 }
 
-func newMockConn(conn net.Conn) *ircConn {
+func newMockConn(conf Config, conn net.Conn) *ircConn {
 	ctime := time.Now()
 	c := &ircConn{
 		sock:      conn,
 		connTime:  &ctime,
 		connected: true,
 	}
-	c.newReadWriter()
+	c.newReadWriter(conf.ReadBufferSize, conf.WriteBufferSize)
 
 	return c
 }
@@ -127,19 +170,72 @@ type ErrParseEvent struct {
 
 func (e ErrParseEvent) Error() string { return "unable to parse event: " + e.Line }
 
+// defaultMaxLineLength is the default for Config.MaxLineLength. IRCv3 allows
+// up to 8191 bytes of tags, on top of the standard 512 byte line.
+const defaultMaxLineLength = 8191 + 512
+
+// ErrLineTooLong is returned when the server sends a line which is longer
+// than Config.MaxLineLength.
+type ErrLineTooLong struct {
+	// Max is the configured maximum line length.
+	Max int
+}
+
+func (e ErrLineTooLong) Error() string {
+	return fmt.Sprintf("server sent a line longer than the maximum of %d bytes", e.Max)
+}
+
 func (c *ircConn) decode() (event *Event, err error) {
-	line, err := c.io.ReadString(delim)
-	if err != nil {
-		return nil, err
+	max := c.maxLine
+	if max <= 0 {
+		max = defaultMaxLineLength
+	}
+
+	var line []byte
+	for {
+		if line, err = c.readLine(max); err != nil {
+			return nil, err
+		}
+
+		// Lines should end with CRLF, however some servers only send LF.
+		// Either way, the line ending is removed here, and blank lines
+		// (e.g. from CRLFCRLF) are skipped rather than parsed.
+		line = bytes.TrimRight(line, "\r\n")
+		if len(bytes.TrimSpace(line)) > 0 {
+			break
+		}
 	}
 
-	if event = ParseEvent(line); event == nil {
-		return nil, ErrParseEvent{line}
+	raw := string(line)
+	if event = ParseEvent(raw); event == nil {
+		return nil, ErrParseEvent{raw}
 	}
+	event.raw = raw
 
 	return event, nil
 }
 
+// readLine reads up until (and including) the next LF, returning
+// ErrLineTooLong if that is longer than max.
+func (c *ircConn) readLine(max int) (line []byte, err error) {
+	// ReadSlice is used (rather than ReadString) so the line can be limited
+	// to max, without buffering an unbounded amount of data.
+	for {
+		var chunk []byte
+		chunk, err = c.io.ReadSlice(delim)
+		if len(line)+len(chunk) > max {
+			return nil, ErrLineTooLong{Max: max}
+		}
+
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		return line, err
+	}
+}
+
 func (c *ircConn) encode(event *Event) error {
 	if _, err := c.io.Write(event.Bytes()); err != nil {
 		return err
@@ -151,19 +247,62 @@ func (c *ircConn) encode(event *Event) error {
 	return c.io.Flush()
 }
 
-func (c *ircConn) newReadWriter() {
-	c.io = bufio.NewReadWriter(bufio.NewReader(c.sock), bufio.NewWriter(c.sock))
+// newReadWriter sets up the buffered reader and writer for the connection,
+// using the given buffer sizes, or the bufio defaults if not greater than 0.
+func (c *ircConn) newReadWriter(readSize, writeSize int) {
+	var r *bufio.Reader
+	if readSize > 0 {
+		r = bufio.NewReaderSize(c.sock, readSize)
+	} else {
+		r = bufio.NewReader(c.sock)
+	}
+
+	var w *bufio.Writer
+	if writeSize > 0 {
+		w = bufio.NewWriterSize(c.sock, writeSize)
+	} else {
+		w = bufio.NewWriter(c.sock)
+	}
+
+	c.io = bufio.NewReadWriter(r, w)
 }
 
-func tlsHandshake(conn net.Conn, conf *tls.Config, server string, validate bool) (net.Conn, error) {
+// tlsHandshake wraps conn with TLS, and performs the handshake. If the
+// handshake fails, conn is closed and an ErrTLSHandshake is returned.
+func tlsHandshake(ctx context.Context, conn net.Conn, conf *tls.Config, server string, validate bool) (net.Conn, error) {
 	if conf == nil {
 		conf = &tls.Config{ServerName: server, InsecureSkipVerify: !validate}
+	} else if conf.ServerName == "" && !conf.InsecureSkipVerify {
+		// Without a ServerName, the certificate can't be verified.
+		conf = conf.Clone()
+		conf.ServerName = server
 	}
 
 	tlsConn := tls.Client(conn, conf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, ErrTLSHandshake{Server: server, Err: err}
+	}
+
 	return net.Conn(tlsConn), nil
 }
 
+// ErrTLSHandshake is returned by Connect when the TLS handshake with the
+// server fails (e.g. the certificate is invalid, or the handshake timed out,
+// see Config.TLSHandshakeTimeout).
+type ErrTLSHandshake struct {
+	// Server is the server we attempted the handshake with.
+	Server string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e ErrTLSHandshake) Error() string {
+	return fmt.Sprintf("tls handshake with %s failed: %s", e.Server, e.Err)
+}
+
+func (e ErrTLSHandshake) Unwrap() error { return e.Err }
+
 // Close closes the underlying socket.
 func (c *ircConn) Close() error {
 	return c.sock.Close()
@@ -178,10 +317,102 @@ func (c *ircConn) Close() error {
 // however it will not wait for goroutine-based handlers.
 //
 // If this returns nil, this means that the client requested to be closed
-// (e.g. Client.Close()). Connect will panic if called when the last call has
+// (e.g. Client.Close()). If the server disconnected us with an ERROR (e.g.
+// K-lines, throttling, etc), the returned error will be an *ErrEvent
+// containing the reason. Connect will panic if called when the last call has
 // not completed.
 func (c *Client) Connect() error {
-	return c.internalConnect(nil, nil)
+	return c.internalConnect(context.Background(), nil, nil)
+}
+
+// ConnectContext is the same as Connect, however the client is closed (as
+// with Client.Close()) once ctx is cancelled, in which case ctx.Err() is
+// returned.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	if err := c.internalConnect(ctx, nil, nil); ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Run connects to the server, and if Config.ReconnectDelay is set,
+// reconnects whenever the client is disconnected (waiting between each
+// attempt), until Client.Close() is called. Run returns nil once closed, or
+// the error which caused the client to disconnect if it won't reconnect
+// (e.g. an invalid configuration, or if reconnecting isn't enabled).
+//
+// Handlers should be added before calling Run, as they're kept across
+// reconnects. See RunContext() to also stop once a context is cancelled.
+func (c *Client) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext is the same as Run, however the client is closed once ctx is
+// cancelled, in which case ctx.Err() is returned.
+func (c *Client) RunContext(ctx context.Context) error {
+	// Client.Close() cancels run until each connection starts, and while
+	// waiting to reconnect, so that it isn't missed between connections.
+	run, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	maxDelay := c.Config.MaxReconnectDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxReconnectDelay
+	}
+	delay := c.Config.ReconnectDelay
+
+	c.mu.Lock()
+	c.stop = cancel
+	c.mu.Unlock()
+
+	for {
+		start := time.Now()
+		err := c.internalConnect(run, nil, nil)
+
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case run.Err() != nil || c.wasClosed() || err == nil:
+			return nil
+		case c.Config.ReconnectDelay <= 0:
+			return err
+		}
+
+		if _, ok := err.(*ErrInvalidConfig); ok {
+			return err
+		}
+
+		if time.Since(start) > maxDelay {
+			delay = c.Config.ReconnectDelay
+		}
+
+		c.debug.Printf("disconnected (%s), reconnecting in %s", err, delay)
+
+		c.mu.Lock()
+		c.stop = cancel
+		closed := c.closed
+		c.mu.Unlock()
+
+		if closed {
+			return nil
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-run.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return nil
+		}
+
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
 }
 
 // DialerConnect allows you to specify your own custom dialer which implements
@@ -193,8 +424,11 @@ func (c *Client) Connect() error {
 //	proxyUrl, _ := proxyURI, err = url.Parse("socks5://1.2.3.4:8888")
 //	dialer, _ := proxy.FromURL(proxyURI, &net.Dialer{Timeout: 5 * time.Second})
 //	_ := girc.DialerConnect(dialer)
+//
+// If dialer implements DialContext (as net.Dialer and most proxy dialers
+// do), dialing is bound by Config.DialTimeout.
 func (c *Client) DialerConnect(dialer Dialer) error {
-	return c.internalConnect(nil, dialer)
+	return c.internalConnect(context.Background(), nil, dialer)
 }
 
 // MockConnect is used to implement mocking with an IRC server. Supply a net.Conn
@@ -241,10 +475,24 @@ func (c *Client) DialerConnect(dialer Dialer) error {
 //	 	// Do stuff with event here.
 //	 }
 func (c *Client) MockConnect(conn net.Conn) error {
-	return c.internalConnect(conn, nil)
+	return c.internalConnect(context.Background(), conn, nil)
 }
 
-func (c *Client) internalConnect(mock net.Conn, dialer Dialer) error {
+func (c *Client) internalConnect(parent context.Context, mock net.Conn, dialer Dialer) error {
+	if mock == nil {
+		if err := c.Config.isValid(); err != nil {
+			return err
+		}
+	}
+
+	// Checked before CONNECTING, as every CONNECTING must be followed by
+	// DISCONNECTED.
+	if parent.Err() != nil {
+		return parent.Err()
+	}
+
+	c.RunHandlers(&Event{Command: CONNECTING, Trailing: c.Server()})
+
 	// We want to be the only one handling connects/disconnects right now.
 	c.mu.Lock()
 
@@ -252,59 +500,94 @@ func (c *Client) internalConnect(mock net.Conn, dialer Dialer) error {
 		panic("use of connect more than once")
 	}
 
+	if c.Config.RetainChannels && !c.Config.disableTracking {
+		c.state.Lock()
+		c.state.retainChannels()
+		c.state.Unlock()
+	}
+
 	// Reset the state.
 	c.state.reset()
+	c.closed = false
 
 	if mock == nil {
-		// Validate info, and actually make the connection.
-		c.debug.Printf("connecting to %s...", c.Server())
-		conn, err := newConn(c.Config, dialer, c.Server())
+		// Try each server in turn, starting with the current one, until we
+		// successfully connect.
+		servers := c.servers()
+
+		var err error
+		for i := 0; i < len(servers); i++ {
+			addr := servers[c.serverIndex%len(servers)]
+
+			c.debug.Printf("connecting to %s...", addr)
+			c.conn, err = newConn(c.Config, dialer, addr)
+			if err == nil {
+				break
+			}
+
+			c.debug.Printf("unable to connect to %s: %s", addr, err)
+			c.serverIndex = (c.serverIndex + 1) % len(servers)
+		}
+
 		if err != nil {
+			c.conn = nil
 			c.mu.Unlock()
+			c.disconnected(err)
 			return err
 		}
-
-		c.conn = conn
 	} else {
-		c.conn = newMockConn(mock)
+		c.conn = newMockConn(c.Config, mock)
 	}
 
+	c.conn.maxLine = c.Config.MaxLineLength
+	c.conn.burst = c.Config.ConnectBurst
+
+	servers := c.servers()
+	c.observeConnected(servers[c.serverIndex%len(servers)])
+
 	var ctx context.Context
-	ctx, c.stop = context.WithCancel(context.Background())
-	c.mu.Unlock()
+	ctx, c.stop = context.WithCancel(parent)
 
 	errs := make(chan error, 4)
+	c.conn.fail = func(err error) { sendError(ctx, errs, err) }
+	c.mu.Unlock()
+
 	var wg sync.WaitGroup
 	// 4 being the number of goroutines we need to finish when this function
 	// returns.
 	wg.Add(4)
 	go c.execLoop(ctx, errs, &wg)
-	go c.readLoop(ctx, errs, &wg)
-	go c.sendLoop(ctx, errs, &wg)
-	go c.pingLoop(ctx, errs, &wg)
 
-	// Passwords first.
-	if c.Config.ServerPass != "" {
-		c.write(&Event{Command: PASS, Params: []string{c.Config.ServerPass}, Sensitive: true})
+	// If enabled, events are passed through the reorder buffer on their way
+	// from readLoop to execLoop.
+	rx := c.rx
+	if c.Config.ReorderWindow > 0 {
+		reorder := make(chan *Event)
+		rx = reorder
+
+		wg.Add(1)
+		go c.reorderLoop(ctx, reorder, &wg)
 	}
 
-	// List the IRCv3 capabilities, specifically with the max protocol we
-	// support. The IRCv3 specification doesn't directly state if this should
-	// be called directly before registration, or if it should be called
-	// after NICK/USER requests. It looks like non-supporting networks
-	// should ignore this, and some IRCv3 capable networks require this to
-	// occur before NICK/USER registration.
-	c.listCAP()
+	go c.readLoop(ctx, rx, errs, &wg)
+	go c.sendLoop(ctx, errs, &wg)
+	go c.pingLoop(ctx, errs, &wg)
 
-	// Then nickname.
-	c.write(&Event{Command: NICK, Params: []string{c.Config.Nick}})
+	// WEBIRC must be the very first command sent.
+	if c.Config.WebIRC.Password != "" {
+		c.write(&Event{Command: WEBIRC, Params: []string{
+			c.Config.WebIRC.Password, c.Config.WebIRC.Gateway,
+			c.Config.WebIRC.Hostname, c.Config.WebIRC.Address,
+		}, Sensitive: true})
+	}
 
-	// Then username and realname.
-	if c.Config.Name == "" {
-		c.Config.Name = c.Config.User
+	if c.Config.ConnectCallback != nil {
+		c.Config.ConnectCallback(c)
 	}
 
-	c.write(&Event{Command: USER, Params: []string{c.Config.User, "*", "*"}, Trailing: c.Config.Name})
+	if !c.Config.DisableAutoRegister {
+		_ = c.Register()
+	}
 
 	// Send a virtual event allowing hooks for successful socket connection.
 	c.RunHandlers(&Event{Command: INITIALIZED, Trailing: c.Server()})
@@ -314,10 +597,24 @@ func (c *Client) internalConnect(mock net.Conn, dialer Dialer) error {
 	select {
 	case <-ctx.Done():
 		c.debug.Print("received request to close, beginning clean up")
+
+		// ctx may also have been cancelled via ConnectContext() or Run(),
+		// rather than Close(), so make sure we aren't holding events to
+		// replay (see Config.QueueWhileDisconnected).
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+
 		c.RunHandlers(&Event{Command: STOPPED, Trailing: c.Server()})
 	case err := <-errs:
 		c.debug.Print("received error, beginning clean up")
 		result = err
+
+		if c.wasClosed() {
+			// E.g. the server closed the connection after Client.Quit(),
+			// before we did.
+			result = nil
+		}
 	}
 
 	// Make sure that the connection is closed if not already.
@@ -334,10 +631,25 @@ func (c *Client) internalConnect(mock net.Conn, dialer Dialer) error {
 	// Once we have our error/result, let all other functions know we're done.
 	c.debug.Print("waiting for all routines to finish")
 
-	// Wait for all goroutines to finish.
+	// Wait for all goroutines to finish. ctx has been cancelled above, so
+	// none of them can be blocked sending on errs, and nothing can send on
+	// errs once they've exited, so it's safe to close.
 	wg.Wait()
 	close(errs)
 
+	// sendLoop has exited, so anything left in the send queue is unsent.
+	c.retainUnsent()
+
+	if c.Config.DrainTimeout > 0 {
+		c.debug.Print("waiting for handlers to finish")
+		if !c.Handlers.drain(c.Config.DrainTimeout) {
+			c.debug.Print("timed out waiting for handlers to finish")
+		}
+	}
+
+	c.disconnected(result)
+	c.closeEvents()
+
 	// This helps ensure that the end user isn't improperly using the client
 	// more than once. If they want to do this, they should be using multiple
 	// clients, not multiple instances of Connect().
@@ -348,82 +660,478 @@ func (c *Client) internalConnect(mock net.Conn, dialer Dialer) error {
 	return result
 }
 
+// Register sends the registration sequence (PASS, if Config.ServerPass is
+// set, followed by CAP LS, NICK and USER). This is sent automatically when
+// connecting, unless Config.DisableAutoRegister is enabled, in which case it
+// may be called manually (e.g. from an INITIALIZED handler) once ready.
+// ErrNotConnected is returned if the client isn't connected.
+func (c *Client) Register() error {
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+
+	// Passwords first.
+	if c.Config.ServerPass != "" {
+		c.write(&Event{Command: PASS, Params: []string{c.serverPass()}, Sensitive: true})
+	}
+
+	// List the IRCv3 capabilities, specifically with the max protocol we
+	// support. The IRCv3 specification doesn't directly state if this should
+	// be called directly before registration, or if it should be called
+	// after NICK/USER requests. It looks like non-supporting networks
+	// should ignore this, and some IRCv3 capable networks require this to
+	// occur before NICK/USER registration.
+	c.listCAP()
+
+	// Then nickname.
+	c.write(&Event{Command: NICK, Params: []string{c.Config.Nick}})
+
+	// Then username and realname.
+	if c.Config.Name == "" {
+		c.Config.Name = c.Config.User
+	}
+
+	return c.write(&Event{Command: USER, Params: []string{c.Config.User, "*", "*"}, Trailing: c.Config.Name, EmptyTrailing: true})
+}
+
+// serverPass returns the password to send with PASS, see
+// Config.ServerPassFormat.
+func (c *Client) serverPass() string {
+	if c.Config.ServerPassFormat == "" {
+		return c.Config.ServerPass
+	}
+
+	return strings.NewReplacer(
+		"{nick}", c.Config.Nick,
+		"{user}", c.Config.User,
+		"{pass}", c.Config.ServerPass,
+	).Replace(c.Config.ServerPassFormat)
+}
+
+// disconnected sends the DISCONNECTED event, with err (if any) as the reason.
+// This should be called exactly once per call to internalConnect.
+func (c *Client) disconnected(err error) {
+	event := &Event{Command: DISCONNECTED, Params: []string{c.Server()}}
+	if err != nil {
+		event.Trailing = err.Error()
+	}
+
+	c.RunHandlers(event)
+}
+
+// fail closes the current connection, with err being returned by Connect().
+// Unlike pushing an ERROR event through the event loop, this never waits on
+// the event loop, so it's safe to use from handlers.
+func (c *Client) fail(err error) {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	if conn != nil && conn.fail != nil {
+		conn.fail(err)
+	}
+}
+
+// sendError reports err back to internalConnect via errs. Only the first
+// error is acted upon, after which ctx is cancelled, so this never blocks
+// once the client is shutting down (which would otherwise stop the loops
+// from exiting).
+func sendError(ctx context.Context, errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	case <-ctx.Done():
+	}
+}
+
+// defaultDedupWindow is the default for Config.DedupWindow.
+const defaultDedupWindow = 100 * time.Millisecond
+
+// Defaults for Config.PingStartDelay and Config.PingTimeout.
+const (
+	defaultPingStartDelay = 30 * time.Second
+	defaultPingTimeout    = 60 * time.Second
+)
+
 // readLoop sets a timeout of 300 seconds, and then attempts to read from the
 // IRC server. If there is an error, it calls Reconnect.
-func (c *Client) readLoop(ctx context.Context, errs chan error, wg *sync.WaitGroup) {
+func (c *Client) readLoop(ctx context.Context, rx chan<- *Event, errs chan error, wg *sync.WaitGroup) {
+	defer wg.Done()
 	c.debug.Print("starting readLoop")
 	defer c.debug.Print("closing readLoop")
 
 	var event *Event
 	var err error
 
+	// The last event and when it was received, used for de-duplication.
+	var last string
+	var lastTime time.Time
+
+	// In-progress draft/multiline batches, by reference tag.
+	multiline := make(map[string]*Event)
+
+	dedupWindow := c.Config.DedupWindow
+	if dedupWindow <= 0 {
+		dedupWindow = defaultDedupWindow
+	}
+
+	historicalThreshold := c.Config.HistoricalThreshold
+	if historicalThreshold <= 0 {
+		historicalThreshold = defaultHistoricalThreshold
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
-			wg.Done()
 			return
 		default:
 			_ = c.conn.sock.SetReadDeadline(time.Now().Add(300 * time.Second))
 			event, err = c.conn.decode()
+			if perr, ok := err.(ErrParseEvent); ok {
+				// The server sent something we don't understand, however
+				// the connection itself is fine.
+				c.debug.Printf("skipping malformed line: %q", StripRaw(perr.Line))
+				c.observeMalformed()
+				continue
+			}
 			if err != nil {
-				errs <- err
-				wg.Done()
+				sendError(ctx, errs, err)
 				return
 			}
 
-			// Check if it's an echo-message.
+			c.conn.mu.Lock()
+			c.conn.lastRead = time.Now()
+			c.conn.mu.Unlock()
+
+			c.observeReceived(event)
+
+			if c.Config.Dedup {
+				// The raw line is compared (rather than the encoded event),
+				// as encoding may truncate or otherwise alter the line.
+				if event.raw == last && time.Since(lastTime) < dedupWindow {
+					c.debug.Print("dropping duplicate event: ", StripRaw(event.raw))
+					continue
+				}
+
+				last, lastTime = event.raw, time.Now()
+			}
+
+			// Reassemble draft/multiline batches into a single event.
+			if event = assembleMultiline(multiline, event); event == nil {
+				continue
+			}
+
+			// Check if it's an echo-message. This also catches our own
+			// messages played back by a bouncer.
 			if !c.Config.disableTracking {
 				event.Echo = (event.Command == PRIVMSG || event.Command == NOTICE) &&
-					event.Source != nil && event.Source.Name == c.GetNick()
+					event.Source != nil && c.casefold(event.Source.Name) == c.casefold(c.GetNick())
 			}
 
-			c.rx <- event
+			if _, ok := event.Tags.Get("time"); ok && time.Since(event.Timestamp) > historicalThreshold {
+				event.historical = true
+			}
+
+			if c.Config.PreProcess != nil && !c.Config.PreProcess(event) {
+				c.debug.Print("dropping event from PreProcess: ", StripRaw(event.String()))
+				continue
+			}
+
+			select {
+			case rx <- event:
+			case <-ctx.Done():
+				return
+			}
+
+			// The server will close the connection after sending an ERROR,
+			// so stop reading here. Otherwise the resulting read error may
+			// be returned from Connect() in place of the reason the server
+			// gave us (see execLoop).
+			if event.Command == ERROR {
+				return
+			}
 		}
 	}
 }
 
 // Send sends an event to the server. Use Client.RunHandlers() if you are
-// simply looking to trigger handlers with an event.
-func (c *Client) Send(event *Event) {
-	if !c.Config.AllowFlood {
-		<-time.After(c.conn.rate(event.Len()))
+// simply looking to trigger handlers with an event. If the event was dropped
+// because the send queue is full, ErrSendQueueFull is returned (see
+// Config.SendQueuePolicy).
+//
+// If the client isn't connected, ErrNotConnected is returned, unless
+// Config.QueueWhileDisconnected or Config.ReplayOnReconnect is enabled (and
+// Client.Close() hasn't been called), in which case the event is held until
+// the client has reconnected.
+func (c *Client) Send(event *Event) error {
+	if c.Config.GlobalFormat && event.Trailing != "" &&
+		(event.Command == PRIVMSG || event.Command == TOPIC || event.Command == NOTICE) {
+		event.Trailing = Fmt(event.Trailing)
+	}
+
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	connected := false
+	if conn != nil {
+		conn.mu.RLock()
+		connected = conn.connected
+		conn.mu.RUnlock()
 	}
 
+	if !connected {
+		// Don't hold events if the client was intentionally closed, as it
+		// won't be reconnecting.
+		if (!c.Config.QueueWhileDisconnected && c.Config.ReplayOnReconnect <= 0) || c.wasClosed() {
+			return ErrNotConnected
+		}
+
+		return c.queuePending(event)
+	}
+
+	return c.send(conn, event)
+}
+
+// SendDelay returns how long Client.Send() would currently wait before
+// sending event, due to the write-delay (rate limiting), without sending
+// anything or affecting the write-delay. This may be used to decide whether
+// to send something now, or later. 0 is returned if the event would be sent
+// immediately, if Config.AllowFlood is enabled, or if we aren't connected.
+// Note that the delay may change before the event is actually sent, e.g. if
+// other events are sent in the meantime.
+func (c *Client) SendDelay(event *Event) time.Duration {
+	if c.Config.AllowFlood {
+		return 0
+	}
+
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	if conn == nil {
+		return 0
+	}
+
+	chars := event.Len()
 	if c.Config.GlobalFormat && event.Trailing != "" &&
 		(event.Command == PRIVMSG || event.Command == TOPIC || event.Command == NOTICE) {
-		event.Trailing = Fmt(event.Trailing)
+		// Formatting is applied by Client.Send() before the delay.
+		formatted := event.Copy()
+		formatted.Trailing = Fmt(formatted.Trailing)
+		chars = formatted.Len()
+	}
+
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+
+	if !conn.connected {
+		return 0
+	}
+
+	wait, _, _ := conn.nextRate(chars, time.Now())
+	return wait
+}
+
+// send applies the write-delay (unless Config.AllowFlood is enabled), and
+// writes the event.
+func (c *Client) send(conn *ircConn, event *Event) error {
+	if !c.Config.AllowFlood {
+		<-time.After(conn.rate(event.Len()))
 	}
 
-	c.write(event)
+	return c.write(event)
+}
+
+// pendingEvent is an event held while disconnected, see Client.queuePending().
+type pendingEvent struct {
+	event  *Event
+	queued time.Time
+}
+
+// pendingLimit returns the maximum amount of events held while
+// disconnected.
+func (c *Client) pendingLimit() int {
+	if c.Config.ReplayOnReconnect > 0 {
+		return c.Config.ReplayOnReconnect
+	}
+
+	return sendQueueSize(c.Config)
+}
+
+// queuePending holds an event sent while disconnected, until the client has
+// reconnected. See Config.QueueWhileDisconnected and Config.ReplayOnReconnect.
+func (c *Client) queuePending(event *Event) error {
+	if c.Config.ReplayOnReconnect > 0 && !replayable(event) {
+		return ErrNotConnected
+	}
+
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	if len(c.pending) >= c.pendingLimit() {
+		c.debug.Printf("pending queue full, dropping %s", event.Command)
+		return ErrSendQueueFull
+	}
+
+	c.pending = append(c.pending, pendingEvent{event: event, queued: time.Now()})
+	return nil
+}
+
+// retainUnsent moves any events still waiting in the send queue after the
+// connection was lost to the front of the pending queue, so they can be
+// replayed once reconnected. See Config.ReplayOnReconnect.
+func (c *Client) retainUnsent() {
+	if c.Config.ReplayOnReconnect <= 0 || c.wasClosed() {
+		return
+	}
+
+	var unsent []pendingEvent
+	now := time.Now()
+
+drain:
+	for {
+		select {
+		case event := <-c.tx:
+			if replayable(event) {
+				unsent = append(unsent, pendingEvent{event: event, queued: now})
+			}
+		default:
+			break drain
+		}
+	}
+
+	if len(unsent) == 0 {
+		return
+	}
+
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	c.pending = append(unsent, c.pending...)
+	if limit := c.pendingLimit(); len(c.pending) > limit {
+		c.debug.Printf("pending queue full, dropping %d oldest events", len(c.pending)-limit)
+		c.pending = c.pending[len(c.pending)-limit:]
+	}
+}
+
+// replayable returns true if event should be replayed after reconnecting.
+// Registration and protocol messages are regenerated when reconnecting, so
+// aren't replayed.
+func replayable(event *Event) bool {
+	switch event.Command {
+	case PASS, NICK, USER, CAP, AUTHENTICATE, WEBIRC, PING, PONG, QUIT:
+		return false
+	}
+
+	return true
+}
+
+// flushPending sends any events which were held while disconnected.
+func (c *Client) flushPending() {
+	c.pendingMu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.pendingMu.Unlock()
+
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	if conn == nil {
+		return
+	}
+
+	maxAge := c.Config.ReplayMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultReplayMaxAge
+	}
+
+	for i := 0; i < len(pending); i++ {
+		if c.Config.ReplayOnReconnect > 0 && time.Since(pending[i].queued) > maxAge {
+			c.debug.Printf("dropping expired pending %s", pending[i].event.Command)
+			continue
+		}
+
+		if err := c.send(conn, pending[i].event); err != nil {
+			c.debug.Printf("unable to send pending %s: %s", pending[i].event.Command, err)
+		}
+	}
 }
 
 // write is the lower level function to write an event. It does not have a
-// write-delay when sending events.
-func (c *Client) write(event *Event) {
-	c.tx <- event
+// write-delay when sending events, however it does apply the send queue
+// policy.
+func (c *Client) write(event *Event) error {
+	if c.Config.RejectUnsafe && event.isUnsafe() {
+		c.debug.Printf("rejecting unsafe %s event", event.Command)
+		return ErrUnsafeEvent
+	}
+
+	switch c.Config.SendQueuePolicy {
+	case QueueDropNewest:
+		select {
+		case c.tx <- event:
+		default:
+			c.debug.Printf("send queue full, dropping %s", event.Command)
+			return ErrSendQueueFull
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case c.tx <- event:
+				return nil
+			default:
+			}
+
+			// Make room, unless the queue was drained in the meantime.
+			select {
+			case old := <-c.tx:
+				c.debug.Printf("send queue full, dropping %s", old.Command)
+			default:
+			}
+		}
+	default:
+		c.tx <- event
+	}
+
+	return nil
 }
 
 // rate allows limiting events based on how frequent the event is being sent,
 // as well as how many characters each event has.
 func (c *ircConn) rate(chars int) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var wait time.Duration
+	wait, c.writeDelay, c.burst = c.nextRate(chars, time.Now())
+	return wait
+}
+
+// nextRate returns how long an event with the given amount of characters
+// must wait before being sent at now, along with what the write delay and
+// burst would be afterwards, without updating either. Must be called with
+// the lock held.
+func (c *ircConn) nextRate(chars int, now time.Time) (wait, writeDelay time.Duration, burst int) {
 	_time := time.Second + ((time.Duration(chars) * time.Second) / 100)
 
-	c.mu.Lock()
-	if c.writeDelay += _time - time.Now().Sub(c.lastWrite); c.writeDelay < 0 {
-		c.writeDelay = 0
+	if c.burst > 0 {
+		return 0, c.writeDelay, c.burst - 1
 	}
-	c.mu.Unlock()
 
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	if c.writeDelay > (8 * time.Second) {
-		return _time
+	if writeDelay = c.writeDelay + _time - now.Sub(c.lastWrite); writeDelay < 0 {
+		writeDelay = 0
 	}
 
-	return 0
+	if writeDelay > (8 * time.Second) {
+		return _time, writeDelay, 0
+	}
+
+	return 0, writeDelay, 0
 }
 
 func (c *Client) sendLoop(ctx context.Context, errs chan error, wg *sync.WaitGroup) {
+	defer wg.Done()
 	c.debug.Print("starting sendLoop")
 	defer c.debug.Print("closing sendLoop")
 
@@ -446,7 +1154,13 @@ func (c *Client) sendLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 				c.state.RUnlock()
 
 				if !in {
-					event.Tags = Tags{}
+					// The batch tag may still be used for batches which the
+					// server allows clients to send (e.g. draft/multiline).
+					if ref, ok := event.Tags.Get("batch"); ok && c.HasCap("batch") {
+						event.Tags = Tags{"batch": ref}
+					} else {
+						event.Tags = Tags{}
+					}
 				}
 			}
 
@@ -456,11 +1170,7 @@ func (c *Client) sendLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 			} else {
 				c.debug.Print("> ", StripRaw(event.String()))
 			}
-			if c.Config.Out != nil {
-				if pretty, ok := event.Pretty(); ok {
-					fmt.Fprintln(c.Config.Out, StripRaw(pretty))
-				}
-			}
+			c.writeOut(event)
 
 			c.conn.mu.Lock()
 			c.conn.lastWrite = time.Now()
@@ -482,12 +1192,17 @@ func (c *Client) sendLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 			}
 
 			if err != nil {
-				errs <- err
-				wg.Done()
+				sendError(ctx, errs, err)
 				return
 			}
+
+			c.observeSent(event)
+
+			if event.Command == QUIT && c.wasClosed() {
+				// Client.Quit(), so there's nothing left to send.
+				c.Close()
+			}
 		case <-ctx.Done():
-			wg.Done()
 			return
 		}
 	}
@@ -508,10 +1223,31 @@ type ErrTimedOut struct {
 
 func (ErrTimedOut) Error() string { return "timed out waiting for a requested PING response" }
 
+// ErrIdleTimeout is returned when we haven't received anything from the
+// server within Config.IdleTimeout.
+type ErrIdleTimeout struct {
+	// LastRead is the last time we received anything from the server.
+	LastRead time.Time
+	// Timeout is the configured idle timeout.
+	Timeout time.Duration
+}
+
+func (e ErrIdleTimeout) Error() string {
+	return fmt.Sprintf("no data received from server in %s", time.Since(e.LastRead).Round(time.Second))
+}
+
+// minIdleCheckInterval is the shortest interval at which Config.IdleTimeout
+// is checked, so very short timeouts don't result in a busy loop (or an
+// invalid ticker interval).
+const minIdleCheckInterval = time.Millisecond
+
 func (c *Client) pingLoop(ctx context.Context, errs chan error, wg *sync.WaitGroup) {
-	// Don't run the pingLoop if they want to disable it.
-	if c.Config.PingDelay <= 0 {
-		wg.Done()
+	defer wg.Done()
+
+	// Don't run the pingLoop if they want to disable it, and there is
+	// nothing else for it to do.
+	clientPing := c.Config.PingDelay > 0 && !c.Config.DisableClientPing
+	if !clientPing && c.Config.IdleTimeout <= 0 {
 		return
 	}
 
@@ -521,51 +1257,97 @@ func (c *Client) pingLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 	c.conn.mu.Lock()
 	c.conn.lastPing = time.Now()
 	c.conn.lastPong = time.Now()
+	c.conn.lastRead = time.Now()
 	c.conn.mu.Unlock()
 
-	tick := time.NewTicker(c.Config.PingDelay)
-	defer tick.Stop()
+	// idle is used to check that we have received something from the server
+	// within IdleTimeout. Checking at a fraction of the timeout ensures we
+	// don't notice too long after the timeout has passed.
+	var idle <-chan time.Time
+	if c.Config.IdleTimeout > 0 {
+		interval := c.Config.IdleTimeout / 4
+		if interval < minIdleCheckInterval {
+			interval = minIdleCheckInterval
+		}
+
+		idleTick := time.NewTicker(interval)
+		defer idleTick.Stop()
+		idle = idleTick.C
+	}
+
+	startDelay := c.Config.PingStartDelay
+	if startDelay == 0 {
+		startDelay = defaultPingStartDelay
+	}
+
+	timeout := c.Config.PingTimeout
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+
+	var ping <-chan time.Time
+	if clientPing {
+		tick := time.NewTicker(c.Config.PingDelay)
+		defer tick.Stop()
+		ping = tick.C
+	}
 
 	started := time.Now()
 	past := false
 
 	for {
 		select {
-		case <-tick.C:
+		case <-idle:
+			c.conn.mu.RLock()
+			lastRead := c.conn.lastRead
+			c.conn.mu.RUnlock()
+
+			if time.Since(lastRead) > c.Config.IdleTimeout {
+				sendError(ctx, errs, ErrIdleTimeout{LastRead: lastRead, Timeout: c.Config.IdleTimeout})
+				return
+			}
+		case <-ping:
 			// Delay during connect to wait for the client to register, otherwise
 			// some ircd's will not respond (e.g. during SASL negotiation).
 			if !past {
-				if time.Since(started) < 30*time.Second {
+				if time.Since(started) < startDelay {
 					continue
 				}
 
 				past = true
 			}
 
-			c.conn.mu.RLock()
-			if time.Since(c.conn.lastPong) > c.Config.PingDelay+(60*time.Second) {
-				// It's 60 seconds over what out ping delay is, connection
-				// has probably dropped.
-				errs <- ErrTimedOut{
-					TimeSinceSuccess: time.Since(c.conn.lastPong),
-					LastPong:         c.conn.lastPong,
-					LastPing:         c.conn.lastPing,
-					Delay:            c.Config.PingDelay,
-				}
-
-				wg.Done()
-				c.conn.mu.RUnlock()
-				return
+			token := c.Config.PingPayload
+			if token == "" {
+				token = fmt.Sprintf("%d", time.Now().UnixNano())
 			}
-			c.conn.mu.RUnlock()
 
+			// Only hold the lock while reading/updating the timestamps, and
+			// never while sending on errs, which may block.
 			c.conn.mu.Lock()
-			c.conn.lastPing = time.Now()
+			lastPong, lastPing := c.conn.lastPong, c.conn.lastPing
+			timedOut := time.Since(lastPong) > c.Config.PingDelay+timeout
+			if !timedOut {
+				c.conn.lastPing = time.Now()
+				c.conn.pingToken = token
+			}
 			c.conn.mu.Unlock()
 
-			c.Cmd.Ping(fmt.Sprintf("%d", time.Now().UnixNano()))
+			if timedOut {
+				// It's well over what our ping delay is, connection has
+				// probably dropped.
+				sendError(ctx, errs, ErrTimedOut{
+					TimeSinceSuccess: time.Since(lastPong),
+					LastPong:         lastPong,
+					LastPing:         lastPing,
+					Delay:            c.Config.PingDelay,
+				})
+
+				return
+			}
+
+			c.Cmd.Ping(token)
 		case <-ctx.Done():
-			wg.Done()
 			return
 		}
 	}
@@ -7,7 +7,16 @@ package girc
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -47,9 +56,50 @@ func TestDecode(t *testing.T) {
 		t.Fatalf("should have failed to parse decoded event. got: %#v", event)
 	}
 
+	// Lines longer than the bufio buffer should still be read.
+	long := ":nick!user@host PRIVMSG #channel :" + strings.Repeat("a", 5000)
+	in.WriteString(long + "\r\n")
+	event, err = c.decode()
+	if err != nil || event.Trailing != strings.Repeat("a", 5000) {
+		t.Fatalf("failed to decode long line: %s", err)
+	}
+
+	// But not longer than the maximum.
+	c.maxLine = 100
+	in.WriteString(long + "\r\n")
+	if _, err = c.decode(); err == nil {
+		t.Fatal("should have failed to decode line over maximum length")
+	} else if _, ok := err.(ErrLineTooLong); !ok {
+		t.Fatalf("decode() error = %#v, wanted ErrLineTooLong", err)
+	}
+
 	return
 }
 
+func TestDecodeLineEndings(t *testing.T) {
+	in, _, c := mockBuffers()
+
+	in.WriteString(":nick!user@host PRIVMSG #channel :crlf\r\n")
+	in.WriteString(":nick!user@host PRIVMSG #channel :lf\n")
+	in.WriteString("\r\n\r\n\n   \r\n")
+	in.WriteString(":nick!user@host PRIVMSG #channel :after blank lines\r\r\n")
+
+	for _, want := range []string{"crlf", "lf", "after blank lines"} {
+		event, err := c.decode()
+		if err != nil {
+			t.Fatalf("decode() returned error: %s", err)
+		}
+
+		if event.Trailing != want {
+			t.Fatalf("decode() trailing = %q, wanted %q", event.Trailing, want)
+		}
+	}
+
+	if event, err := c.decode(); err == nil {
+		t.Fatalf("decode() = %#v, wanted EOF", event)
+	}
+}
+
 func TestEncode(t *testing.T) {
 	_, out, c := mockBuffers()
 
@@ -74,6 +124,34 @@ func TestEncode(t *testing.T) {
 	return
 }
 
+func TestBufferSizes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := newMockConn(Config{}, server)
+	if c.io.Reader.Size() != 4096 || c.io.Writer.Size() != 4096 {
+		t.Fatalf("default buffer sizes = %d/%d, wanted 4096", c.io.Reader.Size(), c.io.Writer.Size())
+	}
+
+	c = newMockConn(Config{ReadBufferSize: 64, WriteBufferSize: 32}, server)
+	if c.io.Reader.Size() != 64 || c.io.Writer.Size() != 32 {
+		t.Fatalf("buffer sizes = %d/%d, wanted 64/32", c.io.Reader.Size(), c.io.Writer.Size())
+	}
+
+	// Lines longer than the read buffer should still be decoded.
+	line := ":dummy.int PRIVMSG #channel :" + strings.Repeat("a", 200)
+	go client.Write([]byte(line + "\r\n"))
+
+	event, err := c.decode()
+	if err != nil {
+		t.Fatalf("decode() returned error: %s", err)
+	}
+	if event.String() != line {
+		t.Fatalf("decode() = %q, wanted %q", event.String(), line)
+	}
+}
+
 func TestRate(t *testing.T) {
 	_, _, c := mockBuffers()
 	c.lastWrite = time.Now()
@@ -92,6 +170,66 @@ func TestRate(t *testing.T) {
 	return
 }
 
+func TestRateBurst(t *testing.T) {
+	_, _, c := mockBuffers()
+	c.lastWrite = time.Now()
+	c.burst = 3
+
+	for i := 0; i < 3; i++ {
+		if delay := c.rate(400); delay != 0 {
+			t.Fatalf("rate() = %s within burst, wanted 0", delay)
+		}
+	}
+
+	if c.writeDelay != 0 {
+		t.Fatalf("writeDelay = %s after burst, wanted 0", c.writeDelay)
+	}
+
+	// Normal limiting applies after the burst.
+	c.rate(400)
+	if delay := c.rate(400); delay == 0 {
+		t.Fatal("rate() = 0 after burst was exhausted")
+	}
+}
+
+func TestSendDelay(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	event := &Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: strings.Repeat("a", 400)}
+	if delay := c.SendDelay(event); delay != 0 {
+		t.Fatalf("Client.SendDelay() = %s while disconnected, wanted 0", delay)
+	}
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	c.conn.mu.Lock()
+	c.conn.burst = 0
+	c.conn.lastWrite = time.Now()
+	c.conn.writeDelay = 10 * time.Second
+	c.conn.mu.Unlock()
+
+	delay := c.SendDelay(event)
+	if want := time.Second + time.Duration(event.Len())*time.Second/100; delay != want {
+		t.Fatalf("Client.SendDelay() = %s, wanted %s", delay, want)
+	}
+
+	c.conn.mu.RLock()
+	writeDelay := c.conn.writeDelay
+	c.conn.mu.RUnlock()
+	if writeDelay != 10*time.Second {
+		t.Fatalf("Client.SendDelay() changed the write-delay to %s", writeDelay)
+	}
+
+	c.Config.AllowFlood = true
+	if delay := c.SendDelay(event); delay != 0 {
+		t.Fatalf("Client.SendDelay() = %s with AllowFlood, wanted 0", delay)
+	}
+}
+
 func genMockConn() (client *Client, clientConn net.Conn, serverConn net.Conn) {
 	client = New(Config{
 		Server: "dummy.int",
@@ -117,3 +255,1142 @@ func mockReadBuffer(conn net.Conn) {
 		}
 	}
 }
+
+func TestServerError(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != USER {
+			return nil
+		}
+
+		// Immediately close the connection after the ERROR, like most
+		// servers do.
+		conn.Write([]byte("ERROR :Closing link: (test@local.int) [Throttled]\r\n"))
+		conn.Close()
+		return nil
+	})
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(*ErrEvent); !ok {
+			t.Fatalf("Client.MockConnect() = %#v, wanted *ErrEvent", err)
+		}
+
+		if !strings.Contains(err.Error(), "Throttled") {
+			t.Fatalf("Client.MockConnect() error = %q, should contain the reason", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Client.MockConnect() to return")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.Dedup = true
+
+	var count uint64
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { atomic.AddUint64(&count, 1) })
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	line := "@time=2020-01-01T00:00:00.000Z :nick!user@host PRIVMSG #chan :hello\r\n"
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(line + line)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outside of the window, this is a legitimate repeat.
+	time.Sleep(150 * time.Millisecond)
+	if _, err := conn.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if got := atomic.LoadUint64(&count); got != 2 {
+		t.Fatalf("handler executed %d times, wanted 2", got)
+	}
+
+	// Lines which only differ past the maximum encoded length (e.g. due to
+	// long tags) aren't duplicates.
+	time.Sleep(150 * time.Millisecond)
+	tags := "@+example=" + strings.Repeat("a", maxTagLength-30)
+	lines := tags + " :nick!user@host PRIVMSG #chan :one\r\n" + tags + " :nick!user@host PRIVMSG #chan :two\r\n"
+	if _, err := conn.Write([]byte(lines)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if got := atomic.LoadUint64(&count); got != 4 {
+		t.Fatalf("handler executed %d times, wanted 4", got)
+	}
+}
+
+func TestConnectCallback(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.UserModes = "+iw"
+	c.Config.ConnectCallback = func(c *Client) {
+		c.Cmd.SendRaw("EXTRA command")
+	}
+
+	lines := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		lines <- e.String()
+
+		if e.Command == USER {
+			return []string{":dummy.int 001 test :Welcome"}
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	want := []string{"EXTRA command", "CAP LS 302", "NICK test", "USER test * * :Testing123", "MODE test +iw"}
+	for i := 0; i < len(want); i++ {
+		select {
+		case line := <-lines:
+			if line != want[i] {
+				t.Fatalf("line %d = %q, wanted %q", i, line, want[i])
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want[i])
+		}
+	}
+}
+
+func TestWebIRC(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.ServerPass = "serverpass"
+	c.Config.WebIRC = WebIRC{Password: "secret", Gateway: "cgiirc", Hostname: "user.example.com", Address: "192.0.2.1"}
+	c.Config.ConnectCallback = func(c *Client) {
+		c.Cmd.SendRaw("EXTRA command")
+	}
+
+	lines := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		lines <- string(e.Bytes())
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	want := []string{
+		"WEBIRC secret cgiirc user.example.com 192.0.2.1",
+		"EXTRA command",
+		"PASS serverpass",
+		"CAP LS 302",
+		"NICK test",
+	}
+	for i := 0; i < len(want); i++ {
+		select {
+		case line := <-lines:
+			if line != want[i] {
+				t.Fatalf("line %d = %q, wanted %q", i, line, want[i])
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want[i])
+		}
+	}
+}
+
+func TestSendQueuePolicy(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test", SendQueueSize: 2, SendQueuePolicy: QueueDropNewest})
+
+	for i := 0; i < 2; i++ {
+		if err := c.write(&Event{Command: PING, Params: []string{strconv.Itoa(i)}}); err != nil {
+			t.Fatalf("Client.write() returned error with room in queue: %s", err)
+		}
+	}
+
+	if err := c.write(&Event{Command: PING, Params: []string{"2"}}); err != ErrSendQueueFull {
+		t.Fatalf("Client.write() = %v, wanted ErrSendQueueFull", err)
+	}
+
+	if c.SendQueueLen() != 2 {
+		t.Fatalf("Client.SendQueueLen() = %d, wanted 2", c.SendQueueLen())
+	}
+
+	c = New(Config{Server: "dummy.int", Nick: "test", User: "test", SendQueueSize: 2, SendQueuePolicy: QueueDropOldest})
+
+	for i := 0; i < 3; i++ {
+		if err := c.write(&Event{Command: PING, Params: []string{strconv.Itoa(i)}}); err != nil {
+			t.Fatalf("Client.write() returned error: %s", err)
+		}
+	}
+
+	for _, want := range []string{"1", "2"} {
+		if event := <-c.tx; event.Params[0] != want {
+			t.Fatalf("queued event = %q, wanted %q", event.Params[0], want)
+		}
+	}
+}
+
+func TestPingLoop(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	// Set after New(), to bypass the minimum delay.
+	c.Config.PingDelay = 20 * time.Millisecond
+	c.Config.PingStartDelay = -1
+	c.Config.PingTimeout = 100 * time.Millisecond
+
+	var pings, respond int32 = 0, 1
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != PING {
+			return nil
+		}
+
+		atomic.AddInt32(&pings, 1)
+		if atomic.LoadInt32(&respond) == 0 {
+			return nil
+		}
+
+		return []string{":dummy.int PONG dummy.int :" + e.Params[0]}
+	})
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	// Let several pings elapse, which should all be responded to.
+	time.Sleep(250 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("Client.MockConnect() returned early: %v", err)
+	default:
+	}
+
+	if atomic.LoadInt32(&pings) < 3 {
+		t.Fatalf("only %d pings were sent, wanted at least 3", atomic.LoadInt32(&pings))
+	}
+
+	// Stop responding, which should cause a timeout.
+	atomic.StoreInt32(&respond, 0)
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(ErrTimedOut); !ok {
+			t.Fatalf("Client.MockConnect() = %#v, wanted ErrTimedOut", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for ping timeout")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.PingDelay = -1
+	c.Config.IdleTimeout = 100 * time.Millisecond
+
+	go mockReadBuffer(conn)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	// Any data from the server should keep the connection alive.
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Write([]byte(":dummy.int NOTICE * :still here\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatalf("Client.MockConnect() returned early: %v", err)
+	default:
+	}
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(ErrIdleTimeout); !ok {
+			t.Fatalf("Client.MockConnect() = %#v, wanted ErrIdleTimeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for idle timeout")
+	}
+}
+
+func TestIdleTimeoutTiny(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.PingDelay = -1
+	// Shorter than the check interval would be, which must not panic.
+	c.Config.IdleTimeout = 3 * time.Nanosecond
+
+	go mockReadBuffer(conn)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(server) }()
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(ErrIdleTimeout); !ok {
+			t.Fatalf("Client.MockConnect() = %#v, wanted ErrIdleTimeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for idle timeout")
+	}
+}
+
+func TestPongValidation(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		c, conn, server := genMockConn()
+		c.Config.AllowFlood = true
+		c.Config.PingDelay = 20 * time.Millisecond
+		c.Config.PingStartDelay = -1
+		c.Config.PingTimeout = 100 * time.Millisecond
+		c.Config.DisablePongValidation = disabled
+
+		// PONGs which don't echo our token, along with an unsolicited one.
+		go mockRespond(conn, func(e *Event) []string {
+			if e.Command != PING {
+				return nil
+			}
+
+			return []string{":dummy.int PONG dummy.int :bogus", ":dummy.int PONG dummy.int"}
+		})
+
+		errs := make(chan error, 1)
+		go func() { errs <- c.MockConnect(server) }()
+
+		select {
+		case err := <-errs:
+			if disabled {
+				t.Fatalf("Client.MockConnect() returned %v with validation disabled", err)
+			}
+
+			if _, ok := err.(ErrTimedOut); !ok {
+				t.Fatalf("Client.MockConnect() = %#v, wanted ErrTimedOut", err)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if !disabled {
+				t.Fatal("timed out waiting for invalid PONGs to time out")
+			}
+
+			if since := time.Since(c.LastPong()); since > 100*time.Millisecond {
+				t.Fatalf("Client.LastPong() was %s ago, wanted a recent PONG", since)
+			}
+		}
+
+		c.Close()
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestPingPayload(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.PingDelay = 20 * time.Millisecond
+	c.Config.PingStartDelay = -1
+	c.Config.PingPayload = "token"
+
+	pings := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == PING {
+			select {
+			case pings <- e.String():
+			default:
+			}
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	select {
+	case ping := <-pings:
+		if ping != "PING token" {
+			t.Fatalf("client sent %q, wanted %q", ping, "PING token")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for PING")
+	}
+}
+
+func TestDisableClientPing(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.PingDelay = 20 * time.Millisecond
+	c.Config.PingStartDelay = -1
+	c.Config.DisableClientPing = true
+
+	var pings int32
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == PING {
+			atomic.AddInt32(&pings, 1)
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&pings); n != 0 {
+		t.Fatalf("client sent %d PINGs, wanted none", n)
+	}
+
+	if latency := c.Latency(); latency != 0 {
+		t.Fatalf("Client.Latency() = %s, wanted 0", latency)
+	}
+}
+
+func TestReorderWindow(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.ReorderWindow = 200 * time.Millisecond
+
+	got := make(chan string, 10)
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		got <- e.Trailing
+	})
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	_, err := conn.Write([]byte(
+		"@time=2020-01-01T00:00:02.000Z :a!a@a PRIVMSG #c :second\r\n" +
+			"@time=2020-01-01T00:00:01.000Z :a!a@a PRIVMSG #c :first\r\n" +
+			":a!a@a PRIVMSG #c :live\r\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"live", "first", "second"} {
+		select {
+		case msg := <-got:
+			if msg != want {
+				t.Fatalf("got message %q, wanted %q", msg, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for message %q", want)
+		}
+	}
+}
+
+func TestServerFailover(t *testing.T) {
+	// A server which isn't listening.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mockReadBuffer(conn)
+	}()
+
+	c := New(Config{
+		Servers: []string{closed.Addr().String(), ln.Addr().String()},
+		Nick:    "test",
+		User:    "test",
+	})
+
+	if got := c.CurrentServer(); got != closed.Addr().String() {
+		t.Fatalf("Client.CurrentServer() == %q, wanted %q", got, closed.Addr().String())
+	}
+
+	done := make(chan struct{})
+	c.Handlers.Add(INITIALIZED, func(c *Client, e Event) { close(done) })
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Connect() }()
+
+	select {
+	case <-done:
+	case err = <-errs:
+		t.Fatalf("Client.Connect() returned error: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out during connect")
+	}
+
+	if got := c.CurrentServer(); got != ln.Addr().String() {
+		t.Fatalf("Client.CurrentServer() == %q, wanted %q", got, ln.Addr().String())
+	}
+
+	c.Close()
+	<-errs
+}
+
+func TestDialTimeout(t *testing.T) {
+	// A server which accepts connections, but never completes a TLS
+	// handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mockReadBuffer(conn)
+	}()
+
+	c := New(Config{
+		Servers:     []string{ln.Addr().String()},
+		Nick:        "test",
+		User:        "test",
+		SSL:         true,
+		DialTimeout: 100 * time.Millisecond,
+	})
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Connect() }()
+
+	select {
+	case err = <-errs:
+		if _, ok := err.(ErrTLSHandshake); !ok {
+			t.Fatalf("Client.Connect() error = %#v, wanted ErrTLSHandshake", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client.Connect() not bound by DialTimeout")
+	}
+}
+
+func TestTLSHandshakeError(t *testing.T) {
+	// Uses a self-signed certificate, which will fail verification.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	c := New(Config{
+		Servers:             []string{srv.Listener.Addr().String()},
+		Nick:                "test",
+		User:                "test",
+		SSL:                 true,
+		TLSHandshakeTimeout: 2 * time.Second,
+	})
+
+	err := c.Connect()
+	hsErr, ok := err.(ErrTLSHandshake)
+	if !ok {
+		t.Fatalf("Client.Connect() error = %#v, wanted ErrTLSHandshake", err)
+	}
+
+	if hsErr.Server != "127.0.0.1" {
+		t.Fatalf("ErrTLSHandshake.Server == %q, wanted 127.0.0.1", hsErr.Server)
+	}
+}
+
+func TestTLSState(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+
+	if _, ok := c.TLSState(); ok {
+		t.Fatal("Client.TLSState() returned ok for plaintext connection")
+	}
+	c.Close()
+
+	// Borrow the self-signed certificate from httptest.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mockReadBuffer(conn)
+	}()
+
+	c = New(Config{
+		Servers:   []string{ln.Addr().String()},
+		Nick:      "test",
+		User:      "test",
+		SSL:       true,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+
+	done := make(chan struct{})
+	c.Handlers.Add(INITIALIZED, func(c *Client, e Event) { close(done) })
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Connect() }()
+
+	select {
+	case <-done:
+	case err = <-errs:
+		t.Fatalf("Client.Connect() returned error: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out during connect")
+	}
+
+	state, ok := c.TLSState()
+	if !ok {
+		t.Fatal("Client.TLSState() returned !ok for TLS connection")
+	}
+	if !state.HandshakeComplete || len(state.PeerCertificates) == 0 || state.Version == 0 {
+		t.Fatalf("Client.TLSState() returned incomplete state: %#v", state)
+	}
+
+	c.Close()
+	<-errs
+}
+
+func TestRejectUnsafe(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	unsafe := &Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: "hi\r\nQUIT :bye\x00"}
+
+	if got := string(unsafe.Bytes()); got != "PRIVMSG #channel :hiQUIT :bye" {
+		t.Fatalf("Event.Bytes() = %q, should have stripped unsafe characters", got)
+	}
+
+	if err := c.Send(unsafe); err != nil {
+		t.Fatalf("Client.Send() returned error without RejectUnsafe: %s", err)
+	}
+
+	c.Config.RejectUnsafe = true
+	if err := c.Send(unsafe); err != ErrUnsafeEvent {
+		t.Fatalf("Client.Send() = %v, wanted ErrUnsafeEvent", err)
+	}
+
+	unsafe = &Event{Command: JOIN, Params: []string{"#a\nQUIT"}}
+	if err := c.Send(unsafe); err != ErrUnsafeEvent {
+		t.Fatalf("Client.Send() = %v, wanted ErrUnsafeEvent for unsafe param", err)
+	}
+
+	if err := c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: "safe"}); err != nil {
+		t.Fatalf("Client.Send() returned error for safe event: %s", err)
+	}
+}
+
+func TestSendDisconnected(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test", AllowFlood: true})
+
+	if err := c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: "hello"}); err != ErrNotConnected {
+		t.Fatalf("Client.Send() = %v before connect, wanted ErrNotConnected", err)
+	}
+
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.QueueWhileDisconnected = true
+
+	if err := c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: "queued", EmptyTrailing: true}); err != nil {
+		t.Fatalf("Client.Send() = %v with QueueWhileDisconnected, wanted nil", err)
+	}
+
+	got := make(chan *Event, 1)
+	go mockRespond(conn, func(e *Event) []string {
+		switch e.Command {
+		case USER:
+			return []string{":dummy.int 001 test :Welcome"}
+		case PRIVMSG:
+			got <- e
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	select {
+	case e := <-got:
+		if e.Trailing != "queued" {
+			t.Fatalf("sent %q, wanted queued event", e.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for queued event")
+	}
+}
+
+func TestDisableAutoRegister(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.DisableAutoRegister = true
+
+	received := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		received <- e.Command
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	// Nothing should be sent until we register ourselves.
+	if err := c.Cmd.SendRaw("PROXY custom"); err != nil {
+		t.Fatalf("Commands.SendRaw() returned error: %s", err)
+	}
+	if err := c.Register(); err != nil {
+		t.Fatalf("Client.Register() returned error: %s", err)
+	}
+
+	for _, want := range []string{"PROXY", CAP, NICK, USER} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("received %s, wanted %s", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
+
+// failingConn is a net.Conn where all writes fail.
+type failingConn struct {
+	net.Conn
+}
+
+func (failingConn) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestConnectShutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	c.Config.PingDelay = -1
+
+	// Report more errors than can be buffered, all of which must be
+	// discarded once shutdown has begun.
+	c.Handlers.Add(INITIALIZED, func(c *Client, e Event) {
+		for i := 0; i < 10; i++ {
+			c.rx <- &Event{Command: ERROR, Trailing: "closing connection"}
+		}
+	})
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(failingConn{server}) }()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("Client.MockConnect() returned nil, wanted error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Client.MockConnect() to return")
+	}
+
+	// All goroutines started by the client should have exited.
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running after shutdown, wanted %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMalformedLines(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	received := make(chan string, 1)
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		received <- e.Trailing
+	})
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("::abcd\r\n:nick!user@host PRIVMSG #channel :still here\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case trailing := <-received:
+		if trailing != "still here" {
+			t.Fatalf("received %q, wanted %q", trailing, "still here")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for PRIVMSG after malformed line")
+	}
+
+	if !c.IsConnected() {
+		t.Fatal("Client.IsConnected() = false after malformed line")
+	}
+
+	if m := c.Metrics(); m.MalformedLines != 1 {
+		t.Fatalf("Metrics().MalformedLines = %d, wanted 1", m.MalformedLines)
+	}
+}
+
+func TestReplayOnReconnect(t *testing.T) {
+	c, conn, server := genMockConn()
+	c.Config.AllowFlood = true
+	c.Config.ReplayOnReconnect = 10
+
+	// Stop reading once the client has registered, so that events back up
+	// in the send queue.
+	registered := make(chan struct{})
+	go func() {
+		b := bufio.NewReader(conn)
+		for {
+			line, err := b.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if e := ParseEvent(line); e != nil && e.Command == USER {
+				close(registered)
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		c.MockConnect(server)
+		close(done)
+	}()
+
+	select {
+	case <-registered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for registration")
+	}
+
+	// The first event is lost, as it's being written when the connection
+	// is lost.
+	c.Cmd.Message("#channel", "one")
+	for deadline := time.Now().Add(2 * time.Second); len(c.tx) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for sendLoop")
+		}
+	}
+
+	c.Cmd.Message("#channel", "two")
+	c.Cmd.Ping("lost")
+	c.Cmd.Message("#channel", "three")
+
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+
+	if err := c.Cmd.Message("#channel", "four"); err != nil {
+		t.Fatalf("Client.Send() = %v while disconnected, wanted nil", err)
+	}
+	if err := c.Send(&Event{Command: NICK, Params: []string{"other"}}); err != ErrNotConnected {
+		t.Fatalf("Client.Send(NICK) = %v while disconnected, wanted ErrNotConnected", err)
+	}
+
+	conn, server = net.Pipe()
+	defer conn.Close()
+	defer server.Close()
+
+	got := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		switch e.Command {
+		case USER:
+			return []string{":dummy.int 001 test :Welcome"}
+		case PRIVMSG:
+			got <- e.Trailing
+		case PING:
+			if len(e.Params) > 0 && e.Params[0] == "lost" {
+				got <- "PING"
+			}
+		}
+		return nil
+	})
+
+	go c.MockConnect(server)
+	defer c.Close()
+
+	for _, want := range []string{"two", "three", "four"} {
+		select {
+		case msg := <-got:
+			if msg != want {
+				t.Fatalf("replayed %q, wanted %q", msg, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q to be replayed", want)
+		}
+	}
+}
+
+func TestReplayMaxAge(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.ReplayOnReconnect = 10
+	c.Config.ReplayMaxAge = time.Nanosecond
+
+	if err := c.Cmd.Message("#channel", "stale"); err != nil {
+		t.Fatalf("Client.Send() = %v while disconnected, wanted nil", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	c.pendingMu.Lock()
+	queued := len(c.pending)
+	c.pendingMu.Unlock()
+	if queued != 1 {
+		t.Fatalf("pending = %d, wanted 1", queued)
+	}
+
+	got := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		switch e.Command {
+		case PRIVMSG:
+			got <- e.Trailing
+		case PING:
+			got <- "PING"
+		}
+		return nil
+	})
+
+	go c.MockConnect(server)
+	defer c.Close()
+
+	// flushPending is normally called once registered.
+	for deadline := time.Now().Add(2 * time.Second); !c.IsConnected(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for connect")
+		}
+	}
+	c.flushPending()
+	c.Cmd.Ping("marker")
+
+	select {
+	case msg := <-got:
+		if msg != "PING" {
+			t.Fatalf("replayed expired event %q", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for PING")
+	}
+}
+
+func TestRun(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Each connection is dropped straight away, except every third, which
+	// is kept open until the client disconnects.
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for i := 1; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+
+			if i%3 == 0 {
+				go func() {
+					defer conn.Close()
+					mockReadBuffer(conn)
+				}()
+				continue
+			}
+			conn.Close()
+		}
+	}()
+
+	wait := func(errs chan error) {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			select {
+			case <-accepted:
+			case err := <-errs:
+				t.Fatalf("returned %v, wanted to reconnect", err)
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting to reconnect")
+			}
+		}
+	}
+
+	c := New(Config{
+		Servers:           []string{ln.Addr().String()},
+		Nick:              "test",
+		User:              "test",
+		ReconnectDelay:    10 * time.Millisecond,
+		MaxReconnectDelay: 20 * time.Millisecond,
+	})
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Run() }()
+	wait(errs)
+
+	c.Close()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Client.Run() = %v after Client.Close(), wanted nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client.Run() didn't return after Client.Close()")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { errs <- c.RunContext(ctx) }()
+	wait(errs)
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("Client.RunContext() = %v after cancelling, wanted context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client.RunContext() didn't return after cancelling")
+	}
+
+	// Without ReconnectDelay, the first disconnect is returned.
+	c.Config.ReconnectDelay = 0
+	go func() { errs <- c.Run() }()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("Client.Run() = nil after being disconnected, wanted an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client.Run() didn't return after being disconnected")
+	}
+}
+
+func TestConnectContextCancelled(t *testing.T) {
+	c := New(Config{Server: "127.0.0.1", Port: 1, Nick: "test", User: "test"})
+
+	var connecting, disconnected int32
+	c.Handlers.Add(CONNECTING, func(c *Client, e Event) { atomic.AddInt32(&connecting, 1) })
+	c.Handlers.Add(DISCONNECTED, func(c *Client, e Event) { atomic.AddInt32(&disconnected, 1) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := c.ConnectContext(ctx); err != context.Canceled {
+		t.Fatalf("Client.ConnectContext() = %v, wanted context.Canceled", err)
+	}
+
+	// Every CONNECTING must be followed by DISCONNECTED.
+	if n, m := atomic.LoadInt32(&connecting), atomic.LoadInt32(&disconnected); n != m {
+		t.Fatalf("sent %d CONNECTING and %d DISCONNECTED events", n, m)
+	}
+}
+
+func TestPreProcess(t *testing.T) {
+	var calls int32
+	c := New(Config{
+		Server: "dummy.int", Nick: "test", User: "test", AllowFlood: true,
+		PreProcess: func(e *Event) bool {
+			if e.Command != PRIVMSG {
+				return true
+			}
+
+			atomic.AddInt32(&calls, 1)
+			if strings.Contains(e.Trailing, "spam") {
+				return false
+			}
+
+			e.Trailing = strings.ToLower(e.Trailing)
+			e.Tags = Tags{"example.com/normalized": ""}
+			return true
+		},
+	})
+
+	got := make(chan Event, 5)
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { got <- e })
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {})
+
+	server := NewTestServer(c)
+	defer server.Close()
+	defer c.Close()
+
+	if err := server.Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Send(":nick!user@host PRIVMSG #channel :buy spam", ":nick!user@host PRIVMSG #channel :HELLO")
+
+	select {
+	case e := <-got:
+		if e.Trailing != "hello" {
+			t.Fatalf("handler received %q, wanted the modified event", e.String())
+		}
+		if _, ok := e.Tags.Get("example.com/normalized"); !ok {
+			t.Fatal("handler received event without tag added by PreProcess")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	select {
+	case e := <-got:
+		t.Fatalf("handler received unexpected event %q", e.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Called once per event, regardless of the amount of handlers.
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("PreProcess called %d times, wanted 2", n)
+	}
+}
@@ -21,13 +21,16 @@ const (
 // Emulated event commands used to allow easier hooks into the changing
 // state of the client.
 const (
-	UPDATE_STATE   = "CLIENT_STATE_UPDATED"   // when channel/user state is updated.
-	UPDATE_GENERAL = "CLIENT_GENERAL_UPDATED" // when general state (client nick, server name, etc) is updated.
-	ALL_EVENTS     = "*"                      // trigger on all events
-	CONNECTED      = "CLIENT_CONNECTED"       // when it's safe to send arbitrary commands (joins, list, who, etc), trailing is host:port
-	INITIALIZED    = "CLIENT_INIT"            // verifies successful socket connection, trailing is host:port
-	DISCONNECTED   = "CLIENT_DISCONNECTED"    // occurs when we're disconnected from the server (user-requested or not)
-	STOPPED        = "CLIENT_STOPPED"         // occurs when Client.Stop() has been called
+	UPDATE_STATE    = "CLIENT_STATE_UPDATED"   // when channel/user state is updated.
+	UPDATE_GENERAL  = "CLIENT_GENERAL_UPDATED" // when general state (client nick, server name, etc) is updated.
+	ALL_EVENTS      = "*"                      // trigger on all events
+	CONNECTING      = "CLIENT_CONNECTING"      // occurs before attempting to connect, trailing is host:port
+	CONNECTED       = "CLIENT_CONNECTED"       // when it's safe to send arbitrary commands (joins, list, who, etc), trailing is host:port
+	INITIALIZED     = "CLIENT_INIT"            // verifies successful socket connection, trailing is host:port
+	DISCONNECTED    = "CLIENT_DISCONNECTED"    // occurs once when we're disconnected from the server (user-requested or not), first param is host:port, trailing is the error (if any)
+	STOPPED         = "CLIENT_STOPPED"         // occurs when Client.Stop() has been called
+	MONITOR_ONLINE  = "CLIENT_MONITOR_ONLINE"  // a monitored user came online, source is the user, see Client.Monitor()
+	MONITOR_OFFLINE = "CLIENT_MONITOR_OFFLINE" // a monitored user went offline, first param is their nickname
 )
 
 // User/channel prefixes :: RFC1459.
@@ -45,6 +48,9 @@ const (
 	VoicePrefix        = "+" // user has voice +v
 )
 
+// statusPrefixes are the user prefixes which may be used with STATUSMSG.
+const statusPrefixes = OwnerPrefix + AdminPrefix + OperatorPrefix + HalfOperatorPrefix + VoicePrefix
+
 // User modes :: RFC1459; section 4.2.3.2.
 const (
 	UserModeInvisible     = "i" // invisible
@@ -85,10 +91,12 @@ const (
 	JOIN     = "JOIN"
 	KICK     = "KICK"
 	KILL     = "KILL"
+	KNOCK    = "KNOCK"
 	LINKS    = "LINKS"
 	LIST     = "LIST"
 	LUSERS   = "LUSERS"
 	MODE     = "MODE"
+	MONITOR  = "MONITOR"
 	MOTD     = "MOTD"
 	NAMES    = "NAMES"
 	NICK     = "NICK"
@@ -118,6 +126,7 @@ const (
 	USERS    = "USERS"
 	VERSION  = "VERSION"
 	WALLOPS  = "WALLOPS"
+	WEBIRC   = "WEBIRC"
 	WHO      = "WHO"
 	WHOIS    = "WHOIS"
 	WHOWAS   = "WHOWAS"
@@ -268,7 +277,13 @@ const (
 // IRCv3 commands and extensions :: http://ircv3.net/irc/.
 const (
 	AUTHENTICATE = "AUTHENTICATE"
+	BATCH        = "BATCH"
+	CHATHISTORY  = "CHATHISTORY"
+	FAIL         = "FAIL"
+	METADATA     = "METADATA"
+	REDACT       = "REDACT"
 	STARTTLS     = "STARTTLS"
+	TAGMSG       = "TAGMSG"
 
 	CAP       = "CAP"
 	CAP_ACK   = "ACK"
@@ -288,17 +303,26 @@ const (
 
 // Numeric IRC reply mapping for ircv3 :: http://ircv3.net/irc/.
 const (
-	RPL_LOGGEDIN    = "900"
-	RPL_LOGGEDOUT   = "901"
-	RPL_NICKLOCKED  = "902"
-	RPL_SASLSUCCESS = "903"
-	ERR_SASLFAIL    = "904"
-	ERR_SASLTOOLONG = "905"
-	ERR_SASLABORTED = "906"
-	ERR_SASLALREADY = "907"
-	RPL_SASLMECHS   = "908"
-	RPL_STARTTLS    = "670"
-	ERR_STARTTLS    = "691"
+	RPL_LOGGEDIN     = "900"
+	RPL_LOGGEDOUT    = "901"
+	RPL_NICKLOCKED   = "902"
+	RPL_SASLSUCCESS  = "903"
+	ERR_SASLFAIL     = "904"
+	ERR_SASLTOOLONG  = "905"
+	ERR_SASLABORTED  = "906"
+	ERR_SASLALREADY  = "907"
+	RPL_SASLMECHS    = "908"
+	RPL_STARTTLS     = "670"
+	ERR_STARTTLS     = "691"
+	RPL_MONONLINE    = "730"
+	RPL_MONOFFLINE   = "731"
+	RPL_MONLIST      = "732"
+	RPL_ENDOFMONLIST = "733"
+	ERR_MONLISTFULL  = "734"
+
+	RPL_KEYVALUE          = "761"
+	RPL_KEYNOTSET         = "766"
+	RPL_METADATASYNCLATER = "774"
 )
 
 // Numeric IRC event mapping :: RFC2812; section 5.3.
@@ -336,4 +360,23 @@ const (
 	RPL_LOCALUSERS     = "265" // aircd/hybrid/bahamut, used on freenode.
 	RPL_TOPICWHOTIME   = "333" // ircu, used on freenode.
 	RPL_WHOSPCRPL      = "354" // ircu, used on networks with WHOX support.
+	ERR_CANNOTKNOCK    = "480" // hybrid/unreal, knock rejected by the server.
+	RPL_KNOCK          = "710" // ratbox/charybdis, knock received (channel ops).
+	RPL_KNOCKDLVR      = "711" // ratbox/charybdis, knock delivered.
+	ERR_TOOMANYKNOCK   = "712" // ratbox/charybdis, knock throttled.
+	ERR_CHANOPEN       = "713" // ratbox/charybdis, channel is open, no need to knock.
+	ERR_KNOCKONCHAN    = "714" // ratbox/charybdis, already on the channel.
+	RPL_YOURID         = "042" // ircnet, unique ID of the client.
+	RPL_WHOISCERTFP    = "276" // oftc/charybdis, client certificate fingerprint.
+	RPL_CREATIONTIME   = "329" // bahamut, channel creation time.
+	RPL_WHOISACCOUNT   = "330" // ircu/charybdis, account the user is logged in as.
+	RPL_WHOISACTUALLY  = "338" // ircu/charybdis, actual host/ip of the user.
+	RPL_WHOISHOST      = "378" // unreal/inspircd, host of the user.
+	RPL_HOSTHIDDEN     = "396" // undernet/charybdis, our displayed host changed.
+	ERR_UNKNOWNERROR   = "400" // generic error, used by newer servers.
+	ERR_INVALIDCAPCMD  = "410" // ircv3, invalid CAP subcommand.
+	ERR_INPUTTOOLONG   = "417" // ircv3, line was too long.
+	ERR_LINKCHANNEL    = "470" // charybdis/unreal, forwarded to another channel.
+	ERR_INVALIDKEY     = "525" // hybrid/charybdis, channel key is invalid.
+	RPL_WHOISSECURE    = "671" // unreal/charybdis, user is using a secure connection.
 )
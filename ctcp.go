@@ -7,6 +7,7 @@ package girc
 import (
 	"fmt"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -15,7 +16,11 @@ import (
 // ctcpDelim if the delimiter used for CTCP formatted events/messages.
 const ctcpDelim byte = 0x01 // Prefix and suffix for CTCP messages.
 
-// CTCPEvent is the necessary information from an IRC message.
+// CTCPEvent is the necessary information from an IRC message. For example,
+// the PRIVMSG "\x01PING 1234\x01" from nick decodes to Source nick, Command
+// "PING" and Text "1234", and the same as a NOTICE decodes with Reply set.
+// Custom decoders (see Config.CTCPDecoder) should populate at least Command,
+// and Reply for replies, as CTCP handlers are selected by Command.
 type CTCPEvent struct {
 	// Origin is the original event that the CTCP event was decoded from.
 	Origin *Event `json:"origin"`
@@ -30,8 +35,33 @@ type CTCPEvent struct {
 	Reply bool `json:"reply"`
 }
 
+// decodeCTCP decodes e using Config.CTCPDecoder if set, otherwise
+// DecodeCTCP(). Origin and Source are filled in from e, if a custom decoder
+// doesn't set them.
+func (c *Client) decodeCTCP(e *Event) *CTCPEvent {
+	if c.Config.CTCPDecoder == nil {
+		return DecodeCTCP(e)
+	}
+
+	ctcp := c.Config.CTCPDecoder(*e)
+	if ctcp == nil {
+		return nil
+	}
+
+	if ctcp.Origin == nil {
+		ctcp.Origin = e
+	}
+
+	if ctcp.Source == nil {
+		ctcp.Source = e.Source
+	}
+
+	return ctcp
+}
+
 // DecodeCTCP decodes an incoming CTCP event, if it is CTCP. nil is returned
-// if the incoming event does not have valid CTCP encoding.
+// if the incoming event does not have valid CTCP encoding. This is the
+// standard decoder, which may be replaced with Config.CTCPDecoder.
 func DecodeCTCP(e *Event) *CTCPEvent {
 	// http://www.irchelp.org/protocol/ctcpspec.html
 
@@ -124,11 +154,13 @@ type CTCP struct {
 	mu sync.RWMutex
 	// handlers is a map of CTCP message -> functions.
 	handlers map[string]CTCPHandler
+	// limiter tracks how many automatic replies have been sent to each user.
+	limiter *ctcpLimiter
 }
 
 // newCTCP returns a new clean CTCP handler.
 func newCTCP() *CTCP {
-	return &CTCP{handlers: map[string]CTCPHandler{}}
+	return &CTCP{handlers: map[string]CTCPHandler{}, limiter: &ctcpLimiter{}}
 }
 
 // call executes the necessary CTCP handler for the incoming event/CTCP
@@ -138,7 +170,7 @@ func (c *CTCP) call(client *Client, event *CTCPEvent) {
 	defer c.mu.RUnlock()
 
 	// If they want to catch any panics, add to defer stack.
-	if client.Config.RecoverFunc != nil && event.Origin != nil {
+	if client.recoverPanics() && event.Origin != nil {
 		defer recoverHandlerPanic(client, event.Origin, "ctcp-"+strings.ToLower(event.Command), 3)
 	}
 
@@ -155,7 +187,8 @@ func (c *CTCP) call(client *Client, event *CTCPEvent) {
 		}
 
 		// Send a ERRMSG reply, if we know who sent it.
-		if event.Source != nil && IsValidNick(event.Source.Name) {
+		if event.Source != nil && IsValidNick(event.Source.Name) &&
+			c.limiter.allow(client.Config.CTCPReplyRate, event.Source.Name) {
 			client.Cmd.SendCTCPReply(event.Source.Name, CTCP_ERRMSG, "that is an unknown CTCP query")
 		}
 		return
@@ -235,12 +268,102 @@ type CTCPHandler func(client *Client, ctcp CTCPEvent)
 
 // addDefaultHandlers adds some useful default CTCP response handlers.
 func (c *CTCP) addDefaultHandlers() {
-	c.SetBg(CTCP_PING, handleCTCPPing)
-	c.SetBg(CTCP_PONG, handleCTCPPong)
-	c.SetBg(CTCP_VERSION, handleCTCPVersion)
-	c.SetBg(CTCP_SOURCE, handleCTCPSource)
-	c.SetBg(CTCP_TIME, handleCTCPTime)
-	c.SetBg(CTCP_FINGER, handleCTCPFinger)
+	c.SetBg(CTCP_PING, limitCTCPReply(handleCTCPPing))
+	c.SetBg(CTCP_PONG, limitCTCPReply(handleCTCPPong))
+	c.SetBg(CTCP_VERSION, limitCTCPReply(handleCTCPVersion))
+	c.SetBg(CTCP_SOURCE, limitCTCPReply(handleCTCPSource))
+	c.SetBg(CTCP_TIME, limitCTCPReply(handleCTCPTime))
+	c.SetBg(CTCP_FINGER, limitCTCPReply(handleCTCPFinger))
+}
+
+// CTCPRate is the maximum amount of Replies which will be sent to a single
+// user within Window. See Config.CTCPReplyRate.
+type CTCPRate struct {
+	Replies int
+	Window  time.Duration
+}
+
+// Default CTCP reply limits, see Config.CTCPReplyRate.
+const (
+	defaultCTCPReplies = 3
+	defaultCTCPWindow  = 10 * time.Second
+)
+
+// ctcpLimiter keeps track of automatic replies sent to each user, within
+// the current window.
+type ctcpLimiter struct {
+	mu        sync.Mutex
+	sources   map[string]*ctcpWindow
+	lastSweep time.Time
+}
+
+type ctcpWindow struct {
+	start   time.Time
+	replies int
+}
+
+// allow returns true if a reply to source is allowed, based on rate, and
+// records the reply if so.
+func (l *ctcpLimiter) allow(rate CTCPRate, source string) bool {
+	if rate.Replies < 0 {
+		return true
+	}
+	if rate.Replies == 0 {
+		rate.Replies = defaultCTCPReplies
+	}
+	if rate.Window <= 0 {
+		rate.Window = defaultCTCPWindow
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.sources == nil {
+		l.sources = make(map[string]*ctcpWindow)
+	}
+
+	// Evict users whose window has already passed, so we don't keep track of
+	// everyone who has ever sent us a CTCP request.
+	if now.Sub(l.lastSweep) >= rate.Window {
+		for name, window := range l.sources {
+			if now.Sub(window.start) >= rate.Window {
+				delete(l.sources, name)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	source = ToRFC1459(source)
+	window, ok := l.sources[source]
+	if !ok || now.Sub(window.start) >= rate.Window {
+		l.sources[source] = &ctcpWindow{start: now, replies: 1}
+		return true
+	}
+
+	if window.replies >= rate.Replies {
+		return false
+	}
+
+	window.replies++
+	return true
+}
+
+// limitCTCPReply wraps a default CTCP handler, ensuring it is only called if
+// we haven't sent too many replies to the source (see Config.CTCPReplyRate).
+func limitCTCPReply(handler CTCPHandler) func(client *Client, ctcp CTCPEvent) {
+	return func(client *Client, ctcp CTCPEvent) {
+		if ctcp.Source == nil || ctcp.Reply {
+			return
+		}
+
+		if !client.CTCP.limiter.allow(client.Config.CTCPReplyRate, ctcp.Source.Name) {
+			client.debug.Printf("dropping ctcp %s reply to %s, too many requests", ctcp.Command, ctcp.Source.Name)
+			return
+		}
+
+		handler(client, ctcp)
+	}
 }
 
 // handleCTCPPing replies with a ping and whatever was originally requested.
@@ -259,19 +382,37 @@ func handleCTCPPong(client *Client, ctcp CTCPEvent) {
 	client.Cmd.SendCTCPReply(ctcp.Source.Name, CTCP_PONG, "")
 }
 
-// handleCTCPVersion replies with the name of the client, Go version, as well
-// as the os type (darwin, linux, windows, etc) and architecture type (x86,
-// arm, etc).
+// handleCTCPVersion replies with Config.Version, or if not set, the name and
+// version of the library, Go version, as well as the os type (darwin, linux,
+// windows, etc) and architecture type (x86, arm, etc).
 func handleCTCPVersion(client *Client, ctcp CTCPEvent) {
-	if client.Config.Version != "" {
-		client.Cmd.SendCTCPReply(ctcp.Source.Name, CTCP_VERSION, client.Config.Version)
-		return
+	client.Cmd.SendCTCPReply(ctcp.Source.Name, CTCP_VERSION, client.version())
+}
+
+// girc's module path, used to look up the library version.
+const modulePath = "github.com/lrstanley/girc"
+
+// defaultVersion returns the default CTCP VERSION reply, which includes the
+// library version when it's available from the build information.
+func defaultVersion() string {
+	name := "girc"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		mod := &info.Main
+		for i := 0; i < len(info.Deps); i++ {
+			if info.Deps[i].Path == modulePath {
+				mod = info.Deps[i]
+				break
+			}
+		}
+
+		if mod.Path == modulePath && mod.Version != "" && mod.Version != "(devel)" {
+			name += " " + mod.Version
+		}
 	}
 
-	client.Cmd.SendCTCPReplyf(
-		ctcp.Source.Name, CTCP_VERSION,
-		"girc (github.com/lrstanley/girc) using %s (%s, %s)",
-		runtime.Version(), runtime.GOOS, runtime.GOARCH,
+	return fmt.Sprintf(
+		"%s (%s) using %s (%s, %s)",
+		name, modulePath, runtime.Version(), runtime.GOOS, runtime.GOARCH,
 	)
 }
 
@@ -6,6 +6,7 @@ package girc
 
 import (
 	"reflect"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -181,3 +182,99 @@ func TestClearAll(t *testing.T) {
 		t.Fatalf("ctcp.ClearAll() didn't remove all handlers: 1: %v 2: %v", first, second)
 	}
 }
+
+func TestCTCPLimiter(t *testing.T) {
+	limiter := &ctcpLimiter{}
+	rate := CTCPRate{Replies: 2, Window: 50 * time.Millisecond}
+
+	if !limiter.allow(rate, "nick") || !limiter.allow(rate, "NICK") {
+		t.Fatal("ctcpLimiter.allow() denied replies under the limit")
+	}
+
+	if limiter.allow(rate, "nick") {
+		t.Fatal("ctcpLimiter.allow() allowed replies over the limit")
+	}
+
+	if !limiter.allow(rate, "other") {
+		t.Fatal("ctcpLimiter.allow() denied reply to a different source")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !limiter.allow(rate, "nick") {
+		t.Fatal("ctcpLimiter.allow() denied reply after the window passed")
+	}
+
+	// The sweep should have evicted "other", as their window has passed.
+	limiter.mu.Lock()
+	_, ok := limiter.sources["other"]
+	limiter.mu.Unlock()
+	if ok {
+		t.Fatal("ctcpLimiter.allow() didn't evict expired sources")
+	}
+
+	if !limiter.allow(CTCPRate{Replies: -1}, "nick") {
+		t.Fatal("ctcpLimiter.allow() denied reply with the limit disabled")
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	if v := c.version(); !strings.HasPrefix(v, "girc") || !strings.Contains(v, modulePath) {
+		t.Fatalf("default version = %q, should reference girc", v)
+	}
+
+	c.SetVersion("examplebot 1.0")
+	if v := c.version(); v != "examplebot 1.0" {
+		t.Fatalf("version = %q after Client.SetVersion(), wanted examplebot 1.0", v)
+	}
+
+	c.SetVersion("")
+	if v := c.version(); v != defaultVersion() {
+		t.Fatalf("version = %q after resetting, wanted default", v)
+	}
+}
+
+func TestCTCPDecoder(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	// A non-standard format, using a "!!" prefix rather than delimiters.
+	c.Config.CTCPDecoder = func(e Event) *CTCPEvent {
+		if !strings.HasPrefix(e.Trailing, "!!") {
+			return nil
+		}
+
+		split := strings.SplitN(e.Trailing[2:], " ", 2)
+		ctcp := &CTCPEvent{Command: split[0], Reply: e.Command == NOTICE}
+		if len(split) > 1 {
+			ctcp.Text = split[1]
+		}
+		return ctcp
+	}
+
+	var got []CTCPEvent
+	c.CTCP.Set("TEST", func(client *Client, event CTCPEvent) {
+		got = append(got, event)
+	})
+
+	var messages []string
+	c.OnMessage(func(c *Client, m Message) {
+		messages = append(messages, m.Text)
+	})
+
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG test :!!TEST some text"))
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG test :\x01TEST standard\x01"))
+
+	if len(got) != 1 {
+		t.Fatalf("CTCP handler called %d times, wanted 1", len(got))
+	}
+	if got[0].Text != "some text" || got[0].Source == nil || got[0].Source.Name != "nick" || got[0].Origin == nil {
+		t.Fatalf("CTCP handler received %#v, wanted Text, Source and Origin set", got[0])
+	}
+
+	// The standard format is no longer CTCP, so is a regular message.
+	if want := []string{"\x01TEST standard\x01"}; !reflect.DeepEqual(messages, want) {
+		t.Fatalf("Client.OnMessage() received %q, wanted %q", messages, want)
+	}
+}
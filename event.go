@@ -7,7 +7,9 @@ package girc
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -51,14 +53,32 @@ type Event struct {
 	// Trailing text. e.g. with a PRIVMSG, this is the message text (part
 	// after the colon.)
 	Trailing string `json:"trailing"`
-	// EmptyTrailing, if true, the text prefix (:) will be added even if
-	// Event.Trailing is empty.
+	// EmptyTrailing, if true, the text prefix (:) will always be added,
+	// even if Event.Trailing is empty. Otherwise, the prefix is only added
+	// when required: if Event.Trailing contains a space or starts with a
+	// colon. This is set for all parsed events which had a trailing prefix.
 	EmptyTrailing bool `json:"empty_trailing"`
 	// Sensitive should be true if the message is sensitive (e.g. and should
 	// not be logged/shown in debugging output).
 	Sensitive bool `json:"sensitive"`
+	// Secrets are values (e.g. passwords) within the event which are
+	// replaced with asterisks by Event.String() and Event.Pretty(), so that
+	// the rest of the event can still be logged. This doesn't affect what's
+	// sent to the server (see Event.Bytes()). Secrets of well known commands
+	// (e.g. PASS, OPER, or identifying with NickServ) are masked regardless.
+	Secrets []string `json:"-"`
 	// If the event is an echo-message response.
 	Echo bool `json:"echo"`
+
+	// stop is shared by the copies of an event passed to handlers added
+	// with Caller.AddStoppable(), see StopPropagation().
+	stop *int32
+	// historical is true if the event was received with a server-time
+	// significantly in the past, see IsHistorical().
+	historical bool
+	// raw is the line as it was received from the server (without the line
+	// ending), if the event was received from the server.
+	raw string
 }
 
 // ParseEvent takes a string and attempts to create a Event struct. Returns
@@ -89,6 +109,7 @@ func ParseEvent(raw string) (e *Event) {
 			}
 		}
 		raw = raw[i+1:]
+		i = 0
 	}
 
 	if raw[0] == messagePrefix {
@@ -159,10 +180,9 @@ func ParseEvent(raw string) (e *Event) {
 
 	e.Trailing = raw[i+1:]
 
-	// We need to re-encode the trailing argument even if it was empty.
-	if len(e.Trailing) <= 0 {
-		e.EmptyTrailing = true
-	}
+	// Re-encode the trailing argument exactly as it was received, even if it
+	// was empty or a single word.
+	e.EmptyTrailing = true
 
 	return e
 }
@@ -175,18 +195,29 @@ func (e *Event) Copy() *Event {
 		return nil
 	}
 
-	newEvent := &Event{
+	// The event and its source are allocated together, as events are
+	// copied for every handler.
+	alloc := &struct {
+		event  Event
+		source Source
+	}{}
+
+	newEvent := &alloc.event
+	*newEvent = Event{
 		Timestamp:     e.Timestamp,
 		Command:       e.Command,
 		Trailing:      e.Trailing,
 		EmptyTrailing: e.EmptyTrailing,
 		Sensitive:     e.Sensitive,
+		Secrets:       e.Secrets,
 		Echo:          e.Echo,
+		historical:    e.historical,
 	}
 
 	// Copy Source field, as it's a pointer and needs to be dereferenced.
 	if e.Source != nil {
-		newEvent.Source = e.Source.Copy()
+		alloc.source = *e.Source
+		newEvent.Source = &alloc.source
 	}
 
 	// Copy Params in order to dereference as well.
@@ -197,7 +228,7 @@ func (e *Event) Copy() *Event {
 
 	// Copy tags as necessary.
 	if e.Tags != nil {
-		newEvent.Tags = Tags{}
+		newEvent.Tags = make(Tags, len(e.Tags))
 		for k, v := range e.Tags {
 			newEvent.Tags[k] = v
 		}
@@ -206,6 +237,15 @@ func (e *Event) Copy() *Event {
 	return newEvent
 }
 
+// StopPropagation prevents the event from being passed to any further
+// handlers. This only has an effect when called from a handler added with
+// Caller.AddStoppable(), see there for which handlers are skipped.
+func (e *Event) StopPropagation() {
+	if e.stop != nil {
+		atomic.StoreInt32(e.stop, 1)
+	}
+}
+
 // Equals compares two Events for equality.
 func (e *Event) Equals(ev *Event) bool {
 	if e.Command != ev.Command || e.Trailing != ev.Trailing || len(e.Params) != len(ev.Params) {
@@ -250,8 +290,11 @@ func (e *Event) Len() (length int) {
 	}
 
 	if len(e.Trailing) > 0 || e.EmptyTrailing {
-		// Include prefix and space.
-		length += len(e.Trailing) + 2
+		// Include space, and prefix if needed.
+		length += len(e.Trailing) + 1
+		if e.trailingPrefix() {
+			length++
+		}
 	}
 
 	return
@@ -289,7 +332,9 @@ func (e *Event) Bytes() []byte {
 
 	if len(e.Trailing) > 0 || e.EmptyTrailing {
 		buffer.WriteByte(eventSpace)
-		buffer.WriteByte(messagePrefix)
+		if e.trailingPrefix() {
+			buffer.WriteByte(messagePrefix)
+		}
 		buffer.WriteString(e.Trailing)
 	}
 
@@ -300,9 +345,10 @@ func (e *Event) Bytes() []byte {
 
 	out := buffer.Bytes()
 
-	// Strip newlines and carriage returns.
+	// Strip newlines, carriage returns and NUL bytes, which would otherwise
+	// allow injecting additional commands. Also see Config.RejectUnsafe.
 	for i := 0; i < len(out); i++ {
-		if out[i] == '\n' || out[i] == '\r' {
+		if out[i] == '\n' || out[i] == '\r' || out[i] == 0 {
 			out = append(out[:i], out[i+1:]...)
 			i-- // Decrease the index so we can pick up where we left off.
 		}
@@ -311,21 +357,120 @@ func (e *Event) Bytes() []byte {
 	return out
 }
 
+// trailingPrefix returns true if the trailing text needs the trailing prefix
+// (:), i.e. if it's empty, contains a space, starts with a colon, or
+// EmptyTrailing forces it.
+func (e *Event) trailingPrefix() bool {
+	return e.EmptyTrailing || len(e.Trailing) == 0 ||
+		e.Trailing[0] == messagePrefix || strings.IndexByte(e.Trailing, eventSpace) >= 0
+}
+
+// isUnsafe returns true if the command, params, trailing or source of the
+// event contain characters which would terminate the line (CR, LF or NUL).
+func (e *Event) isUnsafe() bool {
+	const unsafe = "\r\n\x00"
+
+	if strings.ContainsAny(e.Command, unsafe) || strings.ContainsAny(e.Trailing, unsafe) {
+		return true
+	}
+
+	for i := 0; i < len(e.Params); i++ {
+		if strings.ContainsAny(e.Params[i], unsafe) {
+			return true
+		}
+	}
+
+	return e.Source != nil && strings.ContainsAny(e.Source.String(), unsafe)
+}
+
 // String returns a string representation of this event. Strips all newlines
-// and carriage returns.
+// and carriage returns. Secrets are masked, see Event.Secrets.
 func (e *Event) String() string {
-	return string(e.Bytes())
+	return e.mask(string(e.Bytes()))
+}
+
+// maskedSecret replaces secrets in Event.String() and Event.Pretty().
+const maskedSecret = "****"
+
+// servicesSecretCmds are commands sent to NickServ, where the last word is
+// a password.
+var servicesSecretCmds = []string{"IDENTIFY", "ID", "GHOST", "RECOVER", "RELEASE"}
+
+// secrets returns Event.Secrets, along with the secrets of well known
+// commands.
+func (e *Event) secrets() []string {
+	secrets := e.Secrets[:len(e.Secrets):len(e.Secrets)]
+
+	switch e.Command {
+	case PASS:
+		secrets = append(secrets, eventArgs(e)...)
+	case OPER:
+		if args := eventArgs(e); len(args) > 1 {
+			secrets = append(secrets, args[1:]...)
+		}
+	case PRIVMSG:
+		if len(e.Params) == 0 {
+			break
+		}
+
+		target := e.Params[0]
+		if sep := strings.IndexByte(target, '@'); sep > 0 {
+			target = target[:sep]
+		}
+
+		if !strings.EqualFold(target, "NickServ") {
+			break
+		}
+
+		words := strings.Fields(e.Trailing)
+		if len(words) < 2 {
+			break
+		}
+
+		for i := 0; i < len(servicesSecretCmds); i++ {
+			if strings.EqualFold(words[0], servicesSecretCmds[i]) {
+				secrets = append(secrets, words[len(words)-1])
+				break
+			}
+		}
+	}
+
+	return secrets
+}
+
+// mask replaces any secrets of the event within out with asterisks.
+func (e *Event) mask(out string) string {
+	secrets := e.secrets()
+	for i := 0; i < len(secrets); i++ {
+		if secrets[i] != "" {
+			out = strings.Replace(out, secrets[i], maskedSecret, -1)
+		}
+	}
+
+	return out
 }
 
 // Pretty returns a prettified string of the event. If the event doesn't
 // support prettification, ok is false. Pretty is not just useful to make
 // an event prettier, but also to filter out events that most don't visually
 // see in normal IRC clients. e.g. most clients don't show WHO queries.
+//
+// Secrets are masked, see Event.Secrets.
 func (e *Event) Pretty() (out string, ok bool) {
 	if e.Sensitive || e.Echo {
 		return "", false
 	}
 
+	if out, ok = e.pretty(); ok {
+		out = e.mask(out)
+	}
+
+	return out, ok
+}
+
+// pretty returns the unmasked output of Event.Pretty().
+func (e *Event) pretty() (out string, ok bool) {
+
 	if e.Command == ERROR {
 		return fmt.Sprintf("[*] an error occurred: %s", e.Trailing), true
 	}
@@ -354,6 +499,14 @@ func (e *Event) Pretty() (out string, ok bool) {
 		return fmt.Sprintf("[*] successfully connected to %s", e.Trailing), true
 	}
 
+	if e.Command == DISCONNECTED && len(e.Params) > 0 {
+		if e.Trailing != "" {
+			return fmt.Sprintf("[*] disconnected from %s: %s", e.Params[0], e.Trailing), true
+		}
+
+		return fmt.Sprintf("[*] disconnected from %s", e.Params[0]), true
+	}
+
 	if (e.Command == PRIVMSG || e.Command == NOTICE) && len(e.Params) > 0 {
 		if ctcp := DecodeCTCP(e); ctcp != nil {
 			if ctcp.Reply {
@@ -375,16 +528,34 @@ func (e *Event) Pretty() (out string, ok bool) {
 		return "[*] " + e.Trailing, true
 	}
 
+	if e.Command == RPL_LUSERME || e.Command == RPL_LOCALUSERS ||
+		e.Command == RPL_GLOBALUSERS || e.Command == RPL_NOWAWAY ||
+		e.Command == RPL_UNAWAY || e.Command == RPL_HOSTHIDDEN {
+		if len(e.Trailing) > 0 {
+			return "[*] " + e.Trailing, true
+		}
+
+		return "", false
+	}
+
 	if e.Command == JOIN && len(e.Params) > 0 {
 		return fmt.Sprintf("[*] %s (%s) has joined %s", e.Source.Name, e.Source.Host, e.Params[0]), true
 	}
 
 	if e.Command == PART && len(e.Params) > 0 {
-		return fmt.Sprintf("[*] %s (%s) has left %s (%s)", e.Source.Name, e.Source.Host, e.Params[0], e.Trailing), true
+		if len(e.Trailing) > 0 {
+			return fmt.Sprintf("[*] %s (%s) has left %s (%s)", e.Source.Name, e.Source.Host, e.Params[0], e.Trailing), true
+		}
+
+		return fmt.Sprintf("[*] %s (%s) has left %s", e.Source.Name, e.Source.Host, e.Params[0]), true
 	}
 
 	if e.Command == QUIT {
-		return fmt.Sprintf("[*] %s has quit (%s)", e.Source.Name, e.Trailing), true
+		if len(e.Trailing) > 0 {
+			return fmt.Sprintf("[*] %s has quit (%s)", e.Source.Name, e.Trailing), true
+		}
+
+		return fmt.Sprintf("[*] %s has quit", e.Source.Name), true
 	}
 
 	if e.Command == INVITE && len(e.Params) == 1 {
@@ -392,11 +563,12 @@ func (e *Event) Pretty() (out string, ok bool) {
 	}
 
 	if e.Command == KICK && len(e.Params) >= 2 {
-		if e.Trailing == "" && len(e.Params) == 3 {
-			e.Trailing = e.Params[2]
+		reason := e.Trailing
+		if reason == "" && len(e.Params) == 3 {
+			reason = e.Params[2]
 		}
 
-		return fmt.Sprintf("[%s] *** %s has kicked %s: %s", e.Params[0], e.Source.Name, e.Params[1], e.Trailing), true
+		return fmt.Sprintf("[%s] *** %s has kicked %s: %s", e.Params[0], e.Source.Name, e.Params[1], reason), true
 	}
 
 	if e.Command == NICK {
@@ -414,11 +586,29 @@ func (e *Event) Pretty() (out string, ok bool) {
 	}
 
 	if e.Command == TOPIC && len(e.Params) > 0 {
+		if len(e.Trailing) == 0 {
+			return fmt.Sprintf("[%s] *** %s has cleared the topic", e.Params[len(e.Params)-1], e.Source.Name), true
+		}
+
 		return fmt.Sprintf("[%s] *** %s has set the topic to: %s", e.Params[len(e.Params)-1], e.Source.Name, e.Trailing), true
 	}
 
-	if e.Command == MODE && len(e.Params) > 2 {
-		return fmt.Sprintf("[%s] *** %s set modes: %s", e.Params[0], e.Source.Name, strings.Join(e.Params[1:], " ")), true
+	if e.Command == MODE && len(e.Params) > 0 {
+		// Some servers send user modes as the trailing parameter.
+		modes := e.Params[1:]
+		if len(e.Trailing) > 0 {
+			modes = append(modes[:len(modes):len(modes)], e.Trailing)
+		}
+
+		if len(modes) == 0 {
+			return "", false
+		}
+
+		if IsValidChannel(e.Params[0]) {
+			return fmt.Sprintf("[%s] *** %s set modes: %s", e.Params[0], e.Source.Name, strings.Join(modes, " ")), true
+		}
+
+		return fmt.Sprintf("[*] %s set modes on %s: %s", e.Source.Name, e.Params[0], strings.Join(modes, " ")), true
 	}
 
 	if e.Command == CAP_AWAY {
@@ -445,10 +635,56 @@ func (e *Event) Pretty() (out string, ok bool) {
 		return fmt.Sprintf("[*] topic for %s is: %s", e.Params[len(e.Params)-1], e.Trailing), true
 	}
 
+	if e.Command == RPL_NOTOPIC && len(e.Params) > 1 {
+		return fmt.Sprintf("[*] no topic is set for %s", e.Params[1]), true
+	}
+
+	if e.Command == RPL_TOPICWHOTIME && len(e.Params) > 3 {
+		if unix, err := strconv.ParseInt(e.Params[3], 10, 64); err == nil {
+			return fmt.Sprintf("[*] topic for %s set by %s at %s", e.Params[1], e.Params[2], time.Unix(unix, 0).Format(time.RFC1123)), true
+		}
+
+		return fmt.Sprintf("[*] topic for %s set by %s", e.Params[1], e.Params[2]), true
+	}
+
+	if e.Command == RPL_UMODEIS && len(e.Params) > 1 {
+		return fmt.Sprintf("[*] your user modes are: %s", strings.Join(e.Params[1:], " ")), true
+	}
+
+	if e.Command == RPL_AWAY && len(e.Params) > 1 {
+		return fmt.Sprintf("[*] %s is away: %s", e.Params[1], e.Trailing), true
+	}
+
+	if e.Command == RPL_WHOISUSER && len(e.Params) > 3 {
+		return fmt.Sprintf("[*] %s is %s@%s (%s)", e.Params[1], e.Params[2], e.Params[3], e.Trailing), true
+	}
+
+	if e.Command == RPL_WHOISSERVER && len(e.Params) > 2 {
+		return fmt.Sprintf("[*] %s is connected to %s (%s)", e.Params[1], e.Params[2], e.Trailing), true
+	}
+
+	if e.Command == RPL_WHOISACCOUNT && len(e.Params) > 2 {
+		return fmt.Sprintf("[*] %s is logged in as %s", e.Params[1], e.Params[2]), true
+	}
+
+	if e.Command == RPL_WHOISCHANNELS && len(e.Params) > 1 && len(e.Trailing) > 0 {
+		return fmt.Sprintf("[*] %s is in %s", e.Params[1], e.Trailing), true
+	}
+
 	if e.Command == CAP && len(e.Params) == 2 && len(e.Trailing) > 1 && e.Params[1] == CAP_ACK {
 		return "[*] enabling capabilities: " + e.Trailing, true
 	}
 
+	if IsError(e.Command) && len(e.Trailing) > 0 {
+		// The first parameter is our nickname, the rest are usually what the
+		// error relates to (e.g. the channel or nickname).
+		if len(e.Params) > 1 {
+			return fmt.Sprintf("[!] %s: %s", strings.Join(e.Params[1:], " "), e.Trailing), true
+		}
+
+		return "[!] " + e.Trailing, true
+	}
+
 	return "", false
 }
 
@@ -483,6 +719,28 @@ func (e *Event) IsFromChannel() bool {
 	return true
 }
 
+// StatusMessage checks to see if a message was sent to a channel with a
+// status prefix (STATUSMSG), e.g. "@#channel", meaning only members with
+// that status (or higher) received it. If so, the prefix (e.g. "@") and the
+// channel (e.g. "#channel") are returned. See also
+// Commands.MessageStatus().
+func (e *Event) StatusMessage() (prefix, channel string, ok bool) {
+	if e.Source == nil || (e.Command != PRIVMSG && e.Command != NOTICE) || len(e.Params) < 1 {
+		return "", "", false
+	}
+
+	target := e.Params[0]
+	if len(target) < 2 || !strings.ContainsRune(statusPrefixes, rune(target[0])) {
+		return "", "", false
+	}
+
+	if !IsValidChannel(target[1:]) {
+		return "", "", false
+	}
+
+	return target[:1], target[1:], true
+}
+
 // IsFromUser checks to see if a message was from a user (rather than a
 // channel).
 func (e *Event) IsFromUser() bool {
@@ -497,6 +755,34 @@ func (e *Event) IsFromUser() bool {
 	return true
 }
 
+// IsHistorical returns true if the event was received from the server with a
+// server-time (the "time" tag) older than Config.HistoricalThreshold, e.g.
+// backlog played back by a bouncer, or history sent when joining a channel.
+// Clients may want to render such events differently, or not respond to
+// them. Always false for events which weren't received from the server.
+func (e *Event) IsHistorical() bool {
+	return e.historical
+}
+
+// IsServerNotice checks to see if the event is a NOTICE sent by the server
+// itself, rather than a user or service. This includes the notices sent
+// during connection, before registration has completed (e.g.
+// "NOTICE AUTH :*** Looking up your hostname..."), which are sent to "*" or
+// "AUTH". See also Client.IsRegistered().
+func (e *Event) IsServerNotice() bool {
+	if e.Command != NOTICE {
+		return false
+	}
+
+	// Some servers don't send a prefix at all for pre-registration notices.
+	if e.Source == nil {
+		return true
+	}
+
+	// Nicknames can't contain ".", however server names generally do.
+	return e.Source.IsServer() && strings.Contains(e.Source.Name, ".")
+}
+
 // StripAction returns the stripped version of the action encoding from a
 // PRIVMSG ACTION (/me).
 func (e *Event) StripAction() string {
@@ -515,6 +801,10 @@ const (
 
 // Source represents the sender of an IRC event, see RFC1459 section 2.3.1.
 // <servername> | <nick> [ '!' <user> ] [ '@' <host> ]
+//
+// Source is populated by ParseEvent(), and Source.String() (and Bytes())
+// reproduces the original prefix. See Source.IsServer() and
+// Source.IsHostmask() to determine what kind of source it is.
 type Source struct {
 	// Name is the nickname, server name, or service name.
 	Name string `json:"name"`
@@ -6,6 +6,7 @@ package girc
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -126,6 +127,38 @@ func TestParseEvent(t *testing.T) {
 	}
 }
 
+func TestEventTrailingPrefix(t *testing.T) {
+	cases := []struct {
+		event *Event
+		want  string
+	}{
+		{&Event{Command: MODE, Params: []string{"#channel"}}, "MODE #channel"},
+		{&Event{Command: JOIN, Params: []string{"0"}}, "JOIN 0"},
+		{&Event{Command: USER, Params: []string{"test", "*", "*"}, Trailing: "name"}, "USER test * * name"},
+		{&Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: "two words"}, "PRIVMSG #channel :two words"},
+		{&Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: ":colon"}, "PRIVMSG #channel ::colon"},
+		{&Event{Command: AWAY, EmptyTrailing: true}, "AWAY :"},
+		{&Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: "forced", EmptyTrailing: true}, "PRIVMSG #channel :forced"},
+	}
+
+	for _, tt := range cases {
+		if got := tt.event.String(); got != tt.want {
+			t.Errorf("Event.String() = %q, wanted %q", got, tt.want)
+		}
+
+		if tt.event.Len() != len(tt.want) {
+			t.Errorf("Event.Len() = %d for %q, wanted %d", tt.event.Len(), tt.want, len(tt.want))
+		}
+	}
+
+	// Parsed events should be re-encoded as they were received.
+	for _, raw := range []string{":nick!user@host PRIVMSG #channel :hello", "MODE #channel +o nick", "PING :"} {
+		if got := ParseEvent(raw).String(); got != raw {
+			t.Errorf("ParseEvent(%q).String() = %q", raw, got)
+		}
+	}
+}
+
 func TestEventCopy(t *testing.T) {
 	var nilEvent *Event
 
@@ -188,6 +221,31 @@ func TestEventIs(t *testing.T) {
 	if !event.IsFromUser() {
 		t.Fatalf("Event.IsFromUser: returned false on %#v", event)
 	}
+	for raw, want := range map[string]bool{
+		"NOTICE AUTH :*** Looking up your hostname...":           true,
+		":irc.example.com NOTICE * :*** Checking Ident":          true,
+		":irc.example.com NOTICE test :Server is restarting":     true,
+		":nick!user@host NOTICE test :hello":                     false,
+		":NickServ!NickServ@services. NOTICE test :Identify now": false,
+		":irc.example.com PRIVMSG test :not a notice":            false,
+	} {
+		if got := ParseEvent(raw).IsServerNotice(); got != want {
+			t.Errorf("Event.IsServerNotice() = %t on %q, wanted %t", got, raw, want)
+		}
+	}
+
+	for raw, want := range map[string]string{
+		":nick!user@host PRIVMSG @#test :ops only": "@#test",
+		":nick!user@host NOTICE +#test :voiced":    "+#test",
+		":nick!user@host PRIVMSG #test :everyone":  "",
+		":nick!user@host PRIVMSG +test :modeless":  "",
+		":nick!user@host PRIVMSG @nick :nope":      "",
+	} {
+		prefix, channel, ok := ParseEvent(raw).StatusMessage()
+		if got := prefix + channel; ok != (want != "") || got != want {
+			t.Errorf("Event.StatusMessage() = %q, %t on %q, wanted %q", got, ok, raw, want)
+		}
+	}
 }
 
 func TestEventSourceTagEquals(t *testing.T) {
@@ -248,3 +306,105 @@ func TestEventSourceTagEquals(t *testing.T) {
 		}
 	}
 }
+
+func TestEventPretty(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: ":nick!user@host.com JOIN #chan", want: "[*] nick (host.com) has joined #chan"},
+		{raw: ":nick!user@host.com PART #chan", want: "[*] nick (host.com) has left #chan"},
+		{raw: ":nick!user@host.com PART #chan :bye", want: "[*] nick (host.com) has left #chan (bye)"},
+		{raw: ":nick!user@host.com QUIT", want: "[*] nick has quit"},
+		{raw: ":nick!user@host.com KICK #chan other :spam", want: "[#chan] *** nick has kicked other: spam"},
+		{raw: ":nick!user@host.com NICK :other", want: "[*] nick is now known as other"},
+		{raw: ":nick!user@host.com MODE #chan +m", want: "[#chan] *** nick set modes: +m"},
+		{raw: ":nick!user@host.com MODE #chan +o other", want: "[#chan] *** nick set modes: +o other"},
+		{raw: ":nick MODE nick :+i", want: "[*] nick set modes on nick: +i"},
+		{raw: ":nick!user@host.com TOPIC #chan :", want: "[#chan] *** nick has cleared the topic"},
+		{raw: ":dummy.int 331 nick #chan :No topic is set", want: "[*] no topic is set for #chan"},
+		{raw: ":dummy.int 301 nick other :gone", want: "[*] other is away: gone"},
+		{raw: ":dummy.int 311 nick other user host.com * :Real Name", want: "[*] other is user@host.com (Real Name)"},
+		{raw: ":dummy.int 475 nick #chan :Cannot join channel (+k)", want: "[!] #chan: Cannot join channel (+k)"},
+		{raw: ":dummy.int 422 nick :MOTD File is missing", want: "[!] MOTD File is missing"},
+	}
+
+	for _, tt := range tests {
+		event := ParseEvent(tt.raw)
+		got, ok := event.Pretty()
+		if !ok {
+			t.Errorf("Event.Pretty() for %q returned !ok", tt.raw)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("Event.Pretty() for %q = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	kick := ParseEvent(":nick!user@host.com KICK #chan other reason")
+	kick.Pretty()
+	if kick.Trailing != "" {
+		t.Errorf("Event.Pretty() modified the event trailing to %q", kick.Trailing)
+	}
+
+	if _, ok := ParseEvent(":dummy.int 352 nick #chan user host.com dummy.int other H :0 Real").Pretty(); ok {
+		t.Error("Event.Pretty() should not prettify WHO replies")
+	}
+}
+
+func TestSourceRoundTrip(t *testing.T) {
+	tests := []struct {
+		raw    string
+		source string
+	}{
+		{raw: ":nick!~user@host.com PRIVMSG #channel :test", source: "nick!~user@host.com"},
+		{raw: ":nick!user PRIVMSG #channel :test", source: "nick!user"},
+		{raw: ":nick@host PRIVMSG #channel :test", source: "nick@host"},
+		{raw: ":irc.server.com NOTICE * :test", source: "irc.server.com"},
+		{raw: "@time=2020-01-01T00:00:00.000Z :a!b@c PRIVMSG #channel :test", source: "a!b@c"},
+	}
+
+	for _, tt := range tests {
+		event := ParseEvent(tt.raw)
+		if event == nil || event.Source == nil {
+			t.Fatalf("ParseEvent(%q) returned no source", tt.raw)
+		}
+
+		if got := event.String(); got != tt.raw {
+			t.Errorf("ParseEvent(%q).String() = %q", tt.raw, got)
+		}
+
+		if got := string(event.Source.Bytes()); got != tt.source {
+			t.Errorf("Source.Bytes() = %q, wanted %q", got, tt.source)
+		}
+	}
+}
+
+func TestEventSecrets(t *testing.T) {
+	for _, tt := range []struct {
+		event *Event
+		want  string
+	}{
+		{&Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: "key is hunter2", Secrets: []string{"hunter2"}}, "PRIVMSG #channel :key is ****"},
+		{&Event{Command: PASS, Params: []string{"serverpass"}}, "PASS ****"},
+		{&Event{Command: OPER, Params: []string{"user", "operpass"}}, "OPER user ****"},
+		{&Event{Command: PRIVMSG, Params: []string{"NickServ"}, Trailing: "IDENTIFY account secret"}, "PRIVMSG NickServ :IDENTIFY account ****"},
+		{&Event{Command: PRIVMSG, Params: []string{"nickserv@services.example.com"}, Trailing: "ghost nick secret"}, "PRIVMSG nickserv@services.example.com :ghost nick ****"},
+		{&Event{Command: PRIVMSG, Params: []string{"NickServ"}, Trailing: "INFO account"}, "PRIVMSG NickServ :INFO account"},
+		{&Event{Command: PRIVMSG, Params: []string{"#channel"}, Trailing: "IDENTIFY account secret"}, "PRIVMSG #channel :IDENTIFY account secret"},
+	} {
+		if got := tt.event.String(); got != tt.want {
+			t.Errorf("Event.String() = %q, wanted %q", got, tt.want)
+		}
+
+		if got := string(tt.event.Bytes()); strings.Contains(got, maskedSecret) {
+			t.Errorf("Event.Bytes() = %q, secrets shouldn't be masked", got)
+		}
+	}
+
+	event := &Event{Command: PRIVMSG, Params: []string{"NickServ"}, Trailing: "IDENTIFY secret"}
+	if pretty, ok := event.Pretty(); !ok || strings.Contains(pretty, "secret") {
+		t.Fatalf("Event.Pretty() = %q, %t, wanted the secret to be masked", pretty, ok)
+	}
+}
@@ -154,6 +154,44 @@ func StripRaw(text string) string {
 	return text
 }
 
+// ANSI escape codes used by colorPretty.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiCyan   = "\x1b[36m"
+	ansiGray   = "\x1b[90m"
+	ansiYellow = "\x1b[33m"
+)
+
+// colorPretty colorizes the leading "[...]" tag of the output of
+// Event.Pretty() using ANSI escape codes, depending on what kind of event
+// it is.
+func colorPretty(pretty string) string {
+	end := strings.IndexByte(pretty, ']')
+	if len(pretty) == 0 || pretty[0] != '[' || end < 0 {
+		return pretty
+	}
+
+	var color string
+	switch pretty[:end+1] {
+	case "[*]":
+		color = ansiCyan
+	case "[!]":
+		color = ansiRed
+	case "[>]":
+		color = ansiGray
+	default:
+		if IsValidChannel(pretty[1:end]) {
+			color = ansiGreen
+		} else {
+			color = ansiYellow
+		}
+	}
+
+	return color + pretty[:end+1] + ansiReset + pretty[end+1:]
+}
+
 // IsValidChannel validates if channel is an RFC compliant channel or not.
 //
 // NOTE: If you are using this to validate a channel that contains a channel
@@ -350,3 +388,70 @@ func Glob(input, match string) bool {
 	// Check suffix last.
 	return trailingGlob || strings.HasSuffix(input, parts[last])
 }
+
+// normalizeMask ensures mask is a full "nick!user@host" mask, e.g. "nick"
+// becomes "nick!*@*", and "*@host" becomes "*!*@host".
+func normalizeMask(mask string) string {
+	if !strings.Contains(mask, "@") {
+		if !strings.Contains(mask, "!") {
+			return mask + "!*@*"
+		}
+
+		return mask + "@*"
+	}
+
+	if !strings.Contains(mask, "!") {
+		return "*!" + mask
+	}
+
+	return mask
+}
+
+// MatchMask returns true if target (e.g. "nick!user@host") matches mask,
+// using IRC-style wildcards, where "*" matches any amount of characters, and
+// "?" matches exactly one character. Partial masks are expanded to a full
+// mask first, e.g. "nick" is treated as "nick!*@*", and "*@host" is treated
+// as "*!*@host". Matching is case-insensitive, using rfc1459 casemapping.
+// See Client.MatchMask() to use the casemapping of the server.
+func MatchMask(mask, target string) bool {
+	return wildcardMatch(ToRFC1459(normalizeMask(mask)), ToRFC1459(target))
+}
+
+// MatchMask is much like the MatchMask function, however it uses the
+// casemapping advertised by the server (CASEMAPPING).
+func (c *Client) MatchMask(mask, target string) bool {
+	return wildcardMatch(c.casefold(normalizeMask(mask)), c.casefold(target))
+}
+
+// wildcardMatch matches input against pattern, where "*" in pattern matches
+// zero or more characters, and "?" matches exactly one character.
+func wildcardMatch(pattern, input string) bool {
+	var p, i int
+	// star is the index of the last "*" seen in pattern, and mark is the
+	// index in input where we started matching after it, so we can backtrack.
+	star, mark := -1, 0
+
+	for i < len(input) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == input[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			// Let the last "*" consume one more character, and try again.
+			mark++
+			p, i = star+1, mark
+		default:
+			return false
+		}
+	}
+
+	// Any remaining pattern must only be "*".
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
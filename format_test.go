@@ -369,3 +369,48 @@ func TestGlob(t *testing.T) {
 
 	return
 }
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask   string
+		target string
+		want   bool
+	}{
+		{mask: "*!*@*", target: "nick!user@host.com", want: true},
+		{mask: "*", target: "nick!user@host.com", want: true},
+		{mask: "nick!user@host.com", target: "nick!user@host.com", want: true},
+		{mask: "NICK!USER@HOST.COM", target: "nick!user@host.com", want: true},
+		{mask: "nick[away]!*@*", target: "NICK{AWAY}!user@host.com", want: true},
+		{mask: "nick", target: "nick!user@host.com", want: true},
+		{mask: "nick", target: "nick2!user@host.com", want: false},
+		{mask: "nick!user", target: "nick!user@host.com", want: true},
+		{mask: "*@host.com", target: "nick!user@host.com", want: true},
+		{mask: "*!*@host.com", target: "nick!user@other.com", want: false},
+		{mask: "*!*@*.com", target: "nick!user@host.com", want: true},
+		{mask: "*!*@*.com", target: "nick!user@host.org", want: false},
+		{mask: "n?ck!*@*", target: "nick!user@host.com", want: true},
+		{mask: "n?ck!*@*", target: "nck!user@host.com", want: false},
+		{mask: "n??k!*@*", target: "nick!user@host.com", want: true},
+		{mask: "?!*@*", target: "n!user@host.com", want: true},
+		{mask: "?!*@*", target: "!user@host.com", want: false},
+		{mask: "*?!*@*", target: "!user@host.com", want: false},
+		{mask: "**!*@*", target: "nick!user@host.com", want: true},
+		{mask: "*nick*!*@*", target: "thenickname!user@host.com", want: true},
+		{mask: "*a*b*c!*@*", target: "xaxbxc!user@host.com", want: true},
+		{mask: "*a*b*c!*@*", target: "xaxcxb!user@host.com", want: false},
+		{mask: "*!~*@*", target: "nick!~user@host.com", want: true},
+		{mask: "*!~*@*", target: "nick!user@host.com", want: false},
+		{mask: "*!*@host.*", target: "nick!user@host.com", want: true},
+		{mask: "*!*@*host", target: "nick!user@host.host", want: true},
+		{mask: "*!*@*host", target: "nick!user@host.hos", want: false},
+		{mask: "*!*@192.168.?.*", target: "nick!user@192.168.1.50", want: true},
+		{mask: "*!*@192.168.?.*", target: "nick!user@192.168.10.50", want: false},
+		{mask: "", target: "nick!user@host.com", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchMask(tt.mask, tt.target); got != tt.want {
+			t.Errorf("MatchMask(%q, %q) = %v, want %v", tt.mask, tt.target, got, tt.want)
+		}
+	}
+}
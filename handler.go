@@ -5,6 +5,9 @@
 package girc
 
 import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"math/rand"
@@ -12,11 +15,25 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // RunHandlers manually runs handlers for a given event.
+//
+// All internal (non-background) handlers, including those registered for
+// ALL_EVENTS, complete before any external handler is executed. This means
+// state will have been updated by the time external handlers see the event.
 func (c *Client) RunHandlers(event *Event) {
+	c.runEvent(event, false)
+}
+
+// runEvent executes all handlers for event, see Client.RunHandlers(). If
+// limit is true, external handlers are limited by
+// Config.MaxHandlerConcurrency. This is only the case for events dispatched
+// from the event loop, as handlers may themselves execute handlers (e.g.
+// when updating state), which would otherwise wait on their own slot.
+func (c *Client) runEvent(event *Event, limit bool) {
 	if event == nil {
 		return
 	}
@@ -27,31 +44,77 @@ func (c *Client) RunHandlers(event *Event) {
 		prefix += "[echo-message] "
 	}
 	c.debug.Print(prefix + StripRaw(event.String()))
-	if c.Config.Out != nil {
-		if pretty, ok := event.Pretty(); ok {
-			fmt.Fprintln(c.Config.Out, StripRaw(pretty))
-		}
+
+	// Events from ignored users are only passed to internal handlers, so
+	// tracking stays accurate.
+	ignored := c.IsIgnored(*event)
+	if !ignored {
+		c.writeOut(event)
+		c.pushEvent(event)
 	}
 
-	// Background handlers first. If the event is an echo-message, then only
-	// send the echo version to ALL_EVENTS.
-	c.Handlers.exec(ALL_EVENTS, true, c, event.Copy())
-	if !event.Echo {
-		c.Handlers.exec(event.Command, true, c, event.Copy())
+	// Internal handlers first, so that all state-updating handlers (both
+	// ALL_EVENTS and the specific command) have completed before any
+	// external handler is executed. Internal background handlers are
+	// started first, however they aren't waited on.
+	c.runHandlers(true, false, event)
+
+	var stopped bool
+	if !ignored {
+		stopped = c.runHandlers(false, limit, event)
 	}
 
-	c.Handlers.exec(ALL_EVENTS, false, c, event.Copy())
-	if !event.Echo {
-		c.Handlers.exec(event.Command, false, c, event.Copy())
+	// Check if it's a CTCP. Our own CTCP messages (e.g. echo-message, or
+	// played back by a bouncer) aren't requests for us to reply to.
+	if ignored || stopped || event.Echo {
+		return
 	}
 
-	// Check if it's a CTCP.
-	if ctcp := DecodeCTCP(event.Copy()); ctcp != nil {
+	if ctcp := c.decodeCTCP(event); ctcp != nil {
+		// CTCP handlers shouldn't share the event with anything else, but
+		// there's no need to copy it unless it's actually CTCP.
+		origin := event.Copy()
+		if ctcp.Origin == event {
+			ctcp.Origin = origin
+		}
+		if ctcp.Source == event.Source {
+			ctcp.Source = origin.Source
+		}
+
 		// Execute it.
 		c.CTCP.call(c, ctcp)
 	}
 }
 
+// runHandlers executes either the internal or external handlers for event,
+// background handlers first. If the event is an echo-message, then only the
+// ALL_EVENTS handlers are executed. stopped is true if an external handler
+// stopped propagation of the event, see Event.StopPropagation(). If limit
+// is true, handlers are limited by Config.MaxHandlerConcurrency.
+func (c *Client) runHandlers(internal, limit bool, event *Event) (stopped bool) {
+	// Internal handlers can't be stopped, as state depends on them.
+	var stop *int32
+	if !internal {
+		stop = new(int32)
+	}
+
+	c.Handlers.exec(ALL_EVENTS, true, internal, limit, c, event, stop)
+	if !event.Echo {
+		c.Handlers.exec(event.Command, true, internal, limit, c, event, stop)
+	}
+
+	c.Handlers.exec(ALL_EVENTS, false, internal, limit, c, event, stop)
+	if stop != nil && atomic.LoadInt32(stop) != 0 {
+		return true
+	}
+
+	if !event.Echo {
+		c.Handlers.exec(event.Command, false, internal, limit, c, event, stop)
+	}
+
+	return stop != nil && atomic.LoadInt32(stop) != 0
+}
+
 // Handler is lower level implementation of a handler. See
 // Caller.AddHandler()
 type Handler interface {
@@ -69,8 +132,20 @@ func (f HandlerFunc) Execute(client *Client, event Event) {
 
 // Caller manages internal and external (user facing) handlers.
 type Caller struct {
+	// externalLen and internalLen are the total amount of external and
+	// internal handlers. These are only updated while mu is held, however
+	// must be accessed atomically, as they are read without holding mu. They
+	// are first in the struct to ensure 64-bit alignment.
+	externalLen int64
+	internalLen int64
 	// mu is the mutex that should be used when accessing handlers.
 	mu sync.RWMutex
+	// running is the amount of handlers currently executing, including
+	// background handlers. idle is closed once running drops back to 0, see
+	// drain. Both are guarded by runningMu.
+	runningMu sync.Mutex
+	running   int
+	idle      chan struct{}
 
 	// external/internal keys are of structure:
 	//   map[COMMAND][CUID]Handler
@@ -82,6 +157,14 @@ type Caller struct {
 	internal map[string]map[string]Handler
 	// debug is the clients logger used for debugging.
 	debug *log.Logger
+	// sem limits the amount of concurrently executing handlers, if
+	// Config.MaxHandlerConcurrency is set. It is created on first use, see
+	// acquire.
+	sem     chan struct{}
+	semOnce sync.Once
+	// rand is used to generate handler uids, and is shared with the client
+	// (see Config.RandSource).
+	rand *rand.Rand
 }
 
 // newCaller creates and initializes a new handler.
@@ -90,62 +173,85 @@ func newCaller(debugOut *log.Logger) *Caller {
 		external: map[string]map[string]Handler{},
 		internal: map[string]map[string]Handler{},
 		debug:    debugOut,
+		rand:     rand.New(&lockedSource{src: rand.NewSource(randSeed())}),
 	}
 
 	return c
 }
 
-// Len returns the total amount of user-entered registered handlers.
-func (c *Caller) Len() int {
-	var total int
-
-	c.mu.RLock()
-	for command := range c.external {
-		total += len(c.external[command])
+// randSeed returns a seed for a new random source. This uses crypto/rand,
+// so many clients created at the same time don't end up with the same seed.
+func randSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
 	}
-	c.mu.RUnlock()
 
-	return total
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// lockedSource makes a rand.Source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// Len returns the total amount of user-entered registered handlers.
+func (c *Caller) Len() int {
+	return int(atomic.LoadInt64(&c.externalLen))
 }
 
 // Count is much like Caller.Len(), however it counts the number of
 // registered handlers for a given command.
 func (c *Caller) Count(cmd string) int {
-	var total int
+	c.mu.RLock()
+	total := len(c.external[normalizeCommand(cmd)])
+	c.mu.RUnlock()
 
-	cmd = strings.ToUpper(cmd)
+	return total
+}
 
+// Counts returns the number of user-entered registered handlers for each
+// command which has at least one handler registered.
+func (c *Caller) Counts() map[string]int {
 	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := make(map[string]int, len(c.external))
 	for command := range c.external {
-		if command == cmd {
-			total += len(c.external[command])
+		if n := len(c.external[command]); n > 0 {
+			counts[command] = n
 		}
 	}
-	c.mu.RUnlock()
 
-	return total
+	return counts
 }
 
 func (c *Caller) String() string {
-	var total int
-
-	c.mu.RLock()
-	for cmd := range c.internal {
-		total += len(c.internal[cmd])
-	}
-	c.mu.RUnlock()
-
-	return fmt.Sprintf("<Caller external:%d internal:%d>", c.Len(), total)
+	return fmt.Sprintf("<Caller external:%d internal:%d>", c.Len(), atomic.LoadInt64(&c.internalLen))
 }
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 // cuid generates a unique UID string for each handler for ease of removal.
+// This must be called while c.mu is held.
 func (c *Caller) cuid(cmd string, n int) (cuid, uid string) {
 	b := make([]byte, n)
 
 	for i := range b {
-		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
+		b[i] = letterBytes[c.rand.Int63()%int64(len(letterBytes))]
 	}
 
 	return cmd + ":" + string(b), string(b)
@@ -167,82 +273,163 @@ type execStack struct {
 	cuid string
 }
 
-// exec executes all handlers pertaining to specified event. Internal first,
-// then external.
+// exec executes all handlers pertaining to specified event. If internal is
+// true, only internal handlers are executed, otherwise only external
+// handlers are executed. stop (if not nil) is set by handlers added with
+// Caller.AddStoppable() to stop propagation.
 //
 // Please note that there is no specific order/priority for which the handlers
 // are executed.
-func (c *Caller) exec(command string, bg bool, client *Client, event *Event) {
+func (c *Caller) exec(command string, bg, internal, limit bool, client *Client, event *Event, stop *int32) {
+	command = normalizeCommand(command)
+
 	// Build a stack of handlers which can be executed concurrently.
 	var stack []execStack
 
 	c.mu.RLock()
-	// Get internal handlers first.
-	if _, ok := c.internal[command]; ok {
-		for cuid := range c.internal[command] {
-			if (strings.HasSuffix(cuid, ":bg") && !bg) || (!strings.HasSuffix(cuid, ":bg") && bg) {
-				continue
-			}
-
-			stack = append(stack, execStack{c.internal[command][cuid], cuid})
-		}
+	handlers := c.external
+	if internal {
+		handlers = c.internal
 	}
 
-	// Then external handlers.
-	if _, ok := c.external[command]; ok {
-		for cuid := range c.external[command] {
-			if (strings.HasSuffix(cuid, ":bg") && !bg) || (!strings.HasSuffix(cuid, ":bg") && bg) {
-				continue
-			}
-
-			stack = append(stack, execStack{c.external[command][cuid], cuid})
+	for cuid := range handlers[command] {
+		if (strings.HasSuffix(cuid, ":bg") && !bg) || (!strings.HasSuffix(cuid, ":bg") && bg) {
+			continue
 		}
+
+		stack = append(stack, execStack{handlers[command][cuid], cuid})
 	}
 	c.mu.RUnlock()
 
+	if len(stack) == 0 {
+		return
+	}
+
 	// Run all handlers concurrently across the same event. This should
 	// still help prevent mis-ordered events, while speeding up the
 	// execution speed.
 	var wg sync.WaitGroup
-	wg.Add(len(stack))
+	c.started(len(stack))
 	for i := 0; i < len(stack); i++ {
-		go func(index int) {
-			defer wg.Done()
-			c.debug.Printf("[%d/%d] exec %s => %s", index+1, len(stack), stack[index].cuid, command)
-			start := time.Now()
+		if !bg {
+			wg.Add(1)
+		}
+
+		// Each handler gets its own copy of the event, so handlers can't
+		// modify the event seen by any other handler. event itself is never
+		// passed to a handler.
+		copied := event.Copy()
+		if _, ok := stack[i].Handler.(stoppableHandler); ok {
+			copied.stop = stop
+		}
 
-			if bg {
-				go func() {
-					if client.Config.RecoverFunc != nil {
-						defer recoverHandlerPanic(client, event, stack[index].cuid, 3)
-					}
+		// Handlers which others may be waiting on aren't limited, as they
+		// may otherwise never get a slot.
+		_, wait := stack[i].Handler.(waitHandler)
+		limited := limit && !wait
 
-					stack[index].Execute(client, *event)
-					c.debug.Printf("[%d/%d] done %s == %s", index+1, len(stack), stack[index].cuid, time.Since(start))
-				}()
+		go func(index int, event *Event) {
+			defer c.finished()
+			if !bg {
+				defer wg.Done()
+			}
 
-				return
+			if limited {
+				// Blocks if Config.MaxHandlerConcurrency handlers are
+				// already executing.
+				c.acquire(client)
+				defer c.release()
 			}
 
-			if client.Config.RecoverFunc != nil {
+			c.debug.Printf("[%d/%d] exec %s => %s", index+1, len(stack), stack[index].cuid, command)
+			start := time.Now()
+
+			if client.recoverPanics() {
 				defer recoverHandlerPanic(client, event, stack[index].cuid, 3)
 			}
 
 			stack[index].Execute(client, *event)
 			c.debug.Printf("[%d/%d] done %s == %s", index+1, len(stack), stack[index].cuid, time.Since(start))
-		}(i)
+		}(i, copied)
 	}
 
-	// Wait for all of the handlers to complete. Not doing this may cause
-	// new events from becoming ahead of older handlers.
+	// Wait for all of the non-background handlers to complete. Not doing
+	// this may cause new events from becoming ahead of older handlers.
 	wg.Wait()
 }
 
+// acquire blocks until another handler can be executed, based on
+// Config.MaxHandlerConcurrency. Every call must be followed by a call to
+// release, once the handler has completed.
+func (c *Caller) acquire(client *Client) {
+	c.semOnce.Do(func() {
+		if client.Config.MaxHandlerConcurrency > 0 {
+			c.sem = make(chan struct{}, client.Config.MaxHandlerConcurrency)
+		}
+	})
+
+	if c.sem != nil {
+		c.sem <- struct{}{}
+	}
+}
+
+// release frees up a slot acquired with acquire.
+func (c *Caller) release() {
+	if c.sem != nil {
+		<-c.sem
+	}
+}
+
+// started marks n handlers as executing.
+func (c *Caller) started(n int) {
+	c.runningMu.Lock()
+	if c.running == 0 {
+		c.idle = make(chan struct{})
+	}
+	c.running += n
+	c.runningMu.Unlock()
+}
+
+// finished marks a handler started with started as completed, waking up
+// drain if it was the last one.
+func (c *Caller) finished() {
+	c.runningMu.Lock()
+	c.running--
+	if c.running == 0 {
+		close(c.idle)
+	}
+	c.runningMu.Unlock()
+}
+
+// drain waits for all currently executing handlers (including background
+// handlers) to complete, up to timeout. Returns false if timeout elapsed
+// before all handlers completed.
+func (c *Caller) drain(timeout time.Duration) bool {
+	c.runningMu.Lock()
+	if c.running == 0 {
+		c.runningMu.Unlock()
+		return true
+	}
+	idle := c.idle
+	c.runningMu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
 // ClearAll clears all external handlers currently setup within the client.
 // This ignores internal handlers.
 func (c *Caller) ClearAll() {
 	c.mu.Lock()
 	c.external = map[string]map[string]Handler{}
+	atomic.StoreInt64(&c.externalLen, 0)
 	c.mu.Unlock()
 
 	c.debug.Print("cleared all external handlers")
@@ -253,6 +440,7 @@ func (c *Caller) ClearAll() {
 func (c *Caller) clearInternal() {
 	c.mu.Lock()
 	c.internal = map[string]map[string]Handler{}
+	atomic.StoreInt64(&c.internalLen, 0)
 	c.mu.Unlock()
 
 	c.debug.Print("cleared all internal handlers")
@@ -261,10 +449,11 @@ func (c *Caller) clearInternal() {
 // Clear clears all of the handlers for the given event.
 // This ignores internal handlers.
 func (c *Caller) Clear(cmd string) {
-	cmd = strings.ToUpper(cmd)
+	cmd = normalizeCommand(cmd)
 
 	c.mu.Lock()
-	if _, ok := c.external[cmd]; ok {
+	if handlers, ok := c.external[cmd]; ok {
+		atomic.AddInt64(&c.externalLen, -int64(len(handlers)))
 		delete(c.external, cmd)
 	}
 	c.mu.Unlock()
@@ -283,6 +472,33 @@ func (c *Caller) Remove(cuid string) (success bool) {
 	return success
 }
 
+// RemoveWhere removes all handlers for cmd where pred returns true for the
+// handlers cuid, returning the amount of handlers removed. Useful for
+// removing a group of handlers without keeping track of each cuid. This
+// ignores internal handlers. Note that pred is called while handlers are
+// locked, so it must not call any Caller methods.
+func (c *Caller) RemoveWhere(cmd string, pred func(cuid string) bool) (removed int) {
+	cmd = normalizeCommand(cmd)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for uid := range c.external[cmd] {
+		cuid := cmd + ":" + uid
+		if !pred(cuid) {
+			continue
+		}
+
+		delete(c.external[cmd], uid)
+		c.debug.Printf("removed handler %s", cuid)
+		removed++
+	}
+
+	atomic.AddInt64(&c.externalLen, -int64(removed))
+
+	return removed
+}
+
 // remove is much like Remove, however is NOT concurrency safe. Lock Caller.mu
 // on your own.
 func (c *Caller) remove(cuid string) (success bool) {
@@ -302,6 +518,7 @@ func (c *Caller) remove(cuid string) (success bool) {
 	}
 
 	delete(c.external[cmd], uid)
+	atomic.AddInt64(&c.externalLen, -1)
 	c.debug.Printf("removed handler %s", cuid)
 
 	// Assume success.
@@ -318,17 +535,38 @@ func (c *Caller) sregister(internal, bg bool, cmd string, handler Handler) (cuid
 	return cuid
 }
 
+// sregisterTo is much like Caller.sregister(), except that cuid is stored in
+// dst before the Caller mutex is unlocked, so that handlers which refer to
+// their own cuid can't be executed before it's set.
+func (c *Caller) sregisterTo(dst *string, internal, bg bool, cmd string, handler Handler) {
+	c.mu.Lock()
+	*dst = c.register(internal, bg, cmd, handler)
+	c.mu.Unlock()
+}
+
 // register will register a handler in the internal tracker. Unsafe (you
 // must lock c.mu yourself!)
 func (c *Caller) register(internal, bg bool, cmd string, handler Handler) (cuid string) {
 	var uid string
 
-	cmd = strings.ToUpper(cmd)
+	cmd = normalizeCommand(cmd)
 
-	cuid, uid = c.cuid(cmd, 20)
-	if bg {
-		uid += ":bg"
-		cuid += ":bg"
+	// Ensure we never overwrite an existing handler, in the rare case that
+	// the uid is already in use (by either internal or external handlers).
+	for {
+		cuid, uid = c.cuid(cmd, 20)
+		if bg {
+			uid += ":bg"
+			cuid += ":bg"
+		}
+
+		_, inInternal := c.internal[cmd][uid]
+		_, inExternal := c.external[cmd][uid]
+		if !inInternal && !inExternal {
+			break
+		}
+
+		c.debug.Printf("cuid collision for %q, regenerating", cuid)
 	}
 
 	if internal {
@@ -337,12 +575,14 @@ func (c *Caller) register(internal, bg bool, cmd string, handler Handler) (cuid
 		}
 
 		c.internal[cmd][uid] = handler
+		atomic.AddInt64(&c.internalLen, 1)
 	} else {
 		if _, ok := c.external[cmd]; !ok {
 			c.external[cmd] = map[string]Handler{}
 		}
 
 		c.external[cmd][uid] = handler
+		atomic.AddInt64(&c.externalLen, 1)
 	}
 
 	_, file, line, _ := runtime.Caller(3)
@@ -355,6 +595,11 @@ func (c *Caller) register(internal, bg bool, cmd string, handler Handler) (cuid
 // AddHandler registers a handler (matching the handler interface) for the
 // given event. cuid is the handler uid which can be used to remove the
 // handler with Caller.Remove().
+//
+// Numeric replies may be given either as the numeric (e.g. "001"), or by
+// name (e.g. "RPL_WELCOME", see NumericName()), which is the same as
+// giving the numeric. This applies to all methods of Caller which take a
+// command.
 func (c *Caller) AddHandler(cmd string, handler Handler) (cuid string) {
 	return c.sregister(false, false, cmd, handler)
 }
@@ -372,6 +617,42 @@ func (c *Caller) AddBg(cmd string, handler func(client *Client, event Event)) (c
 	return c.sregister(false, true, cmd, HandlerFunc(handler))
 }
 
+// stoppableHandler wraps handlers added with Caller.AddStoppable().
+type stoppableHandler struct {
+	Handler
+}
+
+// AddStoppable registers the handler function for the given event, much
+// like Caller.Add(), however the handler may call Event.StopPropagation() to
+// prevent the event from being processed any further. cuid is the handler
+// uid which can be used to remove the handler with Caller.Remove().
+//
+// Handlers are executed in stages: background handlers are started first,
+// then ALL_EVENTS handlers are executed, followed by handlers for the
+// specific command, and lastly CTCP handlers (see Client.CTCP). Handlers
+// within the same stage are executed concurrently, so stopping propagation
+// only skips the stages after the one the handler belongs to. For example,
+// an ALL_EVENTS handler can prevent the PRIVMSG and CTCP handlers from
+// seeing an event, however not other ALL_EVENTS handlers, nor background
+// handlers (which will have already been started). Internal handlers (which
+// keep track of state) are never skipped.
+func (c *Caller) AddStoppable(cmd string, handler func(client *Client, event Event)) (cuid string) {
+	return c.sregister(false, false, cmd, stoppableHandler{HandlerFunc(handler)})
+}
+
+// waitHandler wraps handlers which other handlers may be blocked waiting on
+// (e.g. those added with Caller.AddTmp(), or by Client.SendAndWait()), which
+// aren't limited by Config.MaxHandlerConcurrency.
+type waitHandler struct {
+	Handler
+}
+
+// addWait registers a waitHandler for the given event, see Caller.Add() and
+// Caller.AddBg().
+func (c *Caller) addWait(cmd string, bg bool, handler func(client *Client, event Event)) (cuid string) {
+	return c.sregister(false, bg, cmd, waitHandler{HandlerFunc(handler)})
+}
+
 // AddTmp adds a "temporary" handler, which is good for one-time or few-time
 // uses. This supports a deadline and/or manual removal, as this differs
 // much from how normal handlers work. An example of a good use for this
@@ -398,25 +679,33 @@ func (c *Caller) AddBg(cmd string, handler func(client *Client, event Event)) (c
 func (c *Caller) AddTmp(cmd string, deadline time.Duration, handler func(client *Client, event Event) bool) (cuid string, done chan struct{}) {
 	done = make(chan struct{})
 
-	cuid = c.sregister(false, true, cmd, HandlerFunc(func(client *Client, event Event) {
-		remove := handler(client, event)
-		if remove {
-			if ok := c.Remove(cuid); ok {
-				close(done)
-			}
+	// Both the handler and the deadline may attempt to remove the handler at
+	// the same time, so ensure done is only closed once.
+	var once sync.Once
+	finish := func() {
+		once.Do(func() {
+			c.Remove(cuid)
+			close(done)
+		})
+	}
+
+	// Ensure cuid is set before the handler can be executed.
+	c.sregisterTo(&cuid, false, true, cmd, waitHandler{HandlerFunc(func(client *Client, event Event) {
+		if handler(client, event) {
+			finish()
 		}
-	}))
+	})})
 
 	if deadline > 0 {
 		go func() {
+			timer := time.NewTimer(deadline)
+			defer timer.Stop()
+
 			select {
-			case <-time.After(deadline):
+			case <-timer.C:
+				finish()
 			case <-done:
 			}
-
-			if ok := c.Remove(cuid); ok {
-				close(done)
-			}
 		}()
 	}
 
@@ -447,8 +736,21 @@ func recoverHandlerPanic(client *Client, event *Event, id string, skip int) {
 		callOk: ok,
 	}
 
-	client.Config.RecoverFunc(client, err)
-	return
+	client.observePanic(err)
+	if client.Config.RecoverFunc != nil {
+		client.Config.RecoverFunc(client, err)
+	}
+
+	if client.Config.QuitOnPanic {
+		client.debug.Printf("quitting due to handler panic: %s", err)
+		client.Quit("")
+	}
+}
+
+// recoverPanics returns true if handler panics should be recovered from,
+// see Config.RecoverFunc and Config.QuitOnPanic.
+func (c *Client) recoverPanics() bool {
+	return c.Config.RecoverFunc != nil || c.Config.QuitOnPanic
 }
 
 // HandlerError is the error returned when a panic is intentionally recovered
@@ -494,3 +796,120 @@ func DefaultRecoverHandler(client *Client, err *HandlerError) {
 	client.debug.Println(err.Error())
 	client.debug.Println(err.String())
 }
+
+// HandlerGroup is a group of handlers which can be removed all at once,
+// useful for plugins which register many handlers. See Client.NewGroup().
+type HandlerGroup struct {
+	caller *Caller
+
+	mu    sync.Mutex
+	cuids []string
+}
+
+// NewGroup returns a new, empty handler group. Handlers added through the
+// group are registered as usual, however they can all be removed with
+// HandlerGroup.Clear().
+func (c *Client) NewGroup() *HandlerGroup {
+	return &HandlerGroup{caller: c.Handlers}
+}
+
+// track records cuid as being part of the group.
+func (g *HandlerGroup) track(cuid string) string {
+	g.mu.Lock()
+	g.cuids = append(g.cuids, cuid)
+	g.mu.Unlock()
+
+	return cuid
+}
+
+// AddHandler is much like Caller.AddHandler(), however the handler is
+// added to the group.
+func (g *HandlerGroup) AddHandler(cmd string, handler Handler) (cuid string) {
+	return g.track(g.caller.AddHandler(cmd, handler))
+}
+
+// Add is much like Caller.Add(), however the handler is added to the group.
+func (g *HandlerGroup) Add(cmd string, handler func(client *Client, event Event)) (cuid string) {
+	return g.track(g.caller.Add(cmd, handler))
+}
+
+// AddBg is much like Caller.AddBg(), however the handler is added to the
+// group.
+func (g *HandlerGroup) AddBg(cmd string, handler func(client *Client, event Event)) (cuid string) {
+	return g.track(g.caller.AddBg(cmd, handler))
+}
+
+// AddStoppable is much like Caller.AddStoppable(), however the handler is
+// added to the group.
+func (g *HandlerGroup) AddStoppable(cmd string, handler func(client *Client, event Event)) (cuid string) {
+	return g.track(g.caller.AddStoppable(cmd, handler))
+}
+
+// Len returns the amount of handlers which have been added through the group
+// (and not yet removed by HandlerGroup.Clear()).
+func (g *HandlerGroup) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.cuids)
+}
+
+// Clear removes all handlers which were added through the group. The group
+// can continue to be used afterwards.
+func (g *HandlerGroup) Clear() {
+	g.mu.Lock()
+	cuids := g.cuids
+	g.cuids = nil
+	g.mu.Unlock()
+
+	for i := 0; i < len(cuids); i++ {
+		g.caller.Remove(cuids[i])
+	}
+}
+
+// AddTmpContext is much like Caller.AddTmp(), however rather than a fixed
+// deadline, the handler is removed once ctx is cancelled (or its deadline
+// passes), or when the handler returns true. done is closed once the handler
+// has been removed for any of these reasons.
+//
+// Once done is closed, reason returns nil if the handler returned true, or
+// the error from ctx (i.e. context.Canceled or context.DeadlineExceeded) if
+// the handler was removed due to ctx. If the handler is removed manually
+// using Caller.Remove(), done is not closed until ctx is cancelled.
+func (c *Caller) AddTmpContext(ctx context.Context, cmd string, handler func(client *Client, event Event) bool) (cuid string, done chan struct{}, reason func() error) {
+	done = make(chan struct{})
+
+	var once sync.Once
+	var err error
+	finish := func(cause error) {
+		once.Do(func() {
+			c.Remove(cuid)
+			err = cause
+			close(done)
+		})
+	}
+
+	// Ensure cuid is set before the handler can be executed.
+	c.sregisterTo(&cuid, false, true, cmd, waitHandler{HandlerFunc(func(client *Client, event Event) {
+		if handler(client, event) {
+			finish(nil)
+		}
+	})})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			finish(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	return cuid, done, func() error {
+		select {
+		case <-done:
+			return err
+		default:
+			return nil
+		}
+	}
+}
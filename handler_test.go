@@ -0,0 +1,592 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallerCuidCollision(t *testing.T) {
+	c := newCaller(log.New(ioutil.Discard, "", 0))
+
+	// Using the same seed for each registration forces the same uid to be
+	// generated first each time.
+	var cuids []string
+	for i := 0; i < 3; i++ {
+		c.rand = rand.New(rand.NewSource(1))
+		cuids = append(cuids, c.Add(PRIVMSG, func(c *Client, e Event) {}))
+	}
+
+	if cuids[0] == cuids[1] || cuids[1] == cuids[2] || cuids[0] == cuids[2] {
+		t.Fatalf("Caller.Add() returned duplicate cuids: %v", cuids)
+	}
+
+	if count := c.Count(PRIVMSG); count != 3 {
+		t.Fatalf("Caller.Count() = %d, wanted 3 (a handler was overwritten)", count)
+	}
+
+	// Internal and external handlers shouldn't collide either.
+	c.rand = rand.New(rand.NewSource(1))
+	c.mu.Lock()
+	cuid := c.register(true, false, PRIVMSG, HandlerFunc(func(c *Client, e Event) {}))
+	c.mu.Unlock()
+
+	for i := 0; i < len(cuids); i++ {
+		if cuid == cuids[i] {
+			t.Fatalf("internal handler cuid %q collides with external handler", cuid)
+		}
+	}
+}
+
+func TestCallerRemoveWhere(t *testing.T) {
+	c := newCaller(log.New(ioutil.Discard, "", 0))
+
+	plugin := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		plugin[c.Add(PRIVMSG, func(c *Client, e Event) {})] = true
+	}
+	other := c.Add(PRIVMSG, func(c *Client, e Event) {})
+	c.Add(NOTICE, func(c *Client, e Event) {})
+
+	c.mu.Lock()
+	c.register(true, false, PRIVMSG, HandlerFunc(func(c *Client, e Event) {}))
+	c.mu.Unlock()
+
+	removed := c.RemoveWhere("privmsg", func(cuid string) bool { return plugin[cuid] })
+	if removed != 3 {
+		t.Fatalf("Caller.RemoveWhere() = %d, wanted 3", removed)
+	}
+
+	if count := c.Count(PRIVMSG); count != 1 {
+		t.Fatalf("Caller.Count(PRIVMSG) = %d, wanted 1", count)
+	}
+
+	if !c.Remove(other) {
+		t.Fatal("Caller.RemoveWhere() removed a handler it shouldn't have")
+	}
+
+	if removed = c.RemoveWhere(PRIVMSG, func(string) bool { return true }); removed != 0 {
+		t.Fatalf("Caller.RemoveWhere() = %d, wanted 0 (internal handlers are excluded)", removed)
+	}
+
+	if count := c.Count(NOTICE); count != 1 {
+		t.Fatalf("Caller.Count(NOTICE) = %d, wanted 1", count)
+	}
+
+	// Commands without any external handlers left are excluded.
+	if counts := c.Counts(); len(counts) != 1 || counts[NOTICE] != 1 {
+		t.Fatalf("Caller.Counts() = %v, wanted map[NOTICE:1]", counts)
+	}
+}
+
+func TestCallerRegisterCaller(t *testing.T) {
+	debug := &lockedBuffer{}
+	c := newCaller(log.New(debug, "", 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c.Add(PRIVMSG, func(c *Client, e Event) {})
+	c.AddTmp(PRIVMSG, 0, func(c *Client, e Event) bool { return true })
+	c.AddTmpContext(ctx, PRIVMSG, func(c *Client, e Event) bool { return true })
+
+	// Each registration should be logged with where it was added from.
+	lines := strings.Split(strings.TrimSpace(debug.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("logged %d lines, wanted 3: %q", len(lines), lines)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "handler_test.go:") {
+			t.Fatalf("registration logged as %q, wanted it to refer to handler_test.go", line)
+		}
+	}
+}
+
+func TestCallerLen(t *testing.T) {
+	c := newCaller(log.New(ioutil.Discard, "", 0))
+
+	// count counts the handlers the slow way, to compare against.
+	count := func() (external, internal int) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+
+		for cmd := range c.external {
+			external += len(c.external[cmd])
+		}
+		for cmd := range c.internal {
+			internal += len(c.internal[cmd])
+		}
+		return external, internal
+	}
+
+	check := func(step string) {
+		t.Helper()
+
+		external, internal := count()
+		if c.Len() != external {
+			t.Fatalf("Caller.Len() = %d after %s, wanted %d", c.Len(), step, external)
+		}
+
+		want := fmt.Sprintf("<Caller external:%d internal:%d>", external, internal)
+		if c.String() != want {
+			t.Fatalf("Caller.String() = %q after %s, wanted %q", c.String(), step, want)
+		}
+	}
+
+	cuid := c.Add(PRIVMSG, func(c *Client, e Event) {})
+	c.AddBg(PRIVMSG, func(c *Client, e Event) {})
+	c.Add(NOTICE, func(c *Client, e Event) {})
+	c.Add(JOIN, func(c *Client, e Event) {})
+	c.sregister(true, false, PRIVMSG, HandlerFunc(func(c *Client, e Event) {}))
+	check("adding handlers")
+
+	c.Remove(cuid)
+	c.Remove(cuid)
+	check("Remove()")
+
+	c.RemoveWhere(PRIVMSG, func(string) bool { return true })
+	check("RemoveWhere()")
+
+	c.Clear(NOTICE)
+	c.Clear(NOTICE)
+	check("Clear()")
+
+	c.ClearAll()
+	check("ClearAll()")
+
+	c.clearInternal()
+	check("clearInternal()")
+}
+
+func TestHandlerGroup(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+	other := c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {})
+
+	group := c.NewGroup()
+	group.Add(PRIVMSG, func(c *Client, e Event) {})
+	group.AddBg(PRIVMSG, func(c *Client, e Event) {})
+	group.AddHandler(NOTICE, HandlerFunc(func(c *Client, e Event) {}))
+
+	if group.Len() != 3 {
+		t.Fatalf("HandlerGroup.Len() = %d, wanted 3", group.Len())
+	}
+
+	if c.Handlers.Len() != 4 {
+		t.Fatalf("Caller.Len() = %d, wanted 4", c.Handlers.Len())
+	}
+
+	group.Clear()
+
+	if group.Len() != 0 {
+		t.Fatalf("HandlerGroup.Len() = %d after Clear(), wanted 0", group.Len())
+	}
+
+	if c.Handlers.Len() != 1 {
+		t.Fatalf("Caller.Len() = %d after HandlerGroup.Clear(), wanted 1", c.Handlers.Len())
+	}
+
+	if !c.Handlers.Remove(other) {
+		t.Fatal("HandlerGroup.Clear() removed a handler outside of the group")
+	}
+}
+
+func TestCallerExecConcurrent(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	var count uint64
+	for i := 0; i < 5; i++ {
+		c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { atomic.AddUint64(&count, 1) })
+	}
+
+	// Each exec call must only wait on its own handlers, even when many
+	// events are dispatched concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Handlers.exec(PRIVMSG, false, false, false, c, ParseEvent(":nick!user@host PRIVMSG #chan :hello"), nil)
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadUint64(&count); got != 250 {
+		t.Fatalf("handlers executed %d times, wanted 250", got)
+	}
+}
+
+func TestCallerMaxHandlerConcurrency(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test", MaxHandlerConcurrency: 2})
+
+	var current, max, done int64
+	for i := 0; i < 6; i++ {
+		c.Handlers.AddBg(PRIVMSG, func(c *Client, e Event) {
+			n := atomic.AddInt64(&current, 1)
+			for {
+				m := atomic.LoadInt64(&max)
+				if n <= m || atomic.CompareAndSwapInt64(&max, m, n) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt64(&current, -1)
+			atomic.AddInt64(&done, 1)
+		})
+	}
+
+	c.runEvent(ParseEvent(":nick!user@host PRIVMSG #chan :hello"), true)
+	if !c.Handlers.drain(2 * time.Second) {
+		t.Fatal("timed out waiting for handlers to complete")
+	}
+
+	if atomic.LoadInt64(&done) != 6 {
+		t.Fatalf("%d handlers executed, wanted 6", atomic.LoadInt64(&done))
+	}
+
+	if got := atomic.LoadInt64(&max); got > 2 {
+		t.Fatalf("%d handlers executed concurrently, wanted at most 2", got)
+	}
+}
+
+func TestClientMaxHandlerConcurrency(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.MaxHandlerConcurrency = 1
+
+	go mockRespond(conn, func(e *Event) []string {
+		switch e.Command {
+		case USER:
+			return []string{
+				":dummy.int 001 test :Welcome to the network",
+				":test!user@host JOIN #chan",
+				":nick!user@host PRIVMSG #chan :hello",
+			}
+		case WHOIS:
+			return []string{":dummy.int 318 test nick :End of /WHOIS list"}
+		}
+
+		return nil
+	})
+
+	// Internal handlers (and the handlers they execute when updating state)
+	// must not wait on the slot held by this handler.
+	var updates int64
+	c.Handlers.Add(UPDATE_STATE, func(c *Client, e Event) { atomic.AddInt64(&updates, 1) })
+
+	done := make(chan struct{})
+	c.Handlers.AddBg(PRIVMSG, func(c *Client, e Event) {
+		// Temporary handlers must also not wait on the slot held by this
+		// handler.
+		if _, err := c.SendAndWait(&Event{Command: WHOIS, Params: []string{"nick"}}, RPL_ENDOFWHOIS, time.Second); err != nil {
+			t.Errorf("Client.SendAndWait() returned error: %s", err)
+		}
+		close(done)
+	})
+
+	go c.MockConnect(server)
+	defer c.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for handlers to execute")
+	}
+
+	if atomic.LoadInt64(&updates) == 0 {
+		t.Fatal("UPDATE_STATE handler wasn't executed")
+	}
+}
+
+func TestCallerAddTmpContext(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	// Handler returning true.
+	_, done, reason := c.Handlers.AddTmpContext(context.Background(), PRIVMSG, func(c *Client, e Event) bool {
+		return e.Trailing == "stop"
+	})
+
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #chan :continue"))
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #chan :stop"))
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for done after handler returned true")
+	}
+
+	if err := reason(); err != nil {
+		t.Fatalf("reason() = %v, wanted nil", err)
+	}
+
+	if c.Handlers.Len() != 0 {
+		t.Fatalf("Caller.Len() = %d, wanted 0", c.Handlers.Len())
+	}
+
+	// Cancelled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done, reason = c.Handlers.AddTmpContext(ctx, PRIVMSG, func(c *Client, e Event) bool { return false })
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for done after cancel")
+	}
+
+	if err := reason(); err != context.Canceled {
+		t.Fatalf("reason() = %v, wanted context.Canceled", err)
+	}
+
+	if c.Handlers.Len() != 0 {
+		t.Fatalf("Caller.Len() = %d, wanted 0", c.Handlers.Len())
+	}
+}
+
+func TestCallerDrain(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	if !c.Handlers.drain(0) {
+		t.Fatal("Caller.drain() = false with no running handlers")
+	}
+
+	release := make(chan struct{})
+	c.Handlers.AddBg(PRIVMSG, func(c *Client, e Event) {
+		<-release
+	})
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #chan :hello"))
+
+	if c.Handlers.drain(50 * time.Millisecond) {
+		t.Fatal("Caller.drain() = true while a handler is still running")
+	}
+
+	close(release)
+	start := time.Now()
+	if !c.Handlers.drain(5 * time.Second) {
+		t.Fatal("timed out waiting for handlers to complete")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Caller.drain() took %s after the handler completed", elapsed)
+	}
+
+	// Draining again once idle shouldn't block.
+	if !c.Handlers.drain(0) {
+		t.Fatal("Caller.drain() = false after all handlers completed")
+	}
+}
+
+func TestCallerAddTmpRace(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+	event := ParseEvent(":nick!user@host PRIVMSG #chan :hello")
+
+	// Race the handler returning true against the deadline elapsing.
+	for i := 0; i < 200; i++ {
+		_, done := c.Handlers.AddTmp(PRIVMSG, time.Duration(i%3)*time.Microsecond+time.Microsecond, func(c *Client, e Event) bool {
+			return true
+		})
+
+		c.RunHandlers(event)
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for done")
+		}
+	}
+
+	if !c.Handlers.drain(2 * time.Second) {
+		t.Fatal("timed out waiting for handlers to complete")
+	}
+
+	if c.Handlers.Len() != 0 {
+		t.Fatalf("Caller.Len() = %d, wanted 0", c.Handlers.Len())
+	}
+}
+
+func TestRunHandlersOrder(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	var internalDone int32
+	for _, cmd := range []string{ALL_EVENTS, PRIVMSG} {
+		c.Handlers.sregister(true, false, cmd, HandlerFunc(func(c *Client, e Event) {
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&internalDone, 1)
+		}))
+	}
+
+	var seen []int32
+	var mu sync.Mutex
+	record := func(c *Client, e Event) {
+		mu.Lock()
+		seen = append(seen, atomic.LoadInt32(&internalDone))
+		mu.Unlock()
+	}
+
+	c.Handlers.Add(ALL_EVENTS, record)
+	c.Handlers.AddBg(ALL_EVENTS, record)
+	c.Handlers.Add(PRIVMSG, record)
+
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #chan :hello"))
+
+	// Wait for the background handler.
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(seen) != 3 {
+		t.Fatalf("external handlers executed %d times, wanted 3", len(seen))
+	}
+
+	for i := 0; i < len(seen); i++ {
+		if seen[i] != 2 {
+			t.Fatalf("external handler executed with %d of 2 internal handlers completed", seen[i])
+		}
+	}
+}
+
+func TestCallerNumericNames(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	var mu sync.Mutex
+	seen := map[string]int{}
+	record := func(name string) func(c *Client, e Event) {
+		return func(c *Client, e Event) {
+			mu.Lock()
+			seen[name]++
+			mu.Unlock()
+		}
+	}
+
+	c.Handlers.Add("RPL_WELCOME", record("RPL_WELCOME"))
+	c.Handlers.Add("rpl_endofmotd", record("rpl_endofmotd"))
+	c.Handlers.Add(RPL_WELCOME, record(RPL_WELCOME))
+	c.Handlers.Add("999", record("999"))
+
+	if got := c.Handlers.Count("RPL_WELCOME"); got != 2 {
+		t.Fatalf("Caller.Count(%q) = %d, wanted 2", "RPL_WELCOME", got)
+	}
+
+	c.RunHandlers(ParseEvent(":dummy.int 001 test :Welcome"))
+	c.RunHandlers(ParseEvent(":dummy.int 376 test :End of /MOTD command."))
+	c.RunHandlers(ParseEvent(":dummy.int 999 test :Unknown"))
+
+	want := map[string]int{"RPL_WELCOME": 1, RPL_WELCOME: 1, "rpl_endofmotd": 1, "999": 1}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("handlers executed = %v, wanted %v", seen, want)
+	}
+}
+
+func TestRunHandlersIsolation(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	// ALL_EVENTS handlers complete before the command handlers are executed,
+	// so modifications here would be visible if the event was shared.
+	c.Handlers.Add(ALL_EVENTS, func(c *Client, e Event) {
+		e.Params[0] = "#modified"
+		e.Source.Name = "modified"
+		e.Tags["modified"] = "true"
+	})
+
+	var seen *Event
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		seen = &e
+	})
+
+	raw := "@msgid=1 :nick!user@host PRIVMSG #channel :hello"
+	event := ParseEvent(raw)
+	c.RunHandlers(event)
+
+	if seen == nil {
+		t.Fatal("PRIVMSG handler wasn't executed")
+	}
+
+	if got := seen.String(); got != raw {
+		t.Fatalf("handler received %q, wanted %q (modified by another handler)", got, raw)
+	}
+
+	if got := event.String(); got != raw {
+		t.Fatalf("event = %q after Client.RunHandlers(), wanted %q", got, raw)
+	}
+}
+
+func TestStopPropagation(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	var mu sync.Mutex
+	var seen []string
+	record := func(name string) {
+		mu.Lock()
+		seen = append(seen, name)
+		mu.Unlock()
+	}
+
+	c.Handlers.AddStoppable(ALL_EVENTS, func(c *Client, e Event) {
+		if e.Trailing == "stop all" {
+			e.StopPropagation()
+		}
+	})
+	c.Handlers.AddStoppable(PRIVMSG, func(c *Client, e Event) {
+		if e.Trailing == "\x01TEST stop\x01" {
+			e.StopPropagation()
+		}
+	})
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		// Not a stoppable handler, so this has no effect.
+		e.StopPropagation()
+		record("privmsg")
+	})
+	c.CTCP.Set("TEST", func(c *Client, e CTCPEvent) {
+		record("ctcp")
+	})
+
+	for _, tt := range []struct {
+		trailing string
+		want     string
+	}{
+		{"hello", "privmsg"},
+		{"stop all", ""},
+		{"\x01TEST\x01", "privmsg ctcp"},
+		{"\x01TEST stop\x01", "privmsg"},
+	} {
+		seen = nil
+		c.RunHandlers(&Event{Source: &Source{Name: "nick"}, Command: PRIVMSG, Params: []string{"test"}, Trailing: tt.trailing})
+
+		if got := strings.Join(seen, " "); got != tt.want {
+			t.Errorf("handlers executed for %q = %q, wanted %q", tt.trailing, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkRunHandlers(b *testing.B) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {})
+	c.Handlers.Add(ALL_EVENTS, func(c *Client, e Event) {})
+
+	event := ParseEvent("@time=2020-01-01T00:00:00.000Z :nick!user@host PRIVMSG #channel :hello world")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.RunHandlers(event)
+	}
+}
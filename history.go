@@ -0,0 +1,155 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// historyTimeout is how long the history helpers wait for the server to
+// send the requested history.
+const historyTimeout = 30 * time.Second
+
+// defaultHistoryLimit is the amount of messages requested when none is
+// specified, and the server doesn't advertise a limit.
+const defaultHistoryLimit = 100
+
+// HistoryLatest requests the latest n messages sent to target (a channel or
+// nickname), using the IRCv3 chathistory extension. See Client.History()
+// for more information.
+func (c *Client) HistoryLatest(target string, n int) ([]*Event, error) {
+	return c.History(target, "LATEST", []string{"*"}, n)
+}
+
+// HistoryBefore requests up to n messages sent to target before t. See
+// Client.History() for more information.
+func (c *Client) HistoryBefore(target string, t time.Time, n int) ([]*Event, error) {
+	return c.History(target, "BEFORE", []string{historyTimestamp(t)}, n)
+}
+
+// HistoryAfter requests up to n messages sent to target after t. See
+// Client.History() for more information.
+func (c *Client) HistoryAfter(target string, t time.Time, n int) ([]*Event, error) {
+	return c.History(target, "AFTER", []string{historyTimestamp(t)}, n)
+}
+
+// HistoryAround requests up to n messages sent to target around t. See
+// Client.History() for more information.
+func (c *Client) HistoryAround(target string, t time.Time, n int) ([]*Event, error) {
+	return c.History(target, "AROUND", []string{historyTimestamp(t)}, n)
+}
+
+// HistoryBetween requests up to n messages sent to target between start and
+// end. See Client.History() for more information.
+func (c *Client) HistoryBetween(target string, start, end time.Time, n int) ([]*Event, error) {
+	return c.History(target, "BETWEEN", []string{historyTimestamp(start), historyTimestamp(end)}, n)
+}
+
+// History sends a CHATHISTORY request with the given subcommand (e.g.
+// "LATEST", "BEFORE", etc) and selectors for target, and returns the events
+// in the resulting batch. n is limited to the maximum advertised by the
+// server (if n <= 0, the maximum is used).
+//
+// ErrNotSupported is returned if the server doesn't support the chathistory
+// extension. If the server rejects the request, an *ErrEvent is returned
+// with the FAIL event. Note that the events returned are also passed to
+// handlers as usual.
+func (c *Client) History(target, subcommand string, selectors []string, n int) ([]*Event, error) {
+	if !c.IsConnected() {
+		return nil, ErrNotConnected
+	}
+
+	if !c.supportsHistory() {
+		return nil, ErrNotSupported{Feature: CHATHISTORY}
+	}
+
+	limit := defaultHistoryLimit
+	c.state.RLock()
+	raw := c.state.serverOptions[CHATHISTORY]
+	c.state.RUnlock()
+
+	if max, err := strconv.Atoi(raw); err == nil && max > 0 {
+		limit = max
+	}
+	if n <= 0 || n > limit {
+		n = limit
+	}
+
+	var mu sync.Mutex
+	var ref string
+	var events []*Event
+	var failed *Event
+	var finished bool
+	done := make(chan struct{})
+
+	finish := func() {
+		finished = true
+		close(done)
+	}
+
+	// This is not a background handler, to ensure that events are collected
+	// in the order they were received.
+	cuid := c.Handlers.addWait(ALL_EVENTS, false, func(_ *Client, e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if finished {
+			return
+		}
+
+		switch {
+		case e.Command == FAIL && len(e.Params) > 0 && e.Params[0] == CHATHISTORY:
+			failed = &e
+			finish()
+		case e.Command == BATCH && len(e.Params) > 0 && len(e.Params[0]) > 1:
+			if ref == "" && len(e.Params) > 2 && e.Params[0][0] == '+' &&
+				e.Params[1] == "chathistory" && c.casefold(e.Params[2]) == c.casefold(target) {
+				ref = e.Params[0][1:]
+			} else if ref != "" && e.Params[0] == "-"+ref {
+				finish()
+			}
+		case ref != "":
+			if id, ok := e.Tags.Get("batch"); ok && id == ref {
+				events = append(events, &e)
+			}
+		}
+	})
+	defer c.Handlers.Remove(cuid)
+
+	params := append([]string{subcommand, target}, selectors...)
+	c.Send(&Event{Command: CHATHISTORY, Params: append(params, strconv.Itoa(n))})
+
+	select {
+	case <-done:
+	case <-time.After(historyTimeout):
+		return nil, ErrNoResponse
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if failed != nil {
+		return nil, &ErrEvent{Event: failed}
+	}
+
+	return events, nil
+}
+
+// supportsHistory returns true if the server supports the chathistory
+// extension.
+func (c *Client) supportsHistory() bool {
+	if c.Config.disableTracking {
+		return true
+	}
+
+	return c.supportsOption(CHATHISTORY) && c.HasCap("draft/chathistory")
+}
+
+// historyTimestamp formats t as a CHATHISTORY timestamp selector.
+func historyTimestamp(t time.Time) string {
+	return "timestamp=" + t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
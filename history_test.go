@@ -0,0 +1,70 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	requests := make(chan string, 5)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != CHATHISTORY {
+			return nil
+		}
+
+		requests <- strings.Join(e.Params, " ")
+
+		if e.Params[1] == "#invalid" {
+			return []string{"FAIL CHATHISTORY INVALID_TARGET LATEST #invalid :Messages could not be retrieved"}
+		}
+
+		return []string{
+			":dummy.int BATCH +ref chathistory #channel",
+			"@batch=ref;time=2020-01-01T00:00:01.000Z :a!a@a PRIVMSG #channel :first",
+			":b!b@b PRIVMSG #channel :live",
+			"@batch=ref;time=2020-01-01T00:00:02.000Z :a!a@a PRIVMSG #channel :second",
+			":dummy.int BATCH -ref",
+		}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if _, err := c.HistoryLatest("#channel", 10); err == nil {
+		t.Fatal("Client.HistoryLatest() should fail when chathistory isn't supported")
+	}
+
+	c.state.Lock()
+	c.state.serverOptions[CHATHISTORY] = "5"
+	c.state.enabledCap = append(c.state.enabledCap, "draft/chathistory")
+	c.state.Unlock()
+
+	events, err := c.HistoryBefore("#channel", time.Date(2020, 1, 1, 0, 0, 3, 0, time.UTC), 10)
+	if err != nil {
+		t.Fatalf("Client.HistoryBefore() returned error: %s", err)
+	}
+
+	if want := "BEFORE #channel timestamp=2020-01-01T00:00:03.000Z 5"; <-requests != want {
+		t.Fatalf("Client.HistoryBefore() didn't send %q", want)
+	}
+
+	if len(events) != 2 || events[0].Trailing != "first" || events[1].Trailing != "second" {
+		t.Fatalf("Client.HistoryBefore() returned unexpected events: %v", events)
+	}
+
+	if _, err = c.HistoryLatest("#invalid", 0); err == nil {
+		t.Fatal("Client.HistoryLatest() should return an error on FAIL")
+	} else if _, ok := err.(*ErrEvent); !ok {
+		t.Fatalf("Client.HistoryLatest() error = %#v, wanted *ErrEvent", err)
+	}
+}
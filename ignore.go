@@ -0,0 +1,65 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+// Ignore ignores all PRIVMSG and NOTICE events (including CTCP) from users
+// matching mask, which is a wildcard hostmask (e.g. "nick!*@*" or
+// "*!*@host.com"). If only a nickname is supplied, it will be treated as
+// "nick!*@*". Ignored events are still passed to internal handlers, so
+// tracking stays accurate, however they will not be passed to any
+// handlers you have added. Ignores persist across reconnects.
+func (c *Client) Ignore(mask string) {
+	mask = normalizeMask(mask)
+
+	c.ignoreMu.Lock()
+	defer c.ignoreMu.Unlock()
+
+	for i := 0; i < len(c.ignores); i++ {
+		if c.ignores[i] == mask {
+			return
+		}
+	}
+
+	c.ignores = append(c.ignores, mask)
+}
+
+// Unignore removes a mask previously added with Client.Ignore().
+func (c *Client) Unignore(mask string) {
+	mask = normalizeMask(mask)
+
+	c.ignoreMu.Lock()
+	defer c.ignoreMu.Unlock()
+
+	for i := 0; i < len(c.ignores); i++ {
+		if c.casefold(c.ignores[i]) == c.casefold(mask) {
+			c.ignores = append(c.ignores[:i], c.ignores[i+1:]...)
+			return
+		}
+	}
+}
+
+// IsIgnored returns true if event is a PRIVMSG or NOTICE from a user
+// matching a mask added with Client.Ignore().
+func (c *Client) IsIgnored(event Event) bool {
+	if event.Source == nil || (event.Command != PRIVMSG && event.Command != NOTICE) {
+		return false
+	}
+
+	c.ignoreMu.RLock()
+	defer c.ignoreMu.RUnlock()
+
+	if len(c.ignores) == 0 {
+		return false
+	}
+
+	source := event.Source.Name + "!" + event.Source.Ident + "@" + event.Source.Host
+	for i := 0; i < len(c.ignores); i++ {
+		if c.MatchMask(c.ignores[i], source) {
+			return true
+		}
+	}
+
+	return false
+}
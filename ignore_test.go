@@ -0,0 +1,49 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestIgnore(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+
+	var count uint64
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { atomic.AddUint64(&count, 1) })
+
+	c.Ignore("spammer")
+	c.Ignore("*!*@BAD.host")
+
+	tests := []struct {
+		raw     string
+		ignored bool
+	}{
+		{raw: ":spammer!user@host.com PRIVMSG #chan :hello", ignored: true},
+		{raw: ":SPAMMER!user@host.com PRIVMSG #chan :hello", ignored: true},
+		{raw: ":spammer!user@host.com NOTICE #chan :hello", ignored: true},
+		{raw: ":spammer!user@host.com JOIN #chan", ignored: false},
+		{raw: ":nick!user@bad.host PRIVMSG #chan :\x01VERSION\x01", ignored: true},
+		{raw: ":nick!user@good.host PRIVMSG #chan :hello", ignored: false},
+	}
+
+	for _, tt := range tests {
+		if got := c.IsIgnored(*ParseEvent(tt.raw)); got != tt.ignored {
+			t.Errorf("Client.IsIgnored(%q) = %v, want %v", tt.raw, got, tt.ignored)
+		}
+	}
+
+	c.RunHandlers(ParseEvent(":spammer!user@host.com PRIVMSG #chan :hello"))
+	if atomic.LoadUint64(&count) != 0 {
+		t.Fatal("Client.RunHandlers() executed handlers for ignored event")
+	}
+
+	c.Unignore("SPAMMER")
+	c.RunHandlers(ParseEvent(":spammer!user@host.com PRIVMSG #chan :hello"))
+	if atomic.LoadUint64(&count) != 1 {
+		t.Fatal("Client.RunHandlers() didn't execute handlers after Client.Unignore()")
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"sync"
+	"time"
+)
+
+// capRedaction is the capability required for Client.Redact().
+const capRedaction = "draft/message-redaction"
+
+// messageIDTimeout is how long Client.MessageWithID() waits for the server to
+// echo the message back.
+const messageIDTimeout = 30 * time.Second
+
+// Message is a parsed PRIVMSG or NOTICE, see Client.OnMessage() and
+// Client.OnNotice().
+type Message struct {
+	// From is the sender of the message.
+	From *Source
+	// Target is who the message was sent to, either a channel or our own
+	// nickname.
+	Target string
+	// Text is the message text. For actions, this is the action text
+	// without the CTCP encoding.
+	Text string
+	// IsChannel is true if the message was sent to a channel.
+	IsChannel bool
+	// IsAction is true if the message is a CTCP ACTION (/me).
+	IsAction bool
+	// Tags are the IRCv3 tags of the message, if any.
+	Tags Tags
+	// Event is the original event.
+	Event Event
+}
+
+// ReplyTarget returns where replies to the message should be sent, either the
+// channel, or the sender for private messages.
+func (m Message) ReplyTarget() string {
+	if m.IsChannel {
+		return m.Target
+	}
+
+	return m.From.Name
+}
+
+// parseMessage converts a PRIVMSG or NOTICE event into a Message. ok is false
+// if the event isn't a message, or is CTCP (other than ACTION), as those
+// are handled via Client.CTCP. decode is used to decode CTCP.
+func parseMessage(e Event, decode func(*Event) *CTCPEvent) (m Message, ok bool) {
+	if e.Source == nil || len(e.Params) < 1 {
+		return m, false
+	}
+
+	m = Message{
+		From:      e.Source,
+		Target:    e.Params[0],
+		Text:      e.Trailing,
+		IsChannel: e.IsFromChannel(),
+		Tags:      e.Tags,
+		Event:     e,
+	}
+
+	if ctcp := decode(&e); ctcp != nil {
+		if e.Command != PRIVMSG || ctcp.Command != CTCP_ACTION {
+			return m, false
+		}
+
+		m.Text = ctcp.Text
+		m.IsAction = true
+	}
+
+	return m, true
+}
+
+// OnMessage registers a handler for incoming PRIVMSG's (including actions),
+// which receives the parsed Message. CTCP requests (other than ACTION) are
+// not passed to handler, see Client.CTCP instead. cuid is the handler uid
+// which can be used to remove the handler with Caller.Remove().
+func (c *Client) OnMessage(handler func(c *Client, m Message)) (cuid string) {
+	return c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		if m, ok := parseMessage(e, c.decodeCTCP); ok {
+			handler(c, m)
+		}
+	})
+}
+
+// OnNotice is like OnMessage, however for incoming NOTICE's. CTCP replies are
+// not passed to handler.
+func (c *Client) OnNotice(handler func(c *Client, m Message)) (cuid string) {
+	return c.Handlers.Add(NOTICE, func(c *Client, e Event) {
+		if m, ok := parseMessage(e, c.decodeCTCP); ok {
+			handler(c, m)
+		}
+	})
+}
+
+// MessageWithID sends a PRIVMSG to target, and returns a channel which
+// receives the msgid which the server assigned to the message, once it is
+// echoed back to us. The msgid can be used to reference the message later
+// (e.g. for reactions or redaction). If the server doesn't echo the message
+// back with a msgid within 30 seconds, the channel is closed without a value.
+//
+// This requires the echo-message capability (see Config.RequestCaps), and
+// returns ErrNotSupported if it hasn't been enabled.
+func (c *Client) MessageWithID(target, message string) (<-chan string, error) {
+	if !c.HasCap("echo-message") {
+		return nil, ErrNotSupported{Feature: "echo-message"}
+	}
+
+	id := make(chan string, 1)
+	event := &Event{Command: PRIVMSG, Params: []string{target}, Trailing: message, EmptyTrailing: true}
+
+	// The handler may run concurrently with the deadline, so ensure we only
+	// send on/close id once.
+	var mu sync.Mutex
+	var closed bool
+	deliver := func(msgid string, ok bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if closed {
+			return
+		}
+
+		if ok {
+			id <- msgid
+		}
+		closed = true
+		close(id)
+	}
+
+	cuid, done := c.Handlers.AddTmp(ALL_EVENTS, messageIDTimeout, func(c *Client, e Event) bool {
+		if !e.Echo || e.Command != PRIVMSG || len(e.Params) < 1 ||
+			c.casefold(e.Params[0]) != c.casefold(target) || e.Trailing != event.Trailing {
+			return false
+		}
+
+		msgid, ok := e.Tags.Get("msgid")
+		if !ok {
+			msgid, ok = e.Tags.Get("draft/msgid")
+		}
+
+		deliver(msgid, ok)
+		return true
+	})
+
+	go func() {
+		<-done
+		deliver("", false)
+	}()
+
+	if err := c.Send(event); err != nil {
+		c.Handlers.Remove(cuid)
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// React sends a reaction (e.g. an emoji) to the message with the given msgid,
+// which was sent to target, using the draft/react client tag. This requires
+// the message-tags capability, and returns ErrNotSupported if it hasn't been
+// enabled. Incoming reactions are received as TAGMSG events, with the
+// reaction in the "+draft/react" tag, and the msgid it refers to in the
+// "+draft/reply" tag.
+func (c *Client) React(target, msgid, reaction string) error {
+	if !c.HasCap("message-tags") {
+		return ErrNotSupported{Feature: "message-tags"}
+	}
+
+	tags := Tags{}
+	if err := tags.Set("+draft/react", reaction); err != nil {
+		return err
+	}
+	if err := tags.Set("+draft/reply", msgid); err != nil {
+		return err
+	}
+
+	return c.Send(&Event{Command: TAGMSG, Params: []string{target}, Tags: tags})
+}
+
+// Redact requests that the server removes the message with the given msgid,
+// which was sent to target, with an optional reason. This requires the
+// draft/message-redaction capability, and returns ErrNotSupported if it
+// hasn't been enabled. Incoming redactions are received as REDACT events,
+// with the target and msgid as the first two params.
+func (c *Client) Redact(target, msgid, reason string) error {
+	if !c.HasCap(capRedaction) {
+		return ErrNotSupported{Feature: capRedaction}
+	}
+
+	event := &Event{Command: REDACT, Params: []string{target, msgid}}
+	if reason != "" {
+		event.Trailing = reason
+		event.EmptyTrailing = true
+	}
+
+	return c.Send(event)
+}
@@ -0,0 +1,162 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		raw  string
+		ok   bool
+		want Message
+	}{
+		{
+			raw: "@msgid=1 :nick!user@host PRIVMSG #channel :hello",
+			ok:  true, want: Message{Target: "#channel", Text: "hello", IsChannel: true},
+		},
+		{
+			raw: ":nick!user@host PRIVMSG test :hello",
+			ok:  true, want: Message{Target: "test", Text: "hello"},
+		},
+		{
+			raw: ":nick!user@host PRIVMSG #channel :\x01ACTION waves\x01",
+			ok:  true, want: Message{Target: "#channel", Text: "waves", IsChannel: true, IsAction: true},
+		},
+		{raw: ":nick!user@host PRIVMSG test :\x01VERSION\x01"},
+		{raw: ":nick!user@host NOTICE test :\x01VERSION girc\x01"},
+		{raw: "PRIVMSG test :no source"},
+	}
+
+	for _, tt := range tests {
+		event := ParseEvent(tt.raw)
+		m, ok := parseMessage(*event, DecodeCTCP)
+		if ok != tt.ok {
+			t.Errorf("parseMessage(%q) ok = %t, wanted %t", tt.raw, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if m.Target != tt.want.Target || m.Text != tt.want.Text || m.IsChannel != tt.want.IsChannel ||
+			m.IsAction != tt.want.IsAction || m.From == nil || m.From.Name != "nick" {
+			t.Errorf("parseMessage(%q) = %#v, wanted %#v", tt.raw, m, tt.want)
+		}
+
+		want := "nick"
+		if tt.want.IsChannel {
+			want = tt.want.Target
+		}
+		if m.ReplyTarget() != want {
+			t.Errorf("Message.ReplyTarget() = %q, wanted %q", m.ReplyTarget(), want)
+		}
+	}
+}
+
+func TestMessageWithID(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != PRIVMSG {
+			return nil
+		}
+
+		return []string{
+			// Unrelated echo, which shouldn't match.
+			"@msgid=other :test!user@host PRIVMSG #other :" + e.Trailing,
+			"@msgid=abc123 :test!user@host PRIVMSG " + e.Params[0] + " :" + e.Trailing,
+		}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if _, err := c.MessageWithID("#channel", "hello"); err == nil {
+		t.Fatal("Client.MessageWithID() should fail without echo-message")
+	}
+
+	c.state.Lock()
+	c.state.enabledCap = append(c.state.enabledCap, "echo-message")
+	c.state.Unlock()
+
+	id, err := c.MessageWithID("#channel", "hello")
+	if err != nil {
+		t.Fatalf("Client.MessageWithID() returned error: %s", err)
+	}
+
+	select {
+	case msgid := <-id:
+		if msgid != "abc123" {
+			t.Fatalf("Client.MessageWithID() msgid = %q, wanted abc123", msgid)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for msgid")
+	}
+}
+
+func TestReactRedact(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	got := make(chan *Event, 2)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == TAGMSG || e.Command == REDACT {
+			got <- e
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if err := c.React("#channel", "abc123", "👍"); err == nil {
+		t.Fatal("Client.React() should fail without message-tags")
+	}
+	if err := c.Redact("#channel", "abc123", "oops"); err == nil {
+		t.Fatal("Client.Redact() should fail without draft/message-redaction")
+	}
+
+	c.state.Lock()
+	c.state.enabledCap = append(c.state.enabledCap, "message-tags", "draft/message-redaction")
+	c.state.Unlock()
+
+	if err := c.React("#channel", "abc123", "👍"); err != nil {
+		t.Fatalf("Client.React() returned error: %s", err)
+	}
+	if err := c.Redact("#channel", "abc123", "oops"); err != nil {
+		t.Fatalf("Client.Redact() returned error: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		var e *Event
+		select {
+		case e = <-got:
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+
+		switch e.Command {
+		case TAGMSG:
+			if react, _ := e.Tags.Get("+draft/react"); react != "👍" {
+				t.Fatalf("TAGMSG react tag = %q, wanted 👍", react)
+			}
+			if reply, _ := e.Tags.Get("+draft/reply"); reply != "abc123" {
+				t.Fatalf("TAGMSG reply tag = %q, wanted abc123", reply)
+			}
+		case REDACT:
+			if e.String() != "REDACT #channel abc123 :oops" {
+				t.Fatalf("REDACT = %q", e.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// capMetadata is the capability required for METADATA.
+const capMetadata = "draft/metadata-2"
+
+// metadataTimeout is how long Client.GetMetadata() and Client.SetMetadata()
+// wait for the server to reply.
+const metadataTimeout = 10 * time.Second
+
+// defaultMetadataSyncDelay is how long to wait before retrying a METADATA
+// SYNC which the server postponed, if the server doesn't say how long.
+const defaultMetadataSyncDelay = 5 * time.Second
+
+// GetMetadata queries the value of key on target (a channel or nickname, or
+// "*" for ourselves), using the IRCv3 metadata extension. value is empty if
+// the key isn't set. The value is also stored, see Client.LookupMetadata().
+//
+// ErrNotSupported is returned if the draft/metadata-2 capability isn't
+// enabled. If the server rejects the request (e.g. the key isn't visible to
+// us), an *ErrEvent is returned with the FAIL event. ErrNoResponse is
+// returned if the server doesn't reply in time.
+func (c *Client) GetMetadata(target, key string) (value string, err error) {
+	event, err := c.metadata(target, key, &Event{Command: METADATA, Params: []string{target, "GET", key}})
+	if err != nil {
+		return "", err
+	}
+
+	if event.Command == RPL_KEYVALUE {
+		value = event.Trailing
+	}
+
+	return value, nil
+}
+
+// SetMetadata sets key on target (a channel or nickname, or "*" for
+// ourselves) to value, using the IRCv3 metadata extension, and waits for the
+// server to confirm the change. If value is empty, the key is removed. See
+// Client.GetMetadata() for the errors which may be returned.
+func (c *Client) SetMetadata(target, key, value string) error {
+	event := &Event{Command: METADATA, Params: []string{target, "SET", key}}
+	if value != "" {
+		event.Trailing = value
+	}
+
+	_, err := c.metadata(target, key, event)
+	return err
+}
+
+// metadata sends event (a METADATA GET or SET of key on target), and waits
+// for the reply.
+func (c *Client) metadata(target, key string, event *Event) (*Event, error) {
+	if !c.IsConnected() {
+		return nil, ErrNotConnected
+	}
+
+	if !c.supportsMetadata() {
+		return nil, ErrNotSupported{Feature: capMetadata}
+	}
+
+	if target == "" || strings.ContainsAny(target, " \r\n") {
+		return nil, ErrInvalidTarget{Target: target}
+	}
+
+	if key == "" || strings.ContainsAny(key, " \r\n") {
+		return nil, fmt.Errorf("invalid metadata key: %q", key)
+	}
+
+	reply, err := c.await(func() { c.Send(event) }, metadataTimeout, func(e *Event) bool {
+		if e.Command == FAIL {
+			return len(e.Params) > 1 && e.Params[0] == METADATA && (hasParam(e, key) || hasParam(e, target))
+		}
+
+		// <me> <target> <key> ...
+		return len(e.Params) > 2 && c.casefold(c.metadataTarget(e.Params[1])) == c.casefold(c.metadataTarget(target)) &&
+			e.Params[2] == key
+	}, RPL_KEYVALUE, RPL_KEYNOTSET, FAIL)
+	if err != nil {
+		return nil, err
+	}
+
+	if reply.Command == FAIL {
+		return nil, &ErrEvent{Event: reply}
+	}
+
+	return reply, nil
+}
+
+// supportsMetadata returns true if the metadata extension has been enabled.
+func (c *Client) supportsMetadata() bool {
+	if c.Config.disableTracking {
+		return true
+	}
+
+	return c.HasCap(capMetadata)
+}
+
+// metadataTarget returns target, where "*" is ourselves.
+func (c *Client) metadataTarget(target string) string {
+	if target == "*" {
+		return c.GetNick()
+	}
+
+	return target
+}
+
+// metadataEntry is the known metadata of a channel or user.
+type metadataEntry struct {
+	// target is the channel name or nickname.
+	target string
+	values map[string]string
+}
+
+// LookupMetadata returns a copy of the metadata which we know of for target
+// (a channel or nickname), i.e. which was returned by Client.GetMetadata(),
+// sent by the server when joining a channel (or when we subscribed to a key
+// which changed), or set by us. nil is returned if nothing is known. Will
+// panic if used when tracking has been disabled.
+func (c *Client) LookupMetadata(target string) map[string]string {
+	c.panicIfNotTracking()
+
+	target = c.metadataTarget(target)
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	values := c.state.metadata[c.state.casefold(target)].values
+	if len(values) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		out[k] = v
+	}
+
+	return out
+}
+
+// handleMetadata handles METADATA, RPL_KEYVALUE and RPL_KEYNOTSET, storing
+// (or removing) the value of the key. These may be sent individually (e.g.
+// in reply to a GET), or within a batch when synchronizing a target.
+func handleMetadata(c *Client, e Event) {
+	params := e.Params
+	if e.Command != METADATA {
+		// Skip our own nickname.
+		if len(params) == 0 {
+			return
+		}
+		params = params[1:]
+	}
+
+	// <target> <key> [<visibility> :<value>]
+	if len(params) < 2 {
+		return
+	}
+
+	target, key := c.metadataTarget(params[0]), params[1]
+	unset := e.Command == RPL_KEYNOTSET || (e.Command == METADATA && e.Trailing == "" && !e.EmptyTrailing)
+
+	c.state.Lock()
+	folded := c.state.casefold(target)
+	entry := c.state.metadata[folded]
+	if unset {
+		delete(entry.values, key)
+		if len(entry.values) == 0 {
+			delete(c.state.metadata, folded)
+		}
+	} else {
+		if entry.values == nil {
+			entry = metadataEntry{target: target, values: make(map[string]string)}
+			c.state.metadata[folded] = entry
+		}
+		entry.values[key] = e.Trailing
+	}
+	c.state.Unlock()
+
+	c.state.notify(c, UPDATE_STATE)
+}
+
+// handleMetadataSyncLater handles RPL_METADATASYNCLATER, where the server
+// has postponed sending the metadata of a target, by retrying the SYNC once
+// the server asks us to (or after a short delay).
+func handleMetadataSyncLater(c *Client, e Event) {
+	// <me> <target> [<retry after>]
+	if len(e.Params) < 2 {
+		return
+	}
+
+	target := e.Params[1]
+	delay := defaultMetadataSyncDelay
+	if len(e.Params) > 2 {
+		if secs, err := strconv.Atoi(e.Params[2]); err == nil && secs > 0 {
+			delay = time.Duration(secs) * time.Second
+		}
+	}
+
+	time.AfterFunc(delay, func() {
+		if c.IsConnected() {
+			c.Send(&Event{Command: METADATA, Params: []string{target, "SYNC"}})
+		}
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != METADATA || len(e.Params) < 3 {
+			return nil
+		}
+
+		target, sub, key := e.Params[0], e.Params[1], e.Params[2]
+		if target == "*" {
+			target = "test"
+		}
+
+		switch {
+		case key == "secret":
+			return []string{"FAIL METADATA KEY_NO_PERMISSION " + target + " secret :You do not have permission"}
+		case sub == "SET" && e.Trailing == "":
+			return []string{":dummy.int 766 test " + target + " " + key + " :key not set"}
+		case sub == "SET":
+			return []string{":dummy.int 761 test " + target + " " + key + " * :" + e.Trailing}
+		case key == "avatar":
+			return []string{":dummy.int 761 test " + target + " avatar * :https://example.com/a.png"}
+		default:
+			return []string{":dummy.int 766 test " + target + " " + key + " :key not set"}
+		}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if _, err := c.GetMetadata("nick", "avatar"); err == nil {
+		t.Fatal("Client.GetMetadata() should fail when metadata isn't supported")
+	}
+
+	c.state.Lock()
+	c.state.enabledCap = append(c.state.enabledCap, capMetadata)
+	c.state.Unlock()
+
+	value, err := c.GetMetadata("Nick", "avatar")
+	if err != nil {
+		t.Fatalf("Client.GetMetadata() returned error: %s", err)
+	}
+	if value != "https://example.com/a.png" {
+		t.Fatalf("Client.GetMetadata() = %q, wanted the avatar", value)
+	}
+
+	if value, err = c.GetMetadata("nick", "missing"); err != nil || value != "" {
+		t.Fatalf("Client.GetMetadata() = %q, %v, wanted an empty value", value, err)
+	}
+
+	if _, err = c.GetMetadata("nick", "secret"); err == nil {
+		t.Fatal("Client.GetMetadata() should fail when the server rejects the request")
+	} else if _, ok := err.(*ErrEvent); !ok {
+		t.Fatalf("Client.GetMetadata() error = %#v, wanted *ErrEvent", err)
+	}
+
+	if err = c.SetMetadata("*", "display-name", "Test User"); err != nil {
+		t.Fatalf("Client.SetMetadata() returned error: %s", err)
+	}
+	if err = c.SetMetadata("*", "status", "busy"); err != nil {
+		t.Fatalf("Client.SetMetadata() returned error: %s", err)
+	}
+	if err = c.SetMetadata("*", "status", ""); err != nil {
+		t.Fatalf("Client.SetMetadata() returned error: %s", err)
+	}
+
+	// Metadata of a channel, sent in a batch after joining it, and an update
+	// to a key which we're subscribed to.
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte(":dummy.int BATCH +sync metadata\r\n" +
+		"@batch=sync :dummy.int 761 test #channel url * :https://example.com\r\n" +
+		"@batch=sync :dummy.int 761 test #channel rules * :be nice\r\n" +
+		":dummy.int BATCH -sync\r\n" +
+		":dummy.int METADATA #channel rules *\r\n" +
+		":nick!user@host NICK renamed\r\n"))
+
+	want := map[string]map[string]string{
+		"renamed":  {"avatar": "https://example.com/a.png"},
+		"test":     {"display-name": "Test User"},
+		"#channel": {"url": "https://example.com"},
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := map[string]map[string]string{}
+		for target := range want {
+			if values := c.LookupMetadata(target); values != nil {
+				got[target] = values
+			}
+		}
+
+		if reflect.DeepEqual(got, want) && c.LookupMetadata("nick") == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Client.LookupMetadata() = %v, wanted %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a snapshot of the client metrics, see Client.Metrics().
+type Metrics struct {
+	// EventsIn and EventsOut are the number of events received from and
+	// sent to the server.
+	EventsIn  uint64
+	EventsOut uint64
+	// BytesIn and BytesOut are the number of bytes received from and sent to
+	// the server (including line endings).
+	BytesIn  uint64
+	BytesOut uint64
+	// Connects is the number of times the client has successfully connected
+	// (so reconnects are Connects-1).
+	Connects uint64
+	// HandlerPanics is the number of handler panics which were recovered
+	// (see Config.RecoverFunc).
+	HandlerPanics uint64
+	// MalformedLines is the number of lines received from the server which
+	// couldn't be parsed, and were skipped.
+	MalformedLines uint64
+	// Lag is the current latency to the server, see Client.Latency().
+	Lag time.Duration
+	// SendQueue is the number of events waiting to be sent, see
+	// Client.SendQueueLen().
+	SendQueue int
+	// Commands are the number of events received from the server, by command.
+	Commands map[string]uint64
+}
+
+// MetricsObserver can be implemented to feed client metrics into your own
+// monitoring system, see Config.MetricsObserver. Methods are called
+// synchronously from the client internals, so they must not block.
+type MetricsObserver interface {
+	// EventReceived is called for each event received from the server, with
+	// the size of the line in bytes.
+	EventReceived(event *Event, bytes int)
+	// EventSent is called for each event sent to the server, with the size
+	// of the line in bytes.
+	EventSent(event *Event, bytes int)
+	// Connected is called each time the client connects to server.
+	Connected(server string)
+	// HandlerPanic is called each time a handler panic is recovered.
+	HandlerPanic(err *HandlerError)
+}
+
+// clientMetrics holds the counters backing Client.Metrics().
+type clientMetrics struct {
+	eventsIn      uint64
+	eventsOut     uint64
+	bytesIn       uint64
+	bytesOut      uint64
+	connects      uint64
+	handlerPanics uint64
+	malformed     uint64
+	// commands maps commands to *uint64 counters.
+	commands sync.Map
+}
+
+// Metrics returns a snapshot of the client metrics. Counters are kept for
+// the lifetime of the client (across reconnects).
+func (c *Client) Metrics() Metrics {
+	m := Metrics{
+		EventsIn:       atomic.LoadUint64(&c.metrics.eventsIn),
+		EventsOut:      atomic.LoadUint64(&c.metrics.eventsOut),
+		BytesIn:        atomic.LoadUint64(&c.metrics.bytesIn),
+		BytesOut:       atomic.LoadUint64(&c.metrics.bytesOut),
+		Connects:       atomic.LoadUint64(&c.metrics.connects),
+		HandlerPanics:  atomic.LoadUint64(&c.metrics.handlerPanics),
+		MalformedLines: atomic.LoadUint64(&c.metrics.malformed),
+		Lag:            c.Latency(),
+		SendQueue:      c.SendQueueLen(),
+		Commands:       make(map[string]uint64),
+	}
+
+	c.metrics.commands.Range(func(key, value interface{}) bool {
+		m.Commands[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+
+	return m
+}
+
+// observeReceived records an event received from the server.
+func (c *Client) observeReceived(event *Event) {
+	size := event.Len() + len(endline)
+
+	atomic.AddUint64(&c.metrics.eventsIn, 1)
+	atomic.AddUint64(&c.metrics.bytesIn, uint64(size))
+
+	counter, ok := c.metrics.commands.Load(event.Command)
+	if !ok {
+		counter, _ = c.metrics.commands.LoadOrStore(event.Command, new(uint64))
+	}
+	atomic.AddUint64(counter.(*uint64), 1)
+
+	if c.Config.MetricsObserver != nil {
+		c.Config.MetricsObserver.EventReceived(event, size)
+	}
+}
+
+// observeSent records an event sent to the server.
+func (c *Client) observeSent(event *Event) {
+	size := event.Len() + len(endline)
+
+	atomic.AddUint64(&c.metrics.eventsOut, 1)
+	atomic.AddUint64(&c.metrics.bytesOut, uint64(size))
+
+	if c.Config.MetricsObserver != nil {
+		c.Config.MetricsObserver.EventSent(event, size)
+	}
+}
+
+// observeConnected records a successful connection to server.
+func (c *Client) observeConnected(server string) {
+	atomic.AddUint64(&c.metrics.connects, 1)
+
+	if c.Config.MetricsObserver != nil {
+		c.Config.MetricsObserver.Connected(server)
+	}
+}
+
+// observePanic records a recovered handler panic.
+func (c *Client) observePanic(err *HandlerError) {
+	atomic.AddUint64(&c.metrics.handlerPanics, 1)
+
+	if c.Config.MetricsObserver != nil {
+		c.Config.MetricsObserver.HandlerPanic(err)
+	}
+}
+
+// observeMalformed records a malformed line received from the server.
+func (c *Client) observeMalformed() {
+	atomic.AddUint64(&c.metrics.malformed, 1)
+}
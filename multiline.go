@@ -0,0 +1,169 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	capMultiline       = "draft/multiline"
+	tagMultilineConcat = "draft/multiline-concat"
+)
+
+// MessageMultiline sends a PRIVMSG to target, which may contain multiple
+// lines. If the draft/multiline capability has been negotiated, the lines
+// are sent as a single batch (splitting into multiple batches if needed to
+// respect the limits advertised by the server), which the server relays as
+// one logical message. Otherwise, each non-empty line is sent as a separate
+// PRIVMSG.
+func (cmd *Commands) MessageMultiline(target, message string) error {
+	if err := checkTargets(target); err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.Replace(message, "\r\n", "\n", -1), "\n")
+
+	if !cmd.c.HasCap(capMultiline) || !cmd.c.HasCap("batch") {
+		for i := 0; i < len(lines); i++ {
+			if lines[i] == "" {
+				continue
+			}
+
+			if err := cmd.Message(target, lines[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	maxLines, maxBytes := cmd.c.multilineLimits()
+
+	var batch []string
+	var size int
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ref := cmd.c.batchRef()
+		if err := cmd.c.Send(&Event{Command: BATCH, Params: []string{"+" + ref, capMultiline, target}}); err != nil {
+			return err
+		}
+		for i := 0; i < len(batch); i++ {
+			if err := cmd.c.Send(&Event{
+				Command: PRIVMSG, Params: []string{target}, Trailing: batch[i],
+				EmptyTrailing: true, Tags: Tags{"batch": ref},
+			}); err != nil {
+				return err
+			}
+		}
+
+		batch, size = nil, 0
+		return cmd.c.Send(&Event{Command: BATCH, Params: []string{"-" + ref}})
+	}
+
+	for _, line := range lines {
+		// The size includes the newline separating each line.
+		if len(batch) > 0 && ((maxLines > 0 && len(batch) >= maxLines) ||
+			(maxBytes > 0 && size+len(line)+1 > maxBytes)) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		batch = append(batch, line)
+		size += len(line) + 1
+	}
+
+	return flush()
+}
+
+// multilineLimits returns the max-lines and max-bytes values advertised by
+// the server for draft/multiline, which are 0 if not advertised.
+func (c *Client) multilineLimits() (maxLines, maxBytes int) {
+	c.state.RLock()
+	values := c.state.capValues[capMultiline]
+	c.state.RUnlock()
+
+	for _, value := range values {
+		i := strings.IndexByte(value, '=')
+		if i < 0 {
+			continue
+		}
+
+		n, _ := strconv.Atoi(value[i+1:])
+		switch value[:i] {
+		case "max-lines":
+			maxLines = n
+		case "max-bytes":
+			maxBytes = n
+		}
+	}
+
+	return maxLines, maxBytes
+}
+
+// batchRef generates a random reference tag for an outgoing batch.
+func (c *Client) batchRef() string {
+	return strconv.FormatInt(c.rand.Int63(), 36)
+}
+
+// assembleMultiline collects the events of incoming draft/multiline batches
+// (tracked in batches), and returns the reassembled message (with the lines
+// separated by newlines) once the batch ends. nil is returned for events
+// which are part of a multiline batch, and all other events are returned
+// as-is.
+func assembleMultiline(batches map[string]*Event, event *Event) *Event {
+	if event.Command == BATCH && len(event.Params) > 0 && len(event.Params[0]) > 1 {
+		ref := event.Params[0][1:]
+
+		switch {
+		case event.Params[0][0] == '+' && len(event.Params) > 2 && event.Params[1] == capMultiline:
+			// Tags of the batch (e.g. msgid, time) apply to the message as
+			// a whole.
+			out := &Event{Source: event.Source.Copy(), Tags: Tags{}, Timestamp: event.Timestamp}
+			for k, v := range event.Tags {
+				out.Tags[k] = v
+			}
+
+			batches[ref] = out
+			return nil
+		case event.Params[0][0] == '-' && batches[ref] != nil:
+			out := batches[ref]
+			delete(batches, ref)
+
+			if out.Command == "" {
+				// Empty batch.
+				return nil
+			}
+			return out
+		}
+
+		return event
+	}
+
+	ref, ok := event.Tags.Get("batch")
+	if !ok || batches[ref] == nil {
+		return event
+	}
+
+	out := batches[ref]
+	if out.Command == "" {
+		out.Command = event.Command
+		out.Params = event.Params
+		out.Trailing = event.Trailing
+		out.EmptyTrailing = true
+		return nil
+	}
+
+	if _, concat := event.Tags.Get(tagMultilineConcat); !concat {
+		out.Trailing += "\n"
+	}
+	out.Trailing += event.Trailing
+	return nil
+}
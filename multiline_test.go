@@ -0,0 +1,107 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageMultiline(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	sent := make(chan *Event, 20)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == PRIVMSG || e.Command == BATCH {
+			sent <- e
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	expect := func(want string) *Event {
+		t.Helper()
+		select {
+		case e := <-sent:
+			if got := strings.TrimSpace(e.String()); !strings.HasPrefix(got, want) {
+				t.Fatalf("got %q, wanted %q", got, want)
+			}
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+		return nil
+	}
+
+	// Without the capability, each line is sent separately.
+	c.Cmd.MessageMultiline("#channel", "a\n\nb")
+	expect("PRIVMSG #channel :a")
+	expect("PRIVMSG #channel :b")
+
+	c.state.Lock()
+	c.state.enabledCap = append(c.state.enabledCap, "batch", capMultiline)
+	c.state.capValues[capMultiline] = []string{"max-bytes=4096", "max-lines=2"}
+	c.state.Unlock()
+
+	c.Cmd.MessageMultiline("#channel", "a\r\n\nb")
+	start := expect("BATCH +")
+	ref := start.Params[0][1:]
+	for _, want := range []string{"@batch=" + ref + " PRIVMSG #channel :a", "@batch=" + ref + " PRIVMSG #channel :", "BATCH -" + ref} {
+		expect(want)
+	}
+	expect("BATCH +")
+	expect("@batch=")
+	expect("BATCH -")
+}
+
+func TestAssembleMultiline(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	got := make(chan Event, 5)
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		got <- e
+	})
+
+	go mockReadBuffer(conn)
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	_, err := conn.Write([]byte(
+		"@msgid=xyz :nick!user@host BATCH +123 draft/multiline #channel\r\n" +
+			"@batch=123 :nick!user@host PRIVMSG #channel :hello\r\n" +
+			"@batch=123 :nick!user@host PRIVMSG #channel :world\r\n" +
+			"@batch=123;draft/multiline-concat :nick!user@host PRIVMSG #channel :!\r\n" +
+			":nick!user@host BATCH -123\r\n" +
+			":nick!user@host PRIVMSG #channel :single\r\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"hello\nworld!", "single"} {
+		select {
+		case e := <-got:
+			if e.Trailing != want {
+				t.Fatalf("got message %q, wanted %q", e.Trailing, want)
+			}
+			if want != "single" {
+				if id, _ := e.Tags.Get("msgid"); id != "xyz" || e.Source.Name != "nick" {
+					t.Fatalf("reassembled event missing msgid/source: %#v", e)
+				}
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for message %q", want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import "strings"
+
+// numericNames maps numeric replies to their canonical constant names. Where
+// multiple names share the same numeric, the most common one is used (e.g.
+// RPL_ISUPPORT over RPL_BOUNCE).
+var numericNames = map[string]string{
+	RPL_WELCOME:           "RPL_WELCOME",
+	RPL_YOURHOST:          "RPL_YOURHOST",
+	RPL_CREATED:           "RPL_CREATED",
+	RPL_MYINFO:            "RPL_MYINFO",
+	RPL_ISUPPORT:          "RPL_ISUPPORT",
+	RPL_YOURID:            "RPL_YOURID",
+	RPL_TRACELINK:         "RPL_TRACELINK",
+	RPL_TRACECONNECTING:   "RPL_TRACECONNECTING",
+	RPL_TRACEHANDSHAKE:    "RPL_TRACEHANDSHAKE",
+	RPL_TRACEUNKNOWN:      "RPL_TRACEUNKNOWN",
+	RPL_TRACEOPERATOR:     "RPL_TRACEOPERATOR",
+	RPL_TRACEUSER:         "RPL_TRACEUSER",
+	RPL_TRACESERVER:       "RPL_TRACESERVER",
+	RPL_TRACESERVICE:      "RPL_TRACESERVICE",
+	RPL_TRACENEWTYPE:      "RPL_TRACENEWTYPE",
+	RPL_TRACECLASS:        "RPL_TRACECLASS",
+	RPL_TRACERECONNECT:    "RPL_TRACERECONNECT",
+	RPL_STATSLINKINFO:     "RPL_STATSLINKINFO",
+	RPL_STATSCOMMANDS:     "RPL_STATSCOMMANDS",
+	RPL_STATSCLINE:        "RPL_STATSCLINE",
+	RPL_STATSNLINE:        "RPL_STATSNLINE",
+	RPL_STATSILINE:        "RPL_STATSILINE",
+	RPL_STATSKLINE:        "RPL_STATSKLINE",
+	RPL_STATSQLINE:        "RPL_STATSQLINE",
+	RPL_STATSYLINE:        "RPL_STATSYLINE",
+	RPL_ENDOFSTATS:        "RPL_ENDOFSTATS",
+	RPL_UMODEIS:           "RPL_UMODEIS",
+	RPL_SERVICEINFO:       "RPL_SERVICEINFO",
+	RPL_ENDOFSERVICES:     "RPL_ENDOFSERVICES",
+	RPL_SERVICE:           "RPL_SERVICE",
+	RPL_SERVLIST:          "RPL_SERVLIST",
+	RPL_SERVLISTEND:       "RPL_SERVLISTEND",
+	RPL_STATSVLINE:        "RPL_STATSVLINE",
+	RPL_STATSLLINE:        "RPL_STATSLLINE",
+	RPL_STATSUPTIME:       "RPL_STATSUPTIME",
+	RPL_STATSOLINE:        "RPL_STATSOLINE",
+	RPL_STATSHLINE:        "RPL_STATSHLINE",
+	RPL_STATSSLINE:        "RPL_STATSSLINE",
+	RPL_STATSPING:         "RPL_STATSPING",
+	RPL_STATSBLINE:        "RPL_STATSBLINE",
+	RPL_STATSDLINE:        "RPL_STATSDLINE",
+	RPL_LUSERCLIENT:       "RPL_LUSERCLIENT",
+	RPL_LUSEROP:           "RPL_LUSEROP",
+	RPL_LUSERUNKNOWN:      "RPL_LUSERUNKNOWN",
+	RPL_LUSERCHANNELS:     "RPL_LUSERCHANNELS",
+	RPL_LUSERME:           "RPL_LUSERME",
+	RPL_ADMINME:           "RPL_ADMINME",
+	RPL_ADMINLOC1:         "RPL_ADMINLOC1",
+	RPL_ADMINLOC2:         "RPL_ADMINLOC2",
+	RPL_ADMINEMAIL:        "RPL_ADMINEMAIL",
+	RPL_TRACELOG:          "RPL_TRACELOG",
+	RPL_TRACEEND:          "RPL_TRACEEND",
+	RPL_TRYAGAIN:          "RPL_TRYAGAIN",
+	RPL_LOCALUSERS:        "RPL_LOCALUSERS",
+	RPL_GLOBALUSERS:       "RPL_GLOBALUSERS",
+	RPL_WHOISCERTFP:       "RPL_WHOISCERTFP",
+	RPL_NONE:              "RPL_NONE",
+	RPL_AWAY:              "RPL_AWAY",
+	RPL_USERHOST:          "RPL_USERHOST",
+	RPL_ISON:              "RPL_ISON",
+	RPL_UNAWAY:            "RPL_UNAWAY",
+	RPL_NOWAWAY:           "RPL_NOWAWAY",
+	RPL_WHOISUSER:         "RPL_WHOISUSER",
+	RPL_WHOISSERVER:       "RPL_WHOISSERVER",
+	RPL_WHOISOPERATOR:     "RPL_WHOISOPERATOR",
+	RPL_WHOWASUSER:        "RPL_WHOWASUSER",
+	RPL_ENDOFWHO:          "RPL_ENDOFWHO",
+	RPL_WHOISCHANOP:       "RPL_WHOISCHANOP",
+	RPL_WHOISIDLE:         "RPL_WHOISIDLE",
+	RPL_ENDOFWHOIS:        "RPL_ENDOFWHOIS",
+	RPL_WHOISCHANNELS:     "RPL_WHOISCHANNELS",
+	RPL_LISTSTART:         "RPL_LISTSTART",
+	RPL_LIST:              "RPL_LIST",
+	RPL_LISTEND:           "RPL_LISTEND",
+	RPL_CHANNELMODEIS:     "RPL_CHANNELMODEIS",
+	RPL_UNIQOPIS:          "RPL_UNIQOPIS",
+	RPL_CREATIONTIME:      "RPL_CREATIONTIME",
+	RPL_WHOISACCOUNT:      "RPL_WHOISACCOUNT",
+	RPL_NOTOPIC:           "RPL_NOTOPIC",
+	RPL_TOPIC:             "RPL_TOPIC",
+	RPL_TOPICWHOTIME:      "RPL_TOPICWHOTIME",
+	RPL_WHOISACTUALLY:     "RPL_WHOISACTUALLY",
+	RPL_INVITING:          "RPL_INVITING",
+	RPL_SUMMONING:         "RPL_SUMMONING",
+	RPL_INVITELIST:        "RPL_INVITELIST",
+	RPL_ENDOFINVITELIST:   "RPL_ENDOFINVITELIST",
+	RPL_EXCEPTLIST:        "RPL_EXCEPTLIST",
+	RPL_ENDOFEXCEPTLIST:   "RPL_ENDOFEXCEPTLIST",
+	RPL_VERSION:           "RPL_VERSION",
+	RPL_WHOREPLY:          "RPL_WHOREPLY",
+	RPL_NAMREPLY:          "RPL_NAMREPLY",
+	RPL_WHOSPCRPL:         "RPL_WHOSPCRPL",
+	RPL_KILLDONE:          "RPL_KILLDONE",
+	RPL_CLOSING:           "RPL_CLOSING",
+	RPL_CLOSEEND:          "RPL_CLOSEEND",
+	RPL_LINKS:             "RPL_LINKS",
+	RPL_ENDOFLINKS:        "RPL_ENDOFLINKS",
+	RPL_ENDOFNAMES:        "RPL_ENDOFNAMES",
+	RPL_BANLIST:           "RPL_BANLIST",
+	RPL_ENDOFBANLIST:      "RPL_ENDOFBANLIST",
+	RPL_ENDOFWHOWAS:       "RPL_ENDOFWHOWAS",
+	RPL_INFO:              "RPL_INFO",
+	RPL_MOTD:              "RPL_MOTD",
+	RPL_INFOSTART:         "RPL_INFOSTART",
+	RPL_ENDOFINFO:         "RPL_ENDOFINFO",
+	RPL_MOTDSTART:         "RPL_MOTDSTART",
+	RPL_ENDOFMOTD:         "RPL_ENDOFMOTD",
+	RPL_WHOISHOST:         "RPL_WHOISHOST",
+	RPL_YOUREOPER:         "RPL_YOUREOPER",
+	RPL_REHASHING:         "RPL_REHASHING",
+	RPL_YOURESERVICE:      "RPL_YOURESERVICE",
+	RPL_MYPORTIS:          "RPL_MYPORTIS",
+	RPL_TIME:              "RPL_TIME",
+	RPL_USERSSTART:        "RPL_USERSSTART",
+	RPL_USERS:             "RPL_USERS",
+	RPL_ENDOFUSERS:        "RPL_ENDOFUSERS",
+	RPL_NOUSERS:           "RPL_NOUSERS",
+	RPL_HOSTHIDDEN:        "RPL_HOSTHIDDEN",
+	ERR_UNKNOWNERROR:      "ERR_UNKNOWNERROR",
+	ERR_NOSUCHNICK:        "ERR_NOSUCHNICK",
+	ERR_NOSUCHSERVER:      "ERR_NOSUCHSERVER",
+	ERR_NOSUCHCHANNEL:     "ERR_NOSUCHCHANNEL",
+	ERR_CANNOTSENDTOCHAN:  "ERR_CANNOTSENDTOCHAN",
+	ERR_TOOMANYCHANNELS:   "ERR_TOOMANYCHANNELS",
+	ERR_WASNOSUCHNICK:     "ERR_WASNOSUCHNICK",
+	ERR_TOOMANYTARGETS:    "ERR_TOOMANYTARGETS",
+	ERR_NOSUCHSERVICE:     "ERR_NOSUCHSERVICE",
+	ERR_NOORIGIN:          "ERR_NOORIGIN",
+	ERR_INVALIDCAPCMD:     "ERR_INVALIDCAPCMD",
+	ERR_NORECIPIENT:       "ERR_NORECIPIENT",
+	ERR_NOTEXTTOSEND:      "ERR_NOTEXTTOSEND",
+	ERR_NOTOPLEVEL:        "ERR_NOTOPLEVEL",
+	ERR_WILDTOPLEVEL:      "ERR_WILDTOPLEVEL",
+	ERR_BADMASK:           "ERR_BADMASK",
+	ERR_TOOMANYMATCHES:    "ERR_TOOMANYMATCHES",
+	ERR_INPUTTOOLONG:      "ERR_INPUTTOOLONG",
+	ERR_UNKNOWNCOMMAND:    "ERR_UNKNOWNCOMMAND",
+	ERR_NOMOTD:            "ERR_NOMOTD",
+	ERR_NOADMININFO:       "ERR_NOADMININFO",
+	ERR_FILEERROR:         "ERR_FILEERROR",
+	ERR_NONICKNAMEGIVEN:   "ERR_NONICKNAMEGIVEN",
+	ERR_ERRONEUSNICKNAME:  "ERR_ERRONEUSNICKNAME",
+	ERR_NICKNAMEINUSE:     "ERR_NICKNAMEINUSE",
+	ERR_NICKCOLLISION:     "ERR_NICKCOLLISION",
+	ERR_UNAVAILRESOURCE:   "ERR_UNAVAILRESOURCE",
+	ERR_USERNOTINCHANNEL:  "ERR_USERNOTINCHANNEL",
+	ERR_NOTONCHANNEL:      "ERR_NOTONCHANNEL",
+	ERR_USERONCHANNEL:     "ERR_USERONCHANNEL",
+	ERR_NOLOGIN:           "ERR_NOLOGIN",
+	ERR_SUMMONDISABLED:    "ERR_SUMMONDISABLED",
+	ERR_USERSDISABLED:     "ERR_USERSDISABLED",
+	ERR_NOTREGISTERED:     "ERR_NOTREGISTERED",
+	ERR_NEEDMOREPARAMS:    "ERR_NEEDMOREPARAMS",
+	ERR_ALREADYREGISTRED:  "ERR_ALREADYREGISTRED",
+	ERR_NOPERMFORHOST:     "ERR_NOPERMFORHOST",
+	ERR_PASSWDMISMATCH:    "ERR_PASSWDMISMATCH",
+	ERR_YOUREBANNEDCREEP:  "ERR_YOUREBANNEDCREEP",
+	ERR_YOUWILLBEBANNED:   "ERR_YOUWILLBEBANNED",
+	ERR_KEYSET:            "ERR_KEYSET",
+	ERR_LINKCHANNEL:       "ERR_LINKCHANNEL",
+	ERR_CHANNELISFULL:     "ERR_CHANNELISFULL",
+	ERR_UNKNOWNMODE:       "ERR_UNKNOWNMODE",
+	ERR_INVITEONLYCHAN:    "ERR_INVITEONLYCHAN",
+	ERR_BANNEDFROMCHAN:    "ERR_BANNEDFROMCHAN",
+	ERR_BADCHANNELKEY:     "ERR_BADCHANNELKEY",
+	ERR_BADCHANMASK:       "ERR_BADCHANMASK",
+	ERR_NOCHANMODES:       "ERR_NOCHANMODES",
+	ERR_BANLISTFULL:       "ERR_BANLISTFULL",
+	ERR_CANNOTKNOCK:       "ERR_CANNOTKNOCK",
+	ERR_NOPRIVILEGES:      "ERR_NOPRIVILEGES",
+	ERR_CHANOPRIVSNEEDED:  "ERR_CHANOPRIVSNEEDED",
+	ERR_CANTKILLSERVER:    "ERR_CANTKILLSERVER",
+	ERR_RESTRICTED:        "ERR_RESTRICTED",
+	ERR_UNIQOPPRIVSNEEDED: "ERR_UNIQOPPRIVSNEEDED",
+	ERR_NOOPERHOST:        "ERR_NOOPERHOST",
+	ERR_NOSERVICEHOST:     "ERR_NOSERVICEHOST",
+	ERR_UMODEUNKNOWNFLAG:  "ERR_UMODEUNKNOWNFLAG",
+	ERR_USERSDONTMATCH:    "ERR_USERSDONTMATCH",
+	ERR_INVALIDKEY:        "ERR_INVALIDKEY",
+	RPL_STARTTLS:          "RPL_STARTTLS",
+	RPL_WHOISSECURE:       "RPL_WHOISSECURE",
+	ERR_STARTTLS:          "ERR_STARTTLS",
+	RPL_KNOCK:             "RPL_KNOCK",
+	RPL_KNOCKDLVR:         "RPL_KNOCKDLVR",
+	ERR_TOOMANYKNOCK:      "ERR_TOOMANYKNOCK",
+	ERR_CHANOPEN:          "ERR_CHANOPEN",
+	ERR_KNOCKONCHAN:       "ERR_KNOCKONCHAN",
+	RPL_MONONLINE:         "RPL_MONONLINE",
+	RPL_MONOFFLINE:        "RPL_MONOFFLINE",
+	RPL_MONLIST:           "RPL_MONLIST",
+	RPL_ENDOFMONLIST:      "RPL_ENDOFMONLIST",
+	ERR_MONLISTFULL:       "ERR_MONLISTFULL",
+	RPL_LOGGEDIN:          "RPL_LOGGEDIN",
+	RPL_LOGGEDOUT:         "RPL_LOGGEDOUT",
+	RPL_NICKLOCKED:        "RPL_NICKLOCKED",
+	RPL_SASLSUCCESS:       "RPL_SASLSUCCESS",
+	ERR_SASLFAIL:          "ERR_SASLFAIL",
+	ERR_SASLTOOLONG:       "ERR_SASLTOOLONG",
+	ERR_SASLABORTED:       "ERR_SASLABORTED",
+	ERR_SASLALREADY:       "ERR_SASLALREADY",
+	RPL_SASLMECHS:         "RPL_SASLMECHS",
+	RPL_KEYVALUE:          "RPL_KEYVALUE",
+	RPL_KEYNOTSET:         "RPL_KEYNOTSET",
+	RPL_METADATASYNCLATER: "RPL_METADATASYNCLATER",
+}
+
+// numericCodes maps the names of numeric replies to the numeric, i.e. the
+// inverse of numericNames, along with names which aren't canonical (e.g.
+// RPL_BOUNCE).
+var numericCodes = func() map[string]string {
+	codes := map[string]string{
+		"RPL_BOUNCE": RPL_BOUNCE,
+	}
+
+	for numeric, name := range numericNames {
+		codes[name] = numeric
+	}
+
+	return codes
+}()
+
+// IsNumeric returns true if command is a three digit numeric reply, e.g.
+// "001" or "433".
+func IsNumeric(command string) bool {
+	if len(command) != 3 {
+		return false
+	}
+
+	for i := 0; i < len(command); i++ {
+		if command[i] < '0' || command[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsError returns true if command is a numeric reply which denotes an error.
+// This includes the standard 400-599 range, as well as known error numerics
+// outside of it (e.g. ERR_SASLFAIL).
+func IsError(command string) bool {
+	if !IsNumeric(command) {
+		return false
+	}
+
+	if command[0] == '4' || command[0] == '5' {
+		return true
+	}
+
+	name, ok := numericNames[command]
+	return ok && name[:4] == "ERR_"
+}
+
+// NumericName returns the canonical name of the numeric reply (e.g.
+// "RPL_WELCOME" for "001"). If the numeric is unknown, or command isn't a
+// numeric, command is returned as-is.
+func NumericName(command string) string {
+	if name, ok := numericNames[command]; ok {
+		return name
+	}
+
+	return command
+}
+
+// NumericCode returns the numeric of the named numeric reply (e.g. "001"
+// for "RPL_WELCOME"), i.e. the inverse of NumericName(). If the name is
+// unknown, name is returned as-is.
+func NumericCode(name string) string {
+	if numeric, ok := numericCodes[name]; ok {
+		return numeric
+	}
+
+	return name
+}
+
+// normalizeCommand returns the command used to register (and look up)
+// handlers for cmd, which is uppercased, and if it's the name of a numeric
+// reply (e.g. "RPL_WELCOME"), the numeric itself. See Caller.Add().
+func normalizeCommand(cmd string) string {
+	return NumericCode(strings.ToUpper(cmd))
+}
@@ -0,0 +1,49 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import "testing"
+
+func TestNumeric(t *testing.T) {
+	tests := []struct {
+		command string
+		numeric bool
+		isError bool
+		name    string
+	}{
+		{command: RPL_WELCOME, numeric: true, name: "RPL_WELCOME"},
+		{command: RPL_ISUPPORT, numeric: true, name: "RPL_ISUPPORT"},
+		{command: ERR_NICKNAMEINUSE, numeric: true, isError: true, name: "ERR_NICKNAMEINUSE"},
+		{command: ERR_SASLFAIL, numeric: true, isError: true, name: "ERR_SASLFAIL"},
+		{command: RPL_SASLSUCCESS, numeric: true, name: "RPL_SASLSUCCESS"},
+		{command: "499", numeric: true, isError: true, name: "499"},
+		{command: "999", numeric: true, name: "999"},
+		{command: PRIVMSG, name: PRIVMSG},
+		{command: "01", name: "01"},
+		{command: "0a1", name: "0a1"},
+	}
+
+	for _, tt := range tests {
+		if got := IsNumeric(tt.command); got != tt.numeric {
+			t.Errorf("IsNumeric(%q) = %v, want %v", tt.command, got, tt.numeric)
+		}
+
+		if got := IsError(tt.command); got != tt.isError {
+			t.Errorf("IsError(%q) = %v, want %v", tt.command, got, tt.isError)
+		}
+
+		if got := NumericName(tt.command); got != tt.name {
+			t.Errorf("NumericName(%q) = %q, want %q", tt.command, got, tt.name)
+		}
+
+		if got := NumericCode(tt.name); got != tt.command {
+			t.Errorf("NumericCode(%q) = %q, want %q", tt.name, got, tt.command)
+		}
+	}
+
+	if got := NumericCode("RPL_BOUNCE"); got != RPL_ISUPPORT {
+		t.Errorf("NumericCode(%q) = %q, want %q", "RPL_BOUNCE", got, RPL_ISUPPORT)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// presenceTimeout is how long Client.IsOn() and Client.UserHost() wait for
+// each reply from the server.
+const presenceTimeout = 10 * time.Second
+
+// maxUserHostNicks is the maximum amount of nicknames which can be queried
+// with a single USERHOST command, per RFC2812.
+const maxUserHostNicks = 5
+
+// IsOn queries which of nicks are currently online using ISON, which may be
+// used as a fallback on networks which don't support MONITOR. The nicknames
+// which are online are returned, as given by the server. Large queries are
+// split across multiple ISON commands. ErrNoResponse is returned if the
+// server doesn't reply in time.
+func (c *Client) IsOn(nicks ...string) ([]string, error) {
+	if !c.IsConnected() {
+		return nil, ErrNotConnected
+	}
+
+	var online []string
+	for _, batch := range batchNicks(nicks, maxLength-len(ISON)-1, 0) {
+		event, err := c.await(func() {
+			c.Send(&Event{Command: ISON, Params: batch})
+		}, presenceTimeout, func(e *Event) bool { return true }, RPL_ISON)
+		if err != nil {
+			return online, err
+		}
+
+		online = append(online, strings.Fields(event.Trailing)...)
+	}
+
+	return online, nil
+}
+
+// UserHostEntry is a single entry from a USERHOST reply. See
+// Client.UserHost().
+type UserHostEntry struct {
+	// Nick is the nickname of the user.
+	Nick string
+	// Ident is the ident/username of the user.
+	Ident string
+	// Host is the hostname of the user.
+	Host string
+	// Oper is true if the user is an IRC operator.
+	Oper bool
+	// Away is true if the user is marked as away.
+	Away bool
+}
+
+// UserHost queries information about nicks using USERHOST, which may be used
+// as a fallback on networks which don't support MONITOR. Entries are only
+// returned for nicknames which are online. Queries are split across
+// multiple USERHOST commands, as servers only allow 5 nicknames per
+// command. ErrNoResponse is returned if the server doesn't reply in time.
+func (c *Client) UserHost(nicks ...string) ([]UserHostEntry, error) {
+	if !c.IsConnected() {
+		return nil, ErrNotConnected
+	}
+
+	var entries []UserHostEntry
+	for _, batch := range batchNicks(nicks, maxLength-len(USERHOST)-1, maxUserHostNicks) {
+		event, err := c.await(func() {
+			c.Send(&Event{Command: USERHOST, Params: batch})
+		}, presenceTimeout, func(e *Event) bool { return true }, RPL_USERHOST)
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, parseUserHost(event.Trailing)...)
+	}
+
+	return entries, nil
+}
+
+// parseUserHost parses the trailing text of an RPL_USERHOST reply, e.g.
+// "nick*=+user@host other=-user@host".
+func parseUserHost(raw string) []UserHostEntry {
+	var entries []UserHostEntry
+
+	for _, reply := range strings.Fields(raw) {
+		sep := strings.IndexByte(reply, '=')
+		if sep < 1 || len(reply) < sep+2 {
+			continue
+		}
+
+		entry := UserHostEntry{Nick: reply[:sep], Away: reply[sep+1] == '-'}
+		if strings.HasSuffix(entry.Nick, "*") {
+			entry.Nick = entry.Nick[:len(entry.Nick)-1]
+			entry.Oper = true
+		}
+
+		mask := reply[sep+2:]
+		if at := strings.IndexByte(mask, '@'); at >= 0 {
+			entry.Ident, entry.Host = mask[:at], mask[at+1:]
+		} else {
+			entry.Host = mask
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// batchNicks splits nicks into batches, where each batch (space separated)
+// is no longer than max, and has no more than limit nicknames (if limit is
+// greater than 0).
+func batchNicks(nicks []string, max, limit int) [][]string {
+	var batches [][]string
+	var batch []string
+	var length int
+
+	for i := 0; i < len(nicks); i++ {
+		if len(batch) > 0 && (length+len(nicks[i])+1 > max || (limit > 0 && len(batch) >= limit)) {
+			batches = append(batches, batch)
+			batch, length = nil, 0
+		}
+
+		batch = append(batch, nicks[i])
+		length += len(nicks[i]) + 1
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// whoTimeout is how long Client.WhoChannel() waits for the server to finish
+// replying.
+const whoTimeout = 30 * time.Second
+
+// WhoxReply is a single member returned by Client.WhoChannel().
+type WhoxReply struct {
+	// Channel is the channel which was queried.
+	Channel string
+	// Nick is the nickname of the member.
+	Nick string
+	// Ident is the ident/username of the member.
+	Ident string
+	// Host is the hostname of the member.
+	Host string
+	// Flags are the WHO flags of the member, e.g. "H@" (here, and an
+	// operator of the channel), or "G" (away).
+	Flags string
+	// Account is the account the member is logged into, or empty if they
+	// aren't logged in (or the server doesn't support WHOX).
+	Account string
+	// Realname is the realname (gecos) of the member.
+	Realname string
+}
+
+// Away returns true if the member is marked as away.
+func (r WhoxReply) Away() bool {
+	return strings.HasPrefix(r.Flags, "G")
+}
+
+// WhoChannel queries all members of channel, including which account each
+// member is logged into, using a single WHOX query (WHO with a format and
+// token), which is much more efficient than a WHOIS for each member. If the
+// server doesn't advertise WHOX support, a plain WHO is used instead, in
+// which case accounts aren't available.
+//
+// The query is complete once the server sends RPL_ENDOFWHO for channel.
+// See Client.SendAndWait() for the caveats of waiting for a reply.
+func (c *Client) WhoChannel(channel string) ([]WhoxReply, error) {
+	if !c.validChannel(channel) {
+		return nil, ErrInvalidTarget{Target: channel}
+	}
+
+	whox := c.supportsOption("WHOX")
+
+	// Tokens 1 and 2 are used for WHO queries sent by girc itself, and can
+	// be up to 3 digits.
+	token := strconv.Itoa(100 + c.rand.Intn(900))
+
+	event := &Event{Command: WHO, Params: []string{channel}}
+	if whox {
+		event.Params = append(event.Params, "%tcuhnfar,"+token)
+	}
+
+	// Other WHO queries (e.g. the one sent after joining a channel) may
+	// finish in the meantime, so only our own RPL_ENDOFWHO counts.
+	events, err := c.sendAndCollect(event, whoTimeout, func(e *Event) bool {
+		return e.Command == RPL_ENDOFWHO && len(e.Params) > 1 && c.casefold(e.Params[1]) == c.casefold(channel)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var replies []WhoxReply
+	for i := 0; i < len(events); i++ {
+		e := events[i]
+
+		switch {
+		case whox && e.Command == RPL_WHOSPCRPL && len(e.Params) == 8 && e.Params[1] == token:
+			// <me> <token> <channel> <ident> <host> <nick> <flags> <account> :<realname>
+			reply := WhoxReply{
+				Channel: e.Params[2], Ident: e.Params[3], Host: e.Params[4],
+				Nick: e.Params[5], Flags: e.Params[6], Account: e.Params[7],
+				Realname: e.Trailing,
+			}
+
+			if reply.Account == "0" {
+				reply.Account = ""
+			}
+
+			replies = append(replies, reply)
+		case !whox && e.Command == RPL_WHOREPLY && len(e.Params) == 7 && c.casefold(e.Params[1]) == c.casefold(channel):
+			// <me> <channel> <ident> <host> <server> <nick> <flags> :<hopcount> <realname>
+			reply := WhoxReply{
+				Channel: e.Params[1], Ident: e.Params[2], Host: e.Params[3],
+				Nick: e.Params[5], Flags: e.Params[6],
+			}
+
+			if sep := strings.IndexByte(e.Trailing, ' '); sep >= 0 {
+				reply.Realname = e.Trailing[sep+1:]
+			}
+
+			replies = append(replies, reply)
+		}
+	}
+
+	return replies, nil
+}
+
+// Monitor asks the server to notify us when any of nicks come online or go
+// offline, using MONITOR. Notifications are sent as MONITOR_ONLINE and
+// MONITOR_OFFLINE events. The server immediately notifies us of the current
+// status of each nickname. As the server forgets monitored nicknames when we
+// disconnect, Monitor must be called again after reconnecting.
+//
+// If the extended-monitor capability is enabled, MONITOR_ONLINE events
+// include the "account" tag (see Event.Tags) when the account of the user is
+// known. Note that the server doesn't tell us the account of a user when
+// they come online, so it's only known if we share a channel with them, or
+// were notified of them logging in since (see CAP_ACCOUNT).
+//
+// ErrNotSupported is returned if the server doesn't advertise MONITOR
+// support via RPL_ISUPPORT.
+func (c *Client) Monitor(nicks ...string) error {
+	return c.monitor(ModeAddPrefix, nicks)
+}
+
+// Unmonitor stops monitoring nicks, see Client.Monitor().
+func (c *Client) Unmonitor(nicks ...string) error {
+	return c.monitor(ModeDelPrefix, nicks)
+}
+
+// monitor adds (with "+") or removes (with "-") nicks from our MONITOR list.
+func (c *Client) monitor(action string, nicks []string) error {
+	if !c.supportsOption(MONITOR) {
+		return ErrNotSupported{Feature: MONITOR}
+	}
+
+	if err := checkTargets(nicks...); err != nil {
+		return err
+	}
+
+	folded := make([]string, len(nicks))
+	for i := 0; i < len(nicks); i++ {
+		folded[i] = c.casefold(nicks[i])
+	}
+
+	c.state.Lock()
+	for i := 0; i < len(folded); i++ {
+		if action == ModeDelPrefix {
+			delete(c.state.monitor, folded[i])
+		} else if _, ok := c.state.monitor[folded[i]]; !ok {
+			c.state.monitor[folded[i]] = monitorEntry{nick: nicks[i]}
+		}
+	}
+	c.state.Unlock()
+
+	for _, batch := range batchNicks(nicks, maxLength-len(MONITOR)-3, 0) {
+		if err := c.Send(&Event{Command: MONITOR, Params: []string{action, strings.Join(batch, ",")}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// monitorEntry is a nickname which we've asked the server to monitor.
+type monitorEntry struct {
+	// nick is the nickname as given to Client.Monitor().
+	nick string
+	// account is the account of the user, if known.
+	account string
+}
+
+// handleMonitor handles RPL_MONONLINE and RPL_MONOFFLINE, sending a
+// MONITOR_ONLINE or MONITOR_OFFLINE event for each nickname.
+func handleMonitor(c *Client, e Event) {
+	for _, target := range strings.Split(e.Trailing, ",") {
+		if target == "" {
+			continue
+		}
+
+		source := ParseSource(target)
+		nick := c.casefold(source.Name)
+
+		if e.Command == RPL_MONOFFLINE {
+			if !c.Config.disableTracking {
+				c.state.Lock()
+				if entry, ok := c.state.monitor[nick]; ok {
+					// They'll need to log in again.
+					entry.account = ""
+					c.state.monitor[nick] = entry
+				}
+				c.state.Unlock()
+			}
+
+			c.RunHandlers(&Event{Command: MONITOR_OFFLINE, Params: []string{source.Name}})
+			continue
+		}
+
+		event := &Event{Command: MONITOR_ONLINE, Source: source, Params: []string{source.Name}}
+		if account := c.monitorAccount(source.Name); account != "" {
+			event.Tags = Tags{"account": account}
+		}
+
+		c.RunHandlers(event)
+	}
+}
+
+// monitorAccount returns the account of the monitored user nick, if known.
+// This requires extended-monitor.
+func (c *Client) monitorAccount(nick string) string {
+	if c.Config.disableTracking || !c.HasCap("extended-monitor") {
+		return ""
+	}
+
+	folded := c.casefold(nick)
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	if entry := c.state.monitor[folded]; entry.account != "" {
+		return entry.account
+	}
+
+	if user := c.state.lookupUser(nick); user != nil {
+		return user.Extras.Account
+	}
+
+	return ""
+}
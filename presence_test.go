@@ -0,0 +1,241 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsOnUserHost(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	online := map[string]string{
+		"alice": "alice*=+a@alice.host",
+		"bob":   "bob=-b@bob.host",
+		"frank": "frank=+f@frank.host",
+	}
+
+	var userhosts int
+	go mockRespond(conn, func(e *Event) []string {
+		var replies []string
+		for i := 0; i < len(e.Params); i++ {
+			if reply, ok := online[e.Params[i]]; ok {
+				if e.Command == ISON {
+					reply = e.Params[i]
+				}
+				replies = append(replies, reply)
+			}
+		}
+
+		switch e.Command {
+		case ISON:
+			return []string{":dummy.int 303 test :" + strings.Join(replies, " ")}
+		case USERHOST:
+			userhosts++
+			return []string{":dummy.int 302 test :" + strings.Join(replies, " ")}
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	nicks, err := c.IsOn("alice", "bob", "carol")
+	if err != nil {
+		t.Fatalf("Client.IsOn() returned error: %s", err)
+	}
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(nicks, want) {
+		t.Fatalf("Client.IsOn() = %v, wanted %v", nicks, want)
+	}
+
+	entries, err := c.UserHost("alice", "bob", "carol", "dave", "erin", "frank")
+	if err != nil {
+		t.Fatalf("Client.UserHost() returned error: %s", err)
+	}
+
+	want := []UserHostEntry{
+		{Nick: "alice", Ident: "a", Host: "alice.host", Oper: true},
+		{Nick: "bob", Ident: "b", Host: "bob.host", Away: true},
+		{Nick: "frank", Ident: "f", Host: "frank.host"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("Client.UserHost() = %#v, wanted %#v", entries, want)
+	}
+
+	// 6 nicknames should be split across 2 commands.
+	if userhosts != 2 {
+		t.Fatalf("sent %d USERHOST commands, wanted 2", userhosts)
+	}
+}
+
+func TestWhoChannel(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != WHO || len(e.Params) < 1 || e.Params[0] != "#channel" {
+			return nil
+		}
+
+		if len(e.Params) < 2 {
+			return []string{
+				":dummy.int 352 test #channel a alice.host dummy.int alice H@ :0 Alice Smith",
+				":dummy.int 352 test #other b bob.host dummy.int bob H :0 Bob",
+				":dummy.int 315 test #channel :End of /WHO list.",
+			}
+		}
+
+		// An unrelated WHO (e.g. sent after joining another channel) which
+		// finishes first shouldn't end the query.
+		token := e.Params[1][strings.IndexByte(e.Params[1], ',')+1:]
+		return []string{
+			":dummy.int 354 test " + token + " #channel a alice.host alice H@ alice :Alice Smith",
+			":dummy.int 315 test #other :End of /WHO list.",
+			":dummy.int 354 test 1 #channel x x.host mallory H mallory :Mallory",
+			":dummy.int 354 test " + token + " #channel b bob.host bob G 0 :Bob",
+			":dummy.int 315 test #channel :End of /WHO list.",
+		}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if _, err := c.WhoChannel("channel"); err == nil {
+		t.Fatal("Client.WhoChannel() should fail with an invalid channel")
+	}
+
+	// Without WHOX, accounts aren't available.
+	replies, err := c.WhoChannel("#channel")
+	if err != nil {
+		t.Fatalf("Client.WhoChannel() returned error: %s", err)
+	}
+
+	want := []WhoxReply{
+		{Channel: "#channel", Nick: "alice", Ident: "a", Host: "alice.host", Flags: "H@", Realname: "Alice Smith"},
+	}
+	if !reflect.DeepEqual(replies, want) {
+		t.Fatalf("Client.WhoChannel() = %#v, wanted %#v", replies, want)
+	}
+
+	c.state.Lock()
+	c.state.serverOptions["WHOX"] = ""
+	c.state.Unlock()
+
+	replies, err = c.WhoChannel("#channel")
+	if err != nil {
+		t.Fatalf("Client.WhoChannel() returned error: %s", err)
+	}
+
+	want = []WhoxReply{
+		{Channel: "#channel", Nick: "alice", Ident: "a", Host: "alice.host", Flags: "H@", Account: "alice", Realname: "Alice Smith"},
+		{Channel: "#channel", Nick: "bob", Ident: "b", Host: "bob.host", Flags: "G", Realname: "Bob"},
+	}
+	if !reflect.DeepEqual(replies, want) {
+		t.Fatalf("Client.WhoChannel() = %#v, wanted %#v", replies, want)
+	}
+
+	if !replies[1].Away() {
+		t.Fatal("WhoxReply.Away() = false, wanted true")
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != MONITOR || len(e.Params) != 2 || e.Params[0] != "+" {
+			return nil
+		}
+
+		return []string{
+			":dummy.int 730 test :alice!a@alice.host",
+			":dummy.int 731 test :bob",
+		}
+	})
+
+	events := make(chan *Event, 10)
+	c.Handlers.Add(MONITOR_ONLINE, func(c *Client, e Event) { events <- &e })
+	c.Handlers.Add(MONITOR_OFFLINE, func(c *Client, e Event) { events <- &e })
+
+	next := func() *Event {
+		t.Helper()
+
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for monitor event")
+		}
+		return nil
+	}
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if _, ok := c.Monitor("alice").(ErrNotSupported); !ok {
+		t.Fatal("Client.Monitor() should fail when MONITOR isn't in ISUPPORT")
+	}
+
+	c.state.Lock()
+	c.state.serverOptions[MONITOR] = "100"
+	c.state.enabledCap = append(c.state.enabledCap, "extended-monitor")
+	c.state.Unlock()
+
+	if err := c.Monitor("alice", "bob"); err != nil {
+		t.Fatalf("Client.Monitor() returned error: %s", err)
+	}
+
+	// The account isn't known yet.
+	if e := next(); e.Command != MONITOR_ONLINE || e.Source.Name != "alice" || e.Source.Host != "alice.host" || e.Tags != nil {
+		t.Fatalf("received %#v, wanted MONITOR_ONLINE for alice without an account", e)
+	}
+	if e := next(); e.Command != MONITOR_OFFLINE || e.Params[0] != "bob" {
+		t.Fatalf("received %#v, wanted MONITOR_OFFLINE for bob", e)
+	}
+
+	// With extended-monitor, we're notified when alice logs in, however
+	// that is forgotten when she goes offline.
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte(":alice!a@alice.host ACCOUNT alice_account\r\n" +
+		":dummy.int 731 test :alice\r\n:dummy.int 730 test :alice!a@alice.host\r\n"))
+
+	if e := next(); e.Command != MONITOR_OFFLINE || e.Params[0] != "alice" {
+		t.Fatalf("received %#v, wanted MONITOR_OFFLINE for alice", e)
+	}
+
+	if e := next(); e.Command != MONITOR_ONLINE || e.Tags != nil {
+		t.Fatalf("received %#v, wanted MONITOR_ONLINE for alice without an account", e)
+	}
+
+	// Once she logs in again, the account is known.
+	conn.Write([]byte(":alice!a@alice.host ACCOUNT alice_account\r\n:dummy.int 730 test :alice!a@alice.host\r\n"))
+
+	e := next()
+	if account, _ := e.Tags.Get("account"); e.Command != MONITOR_ONLINE || account != "alice_account" {
+		t.Fatalf("received %#v, wanted MONITOR_ONLINE for alice with account alice_account", e)
+	}
+
+	if err := c.Unmonitor("alice"); err != nil {
+		t.Fatalf("Client.Unmonitor() returned error: %s", err)
+	}
+
+	c.state.RLock()
+	_, monitored := c.state.monitor["alice"]
+	c.state.RUnlock()
+	if monitored {
+		t.Fatal("alice is still monitored after Client.Unmonitor()")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxReorderEvents is the maximum number of events held by the reorder
+// buffer (see Config.ReorderWindow), after which the oldest are released
+// immediately.
+const maxReorderEvents = 1000
+
+// reorderItem is an event held by the reorder buffer.
+type reorderItem struct {
+	event   *Event
+	arrived time.Time
+}
+
+// reorderLoop sits between readLoop and execLoop when Config.ReorderWindow
+// is set. Events with a server-time tag are held for up to ReorderWindow,
+// and released sorted by their server-time. Events without a server-time tag
+// are passed through immediately.
+func (c *Client) reorderLoop(ctx context.Context, in <-chan *Event, wg *sync.WaitGroup) {
+	c.debug.Print("starting reorderLoop")
+	defer c.debug.Print("closing reorderLoop")
+	defer wg.Done()
+
+	window := c.Config.ReorderWindow
+	timer := time.NewTimer(window)
+	timer.Stop()
+	defer timer.Stop()
+
+	// pending is sorted by event timestamp.
+	var pending []reorderItem
+
+	// release sends the first n pending events on to execLoop.
+	release := func(n int) bool {
+		for i := 0; i < n; i++ {
+			select {
+			case c.rx <- pending[i].event:
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		pending = append(pending[:0], pending[n:]...)
+		return true
+	}
+
+	for {
+		// Release any events which have been held for the full window, along
+		// with any events which come before them.
+		now := time.Now()
+		n := 0
+		for i := range pending {
+			if now.Sub(pending[i].arrived) >= window {
+				n = i + 1
+			}
+		}
+		if len(pending)-n > maxReorderEvents {
+			n = len(pending) - maxReorderEvents
+		}
+		if n > 0 && !release(n) {
+			return
+		}
+
+		if len(pending) > 0 {
+			oldest := pending[0].arrived
+			for i := range pending {
+				if pending[i].arrived.Before(oldest) {
+					oldest = pending[i].arrived
+				}
+			}
+
+			timer.Reset(window - now.Sub(oldest))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case event := <-in:
+			timer.Stop()
+
+			if _, ok := event.Tags.Get("time"); !ok {
+				// Flush everything before an ERROR, as the connection is
+				// about to be closed.
+				if event.Command == ERROR && !release(len(pending)) {
+					return
+				}
+
+				select {
+				case c.rx <- event:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			i := len(pending)
+			for i > 0 && event.Timestamp.Before(pending[i-1].event.Timestamp) {
+				i--
+			}
+
+			pending = append(pending, reorderItem{})
+			copy(pending[i+1:], pending[i:])
+			pending[i] = reorderItem{event: event, arrived: time.Now()}
+		}
+	}
+}
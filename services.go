@@ -0,0 +1,179 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultServicesNick = "NickServ"
+	defaultIdentifyCmd  = "IDENTIFY {pass}"
+	servicesGhostCmd    = "GHOST %s %s"
+	// servicesTimeout is how long we wait for services to respond to a GHOST
+	// request, before attempting to change nicknames anyway.
+	servicesTimeout = 10 * time.Second
+)
+
+// servicesNick returns the configured services nickname, or the default.
+func (c *Client) servicesNick() string {
+	if c.Config.ServicesNick != "" {
+		return c.Config.ServicesNick
+	}
+
+	return defaultServicesNick
+}
+
+// Identify sends the identify command (see Config.IdentifyCmd) to the services
+// bot (see Config.ServicesNick) with the given password. The password is
+// masked when logged (see Event.Secrets). Where the network supports it,
+// SASL should be preferred over this (see Config.SASL).
+func (c *Client) Identify(password string) error {
+	format := c.Config.IdentifyCmd
+	if format == "" {
+		format = defaultIdentifyCmd
+	}
+
+	if !strings.Contains(format, "{pass}") {
+		return errors.New("identify command is missing {pass}")
+	}
+
+	return c.Send(&Event{
+		Command:  PRIVMSG,
+		Params:   []string{c.servicesNick()},
+		Trailing: strings.NewReplacer("{nick}", c.GetNick(), "{pass}", password).Replace(format),
+		Secrets:  []string{password},
+	})
+}
+
+// Recover attempts to recover nick, by asking services to disconnect
+// (GHOST) whoever is currently using it. Once services responds (or after a
+// short timeout), the client will change to nick, and identify using
+// password. Recover does not block.
+func (c *Client) Recover(nick, password string) {
+	services := c.servicesNick()
+
+	_, done := c.Handlers.AddTmp(NOTICE, servicesTimeout, func(c *Client, e Event) bool {
+		return e.Source != nil && ToRFC1459(e.Source.Name) == ToRFC1459(services)
+	})
+
+	go func() {
+		<-done
+
+		if !c.IsConnected() {
+			return
+		}
+
+		c.Cmd.Nick(nick)
+
+		// Our nickname won't be identified if we had to wait for it to become
+		// available, unless we authenticated with SASL.
+		if !c.HasCap("sasl") {
+			if err := c.Identify(password); err != nil {
+				c.debug.Printf("unable to identify after recovering %q: %s", nick, err)
+			}
+		}
+	}()
+
+	c.Send(&Event{
+		Command:  PRIVMSG,
+		Params:   []string{services},
+		Trailing: fmt.Sprintf(servicesGhostCmd, nick, password),
+		Secrets:  []string{password},
+	})
+}
+
+// RequireAccount returns true if the source of event is logged in to one of
+// the given services accounts. The account is determined (in order) from the
+// account message tag (account-tag), or from the users account in state
+// (extended-join/account-notify). Account names are compared
+// case-insensitively.
+//
+// If the account is unknown and Config.AccountWhoisTimeout is set, a WHOIS is
+// sent to look up the account, and RequireAccount blocks until the server
+// responds or the timeout elapses (in which case false is returned). As this
+// waits on other events, it must be called from a background handler (see
+// Caller.AddBg()) in that case, and may add up to a round-trip to the server
+// of latency.
+func (c *Client) RequireAccount(event Event, accounts ...string) bool {
+	if event.Source == nil || len(accounts) == 0 {
+		return false
+	}
+
+	account, known := c.resolveAccount(event)
+	if !known && c.Config.AccountWhoisTimeout > 0 {
+		account = c.whoisAccount(event.Source.Name, c.Config.AccountWhoisTimeout)
+	}
+
+	if account == "" {
+		return false
+	}
+
+	account = c.casefold(account)
+	for i := 0; i < len(accounts); i++ {
+		if c.casefold(accounts[i]) == account {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveAccount returns the account of the source of event, without asking
+// the server. known is false if we don't know if they are logged in.
+func (c *Client) resolveAccount(event Event) (account string, known bool) {
+	if account, ok := event.Tags.Get("account"); ok {
+		return account, true
+	}
+
+	if c.Config.disableTracking {
+		return "", false
+	}
+
+	// Without account-notify, state may be stale.
+	if !c.HasCap("account-notify") {
+		return "", false
+	}
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	user := c.state.lookupUser(event.Source.Name)
+	if user == nil {
+		return "", false
+	}
+
+	return user.Extras.Account, true
+}
+
+// whoisAccount sends a WHOIS for nick, and returns the account which they
+// are logged in to (if any), as reported by RPL_WHOISACCOUNT.
+func (c *Client) whoisAccount(nick string, timeout time.Duration) (account string) {
+	events, _ := c.SendAndWait(&Event{Command: WHOIS, Params: []string{nick}}, RPL_ENDOFWHOIS, timeout)
+	for i := 0; i < len(events); i++ {
+		if events[i].Command == RPL_WHOISACCOUNT && len(events[i].Params) > 2 &&
+			c.casefold(events[i].Params[1]) == c.casefold(nick) {
+			account = events[i].Params[2]
+			break
+		}
+	}
+
+	if account == "" {
+		return ""
+	}
+
+	if !c.Config.disableTracking {
+		c.state.Lock()
+		if user := c.state.lookupUser(nick); user != nil {
+			user.Extras.Account = account
+		}
+		c.state.Unlock()
+	}
+
+	return account
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecover(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	lines := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		switch e.Command {
+		case PRIVMSG, NICK:
+			lines <- string(e.Bytes())
+		}
+
+		if e.Command == PRIVMSG && e.Params[0] == defaultServicesNick {
+			return []string{":NickServ!NickServ@services.int NOTICE test :nick has been ghosted."}
+		}
+
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	// Registration NICK.
+	<-lines
+
+	c.Recover("nick", "secret")
+
+	want := []string{
+		"PRIVMSG NickServ :GHOST nick secret",
+		"NICK nick",
+		"PRIVMSG NickServ :IDENTIFY secret",
+	}
+
+	for i := 0; i < len(want); i++ {
+		select {
+		case line := <-lines:
+			if line != want[i] {
+				t.Fatalf("Client.Recover() sent %q, wanted %q", line, want[i])
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want[i])
+		}
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.IdentifyCmd = "IDENTIFY {nick} {pass}"
+
+	if err := c.Identify("secret"); err != ErrNotConnected {
+		t.Fatalf("Client.Identify() = %v before connecting, wanted ErrNotConnected", err)
+	}
+
+	lines := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command == PRIVMSG {
+			lines <- string(e.Bytes())
+		}
+		return nil
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	// The password isn't treated as a format string.
+	if err := c.Identify("100%s%v"); err != nil {
+		t.Fatalf("Client.Identify() returned error: %s", err)
+	}
+
+	select {
+	case line := <-lines:
+		if want := "PRIVMSG NickServ :IDENTIFY test 100%s%v"; line != want {
+			t.Fatalf("Client.Identify() sent %q, wanted %q", line, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for IDENTIFY")
+	}
+
+	c.Config.IdentifyCmd = "IDENTIFY %s"
+	if err := c.Identify("secret"); err == nil {
+		t.Fatal("Client.Identify() should fail when IdentifyCmd is missing {pass}")
+	}
+
+	if err := (&Config{Server: "dummy.int", Nick: "test", User: "test", IdentifyCmd: "IDENTIFY"}).isValid(); err == nil {
+		t.Fatal("Config.isValid() should fail when IdentifyCmd is missing {pass}")
+	}
+}
+
+func TestRequireAccount(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != WHOIS || len(e.Params) == 0 {
+			return nil
+		}
+
+		out := []string{":dummy.int 311 test " + e.Params[0] + " user host * :realname"}
+		if e.Params[0] == "admin" {
+			out = append(out, ":dummy.int 330 test admin Admin :is logged in as")
+		}
+		return append(out, ":dummy.int 318 test "+e.Params[0]+" :End of /WHOIS list.")
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	tagged := ParseEvent("@account=admin :someone!user@host PRIVMSG #channel :!cmd")
+	if !c.RequireAccount(*tagged, "ADMIN") {
+		t.Fatal("Client.RequireAccount() = false for matching account tag")
+	}
+	if c.RequireAccount(*tagged, "other") {
+		t.Fatal("Client.RequireAccount() = true for non-matching account tag")
+	}
+
+	event := ParseEvent(":admin!user@host PRIVMSG #channel :!cmd")
+	if c.RequireAccount(*event, "admin") {
+		t.Fatal("Client.RequireAccount() = true for unknown account without AccountWhoisTimeout")
+	}
+
+	c.Config.AccountWhoisTimeout = 2 * time.Second
+
+	if !c.RequireAccount(*event, "admin") {
+		t.Fatal("Client.RequireAccount() = false for account from WHOIS")
+	}
+
+	event = ParseEvent(":nobody!user@host PRIVMSG #channel :!cmd")
+	if c.RequireAccount(*event, "admin") {
+		t.Fatal("Client.RequireAccount() = true for user without an account")
+	}
+}
@@ -6,6 +6,7 @@ package girc
 
 import (
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,6 +18,13 @@ type state struct {
 	sync.RWMutex
 	// nick, ident, and host are the internal trackers for our user.
 	nick, ident, host string
+	// registered is true once the server has accepted our registration
+	// (RPL_WELCOME).
+	registered bool
+	// ready is closed once registration has completed (end of MOTD), and
+	// isReady is true once it has been closed. See Client.Ready().
+	ready   chan struct{}
+	isReady bool
 	// channels represents all channels we're active in.
 	channels map[string]*Channel
 	// users represents all of users that we're tracking.
@@ -27,12 +35,44 @@ type state struct {
 	// last capability check. These will get sent once we have received the
 	// last capability list command from the server.
 	tmpCap []string
+	// capValues are the values advertised by the server (via CAP LS) for
+	// the capabilities which we requested, e.g. "draft/multiline" may have
+	// ["max-bytes=4096", "max-lines=24"].
+	capValues map[string][]string
 	// serverOptions are the standard capabilities and configurations
 	// supported by the server at connection time. This also includes
 	// RPL_ISUPPORT entries.
 	serverOptions map[string]string
+	// serverName and serverVersion are the name and software version of the
+	// server, from RPL_MYINFO or RPL_YOURHOST.
+	serverName    string
+	serverVersion string
+	// monitor are the nicknames which we've asked the server to monitor,
+	// keyed by the casefolded nickname. See Client.Monitor().
+	monitor map[string]monitorEntry
+	// sasl are the SASL mechanisms left to try, the first being the one
+	// currently in use, and saslMech is the name of the mechanism which we
+	// authenticated with. See Config.SASLMechanisms.
+	sasl     []SASLMech
+	saslMech string
+	// keys are the keys (passwords) which channels were last joined with,
+	// keyed by the casefolded channel name, and retained are the channels
+	// to join again once registered, see Config.RetainChannels. Unlike the
+	// rest of the state, these are kept across reconnects.
+	keys     map[string]channelKey
+	retained []string
+	// metadata are the known metadata values of channels and users, keyed by
+	// the casefolded channel name or nickname. See Client.LookupMetadata().
+	metadata map[string]metadataEntry
+	// nickAttempts is the amount of fallback nicknames which have been
+	// attempted during registration, see Client.nextNick().
+	nickAttempts int
 	// motd is the servers message of the day.
 	motd string
+	// away is true if the server has confirmed that we are marked as away,
+	// and awayMessage is the message which we last requested to be set.
+	away        bool
+	awayMessage string
 }
 
 // notify sends state change notifications so users can update their refs
@@ -47,14 +87,92 @@ func (s *state) reset() {
 	s.nick = ""
 	s.ident = ""
 	s.host = ""
+	s.registered = false
+	s.nickAttempts = 0
+	s.ready = make(chan struct{})
+	s.isReady = false
 	s.channels = make(map[string]*Channel)
 	s.users = make(map[string]*User)
 	s.serverOptions = make(map[string]string)
+	s.serverName = ""
+	s.serverVersion = ""
 	s.enabledCap = []string{}
+	s.tmpCap = []string{}
+	s.capValues = make(map[string][]string)
+	s.monitor = make(map[string]monitorEntry)
+	s.metadata = make(map[string]metadataEntry)
+	s.sasl = nil
+	s.saslMech = ""
 	s.motd = ""
+	s.away = false
+	s.awayMessage = ""
+
+	if s.keys == nil {
+		s.keys = make(map[string]channelKey)
+	}
 	s.Unlock()
 }
 
+// retainChannels stores the channels we're currently in, to be joined again
+// once registered. Nothing is stored if we aren't in any channels (e.g. if
+// the previous connection attempt failed), so channels aren't forgotten
+// across failed attempts. Must be called with the state lock held.
+func (s *state) retainChannels() {
+	if len(s.channels) == 0 {
+		return
+	}
+
+	s.retained = make([]string, 0, len(s.channels))
+	for _, channel := range s.channels {
+		s.retained = append(s.retained, channel.Name)
+
+		// The key may have been changed since we joined.
+		if key, ok := channel.Modes.Get("k"); ok && key != "*" {
+			s.keys[s.casefold(channel.Name)] = channelKey{channel: channel.Name, key: key}
+		}
+	}
+	sort.Strings(s.retained)
+}
+
+// channelKey is the key (password) which a channel was last joined with.
+type channelKey struct {
+	// channel is the channel name, as it was joined.
+	channel string
+	key     string
+}
+
+// casefold normalizes input for case-insensitive comparison, based on the
+// CASEMAPPING advertised by the server, see Client.casefold(). Must be
+// called with the state lock held.
+func (s *state) casefold(input string) string {
+	return casefoldWith(s.serverOptions["CASEMAPPING"], input)
+}
+
+// hasCap returns true if the capability has been enabled. Must be called
+// with the state lock held.
+func (s *state) hasCap(name string) bool {
+	for i := 0; i < len(s.enabledCap); i++ {
+		if strings.EqualFold(s.enabledCap[i], name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeCap removes the capability (if enabled). Must be called with the
+// state lock held.
+func (s *state) removeCap(name string) {
+	for i := 0; i < len(s.enabledCap); i++ {
+		if strings.EqualFold(s.enabledCap[i], name) {
+			s.enabledCap = append(s.enabledCap[:i], s.enabledCap[i+1:]...)
+			break
+		}
+	}
+
+	delete(s.capValues, name)
+}
+
 // User represents an IRC user and the state attached to them.
 type User struct {
 	// Nick is the users current nickname. rfc1459 compliant.
@@ -70,9 +188,10 @@ type User struct {
 	Host string `json:"host"`
 
 	// ChannelList is a sorted list of all channels that we are currently
-	// tracking the user in. Each channel name is rfc1459 compliant. See
-	// User.Channels() for a shorthand if you're looking for the *Channel
-	// version of the channel list.
+	// tracking the user in. Each channel name is casefolded, based on the
+	// CASEMAPPING advertised by the server. See User.Channels() for a
+	// shorthand if you're looking for the *Channel version of the channel
+	// list.
 	ChannelList []string `json:"channels"`
 
 	// FirstSeen represents the first time that the user was seen by the
@@ -104,7 +223,18 @@ type User struct {
 		// set as their away message. May also be empty if unsupported by the
 		// server/tracking is disabled.
 		Away string `json:"away"`
+		// Idle is how long the user had been idle, as of IdleUpdated. Only
+		// known if the user has been WHOIS'd (RPL_WHOISIDLE).
+		Idle time.Duration `json:"idle"`
+		// Signon is when the user connected to the server. Only known if the
+		// user has been WHOIS'd, and if the server provides it.
+		Signon time.Time `json:"signon"`
+		// IdleUpdated is when Idle and Signon were last updated.
+		IdleUpdated time.Time `json:"idle_updated"`
 	} `json:"extras"`
+
+	// casemapping is the CASEMAPPING which ChannelList was folded with.
+	casemapping string
 }
 
 // Channels returns a reference of *Channels that the client knows the user
@@ -151,7 +281,7 @@ func (u *User) addChannel(name string) {
 		return
 	}
 
-	u.ChannelList = append(u.ChannelList, ToRFC1459(name))
+	u.ChannelList = append(u.ChannelList, casefoldWith(u.casemapping, name))
 	sort.Strings(u.ChannelList)
 
 	u.Perms.set(name, Perms{})
@@ -159,7 +289,7 @@ func (u *User) addChannel(name string) {
 
 // deleteChannel removes an existing channel from the users channel list.
 func (u *User) deleteChannel(name string) {
-	name = ToRFC1459(name)
+	name = casefoldWith(u.casemapping, name)
 
 	j := -1
 	for i := 0; i < len(u.ChannelList); i++ {
@@ -178,7 +308,7 @@ func (u *User) deleteChannel(name string) {
 
 // InChannel checks to see if a user is in the given channel.
 func (u *User) InChannel(name string) bool {
-	name = ToRFC1459(name)
+	name = casefoldWith(u.casemapping, name)
 
 	for i := 0; i < len(u.ChannelList); i++ {
 		if u.ChannelList[i] == name {
@@ -214,12 +344,19 @@ type Channel struct {
 	Topic string `json:"topic"`
 
 	// UserList is a sorted list of all users we are currently tracking within
-	// the channel. Each is the nickname, and is rfc1459 compliant.
+	// the channel. Each is the nickname, casefolded based on the CASEMAPPING
+	// advertised by the server.
 	UserList []string `json:"user_list"`
 	// Joined represents the first time that the client joined the channel.
 	Joined time.Time `json:"joined"`
+	// Created is when the channel was created, as reported by the server
+	// (RPL_CREATIONTIME). Zero if unknown.
+	Created time.Time `json:"created"`
 	// Modes are the known channel modes that the bot has captured.
 	Modes CModes `json:"modes"`
+
+	// casemapping is the CASEMAPPING which UserList was folded with.
+	casemapping string
 }
 
 // Users returns a reference of *Users that the client knows the channel has
@@ -302,13 +439,13 @@ func (ch *Channel) addUser(nick string) {
 		return
 	}
 
-	ch.UserList = append(ch.UserList, ToRFC1459(nick))
+	ch.UserList = append(ch.UserList, casefoldWith(ch.casemapping, nick))
 	sort.Strings(ch.UserList)
 }
 
 // deleteUser removes an existing user from the users list.
 func (ch *Channel) deleteUser(nick string) {
-	nick = ToRFC1459(nick)
+	nick = casefoldWith(ch.casemapping, nick)
 
 	j := -1
 	for i := 0; i < len(ch.UserList); i++ {
@@ -347,7 +484,7 @@ func (ch *Channel) Len() int {
 
 // UserIn checks to see if a given user is in a channel.
 func (ch *Channel) UserIn(name string) bool {
-	name = ToRFC1459(name)
+	name = casefoldWith(ch.casemapping, name)
 
 	for i := 0; i < len(ch.UserList); i++ {
 		if ch.UserList[i] == name {
@@ -369,15 +506,16 @@ func (s *state) createChannel(name string) (ok bool) {
 	supported := s.chanModes()
 	prefixes, _ := parsePrefixes(s.userPrefixes())
 
-	if _, ok := s.channels[ToRFC1459(name)]; ok {
+	if _, ok := s.channels[s.casefold(name)]; ok {
 		return false
 	}
 
-	s.channels[ToRFC1459(name)] = &Channel{
-		Name:     name,
-		UserList: []string{},
-		Joined:   time.Now(),
-		Modes:    NewCModes(supported, prefixes),
+	s.channels[s.casefold(name)] = &Channel{
+		Name:        name,
+		UserList:    []string{},
+		Joined:      time.Now(),
+		Modes:       NewCModes(supported, prefixes),
+		casemapping: s.serverOptions["CASEMAPPING"],
 	}
 
 	return true
@@ -385,7 +523,7 @@ func (s *state) createChannel(name string) (ok bool) {
 
 // deleteChannel removes the channel from state, if not already done.
 func (s *state) deleteChannel(name string) {
-	name = ToRFC1459(name)
+	name = s.casefold(name)
 
 	_, ok := s.channels[name]
 	if !ok {
@@ -404,32 +542,34 @@ func (s *state) deleteChannel(name string) {
 	}
 
 	delete(s.channels, name)
+	delete(s.metadata, name)
 }
 
 // lookupChannel returns a reference to a channel, nil returned if no results
 // found.
 func (s *state) lookupChannel(name string) *Channel {
-	return s.channels[ToRFC1459(name)]
+	return s.channels[s.casefold(name)]
 }
 
 // lookupUser returns a reference to a user, nil returned if no results
 // found.
 func (s *state) lookupUser(name string) *User {
-	return s.users[ToRFC1459(name)]
+	return s.users[s.casefold(name)]
 }
 
 // createUser creates the user in state, if not already done.
 func (s *state) createUser(nick string) (ok bool) {
-	if _, ok := s.users[ToRFC1459(nick)]; ok {
+	if _, ok := s.users[s.casefold(nick)]; ok {
 		// User already exists.
 		return false
 	}
 
-	s.users[ToRFC1459(nick)] = &User{
-		Nick:       nick,
-		FirstSeen:  time.Now(),
-		LastActive: time.Now(),
-		Perms:      &UserPerms{channels: make(map[string]Perms)},
+	s.users[s.casefold(nick)] = &User{
+		Nick:        nick,
+		FirstSeen:   time.Now(),
+		LastActive:  time.Now(),
+		Perms:       &UserPerms{channels: make(map[string]Perms)},
+		casemapping: s.serverOptions["CASEMAPPING"],
 	}
 
 	return true
@@ -447,7 +587,7 @@ func (s *state) deleteUser(channelName, nick string) {
 			s.channels[user.ChannelList[i]].deleteUser(nick)
 		}
 
-		delete(s.users, ToRFC1459(nick))
+		delete(s.users, s.casefold(nick))
 		return
 	}
 
@@ -463,19 +603,25 @@ func (s *state) deleteUser(channelName, nick string) {
 		// This means they are no longer in any channels we track, delete
 		// them from state.
 
-		delete(s.users, ToRFC1459(nick))
+		delete(s.users, s.casefold(nick))
 	}
 }
 
 // renameUser renames the user in state, in all locations where relevant.
 func (s *state) renameUser(from, to string) {
-	from = ToRFC1459(from)
+	from = s.casefold(from)
 
 	// Update our nickname.
-	if from == ToRFC1459(s.nick) {
+	if from == s.casefold(s.nick) {
 		s.nick = to
 	}
 
+	if entry, ok := s.metadata[from]; ok {
+		delete(s.metadata, from)
+		entry.target = to
+		s.metadata[s.casefold(to)] = entry
+	}
+
 	user := s.lookupUser(from)
 	if user == nil {
 		return
@@ -485,12 +631,12 @@ func (s *state) renameUser(from, to string) {
 
 	user.Nick = to
 	user.LastActive = time.Now()
-	s.users[ToRFC1459(to)] = user
+	s.users[s.casefold(to)] = user
 
 	for i := 0; i < len(user.ChannelList); i++ {
 		for j := 0; j < len(s.channels[user.ChannelList[i]].UserList); j++ {
 			if s.channels[user.ChannelList[i]].UserList[j] == from {
-				s.channels[user.ChannelList[i]].UserList[j] = ToRFC1459(to)
+				s.channels[user.ChannelList[i]].UserList[j] = s.casefold(to)
 
 				sort.Strings(s.channels[user.ChannelList[i]].UserList)
 				break
@@ -36,6 +36,7 @@ const dummyStartState = `:dummy.int NOTICE * :*** Looking up your hostname...
 :dummy.int 376 nick :End of /MOTD command.
 :nick!~user@local.int JOIN #channel * :realname
 :dummy.int 332 nick #channel :example topic
+:dummy.int 329 nick #channel 1500000000
 :dummy.int 353 nick = #channel :nick!~user@local.int @nick2!nick2@other.int
 :dummy.int 366 nick #channel :End of /NAMES list.
 :dummy.int 354 nick 1 #channel ~user local.int nick 0 :realname
@@ -48,6 +49,7 @@ const dummyStartState = `:dummy.int NOTICE * :*** Looking up your hostname...
 :dummy.int 354 nick 1 #channel2 ~user local.int nick 0 :realname
 :dummy.int 354 nick 1 #channel2 nick2 other.int nick2 nick2 :realname2
 :dummy.int 315 nick #channel2 :End of /WHO list.
+:dummy.int 317 nick nick2 120 1500000000 :seconds idle, signon time
 `
 
 const dummyEndState = `:nick2!nick2@other.int QUIT :example reason
@@ -137,6 +139,14 @@ func TestState(t *testing.T) {
 			t.Fatalf("Channel.Topic == %q, want \"example topic\"", topic)
 		}
 
+		if created, ok := c.ChannelCreated("#channel"); !ok || !created.Equal(time.Unix(1500000000, 0)) || !ch.Created.Equal(created) {
+			t.Fatalf("Client.ChannelCreated() == %s, %t, wanted %s", created, ok, time.Unix(1500000000, 0))
+		}
+
+		if _, ok := c.ChannelCreated("#channel2"); ok {
+			t.Fatal("Client.ChannelCreated() returned ok for channel without RPL_CREATIONTIME")
+		}
+
 		if in := ch.UserIn("nick"); !in {
 			t.Fatalf("Channel.UserIn == %t, want %t", in, true)
 		}
@@ -190,6 +200,15 @@ func TestState(t *testing.T) {
 			t.Fatal("User.InChannel() returned false for existing channel")
 		}
 
+		user2 := c.LookupUser("nick2")
+		if user2 == nil {
+			t.Fatal("Client.LookupUser() returned nil on existing user")
+		}
+
+		if user2.Extras.Idle != 120*time.Second || !user2.Extras.Signon.Equal(time.Unix(1500000000, 0)) || user2.Extras.IdleUpdated.IsZero() {
+			t.Fatalf("User.Extras idle == %s, signon == %s, updated == %s", user2.Extras.Idle, user2.Extras.Signon, user2.Extras.IdleUpdated)
+		}
+
 		finishStart <- true
 	})
 
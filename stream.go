@@ -0,0 +1,113 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import "sync"
+
+// defaultEventsBufferSize is the default for Config.EventsBufferSize.
+const defaultEventsBufferSize = 100
+
+// eventStream is a channel of events for a single connection, see
+// Client.Events().
+type eventStream struct {
+	// mu is read-locked while sending on ch, and write-locked when closing it,
+	// to ensure we never send on a closed channel.
+	mu   sync.RWMutex
+	ch   chan Event
+	done chan struct{}
+}
+
+// Events returns a channel which receives a copy of every incoming event
+// (much like an ALL_EVENTS handler), for those who would rather pull events
+// than register handlers. Events from ignored users are not sent (see
+// Client.Ignore()).
+//
+// The channel is buffered (see Config.EventsBufferSize). If it is full,
+// Config.EventsPolicy applies: by default, event handling is blocked until
+// there is room, so a slow consumer will slow down the client. The channel
+// is closed once the client disconnects, so Events should be called again
+// after reconnecting.
+func (c *Client) Events() <-chan Event {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	if c.stream == nil {
+		size := c.Config.EventsBufferSize
+		if size <= 0 {
+			size = defaultEventsBufferSize
+		}
+
+		c.stream = &eventStream{ch: make(chan Event, size), done: make(chan struct{})}
+	}
+
+	return c.stream.ch
+}
+
+// pushEvent sends a copy of event to the channel returned by Client.Events(),
+// if it's in use.
+func (c *Client) pushEvent(event *Event) {
+	c.streamMu.Lock()
+	s := c.stream
+	c.streamMu.Unlock()
+
+	if s == nil {
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	switch c.Config.EventsPolicy {
+	case QueueDropNewest:
+		select {
+		case s.ch <- *event.Copy():
+		default:
+			c.debug.Printf("events channel full, dropping %s", event.Command)
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case s.ch <- *event.Copy():
+				return
+			default:
+			}
+
+			select {
+			case old := <-s.ch:
+				c.debug.Printf("events channel full, dropping %s", old.Command)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- *event.Copy():
+		case <-s.done:
+		}
+	}
+}
+
+// closeEvents closes the channel returned by Client.Events(), if in use.
+func (c *Client) closeEvents() {
+	c.streamMu.Lock()
+	s := c.stream
+	c.stream = nil
+	c.streamMu.Unlock()
+
+	if s == nil {
+		return
+	}
+
+	// Unblock any pending sends before closing.
+	close(s.done)
+	s.mu.Lock()
+	close(s.ch)
+	s.mu.Unlock()
+}
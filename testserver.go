@@ -0,0 +1,248 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTestServerName is the default for TestServer.Name.
+	defaultTestServerName = "girc.test"
+	// defaultTestTimeout is the default for TestServer.Timeout.
+	defaultTestTimeout = 5 * time.Second
+	// testServerBuffer is the amount of lines from the client which are
+	// buffered, before the client blocks when sending.
+	testServerBuffer = 1024
+)
+
+// TestServer is an in-memory IRC server for testing code which uses girc
+// (e.g. bots), without needing a real IRC server. Lines sent by the server
+// are scripted with TestServer.Send(), and what the client sent can be
+// checked with TestServer.Expect(). For example:
+//
+//	client := girc.New(girc.Config{Server: "irc.example.com", Nick: "bot", User: "bot"})
+//	// Add handlers here, before connecting.
+//
+//	server := girc.NewTestServer(client)
+//	defer server.Close()
+//
+//	if err := server.Register(); err != nil {
+//		t.Fatal(err)
+//	}
+//
+//	server.Send(":nick!user@host PRIVMSG bot :!ping")
+//	if _, err := server.Expect("PRIVMSG nick :pong"); err != nil {
+//		t.Fatal(err)
+//	}
+type TestServer struct {
+	// Client is the client connected to the server.
+	Client *Client
+	// Name is the name of the server, used as the source of lines sent with
+	// TestServer.Send() which don't have one. Defaults to "girc.test".
+	Name string
+	// Timeout is how long TestServer.Expect() and friends wait for the
+	// client. Defaults to 5 seconds.
+	Timeout time.Duration
+
+	conn  net.Conn
+	lines chan *Event
+	done  chan struct{}
+}
+
+// NewTestServer connects client to a new TestServer. Any handlers should be
+// added to client before calling this, as the client starts connecting
+// (and registering, see TestServer.Register()) immediately. Call
+// TestServer.Close() once finished.
+func NewTestServer(client *Client) *TestServer {
+	clientConn, serverConn := net.Pipe()
+
+	s := &TestServer{
+		Client:  client,
+		Name:    defaultTestServerName,
+		Timeout: defaultTestTimeout,
+		conn:    serverConn,
+		lines:   make(chan *Event, testServerBuffer),
+		done:    make(chan struct{}),
+	}
+
+	go s.readLoop()
+	go func() {
+		_ = client.MockConnect(clientConn)
+		close(s.done)
+	}()
+
+	return s
+}
+
+// readLoop reads everything sent by the client, until the connection is
+// closed.
+func (s *TestServer) readLoop() {
+	defer close(s.lines)
+
+	b := bufio.NewReader(s.conn)
+	for {
+		line, err := b.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		if event := ParseEvent(line); event != nil {
+			s.lines <- event
+		}
+	}
+}
+
+// Send sends each of lines to the client, as if sent by the server. Lines
+// without a source are sent from the server (see TestServer.Name), e.g.
+// "001 bot :Welcome" is sent as ":girc.test 001 bot :Welcome".
+func (s *TestServer) Send(lines ...string) error {
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		// Add the source after any tags.
+		var tags string
+		if line != "" && line[0] == prefixTag {
+			if sep := strings.IndexByte(line, eventSpace); sep > 0 {
+				tags, line = line[:sep+1], line[sep+1:]
+			}
+		}
+
+		if line != "" && line[0] != messagePrefix {
+			line = string(messagePrefix) + s.Name + " " + line
+		}
+
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+		if _, err := s.conn.Write([]byte(tags + line + "\r\n")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ErrTestTimeout is returned by TestServer.Expect() and friends when the
+// client didn't do what was expected within TestServer.Timeout.
+type ErrTestTimeout struct {
+	Waiting string // Waiting is what we were waiting for.
+}
+
+func (e ErrTestTimeout) Error() string { return "timed out waiting for " + e.Waiting }
+
+// Expect waits for the client to send line, which is returned. Anything
+// else sent by the client in the meantime is skipped. Tags and the source of
+// line are ignored, as is whether or not the last parameter is prefixed
+// with a colon, e.g. "PRIVMSG #channel hello" matches
+// "PRIVMSG #channel :hello".
+func (s *TestServer) Expect(line string) (*Event, error) {
+	want := ParseEvent(line)
+	if want == nil {
+		return nil, fmt.Errorf("invalid line: %q", line)
+	}
+
+	return s.expect(line, func(e *Event) bool { return sameArgs(e, want) })
+}
+
+// ExpectCommand waits for the client to send an event with the given
+// command (e.g. PRIVMSG), which is returned. Anything else sent by the
+// client in the meantime is skipped.
+func (s *TestServer) ExpectCommand(command string) (*Event, error) {
+	command = strings.ToUpper(command)
+	return s.expect(command, func(e *Event) bool { return e.Command == command })
+}
+
+// expect waits for the client to send an event for which match returns
+// true. what is used to describe what was expected.
+func (s *TestServer) expect(what string, match func(e *Event) bool) (*Event, error) {
+	timeout := time.After(s.Timeout)
+
+	for {
+		select {
+		case event, ok := <-s.lines:
+			if !ok {
+				return nil, fmt.Errorf("connection closed while waiting for %q", what)
+			}
+
+			if match(event) {
+				return event, nil
+			}
+		case <-timeout:
+			return nil, ErrTestTimeout{Waiting: strconv.Quote(what)}
+		}
+	}
+}
+
+// Register completes registration of the client, sending the welcome,
+// RPL_ISUPPORT and end of MOTD replies, and waits for the client to process
+// them (see Client.Ready()). The client won't have negotiated any
+// capabilities. Nothing sent by the client is consumed, so the registration
+// sequence can still be checked with TestServer.Expect().
+func (s *TestServer) Register() error {
+	nick := s.Client.Config.Nick
+	err := s.Send(
+		RPL_WELCOME+" "+nick+" :Welcome to the girc test server "+nick,
+		RPL_ISUPPORT+" "+nick+" CHANTYPES=# PREFIX=(ov)@+ NETWORK=GircTest :are supported by this server",
+		RPL_ENDOFMOTD+" "+nick+" :End of /MOTD command.",
+	)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-s.Client.Ready():
+		return nil
+	case <-time.After(s.Timeout):
+		return ErrTestTimeout{Waiting: "registration"}
+	}
+}
+
+// Close closes the connection to the client, and waits for the client to
+// disconnect.
+func (s *TestServer) Close() error {
+	_ = s.conn.Close()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(s.Timeout):
+		return ErrTestTimeout{Waiting: "disconnect"}
+	}
+}
+
+// sameArgs returns true if a and b have the same command and arguments,
+// regardless of whether the last argument is a trailing parameter.
+func sameArgs(a, b *Event) bool {
+	if a.Command != b.Command {
+		return false
+	}
+
+	argsA, argsB := eventArgs(a), eventArgs(b)
+	if len(argsA) != len(argsB) {
+		return false
+	}
+
+	for i := 0; i < len(argsA); i++ {
+		if argsA[i] != argsB[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// eventArgs returns all parameters of e, including the trailing parameter
+// if there is one.
+func eventArgs(e *Event) []string {
+	if e.Trailing == "" && !e.EmptyTrailing {
+		return e.Params
+	}
+
+	return append(e.Params[:len(e.Params):len(e.Params)], e.Trailing)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTestServer(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "user", Name: "Real Name"})
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		if e.Trailing == "!ping" {
+			c.Cmd.Reply(e, "pong")
+		}
+	})
+
+	server := NewTestServer(c)
+	defer server.Close()
+	server.Timeout = 2 * time.Second
+
+	if err := server.Register(); err != nil {
+		t.Fatalf("TestServer.Register() returned error: %s", err)
+	}
+
+	if _, err := server.Expect("NICK test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := server.Expect("USER user * * :Real Name"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.IsRegistered() {
+		t.Fatal("Client.IsRegistered() = false after TestServer.Register()")
+	}
+
+	if err := server.Send("@msgid=1 :nick!user@host PRIVMSG #channel :!ping"); err != nil {
+		t.Fatalf("TestServer.Send() returned error: %s", err)
+	}
+
+	// The client sends "PRIVMSG #channel :pong", however the trailing colon
+	// shouldn't matter.
+	event, err := server.Expect("PRIVMSG #channel pong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Trailing != "pong" {
+		t.Fatalf("TestServer.Expect() = %q, wanted the reply", event.String())
+	}
+
+	server.Timeout = 50 * time.Millisecond
+	if _, err := server.ExpectCommand(JOIN); err == nil {
+		t.Fatal("TestServer.ExpectCommand() should time out")
+	} else if _, ok := err.(ErrTestTimeout); !ok {
+		t.Fatalf("TestServer.ExpectCommand() error = %#v, wanted ErrTestTimeout", err)
+	}
+
+	server.Timeout = 2 * time.Second
+	if err := server.Close(); err != nil {
+		t.Fatalf("TestServer.Close() returned error: %s", err)
+	}
+
+	if c.IsConnected() {
+		t.Fatal("Client.IsConnected() = true after TestServer.Close()")
+	}
+}
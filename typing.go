@@ -0,0 +1,99 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"fmt"
+	"time"
+)
+
+// Typing notification states, see Client.Typing().
+const (
+	TypingActive = "active" // the user is typing.
+	TypingPaused = "paused" // the user has typed something, but stopped.
+	TypingDone   = "done"   // the user has stopped typing, without sending.
+)
+
+// typingInterval is how often an active typing notification is sent to the
+// same target. Receivers expire active notifications after 6 seconds, so
+// this ensures they're refreshed in time.
+const typingInterval = 3 * time.Second
+
+// typingStatus is the last typing notification sent to a target.
+type typingStatus struct {
+	target string
+	state  string
+	sent   time.Time
+}
+
+// Typing sends a typing notification to target (a channel or nickname),
+// using the "+typing" client tag. state should be one of TypingActive,
+// TypingPaused or TypingDone.
+//
+// Typing may be called as often as needed (e.g. on every key press), as
+// redundant notifications aren't sent: an active notification is only
+// refreshed every 3 seconds, and paused/done are only sent if the state has
+// changed. This requires the message-tags capability, and returns
+// ErrNotSupported if it hasn't been enabled.
+func (c *Client) Typing(target, state string) error {
+	if state != TypingActive && state != TypingPaused && state != TypingDone {
+		return fmt.Errorf("invalid typing state: %q", state)
+	}
+
+	if !c.HasCap("message-tags") {
+		return ErrNotSupported{Feature: "message-tags"}
+	}
+
+	key := c.casefold(target)
+
+	c.typingMu.Lock()
+	last, ok := c.typing[key]
+
+	switch {
+	case state == TypingActive && ok && last.state == TypingActive && time.Since(last.sent) < typingInterval:
+		c.typingMu.Unlock()
+		return nil
+	case state != TypingActive && (!ok || last.state == state):
+		// Nothing to pause or finish.
+		c.typingMu.Unlock()
+		return nil
+	}
+
+	if state == TypingDone {
+		delete(c.typing, key)
+	} else {
+		if c.typing == nil {
+			c.typing = make(map[string]typingStatus)
+		}
+		c.typing[key] = typingStatus{target: target, state: state, sent: time.Now()}
+	}
+	c.typingMu.Unlock()
+
+	return c.Send(&Event{Command: TAGMSG, Params: []string{target}, Tags: Tags{"+typing": state}})
+}
+
+// OnTyping registers a handler for incoming typing notifications, where from
+// is the nickname of the user typing, target is the channel (or our own
+// nickname), and state is one of TypingActive, TypingPaused or TypingDone.
+// Note that active notifications should be considered expired if not
+// refreshed within 6 seconds. cuid is the handler uid which can be used to
+// remove the handler with Caller.Remove().
+func (c *Client) OnTyping(handler func(c *Client, from, target, state string)) (cuid string) {
+	return c.Handlers.Add(TAGMSG, func(c *Client, e Event) {
+		if e.Source == nil || len(e.Params) < 1 {
+			return
+		}
+
+		state, ok := e.Tags.Get("+typing")
+		if !ok {
+			// Older implementations used the draft tag.
+			if state, ok = e.Tags.Get("+draft/typing"); !ok {
+				return
+			}
+		}
+
+		handler(c, e.Source.Name, e.Params[0], state)
+	})
+}
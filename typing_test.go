@@ -0,0 +1,85 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTyping(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+
+	sent := make(chan string, 10)
+	go mockRespond(conn, func(e *Event) []string {
+		if e.Command != TAGMSG {
+			return nil
+		}
+
+		state, _ := e.Tags.Get("+typing")
+		sent <- state
+		return []string{"@+typing=" + state + " :nick!user@host TAGMSG #channel"}
+	})
+
+	type typing struct{ from, target, state string }
+	received := make(chan typing, 10)
+	c.OnTyping(func(c *Client, from, target, state string) {
+		received <- typing{from, target, state}
+	})
+
+	mockConnected(t, c, server)
+	defer c.Close()
+
+	if err := c.Typing("#channel", TypingActive); err == nil {
+		t.Fatal("Client.Typing() should fail without message-tags")
+	}
+
+	c.state.Lock()
+	c.state.enabledCap = append(c.state.enabledCap, "message-tags")
+	c.state.Unlock()
+
+	if err := c.Typing("#channel", "typing"); err == nil {
+		t.Fatal("Client.Typing() should fail with an invalid state")
+	}
+
+	// Redundant notifications shouldn't be sent.
+	for _, state := range []string{
+		TypingDone, TypingActive, TypingActive, TypingPaused,
+		TypingPaused, TypingDone, TypingDone,
+	} {
+		if err := c.Typing("#channel", state); err != nil {
+			t.Fatalf("Client.Typing() returned error: %s", err)
+		}
+	}
+
+	for _, want := range []string{TypingActive, TypingPaused, TypingDone} {
+		select {
+		case state := <-sent:
+			if state != want {
+				t.Fatalf("sent typing state %q, wanted %q", state, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+
+		select {
+		case got := <-received:
+			if got != (typing{"nick", "#channel", want}) {
+				t.Fatalf("Client.OnTyping() received %#v, wanted state %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for Client.OnTyping() %q", want)
+		}
+	}
+
+	select {
+	case state := <-sent:
+		t.Fatalf("sent redundant typing state %q", state)
+	case <-time.After(50 * time.Millisecond):
+	}
+}